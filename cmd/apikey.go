@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"whimsy/pkg/apikeys"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+func init() {
+	apikeyCreateCmd.Flags().String("name", "", "Who or what the key is for")
+	apikeyCreateCmd.Flags().StringSlice("scopes", nil, "Permissions the key holds, e.g. users:read,reports:*")
+	apikeyCreateCmd.Flags().Duration("ttl", 0, "How long the key is valid, forever if 0")
+	apikeyCreateCmd.Flags().String("rateLimitClass", apikeys.RateLimitStandard, "Rate limit class -- standard, elevated, internal")
+	_ = apikeyCreateCmd.MarkFlagRequired("name")
+
+	apikeyCmd.AddCommand(apikeyCreateCmd, apikeyListCmd, apikeyRevokeCmd)
+	root.AddCommand(apikeyCmd)
+}
+
+// withGorm runs fn with a database connection from buildGorm.
+func withGorm(fn func(ctx context.Context, db *gorm.DB) error) error {
+	ctx, cancel := newContext()
+	defer cancel()
+
+	db, cleanup, err := buildGorm(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return fn(ctx, db)
+}
+
+var apikeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "manage API keys for server to server clients",
+}
+
+var apikeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create an API key and print it once",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		scopes, _ := cmd.Flags().GetStringSlice("scopes")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		class, _ := cmd.Flags().GetString("rateLimitClass")
+
+		return withGorm(func(ctx context.Context, db *gorm.DB) error {
+			key, k, err := apikeys.NewStore(db).Create(ctx, apikeys.CreateOptions{
+				Name:           name,
+				Scopes:         scopes,
+				RateLimitClass: class,
+				TTL:            ttl,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Created %s (%s). Store the key now, it can't be shown again.\n", k.Prefix, k.Name)
+			fmt.Println(key)
+			return nil
+		})
+	},
+}
+
+var apikeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list API keys",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withGorm(func(ctx context.Context, db *gorm.DB) error {
+			keys, err := apikeys.NewStore(db).List(ctx)
+			if err != nil {
+				return err
+			}
+			formatTime := func(t *time.Time) string {
+				if t == nil {
+					return "-"
+				}
+				return t.Format(time.RFC3339)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "PREFIX\tNAME\tSCOPES\tCLASS\tEXPIRES\tLAST USED\tREVOKED")
+			for _, k := range keys {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Prefix, k.Name, k.Scopes, k.RateLimitClass,
+					formatTime(k.ExpiresAt), formatTime(k.LastUsedAt), formatTime(k.RevokedAt))
+			}
+			return tw.Flush()
+		})
+	},
+}
+
+var apikeyRevokeCmd = &cobra.Command{
+	Use:   "revoke <prefix>",
+	Short: "revoke an API key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withGorm(func(ctx context.Context, db *gorm.DB) error {
+			if err := apikeys.NewStore(db).Revoke(ctx, args[0]); err != nil {
+				return fmt.Errorf("revoke %s: %w", args[0], err)
+			}
+			fmt.Fprintf(os.Stderr, "Revoked %s.\n", args[0])
+			return nil
+		})
+	},
+}
@@ -3,8 +3,20 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/outbox"
+	"whimsy/pkg/redact"
+	"whimsy/pkg/scheduler"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+	"whimsy/pkg/webhooks"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -33,6 +45,12 @@ func init() {
 	bindEnv("rds.region", "RDS_REGION")
 	root.PersistentFlags().String("rds.user", "whimsy", "RDS DB User")
 	bindEnv("rds.user", "RDS_USER")
+	root.PersistentFlags().String("rds.sslMode", database.SSLRequire, "RDS TLS mode -- disable, prefer, require, verify-ca, verify-full")
+	bindEnv("rds.sslMode", "RDS_SSL_MODE")
+	root.PersistentFlags().String("rds.caBundlePath", "", "Path to the RDS CA bundle, needed for verify-ca and verify-full")
+	bindEnv("rds.caBundlePath", "RDS_CA_BUNDLE_PATH")
+	root.PersistentFlags().StringSlice("rds.replicas", nil, "RDS read replica endpoints, host or host:port, authenticated like rds.host")
+	bindEnv("rds.replicas", "RDS_REPLICAS")
 
 	root.PersistentFlags().String("logLevel", "debug", "Log level -- trace, debug, info, warn. error")
 	bindEnv("logLevel", "LOGLEVEL")
@@ -42,15 +60,146 @@ func init() {
 	root.PersistentFlags().String("pg.dbName", "whimsy", "PG DB Name")
 	root.PersistentFlags().String("pg.user", "postgres", "PG DB User")
 	root.PersistentFlags().String("pg.password", "password", "PG DB Password")
+	root.PersistentFlags().String("pg.sslMode", database.SSLDisable, "PG TLS mode -- disable, prefer, require, verify-ca, verify-full")
+	bindEnv("pg.sslMode", "PG_SSL_MODE")
+	root.PersistentFlags().String("pg.sslRootCert", "", "Path to the CA certificates of the PG server, needed for verify-ca and verify-full")
+	bindEnv("pg.sslRootCert", "PG_SSL_ROOT_CERT")
+	root.PersistentFlags().StringSlice("pg.replicas", nil, "PG read replica endpoints, host or host:port, with the pg.user credentials")
+	bindEnv("pg.replicas", "PG_REPLICAS")
+	root.PersistentFlags().Int("db.maxOpenConns", 25, "Most open connections per pool, 0 for no limit")
+	bindEnv("db.maxOpenConns", "DB_MAX_OPEN_CONNS")
+	root.PersistentFlags().Int("db.maxIdleConns", 10, "Most idle connections kept per pool")
+	bindEnv("db.maxIdleConns", "DB_MAX_IDLE_CONNS")
+	root.PersistentFlags().Duration("db.connMaxLifetime", 10*time.Minute, "Connections are closed after this long, at most 14m with RDS IAM auth")
+	bindEnv("db.connMaxLifetime", "DB_CONN_MAX_LIFETIME")
+	root.PersistentFlags().Duration("db.connMaxIdleTime", 5*time.Minute, "Idle connections are closed after this long")
+	bindEnv("db.connMaxIdleTime", "DB_CONN_MAX_IDLE_TIME")
+	root.PersistentFlags().Duration("db.replicaMaxLag", database.DefaultReplicaMaxLag, "Stop reading from replicas further behind the primary than this")
+	bindEnv("db.replicaMaxLag", "DB_REPLICA_MAX_LAG")
+	root.PersistentFlags().Duration("db.replicaCheckInterval", database.DefaultReplicaCheckInterval, "How often replica health and lag are checked")
+	bindEnv("db.replicaCheckInterval", "DB_REPLICA_CHECK_INTERVAL")
 
 	root.PersistentFlags().String("enc.privateKeyStr", "", "encryption private key as a string, PEM encoded")
 	bindEnv("enc.privateKeyStr", "ENC_PRIVATE_KEY_STR")
 	root.PersistentFlags().String("enc.privateKeyPath", "", "Path to encryption private key, PEM encoded")
 	bindEnv("enc.privateKeyPath", "ENC_PRIVATE_KEY_PATH")
 
+	root.PersistentFlags().Duration("auth.tokenTTL", 24*time.Hour, "Default lifetime of signed tokens")
+	bindEnv("auth.tokenTTL", "AUTH_TOKEN_TTL")
+	root.PersistentFlags().Duration("session.idleTTL", 14*24*time.Hour, "Sessions expire after this long without use")
+	bindEnv("session.idleTTL", "SESSION_IDLE_TTL")
+	root.PersistentFlags().Duration("session.maxAge", 90*24*time.Hour, "Sessions expire this long after login regardless of use")
+	bindEnv("session.maxAge", "SESSION_MAX_AGE")
+	root.PersistentFlags().Bool("session.secureCookie", true, "Only send the session cookie over HTTPS")
+	bindEnv("session.secureCookie", "SESSION_SECURE_COOKIE")
+	root.PersistentFlags().Duration("admin.impersonationTTL", 15*time.Minute, "Lifetime of the sessions admins start to impersonate a user")
+	bindEnv("admin.impersonationTTL", "ADMIN_IMPERSONATION_TTL")
+	root.PersistentFlags().String("app.baseURL", "http://localhost:3000", "Frontend base URL used in emailed links")
+	bindEnv("app.baseURL", "APP_BASE_URL")
+	root.PersistentFlags().StringSlice("oidc.providers", nil, "OIDC providers to offer, each configured with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and optionally _SCOPES")
+	bindEnv("oidc.providers", "OIDC_PROVIDERS")
+
+	// mail Flags
+	root.PersistentFlags().String("mail.driver", "smtp", "Mail delivery -- smtp, or log (prints mail unredacted, for local development) or memory")
+	bindEnv("mail.driver", "MAIL_DRIVER")
+	root.PersistentFlags().String("mail.from", "Whimsy <no-reply@whimsy.local>", "From address of outgoing mail")
+	bindEnv("mail.from", "MAIL_FROM")
+	root.PersistentFlags().String("mail.dir", "", "Directory the log driver writes .eml files to, stdout when empty")
+	bindEnv("mail.dir", "MAIL_DIR")
+	root.PersistentFlags().String("mail.smtp.host", "", "SMTP relay host")
+	bindEnv("mail.smtp.host", "MAIL_SMTP_HOST")
+	root.PersistentFlags().Int("mail.smtp.port", 587, "SMTP relay port")
+	bindEnv("mail.smtp.port", "MAIL_SMTP_PORT")
+	root.PersistentFlags().String("mail.smtp.username", "", "SMTP username")
+	bindEnv("mail.smtp.username", "MAIL_SMTP_USERNAME")
+	root.PersistentFlags().String("mail.smtp.password", "", "SMTP password")
+	bindEnv("mail.smtp.password", "MAIL_SMTP_PASSWORD")
+
 	// server Flags
 	root.PersistentFlags().String("http.address", ":5000", "Launch the app, visit localhost:5000/")
 	bindEnv("http.address", "HTTP_ADDRESS")
+	root.PersistentFlags().Int("http.compressMinSize", 1024, "Smallest response body in bytes to compress")
+	bindEnv("http.compressMinSize", "HTTP_COMPRESS_MIN_SIZE")
+	root.PersistentFlags().StringSlice("http.trustedProxies", nil, "Addresses or CIDR ranges of the proxies whose X-Forwarded-For is believed")
+	bindEnv("http.trustedProxies", "HTTP_TRUSTED_PROXIES")
+
+	// worker Flags
+	root.PersistentFlags().Int("worker.concurrency", jobs.DefaultConcurrency, "Jobs a worker runs at once")
+	bindEnv("worker.concurrency", "WORKER_CONCURRENCY")
+	root.PersistentFlags().Duration("worker.pollInterval", jobs.DefaultPollInterval, "How often idle workers look for jobs they weren't notified of")
+	bindEnv("worker.pollInterval", "WORKER_POLL_INTERVAL")
+	root.PersistentFlags().Duration("worker.timeout", jobs.DefaultTimeout, "Longest a job attempt may run")
+	bindEnv("worker.timeout", "WORKER_TIMEOUT")
+	root.PersistentFlags().Duration("worker.drainTimeout", jobs.DefaultDrainTimeout, "How long a stopping worker waits for running jobs before cancelling them")
+	bindEnv("worker.drainTimeout", "WORKER_DRAIN_TIMEOUT")
+
+	root.PersistentFlags().Bool("scheduler.enabled", true, "Run the maintenance tasks in workers, leading in turn")
+	bindEnv("scheduler.enabled", "SCHEDULER_ENABLED")
+	root.PersistentFlags().Duration("scheduler.retryInterval", scheduler.DefaultRetryInterval, "How often workers try to lead the scheduler, and the leader checks its lock")
+	bindEnv("scheduler.retryInterval", "SCHEDULER_RETRY_INTERVAL")
+
+	root.PersistentFlags().String("outbox.sink", "webhooks", "Comma separated sinks workers relay domain events to: log, stdout, jobs, webhooks or sqs")
+	bindEnv("outbox.sink", "OUTBOX_SINK")
+	root.PersistentFlags().String("outbox.sqsQueueURL", "", "SQS queue of the sqs outbox sink; a .fifo queue keeps each aggregate's events in order")
+	bindEnv("outbox.sqsQueueURL", "OUTBOX_SQS_QUEUE_URL")
+	root.PersistentFlags().Int("outbox.batchSize", outbox.DefaultBatchSize, "Events the relay claims at once")
+	bindEnv("outbox.batchSize", "OUTBOX_BATCH_SIZE")
+	root.PersistentFlags().Duration("outbox.pollInterval", outbox.DefaultPollInterval, "How often an idle relay looks for events it wasn't notified of")
+	bindEnv("outbox.pollInterval", "OUTBOX_POLL_INTERVAL")
+	root.PersistentFlags().Duration("outbox.retention", outbox.DefaultRetention, "How long delivered events are kept")
+	bindEnv("outbox.retention", "OUTBOX_RETENTION")
+
+	root.PersistentFlags().Duration("webhooks.timeout", webhooks.DefaultTimeout, "Longest a webhook request may take")
+	bindEnv("webhooks.timeout", "WEBHOOKS_TIMEOUT")
+	root.PersistentFlags().Int("webhooks.maxAttempts", webhooks.DefaultMaxAttempts, "Attempts before a webhook delivery fails")
+	bindEnv("webhooks.maxAttempts", "WEBHOOKS_MAX_ATTEMPTS")
+	root.PersistentFlags().Int("webhooks.disableAfter", webhooks.DefaultDisableAfter, "Failed attempts in a row that disable a webhook endpoint")
+	bindEnv("webhooks.disableAfter", "WEBHOOKS_DISABLE_AFTER")
+	root.PersistentFlags().Bool("webhooks.allowInsecure", false, "Allow http webhook URLs and private addresses, for local development only")
+	bindEnv("webhooks.allowInsecure", "WEBHOOKS_ALLOW_INSECURE")
+
+	// Outbound HTTP clients, each overridable per label with
+	// httpClient.<label>.* or HTTPCLIENT_<LABEL>_*, e.g. HTTPCLIENT_WEBHOOKS_BREAKER_THRESHOLD
+	root.PersistentFlags().Duration("httpClient.timeout", httpclient.DefaultTimeout, "Longest an outbound request attempt may take")
+	bindEnv("httpClient.timeout", "HTTPCLIENT_TIMEOUT")
+	root.PersistentFlags().Int("httpClient.maxRetries", httpclient.DefaultMaxRetries, "Retries of idempotent outbound requests, -1 disables them")
+	bindEnv("httpClient.maxRetries", "HTTPCLIENT_MAX_RETRIES")
+	root.PersistentFlags().Duration("httpClient.retryWait", httpclient.DefaultRetryWait, "Wait before the first retry, doubled with jitter for each one after")
+	bindEnv("httpClient.retryWait", "HTTPCLIENT_RETRY_WAIT")
+	root.PersistentFlags().Duration("httpClient.maxRetryWait", httpclient.DefaultMaxRetryWait, "Longest wait before a retry, including a Retry-After")
+	bindEnv("httpClient.maxRetryWait", "HTTPCLIENT_MAX_RETRY_WAIT")
+	root.PersistentFlags().Int("httpClient.breakerThreshold", httpclient.DefaultBreakerThreshold, "Failures in a row that open the circuit to a host")
+	bindEnv("httpClient.breakerThreshold", "HTTPCLIENT_BREAKER_THRESHOLD")
+	root.PersistentFlags().Duration("httpClient.breakerCooldown", httpclient.DefaultBreakerCooldown, "How long an open circuit fails requests before trying the host again")
+	bindEnv("httpClient.breakerCooldown", "HTTPCLIENT_BREAKER_COOLDOWN")
+	root.PersistentFlags().Int("httpClient.maxDumpBytes", utils.DefaultMaxDumpBytes, "Bytes of each request and response dump logged at trace level")
+	bindEnv("httpClient.maxDumpBytes", "HTTPCLIENT_MAX_DUMP_BYTES")
+
+	// Redaction of logs, HTTP dumps and error responses
+	root.PersistentFlags().StringSlice("redact.fields", redact.DefaultFields, "JSON keys and form fields redacted wherever they appear")
+	bindEnv("redact.fields", "REDACT_FIELDS")
+	root.PersistentFlags().StringSlice("redact.headers", redact.DefaultHeaders, "HTTP headers redacted from dumps")
+	bindEnv("redact.headers", "REDACT_HEADERS")
+	root.PersistentFlags().StringSlice("redact.query", redact.DefaultQuery, "Query parameters redacted from URLs and form bodies")
+	bindEnv("redact.query", "REDACT_QUERY")
+	root.PersistentFlags().StringSlice("redact.paths", nil, "JSONPath patterns redacted from JSON, e.g. $.card.number,$..ssn")
+	bindEnv("redact.paths", "REDACT_PATHS")
+	root.PersistentFlags().StringSlice("redact.patterns", redact.DefaultPatterns, "Patterns redacted from text: pan, ssn and email")
+	bindEnv("redact.patterns", "REDACT_PATTERNS")
+
+	// CORS and security headers, set per environment
+	root.PersistentFlags().StringSlice("cors.allowedOrigins", nil, "Allowed CORS origins, e.g. https://app.example.com,https://*.example.com")
+	bindEnv("cors.allowedOrigins", "CORS_ALLOWED_ORIGINS")
+	root.PersistentFlags().Bool("cors.allowCredentials", false, "Allow credentialed CORS requests, which can't be combined with the * origin")
+	bindEnv("cors.allowCredentials", "CORS_ALLOW_CREDENTIALS")
+	root.PersistentFlags().Duration("cors.maxAge", 10*time.Minute, "How long browsers may cache CORS preflight responses")
+	bindEnv("cors.maxAge", "CORS_MAX_AGE")
+	root.PersistentFlags().Duration("security.hstsMaxAge", 365*24*time.Hour, "Strict-Transport-Security max-age, 0 disables")
+	bindEnv("security.hstsMaxAge", "SECURITY_HSTS_MAX_AGE")
+	root.PersistentFlags().String("security.csp", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy header")
+	bindEnv("security.csp", "SECURITY_CSP")
+	root.PersistentFlags().String("security.referrerPolicy", "no-referrer", "Referrer-Policy header")
+	bindEnv("security.referrerPolicy", "SECURITY_REFERRER_POLICY")
 	viper.BindPFlags(serverCmd.PersistentFlags())
 
 	viper.BindPFlags(root.PersistentFlags())
@@ -69,6 +218,25 @@ func initConfig() {
 	case "error":
 		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	}
+
+	redactor, err := redact.New(redact.Config{
+		Fields:   getStringList("redact.fields"),
+		Headers:  getStringList("redact.headers"),
+		Query:    getStringList("redact.query"),
+		Paths:    getStringList("redact.paths"),
+		Patterns: getStringList("redact.patterns"),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	redact.SetDefault(redactor)
+	log.Logger = log.Output(redactor.Writer(os.Stderr))
+
+	if err := sessions.SetTrustedProxies(getStringList("http.trustedProxies")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func Execute() {
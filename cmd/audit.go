@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"whimsy/pkg/audit"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+func init() {
+	auditCmd.AddCommand(auditVerifyCmd)
+	root.AddCommand(auditCmd)
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "inspect the audit log",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "check the audit log's hash chain for edited or deleted events",
+	Long: `Recomputes the hash chain of the audit log and prints its head. Compare the
+head with one recorded earlier: the chain can't reveal that its newest events
+were removed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withGorm(func(ctx context.Context, db *gorm.DB) error {
+			head, err := audit.Verify(ctx, db)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("verified %d events, head hash %s\n", head.Seq, head.Hash)
+			return nil
+		})
+	},
+}
@@ -14,10 +14,17 @@ func buildRouter(ctx context.Context) (*mux.Router, func(), error) {
 	// This will be filled in by Wire with providers from the provider sets in
 	// wire.Build.
 	wire.Build(
+		setupRDSAuth,
 		setupDB,
+		setupReplicas,
 		setupGorm,
 		setupPrivateKey,
 		setupPublicKey,
+		setupTokenIssuer,
+		setupSessionStore,
+		setupMailer,
+		setupEncrypter,
+		setupOIDCProviders,
 
 		setupRouter,
 	)
@@ -26,8 +33,30 @@ func buildRouter(ctx context.Context) (*mux.Router, func(), error) {
 
 func buildGorm(ctx context.Context) (*gorm.DB, func(), error) {
 	wire.Build(
+		setupRDSAuth,
 		setupDB,
+		setupReplicas,
 		setupGorm,
 	)
 	return nil, nil, nil
 }
+
+func buildBackground(ctx context.Context) (*background, func(), error) {
+	wire.Build(
+		setupRDSAuth,
+		setupDB,
+		setupReplicas,
+		setupGorm,
+		setupMailer,
+		setupPrivateKey,
+		setupEncrypter,
+		setupPgxPool,
+		setupPubSub,
+		setupEventHandlers,
+		setupWorker,
+		setupScheduler,
+		setupOutboxRelay,
+		setupBackground,
+	)
+	return nil, nil, nil
+}
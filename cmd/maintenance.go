@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
+	"whimsy/pkg/outbox"
+	"whimsy/pkg/scheduler"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// How long ended sessions, user tokens and webhook deliveries are kept, for
+// support questions, before the maintenance tasks delete them.
+const (
+	sessionRetention         = 30 * 24 * time.Hour
+	userTokenRetention       = 7 * 24 * time.Hour
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// maintenanceTasks keep the database tidy.
+func maintenanceTasks(db *gorm.DB) []scheduler.Task {
+	return []scheduler.Task{
+		{
+			Name:     "sessions.purge",
+			Schedule: scheduler.Every(time.Hour),
+			Jitter:   5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				cutoff := time.Now().Add(-sessionRetention)
+				res := db.WithContext(ctx).Unscoped().
+					Where("expires_at < ? OR revoked_at < ?", cutoff, cutoff).
+					Delete(&models.Session{})
+				zerolog.Ctx(ctx).Info().Int64("deleted", res.RowsAffected).Msg("purged sessions")
+				return res.Error
+			},
+		},
+		{
+			Name:     "user_tokens.purge",
+			Schedule: scheduler.Every(time.Hour),
+			Jitter:   5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				cutoff := time.Now().Add(-userTokenRetention)
+				res := db.WithContext(ctx).Unscoped().
+					Where("expires_at < ? OR used_at < ?", cutoff, cutoff).
+					Delete(&models.UserToken{})
+				zerolog.Ctx(ctx).Info().Int64("deleted", res.RowsAffected).Msg("purged user tokens")
+				return res.Error
+			},
+		},
+		{
+			Name:     "outbox.cleanup",
+			Schedule: scheduler.Every(time.Hour),
+			Jitter:   5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				n, err := outbox.Cleanup(ctx, db, viper.GetDuration("outbox.retention"))
+				zerolog.Ctx(ctx).Info().Int64("deleted", n).Msg("purged delivered outbox events")
+				return err
+			},
+		},
+		{
+			Name:     "webhook_deliveries.purge",
+			Schedule: scheduler.Every(time.Hour),
+			Jitter:   5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				// Their attempts go with them.
+				res := db.WithContext(ctx).
+					Where("created_at < ? AND state <> ?", time.Now().Add(-webhookDeliveryRetention), models.DeliveryPending).
+					Delete(&models.WebhookDelivery{})
+				zerolog.Ctx(ctx).Info().Int64("deleted", res.RowsAffected).Msg("purged webhook deliveries")
+				return res.Error
+			},
+		},
+		{
+			Name:     "audit.partitions",
+			Schedule: mustParse("@daily"),
+			Missed:   scheduler.RunMissedOnce,
+			Run: func(ctx context.Context) error {
+				return audit.EnsurePartitions(ctx, db, time.Now(), migrate.AuditPartitionsAhead)
+			},
+		},
+	}
+}
+
+func mustParse(spec string) scheduler.Schedule {
+	s, err := scheduler.Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
@@ -10,19 +10,36 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"time"
+	"whimsy/pkg/apikeys"
+	"whimsy/pkg/auth"
+	"whimsy/pkg/authz"
 	"whimsy/pkg/controllers"
+	"whimsy/pkg/database"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/middleware"
 	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
+	"whimsy/pkg/oidc"
+	"whimsy/pkg/outbox"
+	"whimsy/pkg/pubsub"
+	"whimsy/pkg/scheduler"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+	"whimsy/pkg/webhooks"
 
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
@@ -66,7 +83,12 @@ func setupRouter(
 	ctx context.Context,
 	db *gorm.DB,
 	publicKey publicKeyStr,
-) *mux.Router {
+	tokens *auth.TokenIssuer,
+	store *sessions.Store,
+	mail mailer.Mailer,
+	enc utils.Encrypter,
+	oidcProviders []*oidc.Provider,
+) (*mux.Router, error) {
 	router := mux.NewRouter()
 
 	logger := zerolog.Ctx(ctx).With().Caller().Logger() // Add filename and number
@@ -83,79 +105,362 @@ func setupRouter(
 		hlog.FromRequest(r).Info().Int("status_code", status).Int("size", size).Dur("duration", duration).Msg("http request")
 	}))
 
+	// CORS and security headers
+	cors, err := middleware.NewCORS(middleware.CORSOptions{
+		AllowedOrigins:   getStringList("cors.allowedOrigins"),
+		ExposedHeaders:   []string{"X-WHIMSY-REQUEST-ID"},
+		AllowCredentials: viper.GetBool("cors.allowCredentials"),
+		MaxAge:           viper.GetDuration("cors.maxAge"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	securityHeaders := middleware.DefaultSecurityHeaders()
+	securityHeaders.HSTSMaxAge = viper.GetDuration("security.hstsMaxAge")
+	securityHeaders.ContentSecurityPolicy = viper.GetString("security.csp")
+	securityHeaders.ReferrerPolicy = viper.GetString("security.referrerPolicy")
+	router.Use(securityHeaders.Middleware)
+	router.Use(cors.Middleware)
+	router.Methods(http.MethodOptions).HandlerFunc(middleware.PreflightHandler)
+	router.Use(middleware.Compress(viper.GetInt("http.compressMinSize")))
+	router.Use(controllers.Authenticate(store))
+	router.Use(controllers.AuthenticateAPIKey(apikeys.NewStore(db)))
+	router.Use(authz.New(db).Middleware)
+
 	// Default Routes
 	router.NotFoundHandler = http.HandlerFunc(controllers.NotFoundHandler)
 	router.HandleFunc("/", controllers.Welcome).Methods("GET")
 	router.HandleFunc("/health_check", controllers.HealthCheck).Methods("GET")
-	router.HandleFunc("/pk", func(w http.ResponseWriter, r *http.Request) {
+	// The public key only changes on deploys.
+	router.Handle("/pk", middleware.CacheControl("public, max-age=300")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := io.WriteString(w, string(publicKey)); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-	})
+	})))
+
+	hooks := controllers.NewWebhookController(db, enc)
+	hooks.AllowInsecureURLs = viper.GetBool("webhooks.allowInsecure")
+	users := controllers.NewUserController(db, tokens, store, mail, enc, viper.GetString("app.baseURL"))
+	for _, c := range []controllers.Controller{
+		users,
+		controllers.NewOIDCController(users, oidcProviders...),
+		controllers.NewAdminController(db, store, viper.GetDuration("admin.impersonationTTL")),
+		hooks,
+	} {
+		c.Route(router)
+	}
 
-	return router
+	return router, nil
 
 }
 
-func setupDB(ctx context.Context) (*sql.DB, func(), error) {
+func setupDB(ctx context.Context, auth *database.RDSAuth) (*sql.DB, func(), error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	if auth != nil {
+		db, err = database.OpenRDS(primaryConfig(), auth, poolOptions())
+	} else {
+		db, err = database.Open(primaryConfig(), poolOptions())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() {
+		logger := zerolog.Ctx(ctx)
+		if err := db.Close(); err != nil {
+			logger.Err(err).Msg("failed to close DB connection")
+		}
+	}, nil
+}
+
+// setupRDSAuth returns the IAM auth of the RDS primary, shared by every
+// pool on it, or nil when connecting to pg.host.
+func setupRDSAuth() (*database.RDSAuth, error) {
 	if viper.GetString("pg.host") != "" {
-		psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
-			"password='%s' dbname=%s sslmode=disable", viper.GetString("pg.host"), viper.GetString("pg.port"), viper.GetString("pg.user"), viper.GetString("pg.password"), viper.GetString("pg.dbName"))
+		return nil, nil
+	}
+	return rdsAuth(viper.GetString("rds.host"), viper.GetString("rds.port"))
+}
 
-		db, err := sql.Open("pgx", psqlInfo)
-		if err != nil {
-			return nil, nil, err
+// setupPgxPool opens a native pgx pool on the primary, next to the
+// database/sql one gorm uses.
+func setupPgxPool(ctx context.Context, auth *database.RDSAuth) (*pgxpool.Pool, func(), error) {
+	pool, err := database.OpenPool(ctx, primaryConfig(), auth, poolOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, pool.Close, nil
+}
+
+func setupPubSub(pool *pgxpool.Pool) (*pubsub.PubSub, func()) {
+	ps := pubsub.New(pool)
+	return ps, ps.Close
+}
+
+// setupEventHandlers returns the handlers of domain events run as jobs,
+// when outbox.sink lists jobs.
+func setupEventHandlers() outbox.EventHandlers {
+	return outbox.EventHandlers{}
+}
+
+// setupWorker returns a worker for the job kinds of the application, woken
+// by jobs enqueued anywhere.
+func setupWorker(ctx context.Context, db *gorm.DB, mail mailer.Mailer, enc utils.Encrypter, events *pubsub.PubSub, handlers outbox.EventHandlers) *jobs.Worker {
+	w := jobs.NewWorker(db, jobs.WorkerOptions{
+		Concurrency:  viper.GetInt("worker.concurrency"),
+		PollInterval: viper.GetDuration("worker.pollInterval"),
+		Timeout:      viper.GetDuration("worker.timeout"),
+		DrainTimeout: viper.GetDuration("worker.drainTimeout"),
+	})
+	w.Handle(jobs.SendMail{}, jobs.SendMailHandler(mail))
+	w.Handle(webhooks.Deliver{}, webhooks.NewDeliverer(db, enc, webhookOptions()).Handle)
+	handlers.Register(w)
+
+	go func() {
+		for range events.Subscribe(ctx, jobs.NotifyChannel) {
+			w.Wake()
 		}
-		return db, func() {
-			logger := zerolog.Ctx(ctx)
-			if err := db.Close(); err != nil {
-				logger.Err(err).Msg("failed to close DB connection")
+	}()
+	return w
+}
+
+// setupScheduler returns a scheduler for the maintenance tasks, or nil if
+// scheduler.enabled is off.
+func setupScheduler(db *gorm.DB) *scheduler.Scheduler {
+	if !viper.GetBool("scheduler.enabled") {
+		return nil
+	}
+	s := scheduler.New(db, scheduler.Options{
+		RetryInterval: viper.GetDuration("scheduler.retryInterval"),
+	})
+	for _, t := range maintenanceTasks(db) {
+		s.Add(t)
+	}
+	return s
+}
+
+// setupOutboxRelay returns a relay delivering domain events to the sinks
+// listed in outbox.sink, woken by events published anywhere.
+func setupOutboxRelay(ctx context.Context, db *gorm.DB, events *pubsub.PubSub, handlers outbox.EventHandlers) (*outbox.Relay, error) {
+	var sinks outbox.MultiSink
+	for _, name := range getStringList("outbox.sink") {
+		switch name {
+		case "log":
+			sinks = append(sinks, outbox.LogSink{})
+		case "stdout":
+			sinks = append(sinks, &outbox.WriterSink{W: os.Stdout})
+		case "jobs":
+			sinks = append(sinks, outbox.JobSink{Handlers: handlers})
+		case "webhooks":
+			sinks = append(sinks, webhooks.NewDispatcher(webhookOptions()))
+		case "sqs":
+			sess, err := getAWSSession()
+			if err != nil {
+				return nil, err
 			}
-		}, nil
+			queueURL := viper.GetString("outbox.sqsQueueURL")
+			sinks = append(sinks, outbox.SQSSink{
+				Client:   sqs.New(sess),
+				QueueURL: queueURL,
+				FIFO:     strings.HasSuffix(queueURL, ".fifo"),
+			})
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
 	}
+	r := outbox.NewRelay(db, sinks, outbox.RelayOptions{
+		BatchSize:    viper.GetInt("outbox.batchSize"),
+		PollInterval: viper.GetDuration("outbox.pollInterval"),
+	})
 
-	// Setup RDS
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s",
-		viper.GetString("rds.host"),
-		viper.GetString("rds.port"),
-		viper.GetString("rds.user"),
-		"rds-auth-token-placeholder",
-		viper.GetString("rds.dbName"),
-	)
+	go func() {
+		for range events.Subscribe(ctx, outbox.NotifyChannel) {
+			r.Wake()
+		}
+	}()
+	return r, nil
+}
+
+func webhookOptions() webhooks.Options {
+	return webhooks.Options{
+		Timeout:              viper.GetDuration("webhooks.timeout"),
+		MaxAttempts:          viper.GetInt("webhooks.maxAttempts"),
+		DisableAfter:         viper.GetInt("webhooks.disableAfter"),
+		HTTP:                 httpClientOptions("webhooks"),
+		AllowPrivateNetworks: viper.GetBool("webhooks.allowInsecure"),
+	}
+}
+
+// httpClientOptions reads the settings of the outbound client labelled label
+// from httpClient.<label>.* keys, or HTTPCLIENT_<LABEL>_* environment
+// variables, falling back to the httpClient.* ones.
+func httpClientOptions(label string) httpclient.Options {
+	env := "HTTPCLIENT_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(label)) + "_"
+	key := func(name, suffix string) string {
+		k := "httpClient." + label + "." + name
+		bindEnv(k, env+suffix)
+		if viper.IsSet(k) {
+			return k
+		}
+		return "httpClient." + name
+	}
+	return httpclient.Options{
+		Timeout:          viper.GetDuration(key("timeout", "TIMEOUT")),
+		MaxRetries:       viper.GetInt(key("maxRetries", "MAX_RETRIES")),
+		RetryWait:        viper.GetDuration(key("retryWait", "RETRY_WAIT")),
+		MaxRetryWait:     viper.GetDuration(key("maxRetryWait", "MAX_RETRY_WAIT")),
+		BreakerThreshold: viper.GetInt(key("breakerThreshold", "BREAKER_THRESHOLD")),
+		BreakerCooldown:  viper.GetDuration(key("breakerCooldown", "BREAKER_COOLDOWN")),
+		MaxDumpBytes:     viper.GetInt(key("maxDumpBytes", "MAX_DUMP_BYTES")),
+	}
+}
+
+// background is what the worker command runs.
+type background struct {
+	worker    *jobs.Worker
+	scheduler *scheduler.Scheduler
+	relay     *outbox.Relay
+}
+
+func setupBackground(worker *jobs.Worker, sched *scheduler.Scheduler, relay *outbox.Relay) *background {
+	return &background{worker: worker, scheduler: sched, relay: relay}
+}
+
+func poolOptions() database.PoolOptions {
+	return database.PoolOptions{
+		MaxOpenConns:    viper.GetInt("db.maxOpenConns"),
+		MaxIdleConns:    viper.GetInt("db.maxIdleConns"),
+		ConnMaxLifetime: viper.GetDuration("db.connMaxLifetime"),
+		ConnMaxIdleTime: viper.GetDuration("db.connMaxIdleTime"),
+	}
+}
 
-	connConfig, err := pgx.ParseConfig(dsn)
+// primaryConfig returns the settings of pg.host, or of rds.host when it
+// isn't set.
+func primaryConfig() database.ConnConfig {
+	if host := viper.GetString("pg.host"); host != "" {
+		return pgConfig(host, viper.GetString("pg.port"))
+	}
+	return rdsConfig(viper.GetString("rds.host"), viper.GetString("rds.port"))
+}
+
+// pgConfig returns the settings of host with the pg.* user and password.
+func pgConfig(host, port string) database.ConnConfig {
+	return database.ConnConfig{
+		Host:        host,
+		Port:        port,
+		User:        viper.GetString("pg.user"),
+		Password:    viper.GetString("pg.password"),
+		DBName:      viper.GetString("pg.dbName"),
+		SSLMode:     viper.GetString("pg.sslMode"),
+		SSLRootCert: viper.GetString("pg.sslRootCert"),
+	}
+}
+
+// rdsConfig returns the settings of host as rds.user, without a password.
+func rdsConfig(host, port string) database.ConnConfig {
+	return database.ConnConfig{
+		Host:        host,
+		Port:        port,
+		User:        viper.GetString("rds.user"),
+		DBName:      viper.GetString("rds.dbName"),
+		SSLMode:     viper.GetString("rds.sslMode"),
+		SSLRootCert: viper.GetString("rds.caBundlePath"),
+	}
+}
+
+// openPG opens a pool on host with the pg.* user and password.
+func openPG(host, port string) (*sql.DB, error) {
+	return database.Open(pgConfig(host, port), poolOptions())
+}
+
+var (
+	awsSessionOnce sync.Once
+	awsSession     *session.Session
+	awsSessionErr  error
+)
+
+// getAWSSession returns the AWS session shared by the clients of the
+// process.
+func getAWSSession() (*session.Session, error) {
+	awsSessionOnce.Do(func() {
+		awsSession, awsSessionErr = session.NewSession()
+	})
+	return awsSession, awsSessionErr
+}
+
+// rdsAuth signs tokens for rds.user on host.
+func rdsAuth(host, port string) (*database.RDSAuth, error) {
+	awsSession, err := getAWSSession()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return database.NewRDSAuth(
+		net.JoinHostPort(host, port),  // Database Endpoint (With Port)
+		viper.GetString("rds.region"), // AWS Region
+		viper.GetString("rds.user"),   // Database Account
+		awsSession.Config.Credentials,
+	), nil
+}
 
-	db := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(
-		func(ctx context.Context, connConfig *pgx.ConnConfig) error {
-			sess := session.Must(session.NewSession())
+// openRDS opens a pool on host authenticating as rds.user with IAM tokens.
+func openRDS(host, port string) (*sql.DB, error) {
+	auth, err := rdsAuth(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return database.OpenRDS(rdsConfig(host, port), auth, poolOptions())
+}
 
-			authToken, err := rdsutils.BuildAuthToken(
-				viper.GetString("rds.host")+":"+viper.GetString("rds.port"), // Database Endpoint (With Port)
-				viper.GetString("rds.region"),                               // AWS Region
-				viper.GetString("rds.user"),                                 // Database Account
-				sess.Config.Credentials,
-			)
-			if err != nil {
-				return fmt.Errorf("failed to create authentication token: %w", err)
-			}
+// setupReplicas opens the read replicas listed in pg.replicas, or
+// rds.replicas when connecting to RDS, as host or host:port. It returns nil
+// without replicas.
+func setupReplicas(ctx context.Context) (*database.Replicas, func(), error) {
+	open, hosts, defaultPort := openPG, getStringList("pg.replicas"), viper.GetString("pg.port")
+	if viper.GetString("pg.host") == "" {
+		open, hosts, defaultPort = openRDS, getStringList("rds.replicas"), viper.GetString("rds.port")
+	}
+	if len(hosts) == 0 {
+		return nil, func() {}, nil
+	}
 
-			connConfig.Password = authToken
-			return nil
-		},
-	))
+	var replicas []*database.Replica
+	closeAll := func() {
+		for _, r := range replicas {
+			if err := r.DB.Close(); err != nil {
+				zerolog.Ctx(ctx).Err(err).Str("replica", r.Name).Msg("failed to close replica connection")
+			}
+		}
+	}
+	for _, h := range hosts {
+		host, port, err := net.SplitHostPort(h)
+		if err != nil {
+			host, port = h, defaultPort
+		}
+		db, err := open(host, port)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		replicas = append(replicas, &database.Replica{Name: net.JoinHostPort(host, port), DB: db})
+	}
 
-	return db, func() {
-		logger := zerolog.Ctx(ctx)
-		if err := db.Close(); err != nil {
-			logger.Err(err).Msg("failed to close DB connection")
+	rs := database.NewReplicas(database.ReplicaOptions{
+		MaxLag:        viper.GetDuration("db.replicaMaxLag"),
+		CheckInterval: viper.GetDuration("db.replicaCheckInterval"),
+	}, replicas...)
+	return rs, func() {
+		if err := rs.Close(); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("failed to close replica connections")
 		}
 	}, nil
 }
 
-func setupGorm(ctx context.Context, db *sql.DB) (*gorm.DB, error) {
+// setupGorm opens gorm on the primary and migrates it, then routes reads to
+// replicas if there are any.
+func setupGorm(ctx context.Context, db *sql.DB, replicas *database.Replicas) (*gorm.DB, error) {
 	l := zerolog.Ctx(ctx).With().Logger() // Copy logger
 	newLogger := logger.New(
 		&l,
@@ -173,10 +478,18 @@ func setupGorm(ctx context.Context, db *sql.DB) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := gdb.Use(models.Plugin{}); err != nil {
+		return nil, err
+	}
 
 	if err := migrate.Migrate(gdb); err != nil {
 		return nil, err
 	}
+	if replicas != nil {
+		if err := gdb.Use(replicas); err != nil {
+			return nil, err
+		}
+	}
 	return gdb, nil
 }
 
@@ -224,4 +537,92 @@ func setupPublicKey(privateKey *rsa.PrivateKey) (publicKeyStr, error) {
 		return "", err
 	}
 	return publicKeyStr(wr.String()), nil
-}
\ No newline at end of file
+}
+
+// getStringList reads a list that may come from a flag or a comma separated
+// environment variable.
+func getStringList(key string) []string {
+	var out []string
+	for _, v := range viper.GetStringSlice(key) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+func setupTokenIssuer(privateKey *rsa.PrivateKey) *auth.TokenIssuer {
+	return auth.NewTokenIssuer(privateKey, viper.GetDuration("auth.tokenTTL"))
+}
+
+func setupSessionStore(db *gorm.DB) *sessions.Store {
+	store := sessions.NewStore(db, viper.GetDuration("session.idleTTL"), viper.GetDuration("session.maxAge"))
+	store.SecureCookie = viper.GetBool("session.secureCookie")
+	return store
+}
+
+func setupEncrypter(privateKey *rsa.PrivateKey) utils.Encrypter {
+	return utils.Encrypter{PrivateKey: privateKey}
+}
+
+// setupOIDCProviders reads the settings of each provider in oidc.providers
+// from oidc.<name>.* keys, or OIDC_<NAME>_* environment variables.
+func setupOIDCProviders() ([]*oidc.Provider, error) {
+	var providers []*oidc.Provider
+	for _, name := range getStringList("oidc.providers") {
+		name = strings.ToLower(name)
+		env := "OIDC_" + strings.ToUpper(name) + "_"
+		for key, suffix := range map[string]string{
+			"issuer":       "ISSUER",
+			"clientID":     "CLIENT_ID",
+			"clientSecret": "CLIENT_SECRET",
+			"redirectURL":  "REDIRECT_URL",
+			"scopes":       "SCOPES",
+		} {
+			bindEnv("oidc."+name+"."+key, env+suffix)
+		}
+		cfg := oidc.Config{
+			Name:         name,
+			IssuerURL:    viper.GetString("oidc." + name + ".issuer"),
+			ClientID:     viper.GetString("oidc." + name + ".clientID"),
+			ClientSecret: viper.GetString("oidc." + name + ".clientSecret"),
+			RedirectURL:  viper.GetString("oidc." + name + ".redirectURL"),
+			Scopes:       getStringList("oidc." + name + ".scopes"),
+		}
+		if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc provider %q needs an issuer, client ID and redirect URL", name)
+		}
+		label := "oidc." + name
+		providers = append(providers, oidc.NewProvider(cfg, httpclient.New(label, httpClientOptions(label))))
+	}
+	return providers, nil
+}
+
+// setupMailer returns the mailer of mail.driver. The log driver prints
+// messages, and the tokens in them, unredacted, so it's only used when
+// chosen explicitly for local development.
+func setupMailer() (mailer.Mailer, error) {
+	from := viper.GetString("mail.from")
+	switch driver := viper.GetString("mail.driver"); driver {
+	case "smtp":
+		if viper.GetString("mail.smtp.host") == "" {
+			return nil, fmt.Errorf("mail.driver smtp needs mail.smtp.host (use mail.driver log for local development)")
+		}
+		return &mailer.SMTPMailer{
+			Host:     viper.GetString("mail.smtp.host"),
+			Port:     viper.GetInt("mail.smtp.port"),
+			Username: viper.GetString("mail.smtp.username"),
+			Password: viper.GetString("mail.smtp.password"),
+			From:     from,
+		}, nil
+	case "log":
+		log.Warn().Msg("mail.driver log prints outgoing mail, with its tokens; use it for local development only")
+		return &mailer.LogMailer{Dir: viper.GetString("mail.dir"), From: from}, nil
+	case "memory":
+		return &mailer.MemoryMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail.driver %q", driver)
+	}
+}
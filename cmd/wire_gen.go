@@ -15,42 +15,146 @@ import (
 // Injectors from inject.go:
 
 func buildRouter(ctx context.Context) (*mux.Router, func(), error) {
-	db, cleanup, err := setupDB(ctx)
+	rdsAuth, err := setupRDSAuth()
 	if err != nil {
 		return nil, nil, err
 	}
-	gormDB, err := setupGorm(ctx, db)
+	db, cleanup, err := setupDB(ctx, rdsAuth)
 	if err != nil {
+		return nil, nil, err
+	}
+	replicas, cleanup2, err := setupReplicas(ctx)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	gormDB, err := setupGorm(ctx, db, replicas)
+	if err != nil {
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
 	privateKey, err := setupPrivateKey()
 	if err != nil {
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
 	cmdPublicKeyStr, err := setupPublicKey(privateKey)
 	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	tokenIssuer := setupTokenIssuer(privateKey)
+	store := setupSessionStore(gormDB)
+	mailerMailer, err := setupMailer()
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	encrypter := setupEncrypter(privateKey)
+	v, err := setupOIDCProviders()
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	router, err := setupRouter(ctx, gormDB, cmdPublicKeyStr, tokenIssuer, store, mailerMailer, encrypter, v)
+	if err != nil {
+		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	router := setupRouter(ctx, gormDB, cmdPublicKeyStr)
 	return router, func() {
+		cleanup2()
 		cleanup()
 	}, nil
 }
 
 func buildGorm(ctx context.Context) (*gorm.DB, func(), error) {
-	db, cleanup, err := setupDB(ctx)
+	rdsAuth, err := setupRDSAuth()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, cleanup, err := setupDB(ctx, rdsAuth)
 	if err != nil {
 		return nil, nil, err
 	}
-	gormDB, err := setupGorm(ctx, db)
+	replicas, cleanup2, err := setupReplicas(ctx)
 	if err != nil {
 		cleanup()
 		return nil, nil, err
 	}
+	gormDB, err := setupGorm(ctx, db, replicas)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
 	return gormDB, func() {
+		cleanup2()
+		cleanup()
+	}, nil
+}
+
+func buildBackground(ctx context.Context) (*background, func(), error) {
+	rdsAuth, err := setupRDSAuth()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, cleanup, err := setupDB(ctx, rdsAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	replicas, cleanup2, err := setupReplicas(ctx)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	gormDB, err := setupGorm(ctx, db, replicas)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	mailerMailer, err := setupMailer()
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	privateKey, err := setupPrivateKey()
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	encrypter := setupEncrypter(privateKey)
+	pool, cleanup3, err := setupPgxPool(ctx, rdsAuth)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	pubSub, cleanup4 := setupPubSub(pool)
+	eventHandlers := setupEventHandlers()
+	worker := setupWorker(ctx, gormDB, mailerMailer, encrypter, pubSub, eventHandlers)
+	schedulerScheduler := setupScheduler(gormDB)
+	relay, err := setupOutboxRelay(ctx, gormDB, pubSub, eventHandlers)
+	if err != nil {
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	cmdBackground := setupBackground(worker, schedulerScheduler, relay)
+	return cmdBackground, func() {
+		cleanup4()
+		cleanup3()
+		cleanup2()
 		cleanup()
 	}, nil
 }
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	root.AddCommand(workerCmd)
+}
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "run background jobs, scheduled tasks and the outbox relay",
+	Long: `Runs jobs from the queue until interrupted, then stops taking new ones and
+waits up to worker.drainTimeout for those running to finish. Unless
+scheduler.enabled is off, it also runs the scheduled maintenance tasks while
+it leads the workers, and relays domain events from the outbox to outbox.sink.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		bg, cleanup, err := buildBackground(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create worker")
+		}
+		defer cleanup()
+
+		log.Info().Msg("Worker running")
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bg.relay.Run(ctx)
+		}()
+		if bg.scheduler != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bg.scheduler.Run(ctx)
+			}()
+		}
+		bg.worker.Run(ctx)
+		wg.Wait()
+		log.Info().Msg("Worker stopped")
+	},
+}
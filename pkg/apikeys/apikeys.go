@@ -0,0 +1,169 @@
+// Package apikeys issues and checks API keys for server to server clients.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	goerrors "errors"
+	"strings"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/models"
+
+	"gorm.io/gorm"
+)
+
+// KeyPrefix starts every key, so leaked keys are easy to recognize in code
+// and logs.
+const KeyPrefix = "wk_"
+
+// Rate limit classes a key can be assigned.
+const (
+	RateLimitStandard = "standard"
+	RateLimitElevated = "elevated"
+	RateLimitInternal = "internal"
+)
+
+var (
+	ErrInvalidKey   = goerrors.New("invalid api key")
+	ErrKeyNotFound  = goerrors.New("api key not found")
+	ErrUnknownClass = goerrors.New("unknown rate limit class")
+)
+
+// Store creates and checks API keys.
+type Store struct {
+	db *gorm.DB
+	// TouchInterval limits how often last used times are written.
+	TouchInterval time.Duration
+	now           func() time.Time
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db, TouchInterval: time.Minute, now: time.Now}
+}
+
+var prefixEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// CreateOptions describe a new key.
+type CreateOptions struct {
+	Name           string
+	Scopes         []string
+	RateLimitClass string
+	// TTL is how long the key is valid, forever if zero.
+	TTL time.Duration
+}
+
+// Create issues a key and returns it in full. It can't be recovered later.
+func (s *Store) Create(ctx context.Context, opts CreateOptions) (string, *models.ApiKey, error) {
+	class := opts.RateLimitClass
+	switch class {
+	case "":
+		class = RateLimitStandard
+	case RateLimitStandard, RateLimitElevated, RateLimitInternal:
+	default:
+		return "", nil, ErrUnknownClass
+	}
+
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	prefix := KeyPrefix + prefixEncoding.EncodeToString(b)
+	secret, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := &models.ApiKey{
+		Name:           opts.Name,
+		Prefix:         prefix,
+		SecretHash:     hash,
+		Scopes:         strings.Join(opts.Scopes, " "),
+		RateLimitClass: class,
+	}
+	if opts.TTL > 0 {
+		expiresAt := s.now().Add(opts.TTL)
+		key.ExpiresAt = &expiresAt
+	}
+	if err := s.db.WithContext(ctx).Create(key).Error; err != nil {
+		return "", nil, err
+	}
+	return prefix + "." + secret, key, nil
+}
+
+// Authenticate returns the active key for a full key string and records its
+// use.
+func (s *Store) Authenticate(ctx context.Context, full string) (*models.ApiKey, error) {
+	prefix, secret, ok := splitKey(full)
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	var key models.ApiKey
+	if err := s.db.WithContext(ctx).Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidKey
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashOpaqueToken(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, ErrInvalidKey
+	}
+	now := s.now()
+	if !key.Active(now) {
+		return nil, ErrInvalidKey
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= s.TouchInterval {
+		if err := s.db.WithContext(ctx).Model(&key).UpdateColumn("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = &now
+	}
+	return &key, nil
+}
+
+func splitKey(full string) (prefix, secret string, ok bool) {
+	i := strings.IndexByte(full, '.')
+	if i < 0 || !strings.HasPrefix(full, KeyPrefix) {
+		return "", "", false
+	}
+	prefix, secret = full[:i], full[i+1:]
+	return prefix, secret, prefix != KeyPrefix && secret != ""
+}
+
+// List returns every key, newest first.
+func (s *Store) List(ctx context.Context) ([]models.ApiKey, error) {
+	var keys []models.ApiKey
+	err := s.db.WithContext(ctx).Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// Revoke disables the key with prefix.
+func (s *Store) Revoke(ctx context.Context, prefix string) error {
+	res := s.db.WithContext(ctx).Model(&models.ApiKey{}).
+		Where("prefix = ? AND revoked_at IS NULL", prefix).
+		UpdateColumn("revoked_at", s.now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// WithKey returns ctx carrying the key a request authenticated with.
+func WithKey(ctx context.Context, key *models.ApiKey) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext returns the key a request authenticated with, if any. Rate
+// limiting reads its RateLimitClass.
+func FromContext(ctx context.Context) *models.ApiKey {
+	key, _ := ctx.Value(contextKey{}).(*models.ApiKey)
+	return key
+}
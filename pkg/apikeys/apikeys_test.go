@@ -0,0 +1,47 @@
+package apikeys
+
+import (
+	"testing"
+	"time"
+
+	"whimsy/pkg/models"
+)
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		key            string
+		prefix, secret string
+		ok             bool
+	}{
+		{"wk_abcdefgh.s3cret", "wk_abcdefgh", "s3cret", true},
+		{"wk_abcdefgh.", "", "", false},
+		{"wk_.s3cret", "", "", false},
+		{"abcdefgh.s3cret", "", "", false},
+		{"wk_abcdefgh", "", "", false},
+	}
+	for _, tt := range tests {
+		prefix, secret, ok := splitKey(tt.key)
+		if ok != tt.ok || (ok && (prefix != tt.prefix || secret != tt.secret)) {
+			t.Errorf("splitKey(%q) = %q, %q, %v", tt.key, prefix, secret, ok)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		key  models.ApiKey
+		want bool
+	}{
+		{models.ApiKey{}, true},
+		{models.ApiKey{ExpiresAt: &future}, true},
+		{models.ApiKey{ExpiresAt: &past}, false},
+		{models.ApiKey{RevokedAt: &past}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.key.Active(now); got != tt.want {
+			t.Errorf("%d: Active = %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package audit records who changed what, and when, in the append-only
+// audit_events table.
+//
+// Events are written in the transaction of the change they describe, so
+// both commit or neither. They form a hash chain: each event's hash covers
+// its content and the previous event's hash, and Verify recomputes the chain
+// to detect rows edited or deleted behind the application's back. Writers
+// take a transaction scoped advisory lock on the chain head, so audited
+// transactions commit one at a time; keep them short.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"whimsy/pkg/constants"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog/hlog"
+	"gorm.io/gorm"
+)
+
+// Action names what happened, as "<area>.<verb>".
+type Action string
+
+const (
+	ActionUserLock             Action = "admin.user.lock"
+	ActionUserUnlock           Action = "admin.user.unlock"
+	ActionUserImpersonate      Action = "admin.user.impersonate"
+	ActionAdminSessionRevoke   Action = "admin.sessions.revoke"
+	ActionAdminSessionsRevoke  Action = "admin.sessions.revoke_all"
+	ActionPasswordReset        Action = "user.password.reset"
+	ActionEmailVerified        Action = "user.email.verify"
+	ActionTOTPEnabled          Action = "user.mfa.enable"
+	ActionTOTPDisabled         Action = "user.mfa.disable"
+	ActionRecoveryCodesRenewed Action = "user.mfa.recovery_codes"
+	ActionIdentityLinked       Action = "user.identity.link"
+	ActionWebhookCreate        Action = "webhook.create"
+	ActionWebhookUpdate        Action = "webhook.update"
+	ActionWebhookDelete        Action = "webhook.delete"
+)
+
+// Target types.
+const (
+	TargetUser    = "user"
+	TargetSession = "session"
+	TargetWebhook = "webhook_endpoint"
+)
+
+// chainLock is the pg_advisory_xact_lock key serializing chain writers.
+const chainLock int64 = 0x61756469745f6368 // "audit_ch"
+
+// ErrChainBroken is wrapped by the errors Verify returns for a tampered chain.
+var ErrChainBroken = goerrors.New("audit chain broken")
+
+// Change is a field's value before and after an action.
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Event is an action to record.
+type Event struct {
+	Action     Action
+	TargetType string
+	TargetID   string
+	// Changes is typically made with Diff.
+	Changes  map[string]Change
+	Metadata map[string]interface{}
+}
+
+// Diff compares the JSON forms of before and after, which must be structs
+// or maps, and returns their differing top level fields. Fields hidden from
+// JSON, such as password hashes, never appear.
+func Diff(before, after interface{}) (map[string]Change, error) {
+	var b, a map[string]interface{}
+	if err := roundTrip(before, &b); err != nil {
+		return nil, err
+	}
+	if err := roundTrip(after, &a); err != nil {
+		return nil, err
+	}
+	changes := map[string]Change{}
+	for k, from := range b {
+		if to, ok := a[k]; !ok || !reflect.DeepEqual(from, to) {
+			changes[k] = Change{From: from, To: a[k]}
+		}
+	}
+	for k, to := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = Change{To: to}
+		}
+	}
+	return changes, nil
+}
+
+// roundTrip decodes the JSON encoding of v into out, which is the form
+// values take after a trip through a jsonb column.
+func roundTrip(v, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func jsonMap(v interface{}) (models.JSONMap, error) {
+	m := models.JSONMap{}
+	if err := roundTrip(v, &m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = models.JSONMap{}
+	}
+	return m, nil
+}
+
+func uuidFromContext(ctx context.Context, key constants.ContextKey) *uuid.UUID {
+	id, err := uuid.FromString(utils.GetStringValueFromContext(key, ctx))
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+// Record writes ev, attributed to the user, request and client IP of r. Pass
+// the transaction making the change; outside of one, Record starts its own.
+func Record(tx *gorm.DB, r *http.Request, ev Event) error {
+	return RecordContext(r.Context(), tx, sessions.DeviceFromRequest(r).IPAddress, ev)
+}
+
+// RecordContext is Record for work outside of a request, such as commands,
+// attributed to the user of ctx if any.
+func RecordContext(ctx context.Context, tx *gorm.DB, ip string, ev Event) error {
+	tx = tx.WithContext(ctx)
+	if _, inTx := tx.Statement.ConnPool.(gorm.TxCommitter); !inTx {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			return RecordContext(ctx, tx, ip, ev)
+		})
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	e := &models.AuditEvent{
+		ID:             id,
+		CreatedAt:      time.Now().UTC().Truncate(time.Microsecond), // Postgres precision
+		ActorID:        uuidFromContext(ctx, constants.UserIDKey),
+		ImpersonatorID: uuidFromContext(ctx, constants.ImpersonatorIDKey),
+		Action:         string(ev.Action),
+		TargetType:     ev.TargetType,
+		TargetID:       ev.TargetID,
+		IPAddress:      ip,
+	}
+	if reqID, ok := hlog.IDFromCtx(ctx); ok {
+		e.RequestID = reqID.String()
+	}
+	if e.Changes, err = jsonMap(ev.Changes); err != nil {
+		return err
+	}
+	if e.Metadata, err = jsonMap(ev.Metadata); err != nil {
+		return err
+	}
+
+	// The lock is held until tx ends, so the head can't move under us.
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", chainLock).Error; err != nil {
+		return err
+	}
+	var head models.AuditEvent
+	if err := tx.Select("seq", "hash").Order("seq DESC").Limit(1).Find(&head).Error; err != nil {
+		return err
+	}
+	e.Seq = head.Seq + 1
+	e.PrevHash = head.Hash
+	if e.Hash, err = hash(e); err != nil {
+		return err
+	}
+	return tx.Create(e).Error
+}
+
+// chainRecord is what an event's hash covers, in a fixed encoding.
+type chainRecord struct {
+	Seq            int64          `json:"seq"`
+	ID             string         `json:"id"`
+	CreatedAt      string         `json:"createdAt"`
+	ActorID        *uuid.UUID     `json:"actorId"`
+	ImpersonatorID *uuid.UUID     `json:"impersonatorId"`
+	Action         string         `json:"action"`
+	TargetType     string         `json:"targetType"`
+	TargetID       string         `json:"targetId"`
+	RequestID      string         `json:"requestId"`
+	IPAddress      string         `json:"ipAddress"`
+	Changes        models.JSONMap `json:"changes"`
+	Metadata       models.JSONMap `json:"metadata"`
+	PrevHash       string         `json:"prevHash"`
+}
+
+func hash(e *models.AuditEvent) (string, error) {
+	changes, metadata := e.Changes, e.Metadata
+	if changes == nil {
+		changes = models.JSONMap{}
+	}
+	if metadata == nil {
+		metadata = models.JSONMap{}
+	}
+	b, err := json.Marshal(chainRecord{
+		Seq:            e.Seq,
+		ID:             e.ID.String(),
+		CreatedAt:      e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ActorID:        e.ActorID,
+		ImpersonatorID: e.ImpersonatorID,
+		Action:         e.Action,
+		TargetType:     e.TargetType,
+		TargetID:       e.TargetID,
+		RequestID:      e.RequestID,
+		IPAddress:      e.IPAddress,
+		Changes:        changes,
+		Metadata:       metadata,
+		PrevHash:       e.PrevHash,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Head is the last event of a verified chain. Keep a copy elsewhere: the
+// chain can't reveal that its newest events were removed.
+type Head struct {
+	Seq  int64
+	Hash string
+}
+
+// checkLink verifies e follows prev, the zero Head for the first event.
+func checkLink(prev Head, e *models.AuditEvent) error {
+	if e.Seq != prev.Seq+1 {
+		return fmt.Errorf("%w: event %d follows %d", ErrChainBroken, e.Seq, prev.Seq)
+	}
+	if e.PrevHash != prev.Hash {
+		return fmt.Errorf("%w: event %d doesn't link to the hash of %d", ErrChainBroken, e.Seq, prev.Seq)
+	}
+	sum, err := hash(e)
+	if err != nil {
+		return err
+	}
+	if sum != e.Hash {
+		return fmt.Errorf("%w: event %d was modified", ErrChainBroken, e.Seq)
+	}
+	return nil
+}
+
+// Verify recomputes the chain from the first event and returns its head. A
+// tampered chain returns an error wrapping ErrChainBroken, naming the first
+// bad event.
+func Verify(ctx context.Context, db *gorm.DB) (Head, error) {
+	const batch = 1000
+	var head Head
+	for {
+		var events []models.AuditEvent
+		if err := db.WithContext(ctx).Where("seq > ?", head.Seq).Order("seq").Limit(batch).Find(&events).Error; err != nil {
+			return head, err
+		}
+		for i := range events {
+			if err := checkLink(head, &events[i]); err != nil {
+				return head, err
+			}
+			head = Head{Seq: events[i].Seq, Hash: events[i].Hash}
+		}
+		if len(events) < batch {
+			return head, nil
+		}
+	}
+}
+
+// EnsurePartitions creates the monthly partitions of audit_events from the
+// month of now to months ahead. A month whose events already went to the
+// default partition is left there, as Postgres can't create a partition
+// overlapping rows in the default one.
+func EnsurePartitions(ctx context.Context, db *gorm.DB, now time.Time, months int) error {
+	db = db.WithContext(ctx)
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= months; i++ {
+		from, to := start.AddDate(0, i, 0), start.AddDate(0, i+1, 0)
+		name := fmt.Sprintf("audit_events_y%04dm%02d", from.Year(), from.Month())
+
+		var exists bool
+		if err := db.Raw("SELECT to_regclass(?) IS NOT NULL", name).Scan(&exists).Error; err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		var stranded bool
+		if err := db.Raw("SELECT EXISTS (SELECT 1 FROM audit_events_default WHERE created_at >= ? AND created_at < ?)", from, to).Scan(&stranded).Error; err != nil {
+			return err
+		}
+		if stranded {
+			continue
+		}
+		// Names and bounds are generated above, not user input.
+		err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF audit_events FOR VALUES FROM ('%s') TO ('%s')",
+			name, from.Format(time.RFC3339), to.Format(time.RFC3339))).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
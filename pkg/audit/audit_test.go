@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"testing"
+	"time"
+
+	"whimsy/pkg/models"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestDiff(t *testing.T) {
+	type account struct {
+		Email    string     `json:"email"`
+		Locked   *time.Time `json:"locked,omitempty"`
+		Attempts int        `json:"attempts"`
+		Secret   string     `json:"-"`
+	}
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	changes, err := Diff(
+		account{Email: "a@whimsy.test", Attempts: 3, Secret: "x"},
+		account{Email: "a@whimsy.test", Locked: &until, Secret: "y"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Change{
+		"locked":   {To: "2030-01-02T03:04:05Z"},
+		"attempts": {From: 3.0, To: 0.0},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %+v, want %+v", changes, want)
+	}
+	for k, w := range want {
+		if changes[k] != w {
+			t.Errorf("changes[%s] = %+v, want %+v", k, changes[k], w)
+		}
+	}
+}
+
+// chain builds n linked events, as RecordContext would.
+func chain(t *testing.T, n int) []models.AuditEvent {
+	t.Helper()
+	events := make([]models.AuditEvent, n)
+	var prev Head
+	for i := range events {
+		actor := uuid.Must(uuid.NewV4())
+		e := models.AuditEvent{
+			Seq:        prev.Seq + 1,
+			ID:         uuid.Must(uuid.NewV4()),
+			CreatedAt:  time.Date(2022, 3, 1, 12, 0, i, 123456000, time.UTC),
+			ActorID:    &actor,
+			Action:     string(ActionUserLock),
+			TargetType: TargetUser,
+			TargetID:   "42",
+			Changes:    models.JSONMap{"lockedUntil": map[string]interface{}{"from": nil, "to": "2030-01-01T00:00:00Z"}},
+			Metadata:   models.JSONMap{"reason": "ticket 42", "revokedSessions": 2.0},
+			PrevHash:   prev.Hash,
+		}
+		sum, err := hash(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Hash = sum
+		events[i] = e
+		prev = Head{Seq: e.Seq, Hash: e.Hash}
+	}
+	return events
+}
+
+// verify is Verify over events in hand.
+func verify(events []models.AuditEvent) error {
+	var head Head
+	for i := range events {
+		if err := checkLink(head, &events[i]); err != nil {
+			return err
+		}
+		head = Head{Seq: events[i].Seq, Hash: events[i].Hash}
+	}
+	return nil
+}
+
+func TestChain(t *testing.T) {
+	if err := verify(chain(t, 3)); err != nil {
+		t.Fatalf("intact chain: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func([]models.AuditEvent) []models.AuditEvent
+	}{
+		{"modified action", func(es []models.AuditEvent) []models.AuditEvent {
+			es[1].Action = string(ActionUserUnlock)
+			return es
+		}},
+		{"modified metadata", func(es []models.AuditEvent) []models.AuditEvent {
+			es[1].Metadata["reason"] = "no reason"
+			return es
+		}},
+		{"rehashed event", func(es []models.AuditEvent) []models.AuditEvent {
+			es[1].TargetID = "43"
+			es[1].Hash, _ = hash(&es[1])
+			return es
+		}},
+		{"deleted event", func(es []models.AuditEvent) []models.AuditEvent {
+			return append(es[:1], es[2:]...)
+		}},
+		{"reordered events", func(es []models.AuditEvent) []models.AuditEvent {
+			es[1], es[2] = es[2], es[1]
+			return es
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verify(tt.tamper(chain(t, 3)))
+			if !goerrors.Is(err, ErrChainBroken) {
+				t.Errorf("expected ErrChainBroken, got %v", err)
+			}
+		})
+	}
+}
+
+// TestHashSurvivesJSONB checks an event hashes the same after its maps
+// went through a jsonb column, which reorders keys and turns numbers into
+// float64.
+func TestHashSurvivesJSONB(t *testing.T) {
+	e := chain(t, 1)[0]
+	for _, m := range []*models.JSONMap{&e.Changes, &e.Metadata} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back models.JSONMap
+		if err := back.Scan(b); err != nil {
+			t.Fatal(err)
+		}
+		*m = back
+	}
+	sum, err := hash(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != e.Hash {
+		t.Error("hash changed after a round trip through JSON")
+	}
+}
@@ -0,0 +1,22 @@
+// Package auth holds credential primitives shared by the controllers:
+// password hashing, signed tokens, TOTP and account lockout policy.
+package auth
+
+import "time"
+
+var (
+	// MaxFailedLogins is how many consecutive wrong passwords lock an account.
+	MaxFailedLogins = 5
+	// LockoutDuration is how long a locked account refuses logins.
+	LockoutDuration = 15 * time.Minute
+)
+
+var (
+	// VerifyEmailTokenTTL is how long an email verification link is valid.
+	VerifyEmailTokenTTL = 48 * time.Hour
+	// PasswordResetTokenTTL is how long a password reset link is valid.
+	PasswordResetTokenTTL = time.Hour
+)
+
+// MFAChallengeTTL is how long a login has to complete its second step.
+var MFAChallengeTTL = 5 * time.Minute
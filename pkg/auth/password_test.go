@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("invalid hash format %s", hash)
+	}
+
+	ok, needsRehash, err := VerifyPassword("correct horse battery staple", hash)
+	if err != nil || !ok || needsRehash {
+		t.Errorf("got ok=%v needsRehash=%v err=%v", ok, needsRehash, err)
+	}
+	if ok, _, _ := VerifyPassword("Correct horse battery staple", hash); ok {
+		t.Error("wrong password verified")
+	}
+	if _, _, err := VerifyPassword("password", "$2a$10$bcrypt"); err != ErrInvalidHash {
+		t.Errorf("expected invalid hash, got %v", err)
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	weak := DefaultPasswordParams
+	weak.Memory, weak.Time = 8*1024, 1
+	hash, err := hashPassword("correct horse battery staple", weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, needsRehash, err := VerifyPassword("correct horse battery staple", hash)
+	if err != nil || !ok || !needsRehash {
+		t.Errorf("got ok=%v needsRehash=%v err=%v", ok, needsRehash, err)
+	}
+}
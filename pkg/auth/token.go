@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+const issuer = "whimsy"
+
+// Token purposes, so a token minted for one step can't be used for another.
+const (
+	PurposeAccess = "access"
+	// PurposeMFA tokens prove the password step of a two-step login.
+	PurposeMFA = "mfa"
+	// PurposeOIDCState tokens carry the state of an OIDC login between its
+	// start and callback.
+	PurposeOIDCState = "oidc_state"
+)
+
+// TokenIssuer signs and verifies the JWTs handed to clients.
+type TokenIssuer struct {
+	PrivateKey *rsa.PrivateKey
+	TTL        time.Duration
+	now        func() time.Time
+}
+
+func NewTokenIssuer(privateKey *rsa.PrivateKey, ttl time.Duration) *TokenIssuer {
+	return &TokenIssuer{PrivateKey: privateKey, TTL: ttl, now: time.Now}
+}
+
+// Issue returns a token for subject valid for ttl, or the issuer TTL if zero.
+func (i *TokenIssuer) Issue(subject, purpose string, ttl time.Duration) (string, time.Time, error) {
+	return i.IssueWithData(subject, purpose, ttl, nil)
+}
+
+// IssueWithData is Issue with values for Claims.Data. The token is signed,
+// not encrypted, so data must not be secret from the holder.
+func (i *TokenIssuer) IssueWithData(subject, purpose string, ttl time.Duration, data map[string]string) (string, time.Time, error) {
+	if ttl == 0 {
+		ttl = i.TTL
+	}
+	now := i.now()
+	expiresAt := now.Add(ttl)
+	token, err := SignJWT(i.PrivateKey, "", Claims{
+		Issuer:    issuer,
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		ID:        xid.New().String(),
+		Purpose:   purpose,
+		Data:      data,
+	})
+	return token, expiresAt, err
+}
+
+// Verify checks the signature, expiry and purpose of token.
+func (i *TokenIssuer) Verify(token, purpose string) (*Claims, error) {
+	var claims Claims
+	err := ParseJWT(token, func(Header) (*rsa.PublicKey, error) {
+		return &i.PrivateKey.PublicKey, nil
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.Valid(i.now()); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != issuer || claims.Purpose != purpose || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := NewTokenIssuer(key, time.Hour)
+
+	token, expiresAt, err := issuer.Issue("user-1", PurposeAccess, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("invalid expiry %s", expiresAt)
+	}
+
+	claims, err := issuer.Verify(token, PurposeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("invalid subject %s", claims.Subject)
+	}
+
+	if _, err := issuer.Verify(token, "other"); err != ErrInvalidToken {
+		t.Errorf("token accepted for another purpose: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if _, err := issuer.Verify(parts[0]+"."+parts[1]+"x."+parts[2], PurposeAccess); err != ErrInvalidToken {
+		t.Errorf("tampered token accepted: %v", err)
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged, _, _ := NewTokenIssuer(other, time.Hour).Issue("user-1", PurposeAccess, 0)
+	if _, err := issuer.Verify(forged, PurposeAccess); err != ErrInvalidToken {
+		t.Errorf("forged token accepted: %v", err)
+	}
+
+	issuer.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := issuer.Verify(token, PurposeAccess); err != ErrExpiredToken {
+		t.Errorf("expired token accepted: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters per RFC 6238, the defaults every authenticator app supports.
+const (
+	TOTPIssuer = "Whimsy"
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+	// TOTPSkew is how many periods either side of now are accepted, to allow
+	// for drift between the server and the device clock.
+	TOTPSkew = 1
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit secret, base32 encoded.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps enroll from.
+func TOTPURI(account, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(int(TOTPPeriod.Seconds()))},
+	}
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// TOTPStep returns the time step t falls in.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// TOTPCode returns the code for secret at time step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// ValidateTOTP checks code against the steps within TOTPSkew of now and
+// returns the matching step. Steps at or before lastStep are rejected so a
+// code can't be replayed; callers persist the returned step.
+func ValidateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	current := TOTPStep(now)
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// RecoveryCodeCount is how many recovery codes are issued at a time.
+const RecoveryCodeCount = 10
+
+// recoveryAlphabet leaves out characters that are easily confused.
+const recoveryAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// GenerateRecoveryCodes returns n one time codes formatted as
+// xxxx-xxxx-xxxx-xxxx. Each carries about 79 bits of entropy, enough for an
+// unsalted hash, see HashRecoveryCode.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, 32)
+	for i := range codes {
+		chars := make([]byte, 0, 16)
+		for len(chars) < cap(chars) {
+			if _, err := rand.Read(buf); err != nil {
+				return nil, err
+			}
+			for _, c := range buf {
+				// Reject the top of the byte range to avoid modulo bias.
+				if int(c) >= 256/len(recoveryAlphabet)*len(recoveryAlphabet) || len(chars) == cap(chars) {
+					continue
+				}
+				chars = append(chars, recoveryAlphabet[int(c)%len(recoveryAlphabet)])
+			}
+		}
+		codes[i] = groupRecoveryCode(string(chars))
+	}
+	return codes, nil
+}
+
+func groupRecoveryCode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// NormalizeRecoveryCode canonicalizes user input, which may have lost its
+// dashes or changed case, before hashing.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+	return groupRecoveryCode(code)
+}
+
+// HashRecoveryCode hashes a recovery code for storage and lookup.
+func HashRecoveryCode(code string) string {
+	return HashOpaqueToken(NormalizeRecoveryCode(code))
+}
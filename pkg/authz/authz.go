@@ -0,0 +1,220 @@
+// Package authz answers whether the authenticated user may perform an action,
+// based on the roles bound to them in Postgres.
+//
+// Permissions are "<resource type>:<verb>" names such as "users:write". A
+// role permission of "users:*" grants every verb on users and "*" grants
+// everything. Bindings apply to every resource, or to those matching their
+// resource pattern, e.g. "users/<id>" or "users/*". Non-user clients such as
+// API keys are authorized by the scopes set with WithScopes instead.
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"whimsy/pkg/constants"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// grant is one permission a user holds, on resources matching resource.
+type grant struct {
+	Permission string
+	Resource   string
+}
+
+// Authorizer loads grants from the role tables.
+type Authorizer struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Authorizer {
+	return &Authorizer{db: db}
+}
+
+type (
+	contextKey struct{}
+	scopesKey  struct{}
+)
+
+// WithScopes marks a request as made by a non-user client, such as an API
+// key, holding scopes. Scopes are matched like unscoped role permissions.
+func WithScopes(ctx context.Context, principal string, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey{}, scopedPrincipal{principal, scopes})
+}
+
+type scopedPrincipal struct {
+	name   string
+	scopes []string
+}
+
+// requestGrants memoizes the user's grants for one request.
+type requestGrants struct {
+	authorizer *Authorizer
+	once       sync.Once
+	grants     []grant
+	err        error
+}
+
+// Middleware makes the authorizer available to Can and RequirePermission for
+// the rest of the request. Install it after authentication.
+func (a *Authorizer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKey{}, &requestGrants{authorizer: a})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *Authorizer) load(ctx context.Context, userID uuid.UUID) ([]grant, error) {
+	var grants []grant
+	err := a.db.WithContext(ctx).
+		Table("role_bindings").
+		Select("permissions.name AS permission, role_bindings.resource AS resource").
+		Joins("JOIN roles ON roles.id = role_bindings.role_id AND roles.deleted_at IS NULL").
+		Joins("JOIN role_permissions ON role_permissions.role_id = roles.id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id AND permissions.deleted_at IS NULL").
+		Where("role_bindings.user_id = ? AND role_bindings.deleted_at IS NULL", userID).
+		Scan(&grants).Error
+	return grants, err
+}
+
+// matchPermission reports whether a held permission covers action.
+func matchPermission(held, action string) bool {
+	if held == "*" || held == action {
+		return true
+	}
+	if strings.HasSuffix(held, ":*") {
+		return strings.HasPrefix(action, strings.TrimSuffix(held, "*"))
+	}
+	return false
+}
+
+// matchResource reports whether a binding's resource pattern covers resource.
+// An empty resource asks about the action in general, which only unscoped
+// bindings grant.
+func matchResource(pattern, resource string) bool {
+	if pattern == "" || pattern == "*" || pattern == resource {
+		return true
+	}
+	if resource != "" && strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(resource, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+func allowed(grants []grant, action, resource string) bool {
+	for _, g := range grants {
+		if matchPermission(g.Permission, action) && matchResource(g.Resource, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can returns nil if the authenticated user may perform action on resource,
+// e.g. Can(ctx, "users:write", "users/"+id). Pass an empty resource for
+// actions that aren't about one resource. Anonymous requests get a 401 and
+// denials a 403 *errors.Error. Every decision is logged.
+func Can(ctx context.Context, action, resource string) error {
+	logger := zerolog.Ctx(ctx)
+	principal, hasScopes := ctx.Value(scopesKey{}).(scopedPrincipal)
+	decision := func(allow bool, reason string) {
+		event := logger.Info().
+			Str("permission", action).
+			Str("resource", resource).
+			Str("user_id", utils.GetStringValueFromContext(constants.UserIDKey, ctx))
+		if hasScopes {
+			event = event.Str("principal", principal.name)
+		}
+		event.Bool("allowed", allow).Str("reason", reason).Msg("authz decision")
+	}
+
+	if hasScopes {
+		for _, scope := range principal.scopes {
+			if matchPermission(scope, action) {
+				decision(true, "scope")
+				return nil
+			}
+		}
+		decision(false, "no matching scope")
+		return errors.NewForbiddenError(action)
+	}
+
+	userID, err := uuid.FromString(utils.GetStringValueFromContext(constants.UserIDKey, ctx))
+	if err != nil {
+		decision(false, "anonymous")
+		return errors.NewUnauthorizedError("Authentication required.")
+	}
+	rg, ok := ctx.Value(contextKey{}).(*requestGrants)
+	if !ok {
+		decision(false, "authorizer not installed")
+		return errors.NewForbiddenError(action)
+	}
+	rg.once.Do(func() {
+		rg.grants, rg.err = rg.authorizer.load(ctx, userID)
+	})
+	if rg.err != nil {
+		logger.Err(rg.err).Msg("failed to load grants")
+		decision(false, "error")
+		return rg.err
+	}
+	if !allowed(rg.grants, action, resource) {
+		decision(false, "no matching grant")
+		return errors.NewForbiddenError(action)
+	}
+	decision(true, "granted")
+	return nil
+}
+
+// CanActAs returns nil if acting as userID grants the authenticated user
+// nothing more: userID holds no admin:access, and each of their permissions
+// is one Can allows the authenticated user on the same resources. Denials
+// are a 403 *errors.Error.
+func CanActAs(ctx context.Context, userID uuid.UUID) error {
+	rg, ok := ctx.Value(contextKey{}).(*requestGrants)
+	if !ok {
+		return errors.NewForbiddenError("admin:access")
+	}
+	grants, err := rg.authorizer.load(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if allowed(grants, "admin:access", "") {
+		zerolog.Ctx(ctx).Info().Str("target_user_id", userID.String()).Msg("refused to act as an administrator")
+		return errors.NewForbiddenError("admin:access")
+	}
+	for _, g := range grants {
+		if err := Can(ctx, g.Permission, g.Resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequirePermission guards a route with an unscoped permission check:
+//
+//	r.Handle("/admin/users", authz.RequirePermission("users:read")(handler))
+func RequirePermission(action string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := Can(r.Context(), action, ""); err != nil {
+				e := errors.NewGenericError(err)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(errors.StatusCode(e))
+				if err := json.NewEncoder(w).Encode(e); err != nil {
+					utils.LogAndReportError(r.Context(), err, "failed to encode error response")
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"whimsy/pkg/constants"
+	"whimsy/pkg/errors"
+
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		grant    grant
+		action   string
+		resource string
+		want     bool
+	}{
+		{grant{"users:read", ""}, "users:read", "", true},
+		{grant{"users:read", ""}, "users:read", "users/1", true},
+		{grant{"users:read", ""}, "users:write", "", false},
+		{grant{"users:*", ""}, "users:write", "users/1", true},
+		{grant{"users:*", ""}, "usersettings:write", "", false},
+		{grant{"*", ""}, "anything:at-all", "x/1", true},
+		{grant{"users:write", "users/1"}, "users:write", "users/1", true},
+		{grant{"users:write", "users/1"}, "users:write", "users/2", false},
+		{grant{"users:write", "users/1"}, "users:write", "", false},
+		{grant{"users:write", "users/*"}, "users:write", "users/2", true},
+		{grant{"users:write", "users/*"}, "users:write", "", false},
+		{grant{"users:write", "users/*"}, "users:write", "teams/2", false},
+	}
+	for _, tt := range tests {
+		if got := allowed([]grant{tt.grant}, tt.action, tt.resource); got != tt.want {
+			t.Errorf("%+v on %s %q = %v, want %v", tt.grant, tt.action, tt.resource, got, tt.want)
+		}
+	}
+}
+
+// withGrants returns a context as if Middleware had already loaded grants for
+// a signed in user, and a buffer collecting its log.
+func withGrants(grants ...grant) (context.Context, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	ctx := logger.WithContext(context.Background())
+	ctx = context.WithValue(ctx, constants.UserIDKey, uuid.Must(uuid.NewV4()).String())
+	rg := &requestGrants{grants: grants}
+	rg.once.Do(func() {})
+	return context.WithValue(ctx, contextKey{}, rg), &buf
+}
+
+func TestCan(t *testing.T) {
+	ctx, log := withGrants(grant{"users:read", ""}, grant{"users:write", "users/1"})
+
+	if err := Can(ctx, "users:read", "users/7"); err != nil {
+		t.Errorf("expected users:read to be allowed, got %v", err)
+	}
+	if err := Can(ctx, "users:write", "users/1"); err != nil {
+		t.Errorf("expected users:write on users/1 to be allowed, got %v", err)
+	}
+	err := Can(ctx, "users:write", "users/2")
+	if errors.StatusCode(err) != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a log line per decision, got %d", len(lines))
+	}
+	var last map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last["allowed"] != false || last["permission"] != "users:write" || last["resource"] != "users/2" {
+		t.Errorf("unexpected decision log %s", lines[2])
+	}
+}
+
+func TestCanAnonymous(t *testing.T) {
+	if err := Can(context.Background(), "users:read", ""); errors.StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %v", err)
+	}
+	ctx := context.WithValue(context.Background(), constants.UserIDKey, uuid.Must(uuid.NewV4()).String())
+	if err := Can(ctx, "users:read", ""); errors.StatusCode(err) != http.StatusForbidden {
+		t.Errorf("expected 403 without the middleware, got %v", err)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := RequirePermission("users:read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for _, tt := range []struct {
+		grants []grant
+		want   int
+	}{
+		{[]grant{{"users:read", ""}}, http.StatusTeapot},
+		{[]grant{{"users:read", "users/1"}}, http.StatusForbidden},
+		{nil, http.StatusForbidden},
+	} {
+		ctx, _ := withGrants(tt.grants...)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if w.Code != tt.want {
+			t.Errorf("grants %v: expected %d, got %d", tt.grants, tt.want, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var e errors.Error
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error body, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCanWithScopes(t *testing.T) {
+	ctx := WithScopes(context.Background(), "apikey:wk_test", []string{"users:read", "reports:*"})
+	if err := Can(ctx, "users:read", "users/1"); err != nil {
+		t.Errorf("expected users:read to be allowed, got %v", err)
+	}
+	if err := Can(ctx, "reports:export", ""); err != nil {
+		t.Errorf("expected reports:export to be allowed, got %v", err)
+	}
+	if err := Can(ctx, "users:write", ""); errors.StatusCode(err) != http.StatusForbidden {
+		t.Errorf("expected 403, got %v", err)
+	}
+}
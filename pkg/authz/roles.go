@@ -0,0 +1,76 @@
+package authz
+
+import (
+	"context"
+	goerrors "errors"
+
+	"whimsy/pkg/models"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrUnknownRole is returned when granting a role that doesn't exist.
+var ErrUnknownRole = goerrors.New("unknown role")
+
+// RoleSpec declares a role and its permissions for EnsureRoles.
+type RoleSpec struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// DefaultRoles are created by migrate.Migrate.
+var DefaultRoles = []RoleSpec{
+	{Name: "admin", Description: "Full access.", Permissions: []string{"*"}},
+	{Name: "support", Description: "Read access to accounts in the admin API, for customer support.", Permissions: []string{"admin:access", "users:read"}},
+}
+
+// EnsureRoles creates missing roles and permissions and sets each role's
+// permissions to those listed. It is safe to run on every deploy.
+func EnsureRoles(ctx context.Context, db *gorm.DB, specs ...RoleSpec) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, spec := range specs {
+			perms := make([]models.Permission, len(spec.Permissions))
+			for i, name := range spec.Permissions {
+				if err := tx.Where(models.Permission{Name: name}).FirstOrCreate(&perms[i]).Error; err != nil {
+					return err
+				}
+			}
+			var role models.Role
+			if err := tx.Where(models.Role{Name: spec.Name}).
+				Attrs(models.Role{Description: spec.Description}).
+				FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&role).Association("Permissions").Replace(perms); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Grant binds the named role to userID on resource, see RoleBinding. Granting
+// an existing binding is a no-op.
+func Grant(ctx context.Context, db *gorm.DB, userID uuid.UUID, roleName, resource string) error {
+	db = db.WithContext(ctx)
+	var role models.Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUnknownRole
+		}
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.RoleBinding{UserID: userID, RoleID: role.ID, Resource: resource}).Error
+}
+
+// Revoke removes a binding made with Grant.
+func Revoke(ctx context.Context, db *gorm.DB, userID uuid.UUID, roleName, resource string) error {
+	return db.WithContext(ctx).Unscoped().
+		Where("user_id = ? AND resource = ? AND role_id = (?)", userID, resource,
+			db.Model(&models.Role{}).Select("id").Where("name = ?", roleName)).
+		Delete(&models.RoleBinding{}).Error
+}
@@ -5,4 +5,7 @@ type ContextKey string
 const (
 	UserIDKey                     = ContextKey("userID")
 	UserReferenceIDKey            = ContextKey("userRefID")
+	ImpersonatorIDKey             = ContextKey("impersonatorID")
+	TxKey                         = ContextKey("tx")
+	UsePrimaryKey                 = ContextKey("usePrimary")
 )
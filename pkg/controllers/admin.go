@@ -0,0 +1,652 @@
+package controllers
+
+import (
+	goerrors "errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/constants"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// lockIndefinitely is how long an admin lock without an end lasts.
+const lockIndefinitely = 100 * 365 * 24 * time.Hour
+
+// AdminController serves the /admin API for staff. Every route needs the
+// admin:access permission plus one for its action, errors aren't obfuscated,
+// and every change is recorded with audit.Record.
+type AdminController struct {
+	db               *gorm.DB
+	sessions         *sessions.Store
+	impersonationTTL time.Duration
+	now              func() time.Time
+}
+
+func NewAdminController(db *gorm.DB, store *sessions.Store, impersonationTTL time.Duration) *AdminController {
+	return &AdminController{db: db, sessions: store, impersonationTTL: impersonationTTL, now: time.Now}
+}
+
+func (c *AdminController) Route(router *mux.Router) {
+	r := router.PathPrefix("/admin").Subrouter()
+	r.Use(authz.RequirePermission("admin:access"))
+	r.Handle("/users", APIHandler(c.searchUsers, false)).Methods("GET")
+	r.Handle("/users/{id}", APIHandler(c.getUser, false)).Methods("GET")
+	r.Handle("/users/{id}/lock", APIHandler(c.lockUser, false)).Methods("POST")
+	r.Handle("/users/{id}/unlock", APIHandler(c.unlockUser, false)).Methods("POST")
+	r.Handle("/users/{id}/sessions", APIHandler(c.listUserSessions, false)).Methods("GET")
+	r.Handle("/users/{id}/sessions", APIHandler(c.revokeUserSessions, false)).Methods("DELETE")
+	r.Handle("/users/{id}/sessions/{sessionId}", APIHandler(c.revokeUserSession, false)).Methods("DELETE")
+	r.Handle("/users/{id}/impersonate", APIHandler(c.impersonate, false)).Methods("POST")
+	r.Handle("/audit-events", APIHandler(c.listAuditEvents, false)).Methods("GET")
+	r.Handle("/scheduled-runs", APIHandler(c.listScheduledRuns, false)).Methods("GET")
+	r.Handle("/http-clients", APIHandler(c.listHTTPClients, false)).Methods("GET")
+}
+
+// adminUser shows staff the account state users don't see themselves.
+// swagger:model AdminUser
+type adminUser struct {
+	*models.User
+	LockedUntil         *time.Time `json:"lockedUntil,omitempty"`
+	FailedLoginAttempts int        `json:"failedLoginAttempts"`
+	MFAEnabled          bool       `json:"mfaEnabled"`
+}
+
+func newAdminUser(u *models.User) adminUser {
+	return adminUser{User: u, LockedUntil: u.LockedUntil, FailedLoginAttempts: u.FailedLoginAttempts, MFAEnabled: u.MFAEnabled()}
+}
+
+// swagger:model AdminUserList
+type adminUserList struct {
+	Users []adminUser `json:"users"`
+	Total int64       `json:"total"`
+}
+
+// adminActionRequest is the reason staff give for a change, kept in the
+// audit log.
+type adminActionRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type lockRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+	// Until defaults to indefinitely.
+	Until *time.Time `json:"until"`
+}
+
+// swagger:model RevokedSessionsResponse
+type revokedSessionsResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+func userResource(id uuid.UUID) string {
+	return "users/" + id.String()
+}
+
+// loadUser returns the user named by the {id} route variable, locked when
+// tx is a transaction that will change it.
+func loadUser(tx *gorm.DB, r *http.Request, lock bool) (*models.User, error) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, errors.NotFoundError()
+	}
+	if lock {
+		tx = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var user models.User
+	if err := tx.First(&user, "id = ?", id).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.NotFoundError()
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// readAdminRequest decodes and validates a request body.
+func readAdminRequest(w http.ResponseWriter, r *http.Request, out interface{}) error {
+	if err := readBody(w, r, out); err != nil {
+		return err
+	}
+	if err := validate.Struct(out); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	return nil
+}
+
+// likePattern matches q anywhere, with LIKE wildcards in q escaped.
+func likePattern(q string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(q) + "%"
+}
+
+// swagger:route GET /admin/users admin searchUsers
+//
+// Searches users by email or name, newest first. Takes q, limit (at most
+// 100) and offset query parameters.
+//
+// responses:
+//   200: AdminUserList
+//   default: WhimsyErrorResponse
+func (c *AdminController) searchUsers(w http.ResponseWriter, r *http.Request) error {
+	if err := authz.Can(r.Context(), "users:read", ""); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	limit, offset := 25, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return errors.NewBadRequestErrorWithMessage("limit must be between 1 and 100.")
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.NewBadRequestErrorWithMessage("offset must not be negative.")
+		}
+		offset = n
+	}
+
+	q := c.db.WithContext(r.Context()).Model(&models.User{})
+	if s := strings.TrimSpace(query.Get("q")); s != "" {
+		p := likePattern(s)
+		q = q.Where("email ILIKE ? OR first_name ILIKE ? OR last_name ILIKE ?", p, p, p)
+	}
+	var out adminUserList
+	if err := q.Count(&out.Total).Error; err != nil {
+		return err
+	}
+	var users []models.User
+	if err := q.Order("created_at DESC").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		return err
+	}
+	out.Users = make([]adminUser, len(users))
+	for i := range users {
+		out.Users[i] = newAdminUser(&users[i])
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:route GET /admin/users/{id} admin getUser
+//
+// Returns a user with their account state.
+//
+// responses:
+//   200: AdminUser
+//   default: WhimsyErrorResponse
+func (c *AdminController) getUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := loadUser(c.db.WithContext(r.Context()), r, false)
+	if err != nil {
+		return err
+	}
+	if err := authz.Can(r.Context(), "users:read", userResource(user.ID)); err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, newAdminUser(user))
+}
+
+// swagger:route POST /admin/users/{id}/lock admin lockUser
+//
+// Locks an account until the given time, or indefinitely, and signs it out
+// everywhere.
+//
+// responses:
+//   200: AdminUser
+//   default: WhimsyErrorResponse
+func (c *AdminController) lockUser(w http.ResponseWriter, r *http.Request) error {
+	var req lockRequest
+	if err := readAdminRequest(w, r, &req); err != nil {
+		return err
+	}
+	now := c.now()
+	until := now.Add(lockIndefinitely)
+	if req.Until != nil {
+		if !req.Until.After(now) {
+			e := errors.NewBadRequestErrorWithMessage("Bad request.")
+			e.WithFieldViolation("until", "Must be in the future.")
+			return e
+		}
+		until = *req.Until
+	}
+
+	var user *models.User
+	err := c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if user, err = loadUser(tx, r, true); err != nil {
+			return err
+		}
+		if err := authz.Can(r.Context(), "users:lock", userResource(user.ID)); err != nil {
+			return err
+		}
+		before := *user
+		if err := models.SkipVersionCheck(tx).Model(user).UpdateColumns(map[string]interface{}{"locked_until": until}).Error; err != nil {
+			return err
+		}
+		user.LockedUntil = &until
+		revoked, err := c.sessions.WithDB(tx).RevokeAll(r.Context(), user.ID, uuid.Nil)
+		if err != nil {
+			return err
+		}
+		changes, err := audit.Diff(newAdminUser(&before), newAdminUser(user))
+		if err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionUserLock,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Changes:    changes,
+			Metadata:   map[string]interface{}{"reason": req.Reason, "revokedSessions": revoked},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeBody(w, newAdminUser(user))
+}
+
+// swagger:route POST /admin/users/{id}/unlock admin unlockUser
+//
+// Lifts a lock, whether set by an admin or by failed logins.
+//
+// responses:
+//   200: AdminUser
+//   default: WhimsyErrorResponse
+func (c *AdminController) unlockUser(w http.ResponseWriter, r *http.Request) error {
+	var req adminActionRequest
+	if err := readAdminRequest(w, r, &req); err != nil {
+		return err
+	}
+	var user *models.User
+	err := c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if user, err = loadUser(tx, r, true); err != nil {
+			return err
+		}
+		if err := authz.Can(r.Context(), "users:lock", userResource(user.ID)); err != nil {
+			return err
+		}
+		before := *user
+		if err := models.SkipVersionCheck(tx).Model(user).UpdateColumns(map[string]interface{}{
+			"locked_until":          nil,
+			"failed_login_attempts": 0,
+		}).Error; err != nil {
+			return err
+		}
+		user.LockedUntil = nil
+		user.FailedLoginAttempts = 0
+		changes, err := audit.Diff(newAdminUser(&before), newAdminUser(user))
+		if err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionUserUnlock,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Changes:    changes,
+			Metadata:   map[string]interface{}{"reason": req.Reason},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeBody(w, newAdminUser(user))
+}
+
+// swagger:route GET /admin/users/{id}/sessions admin listUserSessions
+//
+// Lists the active sessions of a user.
+//
+// responses:
+//   200: []Session
+//   default: WhimsyErrorResponse
+func (c *AdminController) listUserSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := loadUser(c.db.WithContext(r.Context()), r, false)
+	if err != nil {
+		return err
+	}
+	if err := authz.Can(r.Context(), "users:read", userResource(user.ID)); err != nil {
+		return err
+	}
+	list, err := c.sessions.List(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, list)
+}
+
+// swagger:route DELETE /admin/users/{id}/sessions admin revokeUserSessions
+//
+// Signs a user out everywhere.
+//
+// responses:
+//   200: RevokedSessionsResponse
+//   default: WhimsyErrorResponse
+func (c *AdminController) revokeUserSessions(w http.ResponseWriter, r *http.Request) error {
+	var req adminActionRequest
+	if err := readAdminRequest(w, r, &req); err != nil {
+		return err
+	}
+	var revoked int64
+	err := c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		user, err := loadUser(tx, r, false)
+		if err != nil {
+			return err
+		}
+		if err := authz.Can(r.Context(), "sessions:revoke", userResource(user.ID)); err != nil {
+			return err
+		}
+		if revoked, err = c.sessions.WithDB(tx).RevokeAll(r.Context(), user.ID, uuid.Nil); err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionAdminSessionsRevoke,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Metadata:   map[string]interface{}{"reason": req.Reason, "revokedSessions": revoked},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeBody(w, revokedSessionsResponse{Revoked: revoked})
+}
+
+// swagger:route DELETE /admin/users/{id}/sessions/{sessionId} admin revokeUserSession
+//
+// Signs a user out of one session.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *AdminController) revokeUserSession(w http.ResponseWriter, r *http.Request) error {
+	var req adminActionRequest
+	if err := readAdminRequest(w, r, &req); err != nil {
+		return err
+	}
+	sessionID, err := uuid.FromString(mux.Vars(r)["sessionId"])
+	if err != nil {
+		return errors.NotFoundError()
+	}
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		user, err := loadUser(tx, r, false)
+		if err != nil {
+			return err
+		}
+		if err := authz.Can(r.Context(), "sessions:revoke", userResource(user.ID)); err != nil {
+			return err
+		}
+		if err := c.sessions.WithDB(tx).Revoke(r.Context(), user.ID, sessionID); err != nil {
+			if goerrors.Is(err, sessions.ErrInvalidSession) {
+				return errors.NotFoundError()
+			}
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionAdminSessionRevoke,
+			TargetType: audit.TargetSession,
+			TargetID:   sessionID.String(),
+			Metadata:   map[string]interface{}{"reason": req.Reason, "userId": user.ID},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// swagger:route POST /admin/users/{id}/impersonate admin impersonate
+//
+// Issues a short lived session token to act as a user, for reproducing
+// problems they report. Requests made with it are tagged with the admin in
+// logs and audit events, and can't change the account's security settings.
+// Admins, and users holding permissions the caller doesn't, can't be
+// impersonated. No cookie is set, so the admin's own browser session is unaffected.
+//
+// responses:
+//   201: AuthResponse
+//   default: WhimsyErrorResponse
+func (c *AdminController) impersonate(w http.ResponseWriter, r *http.Request) error {
+	adminID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	if utils.GetStringValueFromContext(constants.ImpersonatorIDKey, r.Context()) != "" {
+		return errors.NewErrorf(r.Context(), http.StatusForbidden, "Not allowed while impersonating.")
+	}
+	var req adminActionRequest
+	if err := readAdminRequest(w, r, &req); err != nil {
+		return err
+	}
+
+	var (
+		user    *models.User
+		token   string
+		session *models.Session
+	)
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if user, err = loadUser(tx, r, false); err != nil {
+			return err
+		}
+		if user.ID == adminID {
+			return errors.NewBadRequestErrorWithMessage("You can't impersonate yourself.")
+		}
+		if err := authz.Can(r.Context(), "users:impersonate", userResource(user.ID)); err != nil {
+			return err
+		}
+		// Impersonating must not escalate, e.g. to another admin's powers.
+		if err := authz.CanActAs(r.Context(), user.ID); err != nil {
+			return err
+		}
+		token, session, err = c.sessions.WithDB(tx).Impersonate(r.Context(), user.ID, adminID, c.impersonationTTL, sessions.DeviceFromRequest(r))
+		if err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionUserImpersonate,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Metadata:   map[string]interface{}{"reason": req.Reason, "sessionId": session.ID, "expiresAt": session.ExpiresAt},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("admin", r.Context()).Warn().
+		Str("target_user_id", user.ID.String()).Str("session_id", session.ID.String()).Msg("impersonation started")
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBodyStatus(w, http.StatusCreated, authResponse{User: user, Token: token, ExpiresAt: session.ExpiresAt})
+}
+
+// swagger:model AuditEventList
+type auditEventList struct {
+	Events []models.AuditEvent `json:"events"`
+	// NextBefore is the before parameter for the next, older page, if any.
+	NextBefore *int64 `json:"nextBefore,omitempty"`
+}
+
+// swagger:model ScheduledRunList
+type scheduledRunList struct {
+	Runs []models.ScheduledRun `json:"runs"`
+	// NextBefore is the before parameter for the next, older page, if any.
+	NextBefore *int64 `json:"nextBefore,omitempty"`
+}
+
+// parseLimit reads the page size, 50 unless given, at most 100.
+func parseLimit(query url.Values) (int, error) {
+	v := query.Get("limit")
+	if v == "" {
+		return 50, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 100 {
+		return 0, errors.NewBadRequestErrorWithMessage("limit must be between 1 and 100.")
+	}
+	return n, nil
+}
+
+// parseTimeParam reads an optional RFC 3339 query parameter.
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.NewBadRequestErrorWithMessage(name + " must be an RFC 3339 time.")
+	}
+	return &t, nil
+}
+
+// swagger:route GET /admin/audit-events admin listAuditEvents
+//
+// Lists audit events, newest first. Filters by the action, targetType,
+// targetId and actorId query parameters, and by creation time with since
+// and until. Takes limit (at most 100) and before, the nextBefore of the
+// previous page.
+//
+// responses:
+//   200: AuditEventList
+//   default: WhimsyErrorResponse
+func (c *AdminController) listAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	if err := authz.Can(r.Context(), "audit:read", ""); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query)
+	if err != nil {
+		return err
+	}
+
+	q := c.db.WithContext(r.Context()).Model(&models.AuditEvent{})
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.NewBadRequestErrorWithMessage("before must be an event seq.")
+		}
+		q = q.Where("seq < ?", n)
+	}
+	if v := query.Get("actorId"); v != "" {
+		id, err := uuid.FromString(v)
+		if err != nil {
+			return errors.NewBadRequestErrorWithMessage("actorId must be a user ID.")
+		}
+		q = q.Where("actor_id = ?", id)
+	}
+	for param, column := range map[string]string{"action": "action", "targetType": "target_type", "targetId": "target_id"} {
+		if v := query.Get(param); v != "" {
+			q = q.Where(column+" = ?", v)
+		}
+	}
+	since, err := parseTimeParam(query, "since")
+	if err != nil {
+		return err
+	}
+	until, err := parseTimeParam(query, "until")
+	if err != nil {
+		return err
+	}
+	if since != nil {
+		q = q.Where("created_at >= ?", *since)
+	}
+	if until != nil {
+		q = q.Where("created_at < ?", *until)
+	}
+
+	out := auditEventList{Events: []models.AuditEvent{}}
+	if err := q.Order("seq DESC").Limit(limit + 1).Find(&out.Events).Error; err != nil {
+		return err
+	}
+	if len(out.Events) > limit {
+		out.Events = out.Events[:limit]
+		next := out.Events[limit-1].Seq
+		out.NextBefore = &next
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:route GET /admin/scheduled-runs admin listScheduledRuns
+//
+// Lists runs of scheduled tasks, newest first. Filters by the task and
+// status query parameters. Takes limit (at most 100) and before, the
+// nextBefore of the previous page.
+//
+// responses:
+//   200: ScheduledRunList
+//   default: WhimsyErrorResponse
+func (c *AdminController) listScheduledRuns(w http.ResponseWriter, r *http.Request) error {
+	if err := authz.Can(r.Context(), "scheduler:read", ""); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query)
+	if err != nil {
+		return err
+	}
+
+	q := c.db.WithContext(r.Context()).Model(&models.ScheduledRun{})
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.NewBadRequestErrorWithMessage("before must be a run ID.")
+		}
+		q = q.Where("id < ?", n)
+	}
+	if v := query.Get("task"); v != "" {
+		q = q.Where("task = ?", v)
+	}
+	if v := query.Get("status"); v != "" {
+		q = q.Where("status = ?", v)
+	}
+
+	out := scheduledRunList{Runs: []models.ScheduledRun{}}
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&out.Runs).Error; err != nil {
+		return err
+	}
+	if len(out.Runs) > limit {
+		out.Runs = out.Runs[:limit]
+		next := out.Runs[limit-1].ID
+		out.NextBefore = &next
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:model HTTPClientStatsList
+type httpClientStatsList struct {
+	Clients []httpclient.Stats `json:"clients"`
+}
+
+// swagger:route GET /admin/http-clients admin listHTTPClients
+//
+// Lists the counters of this instance's outbound HTTP clients by provider
+// label, since it started.
+//
+// responses:
+//   200: HTTPClientStatsList
+//   default: WhimsyErrorResponse
+func (c *AdminController) listHTTPClients(w http.ResponseWriter, r *http.Request) error {
+	if err := authz.Can(r.Context(), "httpclients:read", ""); err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, httpClientStatsList{Clients: httpclient.AllStats()})
+}
@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/auth"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/testutils"
+	"whimsy/pkg/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
+)
+
+func TestAPIHandlerRawErrors(t *testing.T) {
+	failing := func(err error) func(http.ResponseWriter, *http.Request) error {
+		return func(http.ResponseWriter, *http.Request) error { return err }
+	}
+	tests := []struct {
+		name      string
+		err       error
+		obfuscate bool
+		status    int
+		msg       string
+	}{
+		{"obfuscated", goerrors.New("pq: relation missing"), true, http.StatusInternalServerError, "Internal server error."},
+		{"raw", goerrors.New("pq: relation missing"), false, http.StatusInternalServerError, "pq: relation missing"},
+		{"raw redacted", goerrors.New(`pq: duplicate key (email)=(ann@whimsy.test)`), false, http.StatusInternalServerError, `pq: duplicate key (email)=(***@whimsy.test)`},
+		{"typed error unchanged", errors.NotFoundError(), false, http.StatusNotFound, "not found"},
+		{"version conflict", models.ErrVersionConflict, false, http.StatusPreconditionFailed, "The resource was modified, reload it and try again."},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, false, http.StatusServiceUnavailable, "The service is busy, please try again."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			APIHandler(failing(tt.err), tt.obfuscate).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			var body errors.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Msg != tt.msg {
+				t.Errorf("msg = %q, want %q", body.Msg, tt.msg)
+			}
+		})
+	}
+}
+
+func newAdminRouter(t *testing.T) *mux.Router {
+	tokens := auth.NewTokenIssuer(testPrivateKey(t), time.Hour)
+	store := sessions.NewStore(db, time.Hour, 24*time.Hour)
+	router := mux.NewRouter()
+	router.Use(Authenticate(store))
+	router.Use(authz.New(db).Middleware)
+	enc := utils.Encrypter{PrivateKey: testPrivateKey(t)}
+	NewUserController(db, tokens, store, testutils.NewCaptureMailer(), enc, "https://app.whimsy.test").Route(router)
+	NewAdminController(db, store, 15*time.Minute).Route(router)
+	return router
+}
+
+func signupAs(t *testing.T, router http.Handler, email string) authResponse {
+	t.Helper()
+	w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": "correct horse battery staple"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var res authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestImpersonationEscalation(t *testing.T) {
+	router := newAdminRouter(t)
+	ctx := testutils.NewContext(t)
+	if err := authz.EnsureRoles(ctx, db,
+		authz.RoleSpec{Name: "impersonator", Permissions: []string{"admin:access", "users:read", "users:impersonate"}},
+		authz.RoleSpec{Name: "billing", Permissions: []string{"invoices:write"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	admin := signupAs(t, router, "root@whimsy.test")
+	staff := signupAs(t, router, "staff@whimsy.test")
+	billing := signupAs(t, router, "billing@whimsy.test")
+	plain := signupAs(t, router, "plain@whimsy.test")
+	for user, role := range map[*authResponse]string{&admin: "admin", &staff: "impersonator", &billing: "billing"} {
+		if err := authz.Grant(ctx, db, user.User.ID, role, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reason := map[string]string{"reason": "ticket 42"}
+	impersonate := func(caller, target authResponse) int {
+		return doJSON(t, router, "POST", "/admin/users/"+target.User.ID.String()+"/impersonate", caller.Token, reason).Code
+	}
+
+	if code := impersonate(admin, staff); code != http.StatusForbidden {
+		t.Errorf("expected 403 impersonating a user with admin access, got %d", code)
+	}
+	if code := impersonate(staff, billing); code != http.StatusForbidden {
+		t.Errorf("expected 403 impersonating a user with permissions the caller lacks, got %d", code)
+	}
+	if code := impersonate(staff, plain); code != http.StatusCreated {
+		t.Errorf("expected 201 impersonating a plain user, got %d", code)
+	}
+	if code := impersonate(admin, billing); code != http.StatusCreated {
+		t.Errorf("expected 201 for an admin impersonating a billing user, got %d", code)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	router := newAdminRouter(t)
+	ctx := testutils.NewContext(t)
+	admin := signupAs(t, router, "admin@whimsy.test")
+	support := signupAs(t, router, "helpdesk@whimsy.test")
+	target := signupAs(t, router, "target@whimsy.test")
+	if err := authz.Grant(ctx, db, admin.User.ID, "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := authz.Grant(ctx, db, support.User.ID, "support", ""); err != nil {
+		t.Fatal(err)
+	}
+	userPath := "/admin/users/" + target.User.ID.String()
+	reason := map[string]string{"reason": "ticket 42"}
+
+	if w := doJSON(t, router, "GET", "/admin/users", target.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a plain user, got %d", w.Code)
+	}
+
+	// Support staff can search, but not lock.
+	w := doJSON(t, router, "GET", "/admin/users?q=target%40", support.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var list adminUserList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || len(list.Users) != 1 || list.Users[0].ID != target.User.ID {
+		t.Errorf("unexpected search result %+v", list)
+	}
+	if w := doJSON(t, router, "POST", userPath+"/lock", support.Token, reason); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support locking, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", userPath+"/lock", admin.Token, map[string]string{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a reason, got %d", w.Code)
+	}
+
+	// Locking signs the user out and refuses logins.
+	if w := doJSON(t, router, "POST", userPath+"/lock", admin.Token, reason); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", target.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a session of a locked user, got %d", w.Code)
+	}
+	creds := map[string]string{"email": "target@whimsy.test", "password": "correct horse battery staple"}
+	if w := doJSON(t, router, "POST", "/users/login", "", creds); w.Code != http.StatusLocked {
+		t.Errorf("expected 423 for a locked login, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", userPath+"/unlock", admin.Token, reason); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/login", "", creds); w.Code != http.StatusOK {
+		t.Errorf("expected 200 after unlocking, got %d: %s", w.Code, w.Body)
+	}
+
+	// Impersonation acts as the user, without their security settings.
+	w = doJSON(t, router, "POST", userPath+"/impersonate", admin.Token, reason)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("impersonation replaced the admin's session cookie")
+	}
+	var imp authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &imp); err != nil {
+		t.Fatal(err)
+	}
+	if imp.ExpiresAt.After(time.Now().Add(16 * time.Minute)) {
+		t.Errorf("impersonation session lasts until %s", imp.ExpiresAt)
+	}
+	w = doJSON(t, router, "GET", "/users/me", imp.Token, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "target@whimsy.test") {
+		t.Errorf("expected to act as the target, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/mfa/totp", imp.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 enrolling TOTP while impersonating, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", "/admin/users/"+admin.User.ID.String()+"/impersonate", admin.Token, reason); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 impersonating yourself, got %d", w.Code)
+	}
+
+	if w := doJSON(t, router, "DELETE", userPath+"/sessions", admin.Token, reason); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", imp.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the impersonation session to be revoked, got %d", w.Code)
+	}
+
+	if w := doJSON(t, router, "GET", "/admin/audit-events", support.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support reading the audit log, got %d", w.Code)
+	}
+	w = doJSON(t, router, "GET", "/admin/audit-events?limit=3&targetId="+target.User.ID.String(), admin.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var page auditEventList
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 3 || page.NextBefore == nil {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	w = doJSON(t, router, "GET", "/admin/audit-events?limit=3&targetId="+target.User.ID.String()+"&before="+strconv.FormatInt(*page.NextBefore, 10), admin.Token, nil)
+	var rest auditEventList
+	if err := json.Unmarshal(w.Body.Bytes(), &rest); err != nil {
+		t.Fatal(err)
+	}
+	if len(rest.Events) != 1 || rest.NextBefore != nil {
+		t.Fatalf("unexpected last page %+v", rest)
+	}
+
+	// Pages are newest first; check the events oldest first.
+	events := append(rest.Events, page.Events...)
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+		if e.ActorID == nil || *e.ActorID != admin.User.ID || e.Metadata["reason"] != "ticket 42" {
+			t.Errorf("unexpected audit event %+v", e)
+		}
+	}
+	if got, want := strings.Join(actions, ","), "admin.user.lock,admin.user.unlock,admin.user.impersonate,admin.sessions.revoke_all"; got != want {
+		t.Errorf("audit actions = %s, want %s", got, want)
+	}
+	if _, err := audit.Verify(ctx, db); err != nil {
+		t.Errorf("audit chain: %v", err)
+	}
+	if err := db.Model(&models.AuditEvent{}).Where("id = ?", events[0].ID).Update("action", "tampered").Error; err == nil {
+		t.Error("audit events can be updated")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, status := range []models.RunStatus{models.RunSucceeded, models.RunFailed, models.RunSucceeded} {
+		at := now.Add(time.Duration(i) * time.Hour)
+		run := models.ScheduledRun{Task: "sessions.purge", ScheduledAt: at, StartedAt: at, Status: status, Node: "test/1"}
+		if err := db.Create(&run).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := doJSON(t, router, "GET", "/admin/scheduled-runs", support.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support reading scheduled runs, got %d", w.Code)
+	}
+	w = doJSON(t, router, "GET", "/admin/scheduled-runs?task=sessions.purge&status=succeeded&limit=1", admin.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var runs scheduledRunList
+	if err := json.Unmarshal(w.Body.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs.Runs) != 1 || runs.NextBefore == nil || !runs.Runs[0].ScheduledAt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("unexpected runs %+v", runs)
+	}
+	if w := doJSON(t, router, "GET", "/admin/scheduled-runs?limit=0", admin.Token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for limit=0, got %d", w.Code)
+	}
+
+	if w := doJSON(t, router, "GET", "/admin/http-clients", support.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support reading client stats, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "GET", "/admin/http-clients", admin.Token, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"clients":`) {
+		t.Errorf("unexpected client stats %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"whimsy/pkg/apikeys"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/testutils"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	keys := apikeys.NewStore(db)
+	router := mux.NewRouter()
+	router.Use(AuthenticateAPIKey(keys))
+	router.Use(authz.New(db).Middleware)
+	router.Handle("/reports", authz.RequirePermission("reports:read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if k := apikeys.FromContext(r.Context()); k == nil || k.RateLimitClass != apikeys.RateLimitInternal {
+			t.Errorf("expected the key in the context, got %+v", k)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	ctx := testutils.NewContext(t)
+	key, k, err := keys.Create(ctx, apikeys.CreateOptions{Name: "nightly export", Scopes: []string{"reports:*"}, RateLimitClass: apikeys.RateLimitInternal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly, _, err := keys.Create(ctx, apikeys.CreateOptions{Name: "partner", Scopes: []string{"users:read"}, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keys.Create(ctx, apikeys.CreateOptions{Name: "bad", RateLimitClass: "unlimited"}); err != apikeys.ErrUnknownClass {
+		t.Errorf("expected ErrUnknownClass, got %v", err)
+	}
+
+	get := func(auth string) int {
+		r := httptest.NewRequest("GET", "/reports", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("ApiKey " + key); code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", code)
+	}
+	if code := get("ApiKey " + readOnly); code != http.StatusForbidden {
+		t.Errorf("expected 403 without the scope, got %d", code)
+	}
+	if code := get("ApiKey " + k.Prefix + ".wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong secret, got %d", code)
+	}
+
+	list, err := keys.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, listed := range list {
+		if listed.ID == k.ID && listed.LastUsedAt == nil {
+			t.Error("expected last used to be recorded")
+		}
+	}
+
+	if err := keys.Revoke(ctx, k.Prefix); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("ApiKey " + key); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a revoked key, got %d", code)
+	}
+	if err := keys.Revoke(ctx, k.Prefix); err != apikeys.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"net/http"
+	"strings"
+
+	"whimsy/pkg/apikeys"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/constants"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// apiKey returns the key of an "Authorization: ApiKey" header.
+func apiKey(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "apikey ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// sessionToken returns the session token of r and whether it came from the
+// session cookie. A bearer token wins over the cookie.
+func sessionToken(r *http.Request) (string, bool) {
+	if token := bearerToken(r); token != "" {
+		return token, false
+	}
+	if c, err := r.Cookie(sessions.CookieName); err == nil && c.Value != "" {
+		return c.Value, true
+	}
+	return "", false
+}
+
+type sessionContextKey struct{}
+
+// currentSession returns the session a request authenticated with, if any.
+func currentSession(ctx context.Context) *models.Session {
+	s, _ := ctx.Value(sessionContextKey{}).(*models.Session)
+	return s
+}
+
+func writeAuthError(w http.ResponseWriter, r *http.Request, e *errors.Error) {
+	if err := writeBody(w, e); err != nil {
+		utils.LogAndReportError(r.Context(), err, "failed to encode error response")
+	}
+}
+
+// Authenticate puts the user of a valid session in the request context, with
+// the session ID as the user reference. Requests without a session pass
+// through anonymously, handlers that need a user call requireUser.
+func Authenticate(store *sessions.Store) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, fromCookie := sessionToken(r)
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			session, touched, err := store.Lookup(ctx, token, sessions.DeviceFromRequest(r))
+			switch {
+			case goerrors.Is(err, sessions.ErrInvalidSession) && fromCookie:
+				// A stale cookie shouldn't break public routes like login.
+				store.ClearCookie(w)
+				next.ServeHTTP(w, r)
+				return
+			case goerrors.Is(err, sessions.ErrInvalidSession):
+				writeAuthError(w, r, errors.NewUnauthorizedError("Invalid or expired session."))
+				return
+			case err != nil:
+				utils.LogAndReportError(ctx, err, "failed to look up session")
+				writeAuthError(w, r, errors.NewGenericError(err))
+				return
+			}
+			if touched && fromCookie {
+				store.SetCookie(w, token, session.ExpiresAt)
+			}
+
+			ctx = setUserIdInContext(ctx, session.UserID.String())
+			ctx = context.WithValue(ctx, constants.UserReferenceIDKey, session.ID.String())
+			ctx = context.WithValue(ctx, sessionContextKey{}, session)
+			if session.ImpersonatorID != nil {
+				ctx = context.WithValue(ctx, constants.ImpersonatorIDKey, session.ImpersonatorID.String())
+				zerolog.Ctx(ctx).UpdateContext(func(c zerolog.Context) zerolog.Context {
+					return c.Str("impersonator_id", session.ImpersonatorID.String())
+				})
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AuthenticateAPIKey accepts "Authorization: ApiKey <key>" for server to
+// server clients. The key ID becomes the user reference and its scopes
+// are checked by authz.Can; there is no user.
+func AuthenticateAPIKey(keys *apikeys.Store) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := apiKey(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			k, err := keys.Authenticate(ctx, key)
+			switch {
+			case goerrors.Is(err, apikeys.ErrInvalidKey):
+				writeAuthError(w, r, errors.NewUnauthorizedError("Invalid, expired or revoked API key."))
+				return
+			case err != nil:
+				utils.LogAndReportError(ctx, err, "failed to look up api key")
+				writeAuthError(w, r, errors.NewGenericError(err))
+				return
+			}
+
+			ctx = context.WithValue(ctx, constants.UserReferenceIDKey, k.ID.String())
+			ctx = apikeys.WithKey(ctx, k)
+			ctx = authz.WithScopes(ctx, "apikey:"+k.Prefix, k.ScopeList())
+			zerolog.Ctx(ctx).UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("api_key", k.Prefix).Str("rate_limit_class", k.RateLimitClass)
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// forbidImpersonation refuses account security changes in sessions an admin
+// started with impersonation.
+func forbidImpersonation(r *http.Request) error {
+	if utils.GetStringValueFromContext(constants.ImpersonatorIDKey, r.Context()) != "" {
+		return errors.NewErrorf(r.Context(), http.StatusForbidden, "Not allowed while impersonating.")
+	}
+	return nil
+}
+
+// requireUser returns the authenticated user ID or a 401 error.
+func requireUser(r *http.Request) (uuid.UUID, error) {
+	id, err := uuid.FromString(utils.GetStringValueFromContext(constants.UserIDKey, r.Context()))
+	if err != nil {
+		return uuid.Nil, errors.NewUnauthorizedError("Authentication required.")
+	}
+	return id, nil
+}
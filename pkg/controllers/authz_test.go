@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"whimsy/pkg/authz"
+	"whimsy/pkg/testutils"
+)
+
+func TestRequirePermissionWithRoles(t *testing.T) {
+	router, _ := newUserRouter(t)
+	router.Handle("/support", authz.RequirePermission("users:read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": "support@whimsy.test", "password": "correct horse battery staple"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := doJSON(t, router, "GET", "/support", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "GET", "/support", signup.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a role, got %d", w.Code)
+	}
+
+	ctx := testutils.NewContext(t)
+	if err := authz.Grant(ctx, db, signup.User.ID, "support", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := authz.Grant(ctx, db, signup.User.ID, "support", ""); err != nil {
+		t.Fatalf("granting twice should be a no-op, got %v", err)
+	}
+	if w := doJSON(t, router, "GET", "/support", signup.Token, nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 with the support role, got %d: %s", w.Code, w.Body)
+	}
+
+	if err := authz.Revoke(ctx, db, signup.User.ID, "support", ""); err != nil {
+		t.Fatal(err)
+	}
+	if w := doJSON(t, router, "GET", "/support", signup.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 after revoking, got %d", w.Code)
+	}
+	if err := authz.Grant(ctx, db, signup.User.ID, "no-such-role", ""); err != authz.ErrUnknownRole {
+		t.Errorf("expected ErrUnknownRole, got %v", err)
+	}
+}
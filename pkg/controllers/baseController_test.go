@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
 	"whimsy/pkg/testutils"
 
 	"gorm.io/gorm"
@@ -14,6 +15,9 @@ var db *gorm.DB
 
 func TestMain(m *testing.M) {
 	db = testutils.ConnectDb("controllers")
+	if err := db.Use(models.Plugin{}); err != nil {
+		panic(err)
+	}
 	if err := migrate.Migrate(db); err != nil {
 		panic(err)
 	}
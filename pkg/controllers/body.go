@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	goerrors "errors"
+	"io"
+	"reflect"
+	"strings"
+
+	"whimsy/pkg/errors"
+)
+
+// BodyOption customises how readBody decodes a request.
+type BodyOption func(*bodyOptions)
+
+type bodyOptions struct {
+	limit                 int64
+	disallowUnknownFields bool
+}
+
+// WithBodyLimit overrides RequestLimit for a single route.
+func WithBodyLimit(limit int64) BodyOption {
+	return func(o *bodyOptions) { o.limit = limit }
+}
+
+// DisallowUnknownFields rejects bodies with fields not present in the target.
+func DisallowUnknownFields() BodyOption {
+	return func(o *bodyOptions) { o.disallowUnknownFields = true }
+}
+
+var errBodyTooLarge = goerrors.New("request body too large")
+
+// limitedReader returns errBodyTooLarge once more than n bytes are read. It
+// guards the decompressed stream, and also translates the overflow reported
+// by http.MaxBytesReader, whose error type is not exported before go1.19.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = -1
+		return n, errBodyTooLarge
+	}
+	l.n -= int64(n)
+	if err != nil && err != io.EOF && l.n == 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// decompressBody wraps body according to the Content-Encoding header.
+func decompressBody(body io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	default:
+		return nil, errors.NewUnsupportedContentEncodingError(encoding)
+	}
+}
+
+// jsonTypeName describes a Go type the way a JSON client would see it.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// decodeError converts a json decoding error into a typed error response.
+func decodeError(err error, limit int64) (e *errors.Error) {
+	if goerrors.As(err, &e) {
+		return e
+	}
+	if goerrors.Is(err, errBodyTooLarge) {
+		return errors.NewRequestEntityTooLargeError(limit)
+	}
+
+	e = errors.NewInvalidRequestBodyFormatError()
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case goerrors.Is(err, io.EOF):
+		e.WithFieldViolation("body", "Required.")
+	case goerrors.Is(err, io.ErrUnexpectedEOF):
+		e.WithFieldViolation("body", "Unexpected end of JSON input.")
+	case goerrors.As(err, &syntaxErr):
+		e.WithFieldViolation("body", "Invalid JSON at offset %d.", syntaxErr.Offset)
+	case goerrors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		e.WithFieldViolation(field, "Must be a %s.", jsonTypeName(typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		e.WithFieldViolation(field, "Unknown field.")
+	case goerrors.Is(err, gzip.ErrHeader), goerrors.Is(err, gzip.ErrChecksum), goerrors.Is(err, zlib.ErrHeader):
+		e.WithFieldViolation("body", "Invalid compressed body.")
+	}
+	e.WithError(err)
+	return e
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	goerrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"whimsy/pkg/errors"
+)
+
+type testBody struct {
+	Name    string `json:"name"`
+	Address struct {
+		Zip int `json:"zip"`
+	} `json:"address"`
+}
+
+func readTestBody(t *testing.T, r *http.Request, opts ...BodyOption) *errors.Error {
+	t.Helper()
+	var out testBody
+	err := readBody(httptest.NewRecorder(), r, &out, opts...)
+	if err == nil {
+		return nil
+	}
+	var e *errors.Error
+	if !goerrors.As(err, &e) {
+		t.Fatalf("unexpected error type %T: %v", err, err)
+	}
+	return e
+}
+
+func TestReadBodyLimit(t *testing.T) {
+	body := `{"name":"` + strings.Repeat("a", 100) + `"}`
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	if e := readTestBody(t, r, WithBodyLimit(50)); e == nil || e.HTTPStatus != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %v", e)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	if e := readTestBody(t, r, WithBodyLimit(int64(len(body)))); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+}
+
+func TestReadBodyGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"name":"` + strings.Repeat("a", 1000) + `"}`))
+	zw.Close()
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(buf.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	if e := readTestBody(t, r); e != nil {
+		t.Errorf("unexpected error: %v", e)
+	}
+
+	// The decompressed size is capped too.
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(buf.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	if e := readTestBody(t, r, WithBodyLimit(500)); e == nil || e.HTTPStatus != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %v", e)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+	r.Header.Set("Content-Encoding", "br")
+	if e := readTestBody(t, r); e == nil || e.HTTPStatus != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %v", e)
+	}
+}
+
+func TestReadBodyFieldViolations(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"address":{"zip":"10001"}}`: "address.zip:Must be a number.",
+		`{"name":12}`:                 "name:Must be a string.",
+		`{"nickname":"duck"}`:         "nickname:Unknown field.",
+		`{"name":`:                    "body:Unexpected end of JSON input.",
+		`{"name" "duck"}`:             "body:Invalid JSON at offset 9.",
+		``:                            "body:Required.",
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		e := readTestBody(t, r, DisallowUnknownFields())
+		if e == nil || e.BadRequest == nil || len(e.BadRequest.FieldViolations) != 1 {
+			t.Errorf("%s: expected a field violation, got %v", body, e)
+			continue
+		}
+		fv := e.BadRequest.FieldViolations[0]
+		if got := fv.Field + ":" + fv.Description; got != want {
+			t.Errorf("%s: got %q want %q", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"whimsy/pkg/errors"
+	"whimsy/pkg/middleware"
+	"whimsy/pkg/models"
+)
+
+func TestWriteCachedBody(t *testing.T) {
+	body := map[string]string{"name": "duck"}
+	lastModified := time.Date(2022, 3, 28, 12, 0, 0, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	if err := writeCachedBody(w, httptest.NewRequest("GET", "/", nil), body, lastModified); err != nil {
+		t.Fatal(err)
+	}
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.Len() == 0 {
+		t.Fatalf("unexpected response %d %q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("invalid cache control %q", got)
+	}
+
+	for name, header := range map[string]http.Header{
+		"etag":      {"If-None-Match": {etag}},
+		"weak etag": {"If-None-Match": {`"other", W/` + etag}},
+		"wildcard":  {"If-None-Match": {"*"}},
+		"modified":  {"If-Modified-Since": {lastModified.Format(http.TimeFormat)}},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		if err := writeCachedBody(w, r, body, lastModified); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: expected 304, got %d", name, w.Code)
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", `"stale"`)
+	r.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	if err := writeCachedBody(w, r, body, lastModified); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestApplyIfMatch(t *testing.T) {
+	v := &models.Versioned{Version: 3}
+	for header, ok := range map[string]bool{
+		"":                true,
+		"*":               true,
+		versionETag(3):    true,
+		`"v2", "v3"`:      true,
+		versionETag(2):    false,
+		`W/"v3"`:          true,
+		`W/"v2"`:          false,
+		`"not-a-version"`: false,
+	} {
+		r := httptest.NewRequest("PATCH", "/", nil)
+		r.Header.Set("If-Match", header)
+		err := applyIfMatch(r, v)
+		if ok && err != nil {
+			t.Errorf("%q: unexpected error %v", header, err)
+		}
+		if !ok && errors.StatusCode(err) != http.StatusPreconditionFailed {
+			t.Errorf("%q: expected 412, got %v", header, err)
+		}
+	}
+}
+
+func TestIfMatchCompressed(t *testing.T) {
+	v := &models.Versioned{Version: 7}
+	get := middleware.Compress(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", versionETag(v.Version))
+		_ = writeCachedBody(w, r, map[string]string{"name": strings.Repeat("duck ", 100)}, time.Time{})
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	get.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("response not compressed: %v", w.Header())
+	}
+
+	// Clients echo the ETag of the compressed read.
+	r = httptest.NewRequest("PATCH", "/", nil)
+	r.Header.Set("If-Match", w.Header().Get("ETag"))
+	if err := applyIfMatch(r, v); err != nil {
+		t.Errorf("If-Match %q: %v", r.Header.Get("If-Match"), err)
+	}
+}
@@ -2,18 +2,27 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	goerrors "errors"
-	"fmt"
-	"io"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"whimsy/pkg/constants"
+	"whimsy/pkg/database"
 	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/redact"
 	"whimsy/pkg/utils"
 
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgconn"
 	"github.com/rs/zerolog"
 )
 
@@ -25,6 +34,19 @@ type Controller interface {
 
 var RequestLimit int64 = 10000
 
+// validate reports field violations by their JSON names.
+var validate = func() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}()
+
 func HealthCheck(w http.ResponseWriter, _ *http.Request) {
 	utils.Respond(w, utils.Message(true, "OK"))
 }
@@ -46,40 +68,72 @@ func APIHandler(errHandler func(w http.ResponseWriter, r *http.Request) error, o
 			logger := zerolog.Ctx(ctx)
 
 			var friendlyErr *errors.Error
-			if !goerrors.As(err, &friendlyErr) {
+			unhandled := false
+			if goerrors.Is(err, models.ErrVersionConflict) {
+				friendlyErr = errors.NewPreconditionFailedError()
+				friendlyErr.WithError(err)
+				logger.Debug().Err(err).Msg("api handler version conflict")
+			} else if database.IsRetryable(err) {
+				// InTx ran out of attempts; the client may have better luck.
+				friendlyErr = errors.NewErrorf(ctx, http.StatusServiceUnavailable, "The service is busy, please try again.")
+				friendlyErr.WithError(err)
+				logger.Warn().Err(err).Msg("api handler transaction conflict")
+			} else if !goerrors.As(err, &friendlyErr) {
 				// Capture private error messages and report generic.
 				logger.Err(err).Msg("unhandled api handler error")
 				friendlyErr = errors.NewGenericError(err)
+				unhandled = true
 			} else {
 				logger.Debug().Err(friendlyErr).Msg("api handler error")
 			}
 
 			// for some endpoints like /admin we always want to return
-			// the raw error
-			var returnedError interface{}
-			if obfuscateError {
-				returnedError = friendlyErr
-			} else {
-				returnedError = err
+			// the raw error, in the same shape as the others
+			returnedError := friendlyErr
+			if !obfuscateError && unhandled {
+				raw := *friendlyErr
+				raw.Msg = err.Error()
+				returnedError = &raw
 			}
 
-			if err := writeBody(w, returnedError); err != nil {
+			if err := writeBody(w, returnedError.Redacted(redact.Default())); err != nil {
 				utils.LogAndReportError(ctx, err, "failed to encode error response")
 			}
 		}
 	})
 }
 
-func readBody(r *http.Request, out interface{}) (err error) {
+// readBody decodes a JSON request body into out. Bodies are capped at
+// RequestLimit unless overridden with WithBodyLimit, and gzip or deflate
+// encoded bodies are decompressed under the same cap.
+func readBody(w http.ResponseWriter, r *http.Request, out interface{}, opts ...BodyOption) (err error) {
+	o := bodyOptions{limit: RequestLimit}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	body := http.MaxBytesReader(w, r.Body, o.limit)
 	defer func() {
-		cerr := r.Body.Close()
+		cerr := body.Close()
 		if err == nil {
 			err = cerr
 		}
 	}()
-	if err := json.NewDecoder(io.LimitReader(r.Body, RequestLimit)).Decode(out); err != nil {
-		fmt.Println(err)
-		return errors.NewInvalidRequestBodyFormatError()
+
+	decompressed, err := decompressBody(&limitedReader{r: body, n: o.limit}, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Msg("failed to decompress request body")
+		return decodeError(err, o.limit)
+	}
+	defer decompressed.Close()
+
+	dec := json.NewDecoder(&limitedReader{r: decompressed, n: o.limit})
+	if o.disallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(out); err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Msg("failed to decode request body")
+		return decodeError(err, o.limit)
 	}
 	return nil
 }
@@ -92,6 +146,111 @@ func writeBody(w http.ResponseWriter, body interface{}) error {
 	return json.NewEncoder(w).Encode(body)
 }
 
+func writeBodyStatus(w http.ResponseWriter, status int, body interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
+
+const pgUniqueViolation = "23505"
+
+// isUniqueViolation reports a Postgres unique constraint error.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return goerrors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
+
+// computeETag returns a strong entity tag for a serialized response.
+func computeETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements the weak comparison used by If-None-Match.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// writeCachedBody writes body with a strong ETag and answers conditional
+// requests with 304 Not Modified. lastModified may be zero when unknown.
+// Routes set their own policy with middleware.CacheControl; otherwise clients
+// must revalidate on every use.
+func writeCachedBody(w http.ResponseWriter, r *http.Request, body interface{}, lastModified time.Time) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	// Keep an ETag set by the handler, e.g. from versionETag.
+	h := w.Header()
+	etag := h.Get("ETag")
+	if etag == "" {
+		etag = computeETag(b)
+		h.Set("ETag", etag)
+	}
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "private, no-cache")
+	}
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	h.Set("Content-Type", "application/json")
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// versionETag is the entity tag of a models.Versioned resource, for use with
+// If-Match on later updates.
+func versionETag(version int) string {
+	return `"v` + strconv.Itoa(version) + `"`
+}
+
+// applyIfMatch checks the If-Match header against the loaded version of v.
+// Together with the version condition models.Plugin adds to the update, an
+// edit based on a stale read fails with 412. Absent or "*" matches anything.
+// Version tags match weak or not: they name the version, not the bytes, and
+// middleware.Compress weakens them on compressed responses.
+func applyIfMatch(r *http.Request, v *models.Versioned) error {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		version, err := strconv.Atoi(strings.TrimPrefix(strings.Trim(candidate, `"`), "v"))
+		if err == nil && version == v.Version {
+			return nil
+		}
+	}
+	return errors.NewPreconditionFailedError()
+}
+
 func setUserIdInContext(ctx context.Context, userId string) context.Context {
 	return context.WithValue(ctx, constants.UserIDKey, userId)
 }
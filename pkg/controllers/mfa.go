@@ -0,0 +1,431 @@
+package controllers
+
+import (
+	goerrors "errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/auth"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+// mfaChallengeResponse is returned by login when a second factor is needed.
+// swagger:model MFAChallengeResponse
+type mfaChallengeResponse struct {
+	MFARequired bool      `json:"mfaRequired"`
+	MFAToken    string    `json:"mfaToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// totpEnrollmentResponse carries the secret for manual entry and the URI the
+// QR code encodes.
+// swagger:model TOTPEnrollmentResponse
+type totpEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// recoveryCodesResponse is only ever shown once.
+// swagger:model RecoveryCodesResponse
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+func invalidCodeError() *errors.Error {
+	e := errors.NewBadRequestErrorWithMessage("Invalid authentication code.")
+	e.WithFieldViolation("code", "Invalid or already used.")
+	return e
+}
+
+func (c *UserController) routeMFA(r *mux.Router) {
+	r.Handle("/login/mfa", APIHandler(c.loginMFA, true)).Methods("POST")
+	r.Handle("/mfa/totp", APIHandler(c.enrollTOTP, true)).Methods("POST")
+	r.Handle("/mfa/totp", APIHandler(c.disableTOTP, true)).Methods("DELETE")
+	r.Handle("/mfa/totp/qr.png", APIHandler(c.totpQRCode, true)).Methods("GET")
+	r.Handle("/mfa/totp/confirm", APIHandler(c.confirmTOTP, true)).Methods("POST")
+	r.Handle("/mfa/recovery-codes", APIHandler(c.regenerateRecoveryCodes, true)).Methods("POST")
+}
+
+func (c *UserController) currentUser(r *http.Request) (*models.User, error) {
+	userID, err := requireUser(r)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := c.db.WithContext(r.Context()).First(&user, "id = ?", userID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.NewUnauthorizedError("Authentication required.")
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// requireSecondFactor checks code before an authenticated user changes their
+// second factor. Wrong codes count towards the lockout like failed logins,
+// so a stolen session can't guess its way to turning MFA off.
+func (c *UserController) requireSecondFactor(r *http.Request, user *models.User, code string) error {
+	if user.IsLocked(c.now()) {
+		return errors.NewAccountLockedError()
+	}
+	ok, err := c.checkSecondFactor(r, user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.recordFailedLogin(r, user, invalidCodeError())
+	}
+	return nil
+}
+
+// checkSecondFactor accepts a TOTP code or an unused recovery code. Both are
+// consumed with a conditional update, so concurrent requests can't use the
+// same code twice.
+func (c *UserController) checkSecondFactor(r *http.Request, user *models.User, code string) (bool, error) {
+	db := c.db.WithContext(r.Context())
+	if totpCodePattern.MatchString(code) {
+		secret, err := c.enc.DecryptString(user.TOTPSecret)
+		if err != nil {
+			return false, err
+		}
+		step, ok := auth.ValidateTOTP(secret, code, c.now(), user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		res := models.SkipVersionCheck(db).Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			UpdateColumn("totp_last_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		user.TOTPLastStep = step
+		return res.RowsAffected == 1, nil
+	}
+
+	res := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, auth.HashRecoveryCode(code)).
+		Update("used_at", c.now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		utils.CreateTaggedLogger("mfa", r.Context()).Info().Str("user_id", user.ID.String()).Msg("recovery code used")
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and issues new ones.
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]models.RecoveryCode, len(codes))
+	for i, code := range codes {
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: auth.HashRecoveryCode(code)}
+	}
+	return codes, tx.Create(&rows).Error
+}
+
+// swagger:route POST /users/login/mfa users loginMFA
+//
+// Completes a login with the challenge token from /users/login and a TOTP or
+// recovery code. Failures count towards the account lockout.
+//
+// responses:
+//   200: AuthResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) loginMFA(w http.ResponseWriter, r *http.Request) error {
+	var req mfaLoginRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	claims, err := c.tokens.Verify(req.MFAToken, auth.PurposeMFA)
+	if err != nil {
+		e := errors.NewUnauthorizedError("Login expired, sign in again.")
+		e.WithError(err)
+		return e
+	}
+	var user models.User
+	if err := c.db.WithContext(r.Context()).First(&user, "id = ?", claims.Subject).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.NewUnauthorizedError("Login expired, sign in again.")
+		}
+		return err
+	}
+	if user.IsLocked(c.now()) {
+		return errors.NewAccountLockedError()
+	}
+	if !user.MFAEnabled() {
+		return errors.NewUnauthorizedError("Login expired, sign in again.")
+	}
+
+	ok, err := c.checkSecondFactor(r, &user, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.recordFailedLogin(r, &user, errors.NewUnauthorizedError("Invalid authentication code."))
+	}
+	if err := c.recordLogin(r, &user); err != nil {
+		return err
+	}
+	return c.writeAuthResponse(w, r, http.StatusOK, &user)
+}
+
+// swagger:route POST /users/mfa/totp users enrollTOTP
+//
+// Starts TOTP enrollment with a new secret. It takes effect once confirmed
+// with a code from the authenticator.
+//
+// responses:
+//   200: TOTPEnrollmentResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) enrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	if err := forbidImpersonation(r); err != nil {
+		return err
+	}
+	user, err := c.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if user.MFAEnabled() {
+		return errors.NewConflictError("Two-factor authentication is already enabled.")
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	encrypted, err := c.enc.EncryptString(secret)
+	if err != nil {
+		return err
+	}
+	if err := c.db.WithContext(r.Context()).Model(user).Updates(map[string]interface{}{"totp_secret": encrypted}).Error; err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, totpEnrollmentResponse{Secret: secret, URI: auth.TOTPURI(user.Email, secret)})
+}
+
+// swagger:route GET /users/mfa/totp/qr.png users totpQRCode
+//
+// Renders the pending enrollment as a QR code for authenticator apps.
+//
+// produces:
+// - image/png
+//
+// responses:
+//   200:
+//   default: WhimsyErrorResponse
+func (c *UserController) totpQRCode(w http.ResponseWriter, r *http.Request) error {
+	user, err := c.currentUser(r)
+	if err != nil {
+		return err
+	}
+	// The secret is only shown while enrolling.
+	if user.TOTPSecret == "" || user.MFAEnabled() {
+		return errors.NotFoundError()
+	}
+	secret, err := c.enc.DecryptString(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	png, err := qrcode.Encode(auth.TOTPURI(user.Email, secret), qrcode.Medium, 256)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(png)
+	return err
+}
+
+// swagger:route POST /users/mfa/totp/confirm users confirmTOTP
+//
+// Enables TOTP with a code from the newly enrolled authenticator and returns
+// recovery codes.
+//
+// responses:
+//   200: RecoveryCodesResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) confirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	if err := forbidImpersonation(r); err != nil {
+		return err
+	}
+	var req mfaCodeRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	user, err := c.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if user.MFAEnabled() {
+		return errors.NewConflictError("Two-factor authentication is already enabled.")
+	}
+	if user.TOTPSecret == "" {
+		return errors.NewBadRequestErrorWithMessage("Start enrollment first.")
+	}
+
+	secret, err := c.enc.DecryptString(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := auth.ValidateTOTP(secret, req.Code, c.now(), user.TOTPLastStep)
+	if !ok {
+		return invalidCodeError()
+	}
+
+	var codes []string
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled_at": c.now(),
+			"totp_last_step":  step,
+		}).Error; err != nil {
+			return err
+		}
+		if codes, err = replaceRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		if err := audit.Record(tx, r, audit.Event{Action: audit.ActionTOTPEnabled, TargetType: audit.TargetUser, TargetID: user.ID.String()}); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, user.ID, "user.mfa_enabled", nil)
+	})
+	if err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("mfa", r.Context()).Info().Str("user_id", user.ID.String()).Msg("totp enabled")
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// swagger:route DELETE /users/mfa/totp users disableTOTP
+//
+// Turns two-factor authentication off. Needs a current TOTP or recovery code.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *UserController) disableTOTP(w http.ResponseWriter, r *http.Request) error {
+	if err := forbidImpersonation(r); err != nil {
+		return err
+	}
+	var req mfaCodeRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	user, err := c.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if !user.MFAEnabled() {
+		return errors.NewConflictError("Two-factor authentication is not enabled.")
+	}
+	if err := c.requireSecondFactor(r, user, req.Code); err != nil {
+		return err
+	}
+
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := audit.Record(tx, r, audit.Event{Action: audit.ActionTOTPDisabled, TargetType: audit.TargetUser, TargetID: user.ID.String()}); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, user.ID, "user.mfa_disabled", nil)
+	})
+	if err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("mfa", r.Context()).Warn().Str("user_id", user.ID.String()).Msg("totp disabled")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// swagger:route POST /users/mfa/recovery-codes users regenerateRecoveryCodes
+//
+// Replaces all recovery codes. Needs a current TOTP or recovery code.
+//
+// responses:
+//   200: RecoveryCodesResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	if err := forbidImpersonation(r); err != nil {
+		return err
+	}
+	var req mfaCodeRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	user, err := c.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if !user.MFAEnabled() {
+		return errors.NewConflictError("Two-factor authentication is not enabled.")
+	}
+	if err := c.requireSecondFactor(r, user, req.Code); err != nil {
+		return err
+	}
+
+	var codes []string
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if codes, err = replaceRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		if err := audit.Record(tx, r, audit.Event{Action: audit.ActionRecoveryCodesRenewed, TargetType: audit.TargetUser, TargetID: user.ID.String()}); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, user.ID, "user.recovery_codes_renewed", nil)
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, recoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/models"
+)
+
+func TestTOTPLogin(t *testing.T) {
+	router, _ := newUserRouter(t)
+	email := "totp@whimsy.test"
+	password := "correct horse battery staple"
+	creds := map[string]string{"email": email, "password": password}
+
+	w := doJSON(t, router, "POST", "/users/signup", "", creds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+
+	w = doJSON(t, router, "POST", "/users/mfa/totp", signup.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var enrollment totpEnrollmentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	code := func(offset int64) string {
+		c, err := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(time.Now())+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	r := httptest.NewRequest("GET", "/users/mfa/totp/qr.png", nil)
+	r.Header.Set("Authorization", "Bearer "+signup.Token)
+	w = httptest.NewRecorder()
+	if router.ServeHTTP(w, r); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected a png, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	if w := doJSON(t, router, "POST", "/users/mfa/totp/confirm", signup.Token, map[string]string{"code": "000000"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a wrong code, got %d", w.Code)
+	}
+	w = doJSON(t, router, "POST", "/users/mfa/totp/confirm", signup.Token, map[string]string{"code": code(0)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var recovery recoveryCodesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+	var published int64
+	if err := db.Model(&models.OutboxEvent{}).Where("type = ? AND tenant_id = ?", "user.mfa_enabled", signup.User.ID).Count(&published).Error; err != nil || published != 1 {
+		t.Errorf("%d user.mfa_enabled events published: %v", published, err)
+	}
+	if len(recovery.RecoveryCodes) != auth.RecoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", auth.RecoveryCodeCount, len(recovery.RecoveryCodes))
+	}
+
+	login := func() string {
+		w := doJSON(t, router, "POST", "/users/login", "", creds)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var challenge mfaChallengeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+		if !challenge.MFARequired || challenge.MFAToken == "" {
+			t.Fatalf("expected an mfa challenge, got %s", w.Body)
+		}
+		return challenge.MFAToken
+	}
+
+	// The challenge token is not an access token.
+	challenge := login()
+	if w := doJSON(t, router, "GET", "/users/me", challenge, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	// The code used to confirm enrollment can't be replayed.
+	if w := doJSON(t, router, "POST", "/users/login/mfa", "", map[string]string{"mfaToken": challenge, "code": code(0)}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a replayed code, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", "/users/login/mfa", "", map[string]string{"mfaToken": challenge, "code": code(1)}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// Recovery codes work once, in any case and without dashes.
+	recoveryCode := recovery.RecoveryCodes[0]
+	if w := doJSON(t, router, "POST", "/users/login/mfa", "", map[string]string{"mfaToken": login(), "code": recoveryCode}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/login/mfa", "", map[string]string{"mfaToken": login(), "code": recoveryCode}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used recovery code, got %d", w.Code)
+	}
+
+	w = doJSON(t, router, "POST", "/users/mfa/recovery-codes", signup.Token, map[string]string{"code": recovery.RecoveryCodes[1]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "DELETE", "/users/mfa/totp", signup.Token, map[string]string{"code": recovery.RecoveryCodes[2]}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a replaced recovery code, got %d", w.Code)
+	}
+}
+
+func TestTOTPLoginLockout(t *testing.T) {
+	router, _ := newUserRouter(t)
+	creds := map[string]string{"email": "totp-lockout@whimsy.test", "password": "correct horse battery staple"}
+
+	w := doJSON(t, router, "POST", "/users/signup", "", creds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+	var enrollment totpEnrollmentResponse
+	if err := json.Unmarshal(doJSON(t, router, "POST", "/users/mfa/totp", signup.Token, nil).Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	code, err := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := doJSON(t, router, "POST", "/users/mfa/totp/confirm", signup.Token, map[string]string{"code": code}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// A known password must not reset the count of wrong codes.
+	for i := 1; i <= auth.MaxFailedLogins; i++ {
+		w := doJSON(t, router, "POST", "/users/login", "", creds)
+		var challenge mfaChallengeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+		w = doJSON(t, router, "POST", "/users/login/mfa", "", map[string]string{"mfaToken": challenge.MFAToken, "code": "wrong-code"})
+		want := http.StatusUnauthorized
+		if i == auth.MaxFailedLogins {
+			want = http.StatusLocked
+		}
+		if w.Code != want {
+			t.Fatalf("attempt %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+}
+
+func TestMFAChangeLockout(t *testing.T) {
+	router, _ := newUserRouter(t)
+	creds := map[string]string{"email": "mfa-change@whimsy.test", "password": "correct horse battery staple"}
+
+	w := doJSON(t, router, "POST", "/users/signup", "", creds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+	var enrollment totpEnrollmentResponse
+	if err := json.Unmarshal(doJSON(t, router, "POST", "/users/mfa/totp", signup.Token, nil).Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	code, err := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = doJSON(t, router, "POST", "/users/mfa/totp/confirm", signup.Token, map[string]string{"code": code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var recovery recoveryCodesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stolen session can't guess codes to turn MFA off.
+	for i := 1; i <= auth.MaxFailedLogins; i++ {
+		w := doJSON(t, router, "DELETE", "/users/mfa/totp", signup.Token, map[string]string{"code": "wrong-code"})
+		want := http.StatusBadRequest
+		if i == auth.MaxFailedLogins {
+			want = http.StatusLocked
+		}
+		if w.Code != want {
+			t.Fatalf("attempt %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+	if w := doJSON(t, router, "POST", "/users/mfa/recovery-codes", signup.Token, map[string]string{"code": recovery.RecoveryCodes[0]}); w.Code != http.StatusLocked {
+		t.Errorf("expected 423 while locked, got %d", w.Code)
+	}
+}
@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	goerrors "errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/auth"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/oidc"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// oidcStateCookie holds the signed state of a login between its start and
+// callback, tying the callback to the browser that started it.
+const (
+	oidcStateCookie = "whimsy_oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// OIDCController serves "sign in with" logins through OpenID Connect
+// providers. It shares sessions, MFA and login bookkeeping with the
+// UserController.
+type OIDCController struct {
+	*UserController
+	providers map[string]*oidc.Provider
+}
+
+func NewOIDCController(users *UserController, providers ...*oidc.Provider) *OIDCController {
+	c := &OIDCController{UserController: users, providers: map[string]*oidc.Provider{}}
+	for _, p := range providers {
+		c.providers[p.Name] = p
+	}
+	return c
+}
+
+func (c *OIDCController) Route(router *mux.Router) {
+	r := router.PathPrefix("/auth/oidc").Subrouter()
+	r.Handle("/{provider}/start", APIHandler(c.start, true)).Methods("POST")
+	r.Handle("/{provider}/callback", APIHandler(c.callback, true)).Methods("POST")
+}
+
+// swagger:model OIDCStartResponse
+type oidcStartResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+}
+
+type oidcCallbackRequest struct {
+	Code  string `json:"code" validate:"required,max=2048"`
+	State string `json:"state" validate:"required,max=128"`
+}
+
+func (c *OIDCController) provider(r *http.Request) (*oidc.Provider, error) {
+	p, ok := c.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		return nil, errors.NotFoundError()
+	}
+	return p, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oidcLoginFailedError() *errors.Error {
+	return errors.NewUnauthorizedError("Sign in with the provider failed, please try again.")
+}
+
+func (c *OIDCController) setStateCookie(w http.ResponseWriter, value string, expiresAt time.Time, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		Expires:  expiresAt,
+		MaxAge:   maxAge,
+		Secure:   c.sessions.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// swagger:route POST /auth/oidc/{provider}/start auth oidcStart
+//
+// Starts a login with an OpenID Connect provider. The client sends the user
+// to the returned URL; the provider sends them back to the app, which
+// completes the login at the callback route.
+//
+// responses:
+//   200: OIDCStartResponse
+//   default: WhimsyErrorResponse
+func (c *OIDCController) start(w http.ResponseWriter, r *http.Request) error {
+	p, err := c.provider(r)
+	if err != nil {
+		return err
+	}
+	state, err := randomString()
+	if err != nil {
+		return err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return err
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return err
+	}
+	authURL, err := p.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		return err
+	}
+
+	token, expiresAt, err := c.tokens.IssueWithData(p.Name, auth.PurposeOIDCState, oidcStateTTL, map[string]string{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	})
+	if err != nil {
+		return err
+	}
+	c.setStateCookie(w, token, expiresAt, 0)
+	return writeBody(w, oidcStartResponse{AuthorizationURL: authURL})
+}
+
+// swagger:route POST /auth/oidc/{provider}/callback auth oidcCallback
+//
+// Completes a login with the code and state the provider returned. The
+// provider account is linked to the user with the same verified email, or a
+// new user is created. Accounts with two-factor authentication get an MFA
+// challenge, completed at /users/login/mfa.
+//
+// responses:
+//   200: AuthResponse
+//   201: AuthResponse
+//   default: WhimsyErrorResponse
+func (c *OIDCController) callback(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	logger := utils.CreateTaggedLogger("oidc", ctx)
+	p, err := c.provider(r)
+	if err != nil {
+		return err
+	}
+	var req oidcCallbackRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	// The state is single use whatever the outcome.
+	cookie, err := r.Cookie(oidcStateCookie)
+	c.setStateCookie(w, "", time.Time{}, -1)
+	if err != nil {
+		return oidcLoginFailedError()
+	}
+	claims, err := c.tokens.Verify(cookie.Value, auth.PurposeOIDCState)
+	if err != nil || claims.Subject != p.Name ||
+		subtle.ConstantTimeCompare([]byte(claims.Data["state"]), []byte(req.State)) != 1 {
+		logger.Info().Str("provider", p.Name).Msg("oidc callback with invalid state")
+		return oidcLoginFailedError()
+	}
+
+	idToken, err := p.Exchange(ctx, req.Code, claims.Data["verifier"], claims.Data["nonce"])
+	if err != nil {
+		logger.Warn().Err(err).Str("provider", p.Name).Msg("oidc code exchange failed")
+		return oidcLoginFailedError()
+	}
+
+	user, created, err := c.linkIdentity(r, p.Name, idToken)
+	if err != nil {
+		return err
+	}
+	if user.MFAEnabled() {
+		token, expiresAt, err := c.tokens.Issue(user.ID.String(), auth.PurposeMFA, auth.MFAChallengeTTL)
+		if err != nil {
+			return err
+		}
+		return writeBody(w, mfaChallengeResponse{MFARequired: true, MFAToken: token, ExpiresAt: expiresAt})
+	}
+	if err := c.recordLogin(r, user); err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	return c.writeAuthResponse(w, r, status, user)
+}
+
+// linkIdentity returns the user an ID token signs in. Unknown identities are
+// linked to the user with the same email, or to a new user, but only if the
+// provider verified the address.
+func (c *OIDCController) linkIdentity(r *http.Request, provider string, tok *oidc.IDToken) (user *models.User, created bool, err error) {
+	ctx := r.Context()
+	var revokeSessions bool
+	err = c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var identity models.UserIdentity
+		err := tx.Preload("User").Where("provider = ? AND subject = ?", provider, tok.Subject).First(&identity).Error
+		if err == nil && identity.User != nil {
+			user = identity.User
+			return nil
+		} else if err != nil && !goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := normalizeEmail(tok.Email)
+		if email == "" || !bool(tok.EmailVerified) {
+			return errors.NewUnauthorizedError("The provider account has no verified email address.")
+		}
+		user = &models.User{}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email = ?", email).First(user).Error
+		switch {
+		case goerrors.Is(err, gorm.ErrRecordNotFound):
+			now := c.now()
+			user = &models.User{
+				Email:           email,
+				FirstName:       strings.TrimSpace(tok.GivenName),
+				LastName:        strings.TrimSpace(tok.FamilyName),
+				EmailVerifiedAt: &now,
+			}
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			created = true
+		case err != nil:
+			return err
+		case user.EmailVerifiedAt == nil:
+			// Whoever registered the address never proved they own it, and
+			// may be squatting on it. The provider's owner takes over: their
+			// password and sessions go.
+			now := c.now()
+			if err := models.SkipVersionCheck(tx).Model(user).UpdateColumns(map[string]interface{}{
+				"email_verified_at": now,
+				"password_hash":     "",
+				"version":           gorm.Expr("version + 1"),
+			}).Error; err != nil {
+				return err
+			}
+			user.EmailVerifiedAt = &now
+			user.Version++
+			revokeSessions = true
+		}
+
+		if err := tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: provider,
+			Subject:  tok.Subject,
+			Email:    email,
+		}).Error; err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionIdentityLinked,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Metadata:   map[string]interface{}{"provider": provider, "email": email, "created": created, "tookOver": revokeSessions},
+		})
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, false, errors.NewConflictError("This account was linked concurrently, please try again.")
+		}
+		return nil, false, err
+	}
+	if revokeSessions {
+		if _, err := c.sessions.RevokeAll(ctx, user.ID, uuid.Nil); err != nil {
+			return nil, false, err
+		}
+	}
+	utils.CreateTaggedLogger("oidc", setUserIdInContext(ctx, user.ID.String())).Info().
+		Str("provider", provider).Bool("created", created).Bool("took_over", revokeSessions).Msg("oidc identity resolved")
+	return user, created, nil
+}
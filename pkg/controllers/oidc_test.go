@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/models"
+	"whimsy/pkg/oidc"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/testutils"
+	"whimsy/pkg/utils"
+
+	"github.com/gorilla/mux"
+)
+
+func newOIDCRouter(t *testing.T) (*mux.Router, *testutils.MockOIDCIssuer) {
+	issuer := testutils.NewMockOIDCIssuer(t)
+	provider := oidc.NewProvider(oidc.Config{
+		Name:         "mock",
+		IssuerURL:    issuer.URL,
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "https://app.whimsy.test/oidc/callback",
+	}, nil)
+
+	tokens := auth.NewTokenIssuer(testPrivateKey(t), time.Hour)
+	store := sessions.NewStore(db, time.Hour, 24*time.Hour)
+	router := mux.NewRouter()
+	router.Use(Authenticate(store))
+	router.Use(authz.New(db).Middleware)
+	users := NewUserController(db, tokens, store, testutils.NewCaptureMailer(), utils.Encrypter{PrivateKey: testPrivateKey(t)}, "https://app.whimsy.test")
+	users.Route(router)
+	NewOIDCController(users, provider).Route(router)
+	return router, issuer
+}
+
+// oidcLogin signs in through the mock issuer, as the app would.
+func oidcLogin(t *testing.T, router http.Handler, issuer *testutils.MockOIDCIssuer) *httptest.ResponseRecorder {
+	t.Helper()
+	w := doJSON(t, router, "POST", "/auth/oidc/mock/start", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var start oidcStartResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &start); err != nil {
+		t.Fatal(err)
+	}
+	code, state := issuer.Authorize(t, start.AuthorizationURL)
+
+	r := jsonRequest(t, "POST", "/auth/oidc/mock/callback", map[string]string{"code": code, "state": state})
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	router, issuer := newOIDCRouter(t)
+	issuer.SetUser(testutils.OIDCUser{Subject: "sub-1", Email: "Ada@Whimsy.test", EmailVerified: true, GivenName: "Ada"})
+
+	w := oidcLogin(t, router, issuer)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for a new user, got %d: %s", w.Code, w.Body)
+	}
+	var res authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.User.Email != "ada@whimsy.test" || res.User.FirstName != "Ada" || res.User.EmailVerifiedAt == nil {
+		t.Errorf("unexpected user %+v", res.User)
+	}
+
+	// The same subject signs in to the same user, whatever its email now.
+	issuer.SetUser(testutils.OIDCUser{Subject: "sub-1", Email: "changed@whimsy.test"})
+	w = oidcLogin(t, router, issuer)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var again authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.User.ID != res.User.ID {
+		t.Errorf("signed in as %s, want %s", again.User.ID, res.User.ID)
+	}
+
+	// Accounts without a password can't log in with one.
+	w = doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": "ada@whimsy.test", "password": "correct horse battery staple"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a password login without a password, got %d", w.Code)
+	}
+}
+
+func TestOIDCLinksByVerifiedEmail(t *testing.T) {
+	router, issuer := newOIDCRouter(t)
+	creds := map[string]string{"email": "grace@whimsy.test", "password": "correct horse battery staple"}
+	w := doJSON(t, router, "POST", "/users/signup", "", creds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider doesn't vouch for the address, so nothing is linked.
+	issuer.SetUser(testutils.OIDCUser{Subject: "sub-2", Email: "grace@whimsy.test"})
+	if w := oidcLogin(t, router, issuer); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unverified email, got %d: %s", w.Code, w.Body)
+	}
+
+	issuer.SetUser(testutils.OIDCUser{Subject: "sub-2", Email: "grace@whimsy.test", EmailVerified: true})
+	w = oidcLogin(t, router, issuer)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var res authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.User.ID != signup.User.ID {
+		t.Fatalf("linked to %s, want %s", res.User.ID, signup.User.ID)
+	}
+	var identity models.UserIdentity
+	if err := db.First(&identity, "user_id = ?", res.User.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "mock" || identity.Subject != "sub-2" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	// The signup never verified the address, so whoever made it loses the
+	// account: the password and the old session no longer work.
+	if w := doJSON(t, router, "POST", "/users/login", "", creds); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the old password, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", signup.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the old session, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", res.Token, nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for the new session, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	router, issuer := newOIDCRouter(t)
+
+	w := doJSON(t, router, "POST", "/auth/oidc/mock/start", "", nil)
+	var start oidcStartResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &start); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected an HttpOnly state cookie, got %v", cookies)
+	}
+	u, err := url.Parse(start.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("code_challenge_method") != "S256" || u.Query().Get("nonce") == "" {
+		t.Errorf("authorization URL without PKCE or nonce: %s", u)
+	}
+	code, state := issuer.Authorize(t, start.AuthorizationURL)
+
+	callback := func(state string, withCookie bool) int {
+		r := jsonRequest(t, "POST", "/auth/oidc/mock/callback", map[string]string{"code": code, "state": state})
+		if withCookie {
+			r.AddCookie(cookies[0])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if got := callback(state, false); got != http.StatusUnauthorized {
+		t.Errorf("without the state cookie: expected 401, got %d", got)
+	}
+	if got := callback("forged", true); got != http.StatusUnauthorized {
+		t.Errorf("with another state: expected 401, got %d", got)
+	}
+
+	if w := doJSON(t, router, "POST", "/auth/oidc/unknown/start", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown provider: expected 404, got %d", w.Code)
+	}
+}
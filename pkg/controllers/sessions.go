@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	goerrors "errors"
+	"net/http"
+
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// sessionResponse is a session as listed to its user.
+// swagger:model SessionResponse
+type sessionResponse struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+func (c *UserController) routeSessions(r *mux.Router) {
+	r.Handle("/sessions", APIHandler(c.listSessions, true)).Methods("GET")
+	r.Handle("/sessions", APIHandler(c.revokeAllSessions, true)).Methods("DELETE")
+	r.Handle("/sessions/{id}", APIHandler(c.revokeSession, true)).Methods("DELETE")
+}
+
+// swagger:route GET /users/sessions users listSessions
+//
+// Lists the devices the authenticated user is signed in on.
+//
+// responses:
+//   200: []SessionResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) listSessions(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	list, err := c.sessions.List(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	current := currentSession(r.Context())
+	out := make([]sessionResponse, len(list))
+	for i, s := range list {
+		out[i] = sessionResponse{Session: s, Current: current != nil && current.ID == s.ID}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:route DELETE /users/sessions/{id} users revokeSession
+//
+// Signs the authenticated user out of one device.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *UserController) revokeSession(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	sessionID, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		return errors.NotFoundError()
+	}
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := c.sessions.WithDB(tx).Revoke(r.Context(), userID, sessionID); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, userID, "user.session_revoked", map[string]interface{}{"sessionId": sessionID})
+	})
+	if goerrors.Is(err, sessions.ErrInvalidSession) {
+		return errors.NotFoundError()
+	} else if err != nil {
+		return err
+	}
+	if current := currentSession(r.Context()); current != nil && current.ID == sessionID {
+		c.sessions.ClearCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// swagger:route DELETE /users/sessions users revokeAllSessions
+//
+// Signs the authenticated user out everywhere. With ?keepCurrent=true the
+// session making the request stays signed in.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *UserController) revokeAllSessions(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	keep := uuid.Nil
+	current := currentSession(r.Context())
+	if current != nil && r.URL.Query().Get("keepCurrent") == "true" {
+		keep = current.ID
+	}
+	var n int64
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if n, err = c.sessions.WithDB(tx).RevokeAll(r.Context(), userID, keep); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, userID, "user.sessions_revoked", map[string]interface{}{"sessions": n})
+	})
+	if err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("revoke_sessions", r.Context()).Info().Int64("sessions", n).Msg("sessions revoked")
+	if keep == uuid.Nil {
+		c.sessions.ClearCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+)
+
+func TestSessions(t *testing.T) {
+	router, _ := newUserRouter(t)
+	creds := map[string]string{"email": "sessions@whimsy.test", "password": "correct horse battery staple"}
+
+	w := doJSON(t, router, "POST", "/users/signup", "", creds)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+	login := func(platform string) (string, *http.Cookie) {
+		r := jsonRequest(t, "POST", "/users/login", creds)
+		r.Header.Set("X-Platform", platform)
+		w := httptest.NewRecorder()
+		if router.ServeHTTP(w, r); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var res authResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessions.CookieName {
+				if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+					t.Errorf("insecure session cookie %v", c)
+				}
+				return res.Token, c
+			}
+		}
+		t.Fatal("no session cookie")
+		return "", nil
+	}
+	ios, _ := login("iOS")
+	android, cookie := login("Android")
+
+	// Browsers authenticate with the cookie alone.
+	r := httptest.NewRequest("GET", "/users/sessions", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	if router.ServeHTTP(w, r); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var list []sessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	// The signup session plus two logins.
+	if len(list) != 3 {
+		t.Fatalf("expected 3 sessions, got %d", len(list))
+	}
+	var iosID string
+	for _, s := range list {
+		if s.DeviceOS == "iOS" {
+			iosID = s.ID.String()
+		}
+		if s.Current != (s.DeviceOS == "Android") {
+			t.Errorf("session %s on %q has current=%v", s.ID, s.DeviceOS, s.Current)
+		}
+	}
+
+	if w := doJSON(t, router, "DELETE", "/users/sessions/"+iosID, android, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", ios, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a revoked session, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "DELETE", "/users/sessions/"+iosID, android, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an already revoked session, got %d", w.Code)
+	}
+
+	// Log out everywhere.
+	if w := doJSON(t, router, "DELETE", "/users/sessions", android, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", android, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logging out everywhere, got %d", w.Code)
+	}
+	// Each revocation published its event, and the refused one none.
+	for _, typ := range []string{"user.session_revoked", "user.sessions_revoked"} {
+		var published int64
+		if err := db.Model(&models.OutboxEvent{}).Where("type = ? AND tenant_id = ?", typ, signup.User.ID).Count(&published).Error; err != nil || published != 1 {
+			t.Errorf("%d %s events published: %v", published, typ, err)
+		}
+	}
+
+	// A stale cookie is ignored on public routes.
+	r = jsonRequest(t, "POST", "/users/login", creds)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	if router.ServeHTTP(w, r); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with a stale cookie, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	router, _ := newUserRouter(t)
+	w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": "logout@whimsy.test", "password": "correct horse battery staple"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+	if w := doJSON(t, router, "POST", "/users/logout", signup.Token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "GET", "/users/me", signup.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logout, got %d", w.Code)
+	}
+}
@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	goerrors "errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/auth"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/models"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type tokenRequest struct {
+	Token string `json:"token" validate:"required,max=128"`
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email" validate:"required,email,max=254"`
+}
+
+type passwordResetConfirmRequest struct {
+	Token    string `json:"token" validate:"required,max=128"`
+	Password string `json:"password" validate:"required,min=12,max=128"`
+}
+
+func invalidTokenError() *errors.Error {
+	e := errors.NewBadRequestErrorWithMessage("Invalid or expired link.")
+	e.WithFieldViolation("token", "Invalid or expired.")
+	return e
+}
+
+// issueUserToken replaces any outstanding token of purpose for user.
+func (c *UserController) issueUserToken(tx *gorm.DB, user *models.User, purpose models.TokenPurpose, ttl time.Duration) (string, error) {
+	now := c.now()
+	if err := tx.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+		Update("used_at", now).Error; err != nil {
+		return "", err
+	}
+
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Create(&models.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: hash,
+		ExpiresAt: now.Add(ttl),
+	}).Error
+}
+
+// consumeUserToken marks a token used and loads its user, both locked for
+// the rest of the transaction.
+func (c *UserController) consumeUserToken(tx *gorm.DB, token string, purpose models.TokenPurpose) (*models.User, error) {
+	var t models.UserToken
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", auth.HashOpaqueToken(token), purpose).
+		First(&t).Error
+	if goerrors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, invalidTokenError()
+	} else if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	if t.UsedAt != nil || now.After(t.ExpiresAt) {
+		return nil, invalidTokenError()
+	}
+	if err := tx.Model(&t).Update("used_at", now).Error; err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", t.UserID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, invalidTokenError()
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// linkEmail renders a mail with a link carrying token, in the locale of the
+// request.
+func (c *UserController) linkEmail(r *http.Request, user *models.User, template, path, token string, ttl time.Duration) (mailer.Message, error) {
+	link := strings.TrimRight(c.appURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+	name := user.FirstName
+	if name == "" {
+		name = user.Email
+	}
+	msg, err := mailer.Render(mailer.MatchLocale(r.Header.Get("Accept-Language")), template, mailer.LinkData{
+		Name:           name,
+		Link:           link,
+		ExpiresInHours: int(ttl.Hours()),
+	})
+	if err != nil {
+		return mailer.Message{}, err
+	}
+	msg.To = []string{user.Email}
+	return msg, nil
+}
+
+// sendLinkEmail mails a link carrying token in the locale of the request.
+func (c *UserController) sendLinkEmail(r *http.Request, user *models.User, template, path, token string, ttl time.Duration) error {
+	msg, err := c.linkEmail(r, user, template, path, token, ttl)
+	if err != nil {
+		return err
+	}
+	return c.mail.Send(r.Context(), msg)
+}
+
+// sendVerificationEmail starts email verification for user.
+func (c *UserController) sendVerificationEmail(r *http.Request, user *models.User) error {
+	token, err := c.issueUserToken(c.db.WithContext(r.Context()), user, models.TokenPurposeVerifyEmail, auth.VerifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+	return c.sendLinkEmail(r, user, "verify_email", "/verify-email", token, auth.VerifyEmailTokenTTL)
+}
+
+// swagger:route POST /users/verify-email/request users requestEmailVerification
+//
+// Mails a new verification link to the authenticated user.
+//
+// responses:
+//   202:
+//   default: WhimsyErrorResponse
+func (c *UserController) requestEmailVerification(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := c.db.WithContext(r.Context()).First(&user, "id = ?", userID).Error; err != nil {
+		return err
+	}
+	if user.EmailVerifiedAt != nil {
+		return errors.NewConflictError("Email address is already verified.")
+	}
+	if err := c.sendVerificationEmail(r, &user); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// swagger:route POST /users/verify-email users verifyEmail
+//
+// Confirms an email address with the token from a verification link.
+//
+// responses:
+//   200: User
+//   default: WhimsyErrorResponse
+func (c *UserController) verifyEmail(w http.ResponseWriter, r *http.Request) error {
+	var req tokenRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	var user *models.User
+	err := c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if user, err = c.consumeUserToken(tx, req.Token, models.TokenPurposeVerifyEmail); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Updates(map[string]interface{}{"email_verified_at": c.now()}).Error; err != nil {
+			return err
+		}
+		if err := audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionEmailVerified,
+			TargetType: audit.TargetUser,
+			TargetID:   user.ID.String(),
+			Metadata:   map[string]interface{}{"email": user.Email},
+		}); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, user.ID, "user.email_verified", map[string]interface{}{"email": user.Email})
+	})
+	if err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("verify_email", setUserIdInContext(r.Context(), user.ID.String())).Info().Msg("email verified")
+	return writeBody(w, user)
+}
+
+// swagger:route POST /users/password-reset/request users requestPasswordReset
+//
+// Mails a password reset link. The response is the same whether or not the
+// email is registered.
+//
+// responses:
+//   202:
+//   default: WhimsyErrorResponse
+func (c *UserController) requestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var req passwordResetRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	var user models.User
+	err := c.db.WithContext(r.Context()).Where("email = ?", req.Email).First(&user).Error
+	switch {
+	case goerrors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return err
+	default:
+		// Queued rather than sent, so neither the time taken nor a mail
+		// server failure tells registered emails apart.
+		err := c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			token, err := c.issueUserToken(tx, &user, models.TokenPurposeResetPassword, auth.PasswordResetTokenTTL)
+			if err != nil {
+				return err
+			}
+			msg, err := c.linkEmail(r, &user, "reset_password", "/reset-password", token, auth.PasswordResetTokenTTL)
+			if err != nil {
+				return err
+			}
+			_, err = jobs.Enqueue(r.Context(), tx, jobs.SendMail{Message: msg}, jobs.Options{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// swagger:route POST /users/password-reset users resetPassword
+//
+// Sets a new password with the token from a reset link, unlocks the account
+// and signs out every session.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *UserController) resetPassword(w http.ResponseWriter, r *http.Request) error {
+	var req passwordResetConfirmRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+
+	var user *models.User
+	err = c.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) (err error) {
+		if user, err = c.consumeUserToken(tx, req.Token, models.TokenPurposeResetPassword); err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"password_hash":         hash,
+			"failed_login_attempts": 0,
+			"locked_until":          nil,
+		}
+		// Receiving the link proves ownership of the address.
+		if user.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = c.now()
+		}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := audit.Record(tx, r, audit.Event{Action: audit.ActionPasswordReset, TargetType: audit.TargetUser, TargetID: user.ID.String()}); err != nil {
+			return err
+		}
+		return publishUserEvent(r.Context(), tx, user.ID, "user.password_reset", nil)
+	})
+	if err != nil {
+		return err
+	}
+	// Whoever knew the old password is signed out.
+	if _, err := c.sessions.RevokeAll(r.Context(), user.ID, uuid.Nil); err != nil {
+		return err
+	}
+	utils.CreateTaggedLogger("reset_password", setUserIdInContext(r.Context(), user.ID.String())).Info().Msg("password reset")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
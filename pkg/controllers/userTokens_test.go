@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/models"
+	"whimsy/pkg/testutils"
+)
+
+var linkToken = regexp.MustCompile(`https://app\.whimsy\.test/[a-z-]+\?token=\S+`)
+
+// mailedToken extracts the token from the link in a captured message.
+func mailedToken(t *testing.T, text string) string {
+	t.Helper()
+	link := linkToken.FindString(text)
+	u, err := url.Parse(link)
+	if err != nil || u.Query().Get("token") == "" {
+		t.Fatalf("no link in %q", text)
+	}
+	return u.Query().Get("token")
+}
+
+// sendQueuedMail sends the queued mail jobs with m, as the worker would.
+func sendQueuedMail(t *testing.T, m mailer.Mailer) {
+	t.Helper()
+	var queued []models.Job
+	if err := db.Where("kind = ?", jobs.SendMail{}.Kind()).Find(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range queued {
+		b, err := json.Marshal(j.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var job jobs.SendMail
+		if err := json.Unmarshal(b, &job); err != nil {
+			t.Fatal(err)
+		}
+		if err := jobs.SendMailHandler(m)(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(&j).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	router, mail := newUserRouter(t)
+	email := "verify@whimsy.test"
+
+	w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": "correct horse battery staple"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	first := mailedToken(t, testutils.AssertMailSent(t, mail, email, "Confirm").Text)
+
+	// Requesting a new link invalidates the first one.
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+	if w := doJSON(t, router, "POST", "/users/verify-email/request", signup.Token, nil); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	second := mailedToken(t, testutils.AssertMailSent(t, mail, email, "Confirm").Text)
+
+	if w := doJSON(t, router, "POST", "/users/verify-email", "", map[string]string{"token": first}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a replaced token, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", "/users/verify-email", "", map[string]string{"token": second}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/verify-email", "", map[string]string{"token": second}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a used token, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", "/users/verify-email/request", signup.Token, nil); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 once verified, got %d", w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	router, mail := newUserRouter(t)
+	email := "reset@whimsy.test"
+	newPassword := "a brand new passphrase"
+
+	if w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": "correct horse battery staple"}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	mail.Reset()
+
+	// Unknown emails get the same response and no mail.
+	if w := doJSON(t, router, "POST", "/users/password-reset/request", "", map[string]string{"email": "nobody@whimsy.test"}); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	sendQueuedMail(t, mail)
+	if n := len(mail.Messages()); n != 0 {
+		t.Fatalf("expected no mail, got %d", n)
+	}
+
+	r := jsonRequest(t, "POST", "/users/password-reset/request", map[string]string{"email": email})
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	w := httptest.NewRecorder()
+	if router.ServeHTTP(w, r); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	if n := len(mail.Messages()); n != 0 {
+		t.Fatalf("expected the mail to be queued, got %d sent", n)
+	}
+	sendQueuedMail(t, mail)
+	token := mailedToken(t, testutils.AssertMailSent(t, mail, email, "contraseña").Text)
+
+	if w := doJSON(t, router, "POST", "/users/password-reset", "", map[string]string{"token": "bogus", "password": newPassword}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", "/users/password-reset", "", map[string]string{"token": token, "password": newPassword}); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": email, "password": newPassword}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with the new password, got %d: %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, router, "POST", "/users/password-reset", "", map[string]string{"token": token, "password": "yet another passphrase"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a used token, got %d", w.Code)
+	}
+}
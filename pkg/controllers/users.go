@@ -0,0 +1,428 @@
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/middleware"
+	"whimsy/pkg/models"
+	"whimsy/pkg/outbox"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserController serves account signup, login, two-factor, profile and
+// account recovery routes. enc encrypts TOTP secrets at rest, and appURL is
+// the frontend base URL that emailed links point at.
+type UserController struct {
+	db       *gorm.DB
+	tokens   *auth.TokenIssuer
+	sessions *sessions.Store
+	mail     mailer.Mailer
+	enc      utils.Encrypter
+	appURL   string
+	now      func() time.Time
+}
+
+func NewUserController(db *gorm.DB, tokens *auth.TokenIssuer, store *sessions.Store, mail mailer.Mailer, enc utils.Encrypter, appURL string) *UserController {
+	return &UserController{db: db, tokens: tokens, sessions: store, mail: mail, enc: enc, appURL: appURL, now: time.Now}
+}
+
+func (c *UserController) Route(router *mux.Router) {
+	r := router.PathPrefix("/users").Subrouter()
+	r.Handle("/signup", APIHandler(c.signup, true)).Methods("POST")
+	r.Handle("/login", APIHandler(c.login, true)).Methods("POST")
+	r.Handle("/logout", APIHandler(c.logout, true)).Methods("POST")
+	// The profile is per user and changes with every login, so caches
+	// revalidate it with the ETag.
+	r.Handle("/me", middleware.CacheControl("private, no-cache")(APIHandler(c.me, true))).Methods("GET")
+	r.Handle("/me", APIHandler(c.updateMe, true)).Methods("PATCH")
+	r.Handle("/verify-email/request", APIHandler(c.requestEmailVerification, true)).Methods("POST")
+	r.Handle("/verify-email", APIHandler(c.verifyEmail, true)).Methods("POST")
+	r.Handle("/password-reset/request", APIHandler(c.requestPasswordReset, true)).Methods("POST")
+	r.Handle("/password-reset", APIHandler(c.resetPassword, true)).Methods("POST")
+	c.routeMFA(r)
+	c.routeSessions(r)
+}
+
+type signupRequest struct {
+	Email     string `json:"email" validate:"required,email,max=254"`
+	Password  string `json:"password" validate:"required,min=12,max=128"`
+	FirstName string `json:"firstName" validate:"max=100"`
+	LastName  string `json:"lastName" validate:"max=100"`
+}
+
+// profileRequest updates the fields it sets.
+type profileRequest struct {
+	FirstName *string `json:"firstName" validate:"omitempty,max=100"`
+	LastName  *string `json:"lastName" validate:"omitempty,max=100"`
+}
+
+type loginRequest struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required,max=128"`
+}
+
+// authResponse is returned by signup and login. Token is the session token
+// for non-browser clients, browsers also get it as a cookie.
+// swagger:model AuthResponse
+type authResponse struct {
+	User      *models.User `json:"user"`
+	Token     string       `json:"token"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// swagger:route POST /users/signup users signup
+//
+// Creates an account and returns an access token.
+//
+// responses:
+//   201: AuthResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) signup(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	var req signupRequest
+	if err := readBody(w, r, &req, DisallowUnknownFields()); err != nil {
+		return err
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	user := &models.User{
+		Email:        req.Email,
+		FirstName:    strings.TrimSpace(req.FirstName),
+		LastName:     strings.TrimSpace(req.LastName),
+		PasswordHash: hash,
+	}
+	err = c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		return publishUserEvent(ctx, tx, user.ID, "user.registered", map[string]interface{}{"email": user.Email})
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			e := errors.NewConflictError("An account with this email already exists.")
+			e.WithFieldViolation("email", "Already registered.")
+			return e
+		}
+		return err
+	}
+	logger := utils.CreateTaggedLogger("signup", setUserIdInContext(ctx, user.ID.String()))
+	logger.Info().Msg("user signed up")
+	// The account is usable without a verified email, so a mail outage
+	// shouldn't fail the signup; the user can request another link.
+	if err := c.sendVerificationEmail(r, user); err != nil {
+		logger.Error().Err(err).Msg("could not send verification email")
+		utils.ReportError(ctx, err)
+	}
+
+	return c.writeAuthResponse(w, r, http.StatusCreated, user)
+}
+
+// publishUserEvent publishes an event of userID's account, which its
+// webhooks receive, in tx. The payload always holds the user's id.
+func publishUserEvent(ctx context.Context, tx *gorm.DB, userID uuid.UUID, typ string, payload map[string]interface{}) error {
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	payload["id"] = userID
+	_, err := outbox.Publish(ctx, tx, outbox.Event{
+		AggregateType: "user",
+		AggregateID:   userID.String(),
+		Type:          typ,
+		Payload:       payload,
+		TenantID:      &userID,
+	})
+	return err
+}
+
+// writeAuthResponse starts a session for user on the requesting device.
+func (c *UserController) writeAuthResponse(w http.ResponseWriter, r *http.Request, status int, user *models.User) error {
+	token, session, err := c.sessions.Create(r.Context(), user.ID, sessions.DeviceFromRequest(r))
+	if err != nil {
+		return err
+	}
+	c.sessions.SetCookie(w, token, session.ExpiresAt)
+	return writeBodyStatus(w, status, authResponse{User: user, Token: token, ExpiresAt: session.ExpiresAt})
+}
+
+// swagger:route POST /users/login users login
+//
+// Exchanges an email and password for an access token. Accounts are locked
+// for a while after repeated failures. Accounts with two-factor
+// authentication get an MFA challenge instead, completed at /users/login/mfa.
+//
+// responses:
+//   200: AuthResponse
+//   default: WhimsyErrorResponse
+func (c *UserController) login(w http.ResponseWriter, r *http.Request) error {
+	var req loginRequest
+	if err := readBody(w, r, &req); err != nil {
+		return err
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	user, err := c.authenticate(r, req.Email, req.Password)
+	if err != nil {
+		return err
+	}
+	if user.MFAEnabled() {
+		token, expiresAt, err := c.tokens.Issue(user.ID.String(), auth.PurposeMFA, auth.MFAChallengeTTL)
+		if err != nil {
+			return err
+		}
+		return writeBody(w, mfaChallengeResponse{MFARequired: true, MFAToken: token, ExpiresAt: expiresAt})
+	}
+	if err := c.recordLogin(r, user); err != nil {
+		return err
+	}
+	return c.writeAuthResponse(w, r, http.StatusOK, user)
+}
+
+func invalidCredentialsError() *errors.Error {
+	return errors.NewUnauthorizedError("Invalid email or password.")
+}
+
+// authenticate checks the password step of a login, tracking failures for
+// lockout and upgrading outdated password hashes.
+func (c *UserController) authenticate(r *http.Request, email, password string) (*models.User, error) {
+	ctx := r.Context()
+	logger := utils.CreateTaggedLogger("login", ctx)
+	now := c.now()
+
+	var user models.User
+	if err := c.db.WithContext(ctx).Where("email = ?", email).First(&user).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			auth.VerifyDummyPassword(password)
+			return nil, invalidCredentialsError()
+		}
+		return nil, err
+	}
+	if user.IsLocked(now) {
+		logger.Info().Str("user_id", user.ID.String()).Msg("login refused, account locked")
+		return nil, errors.NewAccountLockedError()
+	}
+	// Accounts created through an OIDC provider have no password until they
+	// reset one.
+	if user.PasswordHash == "" {
+		auth.VerifyDummyPassword(password)
+		return nil, invalidCredentialsError()
+	}
+
+	ok, needsRehash, err := auth.VerifyPassword(password, user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, c.recordFailedLogin(r, &user, invalidCredentialsError())
+	}
+
+	if needsRehash {
+		hash, err := auth.HashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		// Login bookkeeping must not conflict with concurrent profile edits.
+		if err := models.SkipVersionCheck(c.db.WithContext(ctx)).Model(&user).UpdateColumns(map[string]interface{}{"password_hash": hash}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// recordFailedLogin counts a failed password or second factor towards the
+// lockout, and returns the error to respond with. The count is read again
+// under a row lock on the primary: user was loaded before the slow password
+// check, maybe from a replica, and concurrent failures must all count.
+func (c *UserController) recordFailedLogin(r *http.Request, user *models.User, failure error) error {
+	ctx := r.Context()
+	locked := false
+	err := c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var current models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "failed_login_attempts", "locked_until").
+			First(&current, "id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		now := c.now()
+		if current.IsLocked(now) {
+			// Locked by a concurrent failure.
+			locked = true
+			return nil
+		}
+		updates := map[string]interface{}{"failed_login_attempts": current.FailedLoginAttempts + 1}
+		if current.FailedLoginAttempts+1 >= auth.MaxFailedLogins {
+			locked = true
+			updates["failed_login_attempts"] = 0
+			updates["locked_until"] = now.Add(auth.LockoutDuration)
+			utils.CreateTaggedLogger("login", ctx).Warn().Str("user_id", user.ID.String()).Msg("account locked after failed logins")
+		}
+		return models.SkipVersionCheck(tx).Model(&current).UpdateColumns(updates).Error
+	})
+	if err != nil {
+		return err
+	}
+	if locked {
+		return errors.NewAccountLockedError()
+	}
+	return failure
+}
+
+// recordLogin marks a completed login and clears the failure count. It only
+// runs once every factor has been checked, so a known password doesn't reset
+// the lockout on second factor guesses.
+func (c *UserController) recordLogin(r *http.Request, user *models.User) error {
+	now := c.now()
+	// Not conditional on the version, but lastLoginAt shows in the user's
+	// representation, so its version tag changes.
+	err := models.SkipVersionCheck(c.db.WithContext(r.Context())).Model(user).
+		UpdateColumns(map[string]interface{}{
+			"failed_login_attempts": 0,
+			"locked_until":          nil,
+			"last_login_at":         now,
+			"version":               gorm.Expr("version + 1"),
+		}).Error
+	if err != nil {
+		return err
+	}
+	user.LastLoginAt = &now
+	user.Version++
+	utils.CreateTaggedLogger("login", r.Context()).Info().Str("user_id", user.ID.String()).Msg("user logged in")
+	return nil
+}
+
+// swagger:route POST /users/logout users logout
+//
+// Ends the current session.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *UserController) logout(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	if session := currentSession(r.Context()); session != nil {
+		if err := c.sessions.Revoke(r.Context(), userID, session.ID); err != nil && !goerrors.Is(err, sessions.ErrInvalidSession) {
+			return err
+		}
+	}
+	c.sessions.ClearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// swagger:route GET /users/me users me
+//
+// Returns the authenticated user.
+//
+// responses:
+//   200: User
+//   default: WhimsyErrorResponse
+func (c *UserController) me(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := c.db.WithContext(r.Context()).First(&user, "id = ?", userID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.NotFoundError()
+		}
+		return err
+	}
+	lastModified := user.UpdatedAt
+	if user.LastLoginAt != nil && user.LastLoginAt.After(lastModified) {
+		lastModified = *user.LastLoginAt
+	}
+	w.Header().Set("ETag", versionETag(user.Version))
+	return writeCachedBody(w, r, &user, lastModified)
+}
+
+// swagger:route PATCH /users/me users updateMe
+//
+// Updates the authenticated user's profile. Send the ETag of the user read
+// last as If-Match, so that a concurrent edit fails with 412 instead of
+// being overwritten.
+//
+// responses:
+//   200: User
+//   default: WhimsyErrorResponse
+func (c *UserController) updateMe(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	var req profileRequest
+	if err := readBody(w, r, &req, DisallowUnknownFields()); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+
+	ctx := r.Context()
+	var user models.User
+	err = c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			if goerrors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.NotFoundError()
+			}
+			return err
+		}
+		if err := applyIfMatch(r, &user.Versioned); err != nil {
+			return err
+		}
+		updates := map[string]interface{}{}
+		if req.FirstName != nil {
+			updates["first_name"] = strings.TrimSpace(*req.FirstName)
+		}
+		if req.LastName != nil {
+			updates["last_name"] = strings.TrimSpace(*req.LastName)
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&user, "id = ?", userID).Error; err != nil {
+			return err
+		}
+		return publishUserEvent(ctx, tx, user.ID, "user.updated", map[string]interface{}{
+			"firstName": user.FirstName,
+			"lastName":  user.LastName,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", versionETag(user.Version))
+	return writeBody(w, &user)
+}
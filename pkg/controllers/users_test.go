@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/testutils"
+	"whimsy/pkg/utils"
+
+	"github.com/gorilla/mux"
+)
+
+func testPrivateKey(t *testing.T) *rsa.PrivateKey {
+	b, err := ioutil.ReadFile("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newUserRouter(t *testing.T) (*mux.Router, *mailer.MemoryMailer) {
+	tokens := auth.NewTokenIssuer(testPrivateKey(t), time.Hour)
+	store := sessions.NewStore(db, time.Hour, 24*time.Hour)
+	mail := testutils.NewCaptureMailer()
+	router := mux.NewRouter()
+	router.Use(Authenticate(store))
+	router.Use(authz.New(db).Middleware)
+	enc := utils.Encrypter{PrivateKey: testPrivateKey(t)}
+	NewUserController(db, tokens, store, mail, enc, "https://app.whimsy.test").Route(router)
+	return router, mail
+}
+
+func jsonRequest(t *testing.T, method, path string, body interface{}) *http.Request {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(method, path, bytes.NewReader(b))
+}
+
+func doJSON(t *testing.T, router http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := jsonRequest(t, method, path, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUserSignupLogin(t *testing.T) {
+	router, _ := newUserRouter(t)
+	email := "signup@whimsy.test"
+	password := "correct horse battery staple"
+
+	w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": "not-an-email", "password": "short"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body)
+	}
+
+	w = doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": password})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var signup authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &signup); err != nil {
+		t.Fatal(err)
+	}
+
+	w = doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": password})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", w.Code)
+	}
+	var events []models.OutboxEvent
+	if err := db.Where("type = ? AND payload->>'email' = ?", "user.registered", email).Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("%d user.registered events, want 1", len(events))
+	}
+
+	w = doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": "SIGNUP@whimsy.test", "password": password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var login authResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+
+	w = doJSON(t, router, "GET", "/users/me", login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w = doJSON(t, router, "GET", "/users/me", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestUpdateMe(t *testing.T) {
+	router, _ := newUserRouter(t)
+	user := signupAs(t, router, "profile@whimsy.test")
+	send := func(method, etagHeader, etag string, body interface{}) *httptest.ResponseRecorder {
+		r := jsonRequest(t, method, "/users/me", body)
+		r.Header.Set("Authorization", "Bearer "+user.Token)
+		if etag != "" {
+			r.Header.Set(etagHeader, etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("GET", "", "", nil)
+	var me models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+		t.Fatal(err)
+	}
+	read := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || me.Version == 0 || read != versionETag(me.Version) {
+		t.Fatalf("expected 200 with a version ETag, got %d %q: %s", w.Code, read, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if w := send("GET", "If-None-Match", read, nil); w.Code != http.StatusNotModified {
+		t.Errorf("unchanged: expected 304, got %d", w.Code)
+	}
+
+	w = send("PATCH", "If-Match", read, map[string]string{"firstName": " Ann "})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var updated models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.FirstName != "Ann" || w.Header().Get("ETag") != versionETag(me.Version+1) {
+		t.Errorf("unexpected update %s with ETag %s", w.Body, w.Header().Get("ETag"))
+	}
+
+	// An edit based on the first read lost the race.
+	if w := send("PATCH", "If-Match", read, map[string]string{"lastName": "Smith"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: expected 412, got %d: %s", w.Code, w.Body)
+	}
+	if w := send("GET", "If-None-Match", read, nil); w.Code != http.StatusOK || w.Header().Get("ETag") != versionETag(updated.Version) {
+		t.Errorf("changed: expected 200 with the new ETag, got %d %s", w.Code, w.Header().Get("ETag"))
+	}
+	if w := send("PATCH", "", "", map[string]string{"email": "other@whimsy.test"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: expected 400, got %d", w.Code)
+	}
+}
+
+func TestUserLockout(t *testing.T) {
+	router, _ := newUserRouter(t)
+	email := "lockout@whimsy.test"
+	password := "correct horse battery staple"
+
+	if w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": password}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	for i := 1; i <= auth.MaxFailedLogins; i++ {
+		w := doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": email, "password": "wrong password"})
+		want := http.StatusUnauthorized
+		if i == auth.MaxFailedLogins {
+			want = http.StatusLocked
+		}
+		if w.Code != want {
+			t.Fatalf("attempt %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+	if w := doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": email, "password": password}); w.Code != http.StatusLocked {
+		t.Errorf("expected 423, got %d", w.Code)
+	}
+}
+
+func TestUserLockoutConcurrent(t *testing.T) {
+	router, _ := newUserRouter(t)
+	email := "parallel@whimsy.test"
+	password := "correct horse battery staple"
+
+	if w := doJSON(t, router, "POST", "/users/signup", "", map[string]string{"email": email, "password": password}); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	// Guesses racing each other all count.
+	var wg sync.WaitGroup
+	for i := 0; i < auth.MaxFailedLogins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": email, "password": "wrong password"})
+		}()
+	}
+	wg.Wait()
+	if w := doJSON(t, router, "POST", "/users/login", "", map[string]string{"email": email, "password": password}); w.Code != http.StatusLocked {
+		t.Errorf("expected 423, got %d", w.Code)
+	}
+}
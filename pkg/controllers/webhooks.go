@@ -0,0 +1,508 @@
+package controllers
+
+import (
+	goerrors "errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/database"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/models"
+	"whimsy/pkg/utils"
+	"whimsy/pkg/webhooks"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// eventTypePattern matches event types and the "user.*" and "*" wildcards
+// endpoints subscribe with.
+var eventTypePattern = regexp.MustCompile(`^(\*|[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)*(\.\*)?)$`)
+
+// WebhookController serves the /webhooks routes on which users register
+// endpoints for the events of their account and follow their deliveries.
+// enc encrypts the signing secrets at rest.
+type WebhookController struct {
+	db  *database.DB
+	enc utils.Encrypter
+	// AllowInsecureURLs accepts http URLs and private hosts, for local
+	// development only. Deliveries still refuse private addresses unless
+	// webhooks.Options.AllowPrivateNetworks is set too.
+	AllowInsecureURLs bool
+}
+
+func NewWebhookController(db *gorm.DB, enc utils.Encrypter) *WebhookController {
+	return &WebhookController{db: database.New(db), enc: enc}
+}
+
+func (c *WebhookController) Route(router *mux.Router) {
+	r := router.PathPrefix("/webhooks").Subrouter()
+	// Changes to endpoints and their audit events commit with the response.
+	r.Handle("", c.db.Middleware(APIHandler(c.createWebhook, true))).Methods("POST")
+	r.Handle("", APIHandler(c.listWebhooks, true)).Methods("GET")
+	r.Handle("/{id}", APIHandler(c.getWebhook, true)).Methods("GET")
+	r.Handle("/{id}", c.db.Middleware(APIHandler(c.updateWebhook, true))).Methods("PATCH")
+	r.Handle("/{id}", c.db.Middleware(APIHandler(c.deleteWebhook, true))).Methods("DELETE")
+	r.Handle("/{id}/ping", APIHandler(c.pingWebhook, true)).Methods("POST")
+	r.Handle("/{id}/deliveries", APIHandler(c.listWebhookDeliveries, true)).Methods("GET")
+	r.Handle("/{id}/deliveries/{deliveryId}", APIHandler(c.getWebhookDelivery, true)).Methods("GET")
+	r.Handle("/{id}/deliveries/{deliveryId}/redeliver", APIHandler(c.redeliverWebhook, true)).Methods("POST")
+}
+
+type webhookRequest struct {
+	URL         string   `json:"url" validate:"required,url,max=2000"`
+	Description string   `json:"description" validate:"max=500"`
+	EventTypes  []string `json:"eventTypes" validate:"required,min=1,max=50"`
+}
+
+type webhookUpdateRequest struct {
+	URL         *string  `json:"url" validate:"omitempty,url,max=2000"`
+	Description *string  `json:"description" validate:"omitempty,max=500"`
+	EventTypes  []string `json:"eventTypes" validate:"omitempty,min=1,max=50"`
+	// Enabled false disables the endpoint, and true enables it again with
+	// its failure count reset.
+	Enabled *bool `json:"enabled"`
+}
+
+// webhookResponse is an endpoint as shown to its owner. Secret is only
+// returned when the endpoint is created.
+// swagger:model WebhookResponse
+type webhookResponse struct {
+	*models.WebhookEndpoint
+	EventTypes []string `json:"eventTypes"`
+	Enabled    bool     `json:"enabled"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+func newWebhookResponse(ep *models.WebhookEndpoint) webhookResponse {
+	return webhookResponse{WebhookEndpoint: ep, EventTypes: ep.EventTypeList(), Enabled: ep.DisabledAt == nil}
+}
+
+// swagger:model WebhookDeliveryList
+type webhookDeliveryList struct {
+	Deliveries []models.WebhookDelivery `json:"deliveries"`
+	// NextBefore is the before parameter for the next, older page, if any.
+	NextBefore *int64 `json:"nextBefore,omitempty"`
+}
+
+// webhookDeliveryResponse is a delivery with its attempts, oldest first.
+// swagger:model WebhookDeliveryResponse
+type webhookDeliveryResponse struct {
+	models.WebhookDelivery
+	AttemptLog []models.WebhookAttempt `json:"attemptLog"`
+}
+
+// checkWebhookFields reports the violations validate can't express. URLs
+// must be https, and hosts that are obviously private are refused early;
+// the delivery transport checks the addresses they resolve to.
+func (c *WebhookController) checkWebhookFields(rawURL *string, eventTypes []string) error {
+	e := errors.NewBadRequestErrorWithMessage("Invalid webhook.")
+	violations := false
+	if rawURL != nil {
+		u, err := url.Parse(*rawURL)
+		switch {
+		case err != nil || u.Host == "" || (u.Scheme != "https" && !(c.AllowInsecureURLs && u.Scheme == "http")):
+			e.WithFieldViolation("url", "Must be an https URL.")
+			violations = true
+		case !c.AllowInsecureURLs && privateHost(u.Hostname()):
+			e.WithFieldViolation("url", "Must be a public address.")
+			violations = true
+		}
+	}
+	for _, t := range eventTypes {
+		if !eventTypePattern.MatchString(t) {
+			e.WithFieldViolation("eventTypes", "%q is not an event type.", t)
+			violations = true
+		}
+	}
+	if violations {
+		return e
+	}
+	return nil
+}
+
+// privateHost reports whether host is an IP address that isn't public, or
+// a name only resolving locally.
+func privateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return !httpclient.IsPublicIP(ip)
+	}
+	return host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".internal") || !strings.Contains(host, ".")
+}
+
+// loadWebhook returns the endpoint of the path owned by the authenticated
+// user. Others' endpoints aren't found.
+func (c *WebhookController) loadWebhook(tx *gorm.DB, r *http.Request, lock bool) (*models.WebhookEndpoint, error) {
+	userID, err := requireUser(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, errors.NotFoundError()
+	}
+	if lock {
+		tx = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var ep models.WebhookEndpoint
+	if err := tx.First(&ep, "id = ? AND owner_id = ?", id, userID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.NotFoundError()
+		}
+		return nil, err
+	}
+	return &ep, nil
+}
+
+// swagger:route POST /webhooks webhooks createWebhook
+//
+// Registers an endpoint for events of the authenticated user's account. The
+// response carries the signing secret, which isn't shown again.
+//
+// responses:
+//   201: WebhookResponse
+//   default: WhimsyErrorResponse
+func (c *WebhookController) createWebhook(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	var req webhookRequest
+	if err := readBody(w, r, &req, DisallowUnknownFields()); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	if err := c.checkWebhookFields(&req.URL, req.EventTypes); err != nil {
+		return err
+	}
+
+	secret, err := webhooks.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	encrypted, err := c.enc.EncryptString(secret)
+	if err != nil {
+		return err
+	}
+	ep := &models.WebhookEndpoint{
+		OwnerID:     userID,
+		URL:         req.URL,
+		Description: strings.TrimSpace(req.Description),
+		EventTypes:  strings.Join(req.EventTypes, " "),
+		Secret:      encrypted,
+	}
+	err = c.db.InTx(r.Context(), func(tx *gorm.DB) error {
+		if err := tx.Create(ep).Error; err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionWebhookCreate,
+			TargetType: audit.TargetWebhook,
+			TargetID:   ep.ID.String(),
+			Metadata:   map[string]interface{}{"url": ep.URL, "eventTypes": req.EventTypes},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	out := newWebhookResponse(ep)
+	out.Secret = secret
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBodyStatus(w, http.StatusCreated, out)
+}
+
+// swagger:route GET /webhooks webhooks listWebhooks
+//
+// Lists the authenticated user's endpoints.
+//
+// responses:
+//   200: []WebhookResponse
+//   default: WhimsyErrorResponse
+func (c *WebhookController) listWebhooks(w http.ResponseWriter, r *http.Request) error {
+	userID, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+	var endpoints []models.WebhookEndpoint
+	if err := c.db.Conn(r.Context()).Where("owner_id = ?", userID).Order("created_at").Find(&endpoints).Error; err != nil {
+		return err
+	}
+	out := make([]webhookResponse, len(endpoints))
+	for i := range endpoints {
+		out[i] = newWebhookResponse(&endpoints[i])
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:route GET /webhooks/{id} webhooks getWebhook
+//
+// Shows one of the authenticated user's endpoints.
+//
+// responses:
+//   200: WebhookResponse
+//   default: WhimsyErrorResponse
+func (c *WebhookController) getWebhook(w http.ResponseWriter, r *http.Request) error {
+	ep, err := c.loadWebhook(c.db.Conn(r.Context()), r, false)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, newWebhookResponse(ep))
+}
+
+// swagger:route PATCH /webhooks/{id} webhooks updateWebhook
+//
+// Changes an endpoint's URL, description or event types, or disables or
+// re-enables it.
+//
+// responses:
+//   200: WebhookResponse
+//   default: WhimsyErrorResponse
+func (c *WebhookController) updateWebhook(w http.ResponseWriter, r *http.Request) error {
+	var req webhookUpdateRequest
+	if err := readBody(w, r, &req, DisallowUnknownFields()); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return errors.NewBadRequestError(err)
+	}
+	if err := c.checkWebhookFields(req.URL, req.EventTypes); err != nil {
+		return err
+	}
+
+	var ep *models.WebhookEndpoint
+	err := c.db.InTx(r.Context(), func(tx *gorm.DB) (err error) {
+		if ep, err = c.loadWebhook(tx, r, true); err != nil {
+			return err
+		}
+		snapshot := *ep
+		before := newWebhookResponse(&snapshot)
+		updates := map[string]interface{}{}
+		if req.URL != nil {
+			ep.URL = *req.URL
+			updates["url"] = ep.URL
+		}
+		if req.Description != nil {
+			ep.Description = strings.TrimSpace(*req.Description)
+			updates["description"] = ep.Description
+		}
+		if req.EventTypes != nil {
+			ep.EventTypes = strings.Join(req.EventTypes, " ")
+			updates["event_types"] = ep.EventTypes
+		}
+		if req.Enabled != nil && *req.Enabled != (ep.DisabledAt == nil) {
+			if *req.Enabled {
+				ep.DisabledAt, ep.ConsecutiveFailures = nil, 0
+				updates["consecutive_failures"] = 0
+			} else {
+				now := tx.NowFunc()
+				ep.DisabledAt = &now
+			}
+			updates["disabled_at"] = ep.DisabledAt
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(ep).Updates(updates).Error; err != nil {
+			return err
+		}
+		changes, err := audit.Diff(before, newWebhookResponse(ep))
+		if err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionWebhookUpdate,
+			TargetType: audit.TargetWebhook,
+			TargetID:   ep.ID.String(),
+			Changes:    changes,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeBody(w, newWebhookResponse(ep))
+}
+
+// swagger:route DELETE /webhooks/{id} webhooks deleteWebhook
+//
+// Deletes an endpoint. Its pending deliveries fail.
+//
+// responses:
+//   204:
+//   default: WhimsyErrorResponse
+func (c *WebhookController) deleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	err := c.db.InTx(r.Context(), func(tx *gorm.DB) error {
+		ep, err := c.loadWebhook(tx, r, true)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(ep).Error; err != nil {
+			return err
+		}
+		return audit.Record(tx, r, audit.Event{
+			Action:     audit.ActionWebhookDelete,
+			TargetType: audit.TargetWebhook,
+			TargetID:   ep.ID.String(),
+			Metadata:   map[string]interface{}{"url": ep.URL},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// swagger:route POST /webhooks/{id}/ping webhooks pingWebhook
+//
+// Sends a webhook.ping event to the endpoint, whatever event types it
+// subscribes to, to test the receiver. It's delivered and logged like
+// other events.
+//
+// responses:
+//   202:
+//   default: WhimsyErrorResponse
+func (c *WebhookController) pingWebhook(w http.ResponseWriter, r *http.Request) error {
+	err := c.db.InTx(r.Context(), func(tx *gorm.DB) error {
+		ep, err := c.loadWebhook(tx, r, false)
+		if err != nil {
+			return err
+		}
+		if ep.DisabledAt != nil {
+			return errors.NewConflictError("The endpoint is disabled.")
+		}
+		_, err = webhooks.Ping(r.Context(), tx, ep)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// swagger:route GET /webhooks/{id}/deliveries webhooks listWebhookDeliveries
+//
+// Lists an endpoint's deliveries, newest first. Filters by the state query
+// parameter. Takes limit (at most 100) and before, the nextBefore of the
+// previous page.
+//
+// responses:
+//   200: WebhookDeliveryList
+//   default: WhimsyErrorResponse
+func (c *WebhookController) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) error {
+	db := c.db.Conn(r.Context())
+	ep, err := c.loadWebhook(db, r, false)
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query)
+	if err != nil {
+		return err
+	}
+
+	q := db.Where("endpoint_id = ?", ep.ID)
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.NewBadRequestErrorWithMessage("before must be a delivery ID.")
+		}
+		q = q.Where("id < ?", n)
+	}
+	if v := query.Get("state"); v != "" {
+		q = q.Where("state = ?", v)
+	}
+
+	out := webhookDeliveryList{Deliveries: []models.WebhookDelivery{}}
+	if err := q.Order("id DESC").Limit(limit + 1).Find(&out.Deliveries).Error; err != nil {
+		return err
+	}
+	if len(out.Deliveries) > limit {
+		out.Deliveries = out.Deliveries[:limit]
+		next := out.Deliveries[limit-1].ID
+		out.NextBefore = &next
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// loadDelivery returns the delivery of the path to ep.
+func loadDelivery(tx *gorm.DB, r *http.Request, ep *models.WebhookEndpoint) (*models.WebhookDelivery, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["deliveryId"], 10, 64)
+	if err != nil {
+		return nil, errors.NotFoundError()
+	}
+	var delivery models.WebhookDelivery
+	if err := tx.First(&delivery, "id = ? AND endpoint_id = ?", id, ep.ID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.NotFoundError()
+		}
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// swagger:route GET /webhooks/{id}/deliveries/{deliveryId} webhooks getWebhookDelivery
+//
+// Shows a delivery with the log of its attempts.
+//
+// responses:
+//   200: WebhookDeliveryResponse
+//   default: WhimsyErrorResponse
+func (c *WebhookController) getWebhookDelivery(w http.ResponseWriter, r *http.Request) error {
+	db := c.db.Conn(r.Context())
+	ep, err := c.loadWebhook(db, r, false)
+	if err != nil {
+		return err
+	}
+	delivery, err := loadDelivery(db, r, ep)
+	if err != nil {
+		return err
+	}
+	out := webhookDeliveryResponse{WebhookDelivery: *delivery, AttemptLog: []models.WebhookAttempt{}}
+	if err := db.Where("delivery_id = ?", delivery.ID).Order("id").Find(&out.AttemptLog).Error; err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeBody(w, out)
+}
+
+// swagger:route POST /webhooks/{id}/deliveries/{deliveryId}/redeliver webhooks redeliverWebhook
+//
+// Queues one more attempt of a delivery, whatever its state, even to a
+// disabled endpoint.
+//
+// responses:
+//   202:
+//   default: WhimsyErrorResponse
+func (c *WebhookController) redeliverWebhook(w http.ResponseWriter, r *http.Request) error {
+	err := c.db.InTx(r.Context(), func(tx *gorm.DB) error {
+		ep, err := c.loadWebhook(tx, r, false)
+		if err != nil {
+			return err
+		}
+		delivery, err := loadDelivery(tx, r, ep)
+		if err != nil {
+			return err
+		}
+		return webhooks.Redeliver(r.Context(), tx, delivery)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
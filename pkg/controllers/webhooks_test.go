@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/authz"
+	"whimsy/pkg/database"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/models"
+	"whimsy/pkg/sessions"
+	"whimsy/pkg/testutils"
+	"whimsy/pkg/utils"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func newWebhookRouter(t *testing.T) (*mux.Router, utils.Encrypter) {
+	tokens := auth.NewTokenIssuer(testPrivateKey(t), time.Hour)
+	store := sessions.NewStore(db, time.Hour, 24*time.Hour)
+	router := mux.NewRouter()
+	router.Use(Authenticate(store))
+	router.Use(authz.New(db).Middleware)
+	enc := utils.Encrypter{PrivateKey: testPrivateKey(t)}
+	NewUserController(db, tokens, store, testutils.NewCaptureMailer(), enc, "https://app.whimsy.test").Route(router)
+	NewWebhookController(db, enc).Route(router)
+	return router, enc
+}
+
+func TestWebhookAPI(t *testing.T) {
+	router, enc := newWebhookRouter(t)
+	owner := signupAs(t, router, "partner@whimsy.test")
+	other := signupAs(t, router, "other-partner@whimsy.test")
+
+	invalid := map[string]interface{}{"url": "ftp://partner.test/hook", "eventTypes": []string{"user.registered", "User Registered"}}
+	if w := doJSON(t, router, "POST", "/webhooks", owner.Token, invalid); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid endpoint: expected 400, got %d: %s", w.Code, w.Body)
+	}
+	for _, u := range []string{"http://partner.test/hook", "https://169.254.169.254/latest", "https://[::1]/hook", "https://localhost/hook", "https://10.0.0.7/hook"} {
+		body := map[string]interface{}{"url": u, "eventTypes": []string{"*"}}
+		if w := doJSON(t, router, "POST", "/webhooks", owner.Token, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", u, w.Code, w.Body)
+		}
+	}
+	if w := doJSON(t, router, "POST", "/webhooks", "", map[string]interface{}{}); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: expected 401, got %d", w.Code)
+	}
+
+	w := doJSON(t, router, "POST", "/webhooks", owner.Token, map[string]interface{}{
+		"url":        "https://partner.test/hook",
+		"eventTypes": []string{"user.*"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created webhookResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Secret == "" || !created.Enabled || len(created.EventTypes) != 1 {
+		t.Fatalf("unexpected endpoint %s", w.Body)
+	}
+	var stored models.WebhookEndpoint
+	if err := db.First(&stored, "id = ?", created.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := enc.DecryptString(stored.Secret); err != nil || secret != created.Secret {
+		t.Errorf("stored secret doesn't decrypt to the one returned: %v", err)
+	}
+	path := "/webhooks/" + created.ID.String()
+
+	w = doJSON(t, router, "GET", "/webhooks", owner.Token, nil)
+	var list []webhookResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Secret != "" {
+		t.Errorf("unexpected list %s", w.Body)
+	}
+	if w := doJSON(t, router, "GET", path, other.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("another account's endpoint: expected 404, got %d", w.Code)
+	}
+
+	if w := doJSON(t, router, "POST", path+"/ping", other.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("pinging another account's endpoint: expected 404, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "POST", path+"/ping", owner.Token, nil); w.Code != http.StatusAccepted {
+		t.Errorf("ping: expected 202, got %d: %s", w.Code, w.Body)
+	}
+	var ping models.OutboxEvent
+	if err := db.Where("type = ? AND tenant_id = ?", "webhook.ping", created.OwnerID).First(&ping).Error; err != nil {
+		t.Errorf("ping not published: %v", err)
+	} else if ping.Payload["endpointId"] != created.ID.String() {
+		t.Errorf("unexpected ping %+v", ping.Payload)
+	}
+
+	// Disabled by failures, then enabled again by its owner.
+	if err := db.Model(&stored).Updates(map[string]interface{}{"disabled_at": time.Now(), "consecutive_failures": 50}).Error; err != nil {
+		t.Fatal(err)
+	}
+	w = doJSON(t, router, "PATCH", path, owner.Token, map[string]interface{}{"enabled": true, "eventTypes": []string{"*"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var updated webhookResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Enabled || updated.ConsecutiveFailures != 0 || updated.EventTypes[0] != "*" {
+		t.Errorf("unexpected update %s", w.Body)
+	}
+
+	// Deliveries and their attempts.
+	delivery := &models.WebhookDelivery{EndpointID: created.ID, EventID: 1, EventType: "user.registered", Body: `{"id":1}`, State: models.DeliveryFailed, Attempts: 1}
+	if err := db.Create(delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&models.WebhookAttempt{DeliveryID: delivery.ID, AttemptedAt: time.Now(), StatusCode: 500}).Error; err != nil {
+		t.Fatal(err)
+	}
+	w = doJSON(t, router, "GET", path+"/deliveries?state=failed", owner.Token, nil)
+	var deliveries webhookDeliveryList
+	if err := json.Unmarshal(w.Body.Bytes(), &deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries.Deliveries) != 1 || deliveries.Deliveries[0].ID != delivery.ID {
+		t.Errorf("unexpected deliveries %s", w.Body)
+	}
+	deliveryPath := path + "/deliveries/" + strconv.FormatInt(delivery.ID, 10)
+	w = doJSON(t, router, "GET", deliveryPath, owner.Token, nil)
+	var shown webhookDeliveryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &shown); err != nil {
+		t.Fatal(err)
+	}
+	if len(shown.AttemptLog) != 1 || shown.AttemptLog[0].StatusCode != 500 {
+		t.Errorf("unexpected delivery %s", w.Body)
+	}
+
+	if w := doJSON(t, router, "POST", deliveryPath+"/redeliver", owner.Token, nil); w.Code != http.StatusAccepted {
+		t.Errorf("redeliver: expected 202, got %d: %s", w.Code, w.Body)
+	}
+	var queued int64
+	if err := db.Model(&models.Job{}).Where("kind = ? AND payload->>'deliveryId' = ?", "webhooks.deliver", strconv.FormatInt(delivery.ID, 10)).Count(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d redeliveries queued", queued)
+	}
+
+	if w := doJSON(t, router, "DELETE", path, other.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("deleting another account's endpoint: expected 404, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "DELETE", path, owner.Token, nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	if w := doJSON(t, router, "GET", path, owner.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("deleted endpoint: expected 404, got %d", w.Code)
+	}
+}
+
+// TestWebhookRequestTransaction checks that an error response rolls back
+// what the handler wrote through the request transaction.
+func TestWebhookRequestTransaction(t *testing.T) {
+	router, _ := newWebhookRouter(t)
+	owner := signupAs(t, router, "tx-partner@whimsy.test")
+	d := database.New(db)
+	handler := d.Middleware(APIHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return d.InTx(r.Context(), func(tx *gorm.DB) error {
+			ep := &models.WebhookEndpoint{OwnerID: owner.User.ID, URL: "https://partner.test/hook", EventTypes: "*", Secret: "secret"}
+			return tx.Create(ep).Error
+		})
+	}, true))
+	failing := d.Middleware(APIHandler(func(w http.ResponseWriter, r *http.Request) error {
+		if err := d.Conn(r.Context()).Create(&models.WebhookEndpoint{OwnerID: owner.User.ID, URL: "https://partner.test/other", EventTypes: "*", Secret: "secret"}).Error; err != nil {
+			return err
+		}
+		return errors.NewConflictError("Too many endpoints.")
+	}, true))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	failing.ServeHTTP(w, httptest.NewRequest("POST", "/webhooks", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", w.Code, w.Body)
+	}
+
+	var urls []string
+	if err := db.Model(&models.WebhookEndpoint{}).Where("owner_id = ?", owner.User.ID).Pluck("url", &urls).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "https://partner.test/hook" {
+		t.Errorf("endpoints %v, want only the committed one", urls)
+	}
+}
@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// SSL modes understood by ConnConfig, as in libpq. verify-full checks the
+// server certificate against SSLRootCert, the RDS CA bundle for RDS, and its
+// host name.
+const (
+	SSLDisable    = "disable"
+	SSLPrefer     = "prefer"
+	SSLRequire    = "require"
+	SSLVerifyCA   = "verify-ca"
+	SSLVerifyFull = "verify-full"
+)
+
+// ConnConfig describes a Postgres server to connect to.
+type ConnConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+	SSLMode  string
+	// SSLRootCert is the path of the CA certificates verifying the server,
+	// for the verify-ca and verify-full modes.
+	SSLRootCert string
+}
+
+// DSN returns the config as a keyword/value connection string, with every
+// value quoted so passwords may hold any character.
+func (c ConnConfig) DSN() string {
+	params := map[string]string{
+		"host":        c.Host,
+		"port":        c.Port,
+		"user":        c.User,
+		"password":    c.Password,
+		"dbname":      c.DBName,
+		"sslmode":     c.SSLMode,
+		"sslrootcert": c.SSLRootCert,
+	}
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "='" + quote.Replace(params[k]) + "'"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c ConnConfig) validate() error {
+	switch c.SSLMode {
+	case "", SSLDisable, "allow", SSLPrefer, SSLRequire:
+	case SSLVerifyCA, SSLVerifyFull:
+		if c.SSLRootCert == "" {
+			return fmt.Errorf("sslmode %s needs a root certificate", c.SSLMode)
+		}
+	default:
+		return fmt.Errorf("unknown sslmode %q", c.SSLMode)
+	}
+	return nil
+}
+
+// PoolOptions size a connection pool. Zero values keep database/sql's
+// defaults.
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Apply sets the options on db.
+func (o PoolOptions) Apply(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+	if o.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(o.ConnMaxIdleTime)
+	}
+}
+
+// Open opens a pool on the server of c, sized by pool.
+func Open(c ConnConfig, pool PoolOptions) (*sql.DB, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("pgx", c.DSN())
+	if err != nil {
+		return nil, err
+	}
+	pool.Apply(db)
+	return db, nil
+}
+
+// RDS IAM auth tokens are valid for 15 minutes.
+const (
+	rdsTokenValidity = 15 * time.Minute
+	// RDSTokenRefresh is how old a cached token gets before it is replaced,
+	// leaving time for slow connects.
+	RDSTokenRefresh = 10 * time.Minute
+	// RDSMaxConnLifetime is the longest ConnMaxLifetime OpenRDS allows, so
+	// connections are recycled while their token would still be valid.
+	RDSMaxConnLifetime = rdsTokenValidity - time.Minute
+)
+
+// RDSAuth signs IAM auth tokens for an RDS endpoint, reusing each for
+// RDSTokenRefresh instead of signing one per connection.
+type RDSAuth struct {
+	Endpoint    string // host:port
+	Region      string
+	User        string
+	Credentials *credentials.Credentials
+
+	mu       sync.Mutex
+	token    string
+	signedAt time.Time
+	now      func() time.Time
+	sign     func(endpoint, region, user string, creds *credentials.Credentials) (string, error)
+}
+
+func NewRDSAuth(endpoint, region, user string, creds *credentials.Credentials) *RDSAuth {
+	return &RDSAuth{
+		Endpoint:    endpoint,
+		Region:      region,
+		User:        user,
+		Credentials: creds,
+		now:         time.Now,
+		sign:        rdsutils.BuildAuthToken,
+	}
+}
+
+// Token returns a valid auth token.
+func (a *RDSAuth) Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if a.token != "" && now.Sub(a.signedAt) < RDSTokenRefresh {
+		return a.token, nil
+	}
+	token, err := a.sign(a.Endpoint, a.Region, a.User, a.Credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to create authentication token: %w", err)
+	}
+	a.token, a.signedAt = token, now
+	return token, nil
+}
+
+// beforeConnect sets the password of each new connection to a token.
+func (a *RDSAuth) beforeConnect(ctx context.Context, cfg *pgx.ConnConfig) error {
+	token, err := a.Token()
+	if err != nil {
+		return err
+	}
+	cfg.Password = token
+	return nil
+}
+
+func rdsConnLifetime(d time.Duration) time.Duration {
+	if d <= 0 || d > RDSMaxConnLifetime {
+		return RDSMaxConnLifetime
+	}
+	return d
+}
+
+// OpenRDS opens a pool on the server of c, authenticating with tokens from
+// auth. Connections live at most RDSMaxConnLifetime.
+func OpenRDS(c ConnConfig, auth *RDSAuth, pool PoolOptions) (*sql.DB, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	c.Password = "rds-auth-token-placeholder"
+	cfg, err := pgx.ParseConfig(c.DSN())
+	if err != nil {
+		return nil, err
+	}
+	pool.ConnMaxLifetime = rdsConnLifetime(pool.ConnMaxLifetime)
+	db := stdlib.OpenDB(*cfg, stdlib.OptionBeforeConnect(auth.beforeConnect))
+	pool.Apply(db)
+	return db, nil
+}
+
+// OpenPool opens a native pgx pool on the server of c, for the features
+// database/sql hides, such as LISTEN/NOTIFY and CopyFrom. With auth, it
+// authenticates like OpenRDS.
+func OpenPool(ctx context.Context, c ConnConfig, auth *RDSAuth, pool PoolOptions) (*pgxpool.Pool, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		c.Password = "rds-auth-token-placeholder"
+		pool.ConnMaxLifetime = rdsConnLifetime(pool.ConnMaxLifetime)
+	}
+	cfg, err := pgxpool.ParseConfig(c.DSN())
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		cfg.BeforeConnect = auth.beforeConnect
+	}
+	if pool.MaxOpenConns > 0 {
+		cfg.MaxConns = int32(pool.MaxOpenConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		cfg.MaxConnLifetime = pool.ConnMaxLifetime
+	}
+	if pool.ConnMaxIdleTime > 0 {
+		cfg.MaxConnIdleTime = pool.ConnMaxIdleTime
+	}
+	// Connect on first use, as sql.Open does.
+	cfg.LazyConnect = true
+	return pgxpool.ConnectConfig(ctx, cfg)
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	goerrors "errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestDSN(t *testing.T) {
+	c := ConnConfig{
+		Host:     "db.internal",
+		Port:     "6432",
+		User:     "whimsy app",
+		Password: `p@ss w0rd' sslmode=disable \`,
+		DBName:   "whimsy",
+		SSLMode:  SSLRequire,
+	}
+	cfg, err := pgx.ParseConfig(c.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != c.Host || cfg.Port != 6432 || cfg.User != c.User || cfg.Password != c.Password || cfg.Database != c.DBName {
+		t.Errorf("parsed %s:%d %q %q %q", cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Database)
+	}
+	if cfg.TLSConfig == nil {
+		t.Error("the password overrode sslmode")
+	}
+}
+
+func TestConnConfigValidate(t *testing.T) {
+	tests := []struct {
+		mode, rootCert string
+		ok             bool
+	}{
+		{"", "", true},
+		{SSLDisable, "", true},
+		{SSLRequire, "", true},
+		{SSLVerifyFull, "/etc/ssl/rds-global-bundle.pem", true},
+		{SSLVerifyFull, "", false},
+		{SSLVerifyCA, "", false},
+		{"strict", "", false},
+	}
+	for _, tt := range tests {
+		err := ConnConfig{SSLMode: tt.mode, SSLRootCert: tt.rootCert}.validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("validate(%q, %q) = %v", tt.mode, tt.rootCert, err)
+		}
+	}
+}
+
+func TestPoolOptions(t *testing.T) {
+	db, err := sql.Open("pgx", "host=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	PoolOptions{MaxOpenConns: 7}.Apply(db)
+	if got := db.Stats().MaxOpenConnections; got != 7 {
+		t.Errorf("MaxOpenConnections = %d", got)
+	}
+}
+
+func TestRDSAuthCachesTokens(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	signed := 0
+	a := NewRDSAuth("db.rds.test:5432", "eu-west-1", "whimsy", credentials.NewStaticCredentials("id", "secret", ""))
+	a.now = func() time.Time { return now }
+	a.sign = func(endpoint, region, user string, creds *credentials.Credentials) (string, error) {
+		signed++
+		if endpoint != "db.rds.test:5432" || region != "eu-west-1" || user != "whimsy" {
+			t.Errorf("signed for %s %s %s", endpoint, region, user)
+		}
+		return "token-" + now.Format(time.Kitchen), nil
+	}
+
+	first, err := a.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(RDSTokenRefresh - time.Second)
+	if tok, _ := a.Token(); tok != first || signed != 1 {
+		t.Errorf("got %s after %d signatures, want the cached token", tok, signed)
+	}
+	now = now.Add(time.Second)
+	if tok, _ := a.Token(); tok == first || signed != 2 {
+		t.Errorf("got %s after %d signatures, want a new token", tok, signed)
+	}
+
+	a.sign = func(string, string, string, *credentials.Credentials) (string, error) {
+		return "", goerrors.New("no credentials")
+	}
+	now = now.Add(RDSTokenRefresh)
+	if _, err := a.Token(); err == nil {
+		t.Error("expected a signing error")
+	}
+}
@@ -0,0 +1,248 @@
+// Package database adds a unit of work to gorm: InTx runs a function in a
+// transaction, nesting as a savepoint inside an enclosing one and retrying
+// on serialization failures and deadlocks, and Middleware runs a whole
+// request in one transaction.
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	goerrors "errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"whimsy/pkg/constants"
+	"whimsy/pkg/errors"
+	"whimsy/pkg/utils"
+
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+// Postgres error codes worth retrying a transaction for.
+const (
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// DefaultMaxAttempts is how many times InTx runs a transaction that keeps
+// failing to serialize.
+const DefaultMaxAttempts = 3
+
+// TxOptions configure the transactions InTx starts.
+type TxOptions struct {
+	// Isolation defaults to the database's, read committed for Postgres.
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxAttempts bounds retries on serialization failures and deadlocks,
+	// DefaultMaxAttempts if 0. 1 disables retries.
+	MaxAttempts int
+}
+
+func (o TxOptions) maxAttempts() int {
+	if o.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+// DB is a *gorm.DB with unit of work helpers.
+type DB struct {
+	*gorm.DB
+	// Options are used by InTx and Middleware.
+	Options TxOptions
+}
+
+func New(db *gorm.DB) *DB {
+	return &DB{DB: db}
+}
+
+// TxFromContext returns the transaction InTx or Middleware is running in
+// ctx, if any.
+func TxFromContext(ctx context.Context) (*gorm.DB, bool) {
+	tx, ok := ctx.Value(constants.TxKey).(*gorm.DB)
+	return tx, ok && tx != nil
+}
+
+// Conn returns the transaction of ctx, or else the database, for queries
+// that should join a unit of work when there is one.
+func (d *DB) Conn(ctx context.Context) *gorm.DB {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx.WithContext(ctx)
+	}
+	return d.WithContext(ctx)
+}
+
+// withTx returns tx bound to a context carrying it, so InTx calls made with
+// tx.Statement.Context nest.
+func withTx(ctx context.Context, tx *gorm.DB) *gorm.DB {
+	return tx.WithContext(context.WithValue(ctx, constants.TxKey, tx))
+}
+
+// InTx runs fn in a transaction with d.Options. See InTxWith.
+func (d *DB) InTx(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return d.InTxWith(ctx, d.Options, fn)
+}
+
+// InTxWith runs fn in a transaction, committed if fn returns nil and rolled
+// back otherwise. Within the transaction of ctx, fn runs in a savepoint
+// instead, and opts don't apply.
+//
+// A transaction failing to serialize or deadlocking is run again, up to
+// opts.MaxAttempts times, so fn must be safe to repeat: keep side effects
+// such as sending mail until after InTx returns. Savepoints aren't retried;
+// the failure aborts the enclosing transaction, which is retried as a whole.
+func (d *DB) InTxWith(ctx context.Context, opts TxOptions, fn func(tx *gorm.DB) error) error {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return fn(withTx(ctx, tx))
+		})
+	}
+
+	txOpts := &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+	for attempt := 1; ; attempt++ {
+		err := d.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return fn(withTx(ctx, tx))
+		}, txOpts)
+		if err == nil || !IsRetryable(err) || attempt >= opts.maxAttempts() {
+			return err
+		}
+		utils.CreateTaggedLogger("database", ctx).Info().Err(err).Int("attempt", attempt).Msg("retrying transaction")
+		if err := sleep(ctx, backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// IsRetryable reports whether err aborted a transaction that may succeed if
+// run again.
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return goerrors.As(err, &pgErr) && (pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected)
+}
+
+// backoff is a random wait before the given retry, from 0 up to 10ms
+// doubled per attempt, so conflicting transactions don't collide again.
+func backoff(attempt int) time.Duration {
+	max := 10 * time.Millisecond << uint(attempt-1)
+	if max > time.Second {
+		max = time.Second
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// bufferedResponse holds a response until the transaction it depends on
+// has committed.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.statusCode())
+	_, _ = w.Write(b.body.Bytes())
+}
+
+// Middleware runs each request in a transaction with d.Options, available
+// through TxFromContext, Conn and InTx. The transaction commits if the
+// handler responds with a 2xx status and rolls back otherwise, including
+// for every errors.Error response. Responses are buffered until the commit,
+// so a client never sees success for a change that was lost; a failed
+// commit responds 503 instead, as it's safe to try again.
+//
+// The middleware doesn't retry; use InTx in handlers that need to. It is
+// opt-in, for routes whose handlers make several related changes.
+func (d *DB) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if _, ok := TxFromContext(ctx); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger := utils.CreateTaggedLogger("database", ctx)
+
+		tx := d.WithContext(ctx).Begin(&sql.TxOptions{Isolation: d.Options.Isolation, ReadOnly: d.Options.ReadOnly})
+		if tx.Error != nil {
+			logger.Error().Err(tx.Error).Msg("starting request transaction failed")
+			unavailable(w, r)
+			return
+		}
+		done := false
+		defer func() {
+			if !done {
+				tx.Rollback() // the handler panicked
+			}
+		}()
+
+		buf := newBufferedResponse()
+		next.ServeHTTP(buf, r.WithContext(context.WithValue(ctx, constants.TxKey, tx)))
+
+		done = true
+		if status := buf.statusCode(); status < 200 || status > 299 {
+			if err := tx.Rollback().Error; err != nil && !goerrors.Is(err, sql.ErrTxDone) {
+				logger.Warn().Err(err).Msg("rolling back request transaction failed")
+			}
+			buf.writeTo(w)
+			return
+		}
+		if err := tx.Commit().Error; err != nil {
+			logger.Error().Err(err).Msg("committing request transaction failed")
+			unavailable(w, r)
+			return
+		}
+		buf.writeTo(w)
+	})
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	e := errors.NewErrorf(r.Context(), http.StatusServiceUnavailable, "The service is busy, please try again.")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.HTTPStatus)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		utils.LogAndReportError(r.Context(), err, "failed to encode error response")
+	}
+}
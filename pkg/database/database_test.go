@@ -0,0 +1,212 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	goerrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"whimsy/pkg/errors"
+	"whimsy/pkg/testutils"
+
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+var db *gorm.DB
+
+func TestMain(m *testing.M) {
+	db = testutils.ConnectDb("database")
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS tx_items (name text PRIMARY KEY)").Error; err != nil {
+		panic(err)
+	}
+	exitVal := m.Run()
+	db.Exec("DROP TABLE tx_items")
+	os.Exit(exitVal)
+}
+
+func resetItems(t *testing.T) {
+	t.Helper()
+	if err := db.Exec("TRUNCATE tx_items").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertItem(tx *gorm.DB, name string) error {
+	return tx.Exec("INSERT INTO tx_items (name) VALUES (?)", name).Error
+}
+
+func items(t *testing.T) []string {
+	t.Helper()
+	var names []string
+	if err := db.Raw("SELECT name FROM tx_items ORDER BY name").Scan(&names).Error; err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: pgSerializationFailure}, true},
+		{fmt.Errorf("saving: %w", &pgconn.PgError{Code: pgDeadlockDetected}), true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{goerrors.New("40001"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 20; attempt++ {
+		if d := backoff(attempt); d < 0 || d > time.Second {
+			t.Errorf("backoff(%d) = %s", attempt, d)
+		}
+	}
+}
+
+func TestInTxRetries(t *testing.T) {
+	resetItems(t)
+	d := New(db)
+	attempts := 0
+	err := d.InTx(context.Background(), func(tx *gorm.DB) error {
+		attempts++
+		if err := insertItem(tx, "a"); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return &pgconn.PgError{Code: pgSerializationFailure}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("err = %v after %d attempts", err, attempts)
+	}
+	if got := items(t); len(got) != 1 {
+		t.Errorf("failed attempts left rows behind: %v", got)
+	}
+
+	attempts = 0
+	d.Options.MaxAttempts = 1
+	err = d.InTx(context.Background(), func(tx *gorm.DB) error {
+		attempts++
+		return &pgconn.PgError{Code: pgDeadlockDetected}
+	})
+	if !IsRetryable(err) || attempts != 1 {
+		t.Errorf("err = %v after %d attempts, want a deadlock after 1", err, attempts)
+	}
+}
+
+func TestInTxSerializable(t *testing.T) {
+	resetItems(t)
+	d := New(db)
+	d.Options.Isolation = sql.LevelSerializable
+	var level string
+	err := d.InTx(context.Background(), func(tx *gorm.DB) error {
+		return tx.Raw("SHOW transaction_isolation").Scan(&level).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != "serializable" {
+		t.Errorf("isolation = %q", level)
+	}
+}
+
+func TestInTxSavepoints(t *testing.T) {
+	resetItems(t)
+	d := New(db)
+	errInner := goerrors.New("inner failed")
+	err := d.InTx(context.Background(), func(tx *gorm.DB) error {
+		if err := insertItem(tx, "outer"); err != nil {
+			return err
+		}
+		// Nested through the context, as a function called with ctx would.
+		err := d.InTx(tx.Statement.Context, func(tx *gorm.DB) error {
+			if err := insertItem(tx, "inner"); err != nil {
+				return err
+			}
+			return errInner
+		})
+		if !goerrors.Is(err, errInner) {
+			t.Errorf("inner err = %v", err)
+		}
+		return d.InTx(tx.Statement.Context, func(tx *gorm.DB) error {
+			return insertItem(tx, "second")
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(items(t)); got != "[outer second]" {
+		t.Errorf("items = %s, want [outer second]", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	d := New(db)
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		status  int
+		want    string
+	}{
+		{"commits on success", func(w http.ResponseWriter, r *http.Request) {
+			if err := insertItem(d.Conn(r.Context()), "kept"); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}, http.StatusCreated, "[kept]"},
+		{"rolls back on error", func(w http.ResponseWriter, r *http.Request) {
+			if err := insertItem(d.Conn(r.Context()), "dropped"); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(errors.NewConflictError("taken").HTTPStatus)
+		}, http.StatusConflict, "[]"},
+		{"fails when the commit does", func(w http.ResponseWriter, r *http.Request) {
+			_ = insertItem(d.Conn(r.Context()), "dup")
+			_ = insertItem(d.Conn(r.Context()), "dup") // aborts the transaction
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusServiceUnavailable, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetItems(t)
+			w := httptest.NewRecorder()
+			d.Middleware(http.HandlerFunc(tt.handler)).ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := fmt.Sprint(items(t)); got != tt.want {
+				t.Errorf("items = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("rolls back on panic", func(t *testing.T) {
+		resetItems(t)
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was swallowed")
+			}
+			if got := fmt.Sprint(items(t)); got != "[]" {
+				t.Errorf("items = %s after a panic", got)
+			}
+		}()
+		d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = insertItem(d.Conn(r.Context()), "dropped")
+			panic("boom")
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	})
+}
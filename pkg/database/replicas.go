@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"whimsy/pkg/constants"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Defaults for ReplicaOptions.
+const (
+	DefaultReplicaMaxLag        = 5 * time.Second
+	DefaultReplicaCheckInterval = 5 * time.Second
+)
+
+// replicationLagSQL is how far a replica is behind in seconds, or NULL when
+// it isn't receiving WAL from the primary. A connected replica that has
+// replayed all it received is current, however old its last transaction;
+// a disconnected one receives nothing, so that can't tell. A primary isn't
+// in recovery and its lag is 0.
+//
+// pg_stat_wal_receiver only shows the status to roles with
+// pg_read_all_stats; for others a running receiver counts as streaming.
+const replicationLagSQL = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN 0
+	WHEN NOT EXISTS (
+		SELECT 1 FROM pg_stat_wal_receiver WHERE status IS NULL OR status = 'streaming'
+	) THEN NULL
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+// ReplicaOptions configure Replicas.
+type ReplicaOptions struct {
+	// MaxLag ejects replicas further behind the primary than this.
+	MaxLag time.Duration
+	// CheckInterval is how often replicas are checked.
+	CheckInterval time.Duration
+}
+
+// Replica is a read replica connection pool.
+type Replica struct {
+	Name string
+	DB   *sql.DB
+
+	healthy int32 // atomic, 1 if serving reads
+}
+
+func (r *Replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// Replicas is a gorm plugin sending reads to read replicas. Reads outside
+// of transactions go to a healthy replica, round robin, and everything else
+// to the primary: writes, transactions, locking reads, and reads with a
+// context made by WithPrimary. Replicas are checked in the background and
+// ejected while unreachable or lagging more than MaxLag; with none healthy,
+// reads go to the primary.
+type Replicas struct {
+	replicas []*Replica
+	opts     ReplicaOptions
+	primary  gorm.ConnPool
+	next     uint32
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+func NewReplicas(opts ReplicaOptions, replicas ...*Replica) *Replicas {
+	if opts.MaxLag <= 0 {
+		opts.MaxLag = DefaultReplicaMaxLag
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultReplicaCheckInterval
+	}
+	return &Replicas{replicas: replicas, opts: opts, stop: make(chan struct{})}
+}
+
+// WithPrimary returns a context whose reads go to the primary, for reading
+// data just written without waiting for replicas to catch up.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, constants.UsePrimaryKey, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	v, _ := ctx.Value(constants.UsePrimaryKey).(bool)
+	return v
+}
+
+func (rs *Replicas) Name() string {
+	return "database:replicas"
+}
+
+// Initialize registers the routing callbacks. Replicas are checked once
+// before it returns and then every CheckInterval until Close.
+func (rs *Replicas) Initialize(db *gorm.DB) error {
+	rs.primary = db.Config.ConnPool
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Query().Before("gorm:query").Register("database:replicas", rs.route(true)),
+		cb.Row().Before("gorm:row").Register("database:replicas", rs.route(true)),
+		cb.Create().Before("gorm:begin_transaction").Register("database:replicas", rs.route(false)),
+		cb.Update().Before("gorm:begin_transaction").Register("database:replicas", rs.route(false)),
+		cb.Delete().Before("gorm:begin_transaction").Register("database:replicas", rs.route(false)),
+		cb.Raw().Before("gorm:raw").Register("database:replicas", rs.route(false)),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	rs.checkAll()
+	rs.done.Add(1)
+	go func() {
+		defer rs.done.Done()
+		t := time.NewTicker(rs.opts.CheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-rs.stop:
+				return
+			case <-t.C:
+				rs.checkAll()
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops the health checks and closes the replica pools.
+func (rs *Replicas) Close() error {
+	close(rs.stop)
+	rs.done.Wait()
+	var first error
+	for _, r := range rs.replicas {
+		if err := r.DB.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// route returns the callback picking the pool of a statement.
+func (rs *Replicas) route(read bool) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		stmt := db.Statement
+		if _, inTx := stmt.ConnPool.(gorm.TxCommitter); inTx {
+			return
+		}
+		if read && !usePrimary(stmt.Context) && !isLockingRead(stmt) {
+			if r := rs.pick(); r != nil {
+				stmt.ConnPool = r.DB
+				return
+			}
+		}
+		// The statement may have been routed to a replica for an earlier
+		// operation of the same chain.
+		stmt.ConnPool = rs.primary
+	}
+}
+
+// isLockingRead reports reads that must see the primary: SELECT ... FOR
+// UPDATE, and raw SQL other than a plain SELECT.
+func isLockingRead(stmt *gorm.Statement) bool {
+	if _, ok := stmt.Clauses["FOR"]; ok {
+		return true
+	}
+	sql := strings.ToUpper(strings.TrimSpace(stmt.SQL.String()))
+	if sql == "" {
+		return false
+	}
+	return !strings.HasPrefix(sql, "SELECT") || strings.Contains(sql, " FOR UPDATE") || strings.Contains(sql, " FOR SHARE") ||
+		strings.Contains(sql, "PG_ADVISORY")
+}
+
+func (rs *Replicas) pick() *Replica {
+	n := len(rs.replicas)
+	start := int(atomic.AddUint32(&rs.next, 1))
+	for i := 0; i < n; i++ {
+		if r := rs.replicas[(start+i)%n]; r.isHealthy() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rs *Replicas) checkAll() {
+	for _, r := range rs.replicas {
+		healthy := rs.check(r)
+		if was := atomic.SwapInt32(&r.healthy, boolToInt32(healthy)) == 1; was != healthy {
+			if healthy {
+				log.Info().Str("replica", r.Name).Msg("replica healthy, serving reads")
+			} else {
+				log.Warn().Str("replica", r.Name).Msg("replica ejected")
+			}
+		}
+	}
+}
+
+func (rs *Replicas) check(r *Replica) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.opts.CheckInterval)
+	defer cancel()
+	var lag sql.NullFloat64
+	if err := r.DB.QueryRowContext(ctx, replicationLagSQL).Scan(&lag); err != nil {
+		log.Debug().Err(err).Str("replica", r.Name).Msg("replica check failed")
+		return false
+	}
+	if !lag.Valid {
+		log.Debug().Str("replica", r.Name).Msg("replica disconnected from the primary")
+		return false
+	}
+	if d := time.Duration(lag.Float64 * float64(time.Second)); d > rs.opts.MaxLag {
+		log.Debug().Str("replica", r.Name).Dur("lag", d).Msg("replica lagging")
+		return false
+	}
+	return true
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
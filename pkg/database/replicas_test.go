@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	goerrors "errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type routedRow struct {
+	ID   int
+	Name string
+}
+
+// newRoutedDB returns a dry run gorm DB with two replicas, neither of which
+// is ever reached.
+func newRoutedDB(t *testing.T) (*gorm.DB, *sql.DB, []*Replica) {
+	t.Helper()
+	open := func() *sql.DB {
+		db, err := sql.Open("pgx", "host=127.0.0.1 port=1 connect_timeout=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	primary := open()
+	replicas := []*Replica{{Name: "a", DB: open()}, {Name: "b", DB: open()}}
+	rs := NewReplicas(ReplicaOptions{CheckInterval: time.Hour}, replicas...)
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: primary}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(rs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rs.Close()
+		primary.Close()
+	})
+	for _, r := range replicas {
+		if r.isHealthy() {
+			t.Fatalf("unreachable replica %s is healthy", r.Name)
+		}
+		atomic.StoreInt32(&r.healthy, 1)
+	}
+	return db, primary, replicas
+}
+
+func TestReplicaRouting(t *testing.T) {
+	db, primary, replicas := newRoutedDB(t)
+	ctx := context.Background()
+	isReplica := func(pool gorm.ConnPool) bool {
+		for _, r := range replicas {
+			if pool == r.DB {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name    string
+		run     func(db *gorm.DB) *gorm.DB
+		replica bool
+	}{
+		{"find", func(db *gorm.DB) *gorm.DB { return db.Find(&[]routedRow{}) }, true},
+		{"count", func(db *gorm.DB) *gorm.DB { var n int64; return db.Model(&routedRow{}).Count(&n) }, true},
+		{"raw select", func(db *gorm.DB) *gorm.DB { var n int; return db.Raw("SELECT 1").Scan(&n) }, true},
+		{"primary hint", func(db *gorm.DB) *gorm.DB {
+			return db.WithContext(WithPrimary(ctx)).Find(&[]routedRow{})
+		}, false},
+		{"select for update", func(db *gorm.DB) *gorm.DB {
+			return db.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&[]routedRow{})
+		}, false},
+		{"raw insert returning", func(db *gorm.DB) *gorm.DB {
+			var id int
+			return db.Raw("INSERT INTO routed_rows (name) VALUES ('x') RETURNING id").Scan(&id)
+		}, false},
+		{"raw advisory lock", func(db *gorm.DB) *gorm.DB { return db.Raw("SELECT pg_advisory_lock(1)").Scan(&struct{}{}) }, false},
+		{"exec", func(db *gorm.DB) *gorm.DB { return db.Exec("UPDATE routed_rows SET name = 'y'") }, false},
+		{"create", func(db *gorm.DB) *gorm.DB { return db.Create(&routedRow{Name: "x"}) }, false},
+		{"update", func(db *gorm.DB) *gorm.DB { return db.Model(&routedRow{ID: 1}).Update("name", "y") }, false},
+		{"delete", func(db *gorm.DB) *gorm.DB { return db.Delete(&routedRow{ID: 1}) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.run(db.WithContext(ctx))
+			if res.Error != nil && !goerrors.Is(res.Error, gorm.ErrDryRunModeUnsupported) {
+				t.Fatal(res.Error)
+			}
+			if got := isReplica(res.Statement.ConnPool); got != tt.replica {
+				t.Errorf("routed to a replica = %v, want %v", got, tt.replica)
+			}
+			if !tt.replica && res.Statement.ConnPool != gorm.ConnPool(primary) {
+				t.Errorf("not routed to the primary: %T", res.Statement.ConnPool)
+			}
+		})
+	}
+
+	t.Run("chained write after read", func(t *testing.T) {
+		q := db.WithContext(ctx).Model(&routedRow{}).Where("id = ?", 1)
+		var n int64
+		q.Count(&n)
+		if res := q.Update("name", "y"); res.Statement.ConnPool != gorm.ConnPool(primary) {
+			t.Error("a write reused the replica of an earlier read")
+		}
+	})
+}
+
+func TestReplicaEjection(t *testing.T) {
+	db, primary, replicas := newRoutedDB(t)
+	atomic.StoreInt32(&replicas[0].healthy, 0)
+	for i := 0; i < 4; i++ {
+		if res := db.Find(&[]routedRow{}); res.Statement.ConnPool != gorm.ConnPool(replicas[1].DB) {
+			t.Fatal("read went to an ejected replica or the primary")
+		}
+	}
+	atomic.StoreInt32(&replicas[1].healthy, 0)
+	if res := db.Find(&[]routedRow{}); res.Statement.ConnPool != gorm.ConnPool(primary) {
+		t.Error("reads didn't fall back to the primary")
+	}
+}
+
+func TestReplicationLagSQL(t *testing.T) {
+	// The test database is a primary.
+	var lag sql.NullFloat64
+	if err := db.Raw(replicationLagSQL).Row().Scan(&lag); err != nil {
+		t.Fatal(err)
+	}
+	if !lag.Valid || lag.Float64 != 0 {
+		t.Errorf("primary lag = %+v, want 0", lag)
+	}
+}
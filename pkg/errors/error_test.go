@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"testing"
 
+	"whimsy/pkg/redact"
+
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/hlog"
 )
@@ -58,3 +60,20 @@ func TestErrors(t *testing.T) {
 	t.Log(string(b))
 
 }
+
+func TestRedacted(t *testing.T) {
+	e := NewBadRequestErrorWithMessage("No account for ann@whimsy.test.")
+	e.WithFieldViolation("card", "4111 1111 1111 1111 was declined.")
+	e.WithReason(ReasonUnknown, map[string]string{"token": "abc", "email": "ann@whimsy.test"})
+
+	r := e.Redacted(redact.Default())
+	if r.Msg != "No account for ***@whimsy.test." || r.BadRequest.FieldViolations[0].Description != "************1111 was declined." {
+		t.Errorf("unexpected redacted error %+v", r)
+	}
+	if m := r.ErrorInfo.Metadata; m["token"] != redact.Redacted || m["email"] != "***@whimsy.test" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+	if e.Msg != "No account for ann@whimsy.test." || e.ErrorInfo.Metadata["token"] != "abc" {
+		t.Error("the original error was changed")
+	}
+}
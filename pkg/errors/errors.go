@@ -5,9 +5,12 @@ import (
 	goerrors "errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"unicode"
 
+	"whimsy/pkg/redact"
+
 	"github.com/go-playground/validator/v10"
 	"golang.org/x/text/language"
 )
@@ -85,6 +88,12 @@ func (e *Error) Unwrap() error { return e.error }
 func NewInvalidRequestBodyFormatError() *Error {
 	return &Error{Msg: "Failed to parse request body.", HTTPStatus: http.StatusBadRequest}
 }
+func NewRequestEntityTooLargeError(limit int64) *Error {
+	return &Error{Msg: fmt.Sprintf("Request body must not exceed %d bytes.", limit), HTTPStatus: http.StatusRequestEntityTooLarge}
+}
+func NewUnsupportedContentEncodingError(encoding string) *Error {
+	return &Error{Msg: fmt.Sprintf("Unsupported content encoding %q.", encoding), HTTPStatus: http.StatusUnsupportedMediaType}
+}
 func NewBadRequestError(err error) (e *Error) {
 	if goerrors.As(err, &e) {
 		return e
@@ -113,6 +122,23 @@ func NewGenericError(err error) *Error {
 	}
 	return &Error{error: err, Msg: "Internal server error.", HTTPStatus: http.StatusInternalServerError}
 }
+func NewPreconditionFailedError() *Error {
+	return &Error{Msg: "The resource was modified, reload it and try again.", HTTPStatus: http.StatusPreconditionFailed}
+}
+func NewUnauthorizedError(msg string) *Error {
+	return &Error{Msg: msg, HTTPStatus: http.StatusUnauthorized}
+}
+func NewAccountLockedError() *Error {
+	return &Error{Msg: "Too many failed attempts, try again later.", HTTPStatus: http.StatusLocked}
+}
+func NewForbiddenError(permission string) *Error {
+	e := &Error{Msg: "You don't have permission to do this.", HTTPStatus: http.StatusForbidden}
+	e.WithReason(ReasonPermissionDenied, map[string]string{"permission": permission})
+	return e
+}
+func NewConflictError(msg string) *Error {
+	return &Error{Msg: msg, HTTPStatus: http.StatusConflict}
+}
 func NotFoundError() *Error {
 	return &Error{Msg: "not found", HTTPStatus: http.StatusNotFound}
 }
@@ -151,9 +177,12 @@ func WrapErrorf(ctx context.Context, err error, status int, format string, a ...
 	return e
 }
 
-// formatAttribute from User.Title.CasedID to title.casedID
+// formatAttribute from User.Title.CasedID to title.casedID, dropping the
+// name of the validated struct.
 func formatAttribute(input string) string {
-	input = strings.TrimPrefix(input, "User.")
+	if i := strings.IndexByte(input, '.'); i >= 0 {
+		input = input[i+1:]
+	}
 	rs := make([]rune, 0, len(input))
 	toLower := true
 	for _, r := range input {
@@ -169,6 +198,17 @@ func formatAttribute(input string) string {
 // TODO: better testing.
 var debugFieldViolations bool = false
 
+// lengthUnit describes what min and max count for a field kind.
+func lengthUnit(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return " items"
+	}
+	return ""
+}
+
 func parseFieldViolations(ves validator.ValidationErrors) []FieldViolation {
 	fieldViolations := make([]FieldViolation, len(ves))
 	for i, fe := range ves {
@@ -186,6 +226,12 @@ func parseFieldViolations(ves validator.ValidationErrors) []FieldViolation {
 			desc = fmt.Sprintf("Must be less than %v.", fe.Value())
 		case "required", "required_unless", "required_with":
 			desc = "Required."
+		case "email":
+			desc = "Must be a valid email address."
+		case "min":
+			desc = fmt.Sprintf("Must be at least %s%s.", fe.Param(), lengthUnit(fe.Kind()))
+		case "max":
+			desc = fmt.Sprintf("Must be at most %s%s.", fe.Param(), lengthUnit(fe.Kind()))
 		case "not_po_box":
 			desc = "P.O. Box not supported."
 		}
@@ -311,6 +357,39 @@ func (e *Error) WithReason(reason ReasonType, metadata map[string]string) {
 	e.ErrorInfo = NewErrorInfo(reason, metadata)
 }
 
+// Redacted returns a copy of e safe to send to clients and reporting
+// services, with its messages and metadata redacted by r.
+func (e *Error) Redacted(r *redact.Redactor) *Error {
+	out := *e
+	out.Msg = r.Text(e.Msg)
+	if e.FieldErrors != nil {
+		out.FieldErrors = make(map[string]string, len(e.FieldErrors))
+		for field, msg := range e.FieldErrors {
+			out.FieldErrors[field] = r.Text(msg)
+		}
+	}
+	if br := e.BadRequest; br != nil {
+		out.BadRequest = &BadRequest{FieldViolations: make([]FieldViolation, len(br.FieldViolations))}
+		for i, fv := range br.FieldViolations {
+			out.BadRequest.FieldViolations[i] = FieldViolation{Field: fv.Field, Description: r.Text(fv.Description)}
+		}
+	}
+	if lm := e.LocalizedMessage; lm != nil {
+		out.LocalizedMessage = &LocalizedMessage{Locale: lm.Locale, Message: r.Text(lm.Message)}
+	}
+	if ei := e.ErrorInfo; ei != nil && ei.Metadata != nil {
+		metadata := make(map[string]string, len(ei.Metadata))
+		for key, val := range ei.Metadata {
+			if r.Field(key) {
+				val = redact.Redacted
+			}
+			metadata[key] = r.Text(val)
+		}
+		out.ErrorInfo = NewErrorInfo(ei.Reason, metadata)
+	}
+	return &out
+}
+
 func StatusCode(err error) int {
 	var e *Error
 	if goerrors.As(err, &e) {
@@ -99,8 +99,9 @@ func NewLocalizedMessage(tag language.Tag, key message.Reference, a ...interface
 type ReasonType string
 
 const (
-	ReasonUnknown         ReasonType = "UNKNOWN"
-	ReasonOutdatedVersion ReasonType = "OUTDATED_VERSION"
+	ReasonUnknown          ReasonType = "UNKNOWN"
+	ReasonOutdatedVersion  ReasonType = "OUTDATED_VERSION"
+	ReasonPermissionDenied ReasonType = "PERMISSION_DENIED"
 )
 
 // Example of an error with outdated client version:
@@ -0,0 +1,108 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrCircuitOpen fails requests to a host that kept failing, until its
+// cooldown is over.
+var ErrCircuitOpen = errors.New("httpclient: circuit open")
+
+// breakerTransport keeps a circuit breaker per host. A network error or a
+// 5xx response is a failure; threshold of them in a row open the circuit.
+// Once cooldown passes, one request is let through: its success closes the
+// circuit and its failure opens it again.
+type breakerTransport struct {
+	next      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*breaker
+}
+
+type breaker struct {
+	failures int
+	openedAt time.Time
+	// probing is set while the request let through after the cooldown is
+	// in flight.
+	probing bool
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !t.allow(host) {
+		return nil, ErrCircuitOpen
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil && req.Context().Err() == context.Canceled {
+		// Cancelled by the caller, which says nothing about the host.
+		t.release(host)
+		return nil, err
+	}
+	failed := err != nil || res.StatusCode >= 500
+	if t.record(host, failed) {
+		zerolog.Ctx(req.Context()).Warn().
+			Str("host", host).
+			Dur("cooldown", t.cooldown).
+			Msg("circuit opened")
+	}
+	return res, err
+}
+
+func (t *breakerTransport) allow(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.hosts[host]
+	if b == nil || b.failures < t.threshold {
+		return true
+	}
+	if b.probing || t.now().Sub(b.openedAt) < t.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// release lets another request probe host after a probe that ended
+// without an outcome.
+func (t *breakerTransport) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.hosts[host]; b != nil {
+		b.probing = false
+	}
+}
+
+// record counts the outcome of a request to host, and reports whether it
+// opened the circuit.
+func (t *breakerTransport) record(host string, failed bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.hosts[host]
+	if !failed {
+		if b != nil {
+			delete(t.hosts, host)
+		}
+		return false
+	}
+	if b == nil {
+		b = &breaker{}
+		t.hosts[host] = b
+	}
+	wasProbing := b.probing
+	b.probing = false
+	b.failures++
+	if b.failures == t.threshold || wasProbing {
+		b.openedAt = t.now()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+// Package httpclient builds the clients used to call other services. Each
+// client is named after its provider with a label, e.g. "webhooks" or
+// "oidc.google", which tags its logs and metrics, and wraps the transport
+// with retries, a circuit breaker per host, request ID propagation and
+// size capped request/response dumps.
+package httpclient
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"whimsy/pkg/utils"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// RequestIDHeader carries the ID of the request being served, so calls can
+// be matched to it in the other service's logs.
+const RequestIDHeader = "X-WHIMSY-REQUEST-ID"
+
+const (
+	DefaultTimeout          = 10 * time.Second
+	DefaultMaxRetries       = 2
+	DefaultRetryWait        = 200 * time.Millisecond
+	DefaultMaxRetryWait     = 30 * time.Second
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// NoRetries as Options.MaxRetries sends each request once.
+const NoRetries = -1
+
+// NoBreaker as Options.BreakerThreshold never opens a circuit, for clients
+// whose requests to a host aren't alike, such as webhooks of many tenants.
+const NoBreaker = -1
+
+type Options struct {
+	// Timeout bounds each attempt, including reading the response body.
+	Timeout time.Duration
+	// MaxRetries is how many times an idempotent request is sent again
+	// after a network error or a 429, 502, 503 or 504.
+	MaxRetries int
+	// RetryWait is the wait before the first retry. It doubles with each
+	// retry, with jitter, unless the response has a Retry-After.
+	RetryWait time.Duration
+	// MaxRetryWait caps waits. A response asking to wait longer is
+	// returned as is.
+	MaxRetryWait time.Duration
+	// BreakerThreshold is how many failures in a row open the circuit to
+	// a host, failing its requests with ErrCircuitOpen for BreakerCooldown,
+	// or NoBreaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// MaxDumpBytes caps the request and response dumps logged at trace
+	// level.
+	MaxDumpBytes int
+	// Transport sends the requests, http.DefaultTransport by default.
+	Transport http.RoundTripper
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultMaxRetries
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryWait <= 0 {
+		o.RetryWait = DefaultRetryWait
+	}
+	if o.MaxRetryWait <= 0 {
+		o.MaxRetryWait = DefaultMaxRetryWait
+	}
+	if o.BreakerThreshold == 0 {
+		o.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if o.BreakerCooldown <= 0 {
+		o.BreakerCooldown = DefaultBreakerCooldown
+	}
+	if o.MaxDumpBytes <= 0 {
+		o.MaxDumpBytes = utils.DefaultMaxDumpBytes
+	}
+	if o.Transport == nil {
+		o.Transport = http.DefaultTransport
+	}
+	return o
+}
+
+// New returns a client for the provider label. Requests go through, in
+// order: request ID propagation, retries, metrics, the host's circuit
+// breaker and logging. Each attempt, not the whole call, is bounded by
+// opts.Timeout, so the client's own Timeout is left unset; bound the
+// call with the request's context.
+func New(label string, opts Options) *http.Client {
+	return &http.Client{Transport: NewTransport(label, opts)}
+}
+
+// NewTransport returns the http.RoundTripper of New, for clients that need
+// other settings, such as not following redirects.
+func NewTransport(label string, opts Options) http.RoundTripper {
+	opts = opts.withDefaults()
+	var rt http.RoundTripper = utils.HttpLoggingRoundTripper{Proxied: opts.Transport, Label: label, MaxBodyBytes: opts.MaxDumpBytes}
+	if opts.BreakerThreshold > 0 {
+		rt = &breakerTransport{next: rt, threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown, hosts: map[string]*breaker{}, now: time.Now}
+	}
+	rt = &metricsTransport{next: rt, metrics: metricsFor(label)}
+	rt = &retryTransport{next: rt, opts: opts, metrics: metricsFor(label), sleep: sleep, jitter: jitter}
+	return requestIDTransport{next: rt}
+}
+
+// requestIDTransport sets RequestIDHeader to the ID hlog gave the request
+// being served, if any.
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id, ok := hlog.IDFromCtx(req.Context()); ok && req.Header.Get(RequestIDHeader) == "" {
+		// A RoundTripper mustn't change the caller's request.
+		req = req.Clone(req.Context())
+		req.Header.Set(RequestIDHeader, id.String())
+	}
+	return t.next.RoundTrip(req)
+}
+
+var (
+	jitterMu  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitterRnd.Int63n(int64(d/2)+1))
+}
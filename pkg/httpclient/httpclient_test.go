@@ -0,0 +1,248 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// server answers with the statuses in turn, then with the last one.
+type server struct {
+	*httptest.Server
+	calls  int32
+	bodies []string
+}
+
+func newServer(t *testing.T, header http.Header, statuses ...int) *server {
+	s := &server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&s.calls, 1)) - 1
+		b, _ := ioutil.ReadAll(r.Body)
+		s.bodies = append(s.bodies, string(b))
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if n >= len(statuses) {
+			n = len(statuses) - 1
+		}
+		w.WriteHeader(statuses[n])
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func fastOptions() Options {
+	return Options{RetryWait: time.Millisecond, MaxRetryWait: time.Second}
+}
+
+func TestRetries(t *testing.T) {
+	s := newServer(t, nil, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	client := New("test.retries", fastOptions())
+	res, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || s.calls != 3 {
+		t.Errorf("got %d after %d calls", res.StatusCode, s.calls)
+	}
+
+	// POSTs are sent once, unless they have an idempotency key.
+	s = newServer(t, nil, http.StatusServiceUnavailable, http.StatusOK)
+	res, err = client.Post(s.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || s.calls != 1 {
+		t.Errorf("POST: got %d after %d calls", res.StatusCode, s.calls)
+	}
+	req, _ := http.NewRequest(http.MethodPost, s.URL, strings.NewReader("hello"))
+	req.Header.Set(IdempotencyKeyHeader, "key")
+	atomic.StoreInt32(&s.calls, 0)
+	s.bodies = nil
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s.calls != 2 || s.bodies[1] != "hello" {
+		t.Errorf("keyed POST: %d calls with bodies %q", s.calls, s.bodies)
+	}
+
+	// Client errors aren't retried.
+	s = newServer(t, nil, http.StatusNotFound)
+	res, err = client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s.calls != 1 {
+		t.Errorf("404: %d calls", s.calls)
+	}
+
+	// Nor are requests asked to wait longer than MaxRetryWait.
+	s = newServer(t, http.Header{"Retry-After": {"120"}}, http.StatusTooManyRequests, http.StatusOK)
+	res, err = client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || s.calls != 1 {
+		t.Errorf("long Retry-After: got %d after %d calls", res.StatusCode, s.calls)
+	}
+
+	var stats Stats
+	for _, s := range AllStats() {
+		if s.Label == "test.retries" {
+			stats = s
+		}
+	}
+	if stats.Requests != 8 || stats.Retries != 3 || stats.Statuses["503"] != 3 || stats.Statuses["200"] != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := retryAfter(tt.header, now); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	s := newServer(t, http.Header{"Retry-After": {"0"}}, http.StatusServiceUnavailable, http.StatusOK)
+	var waits []time.Duration
+	rt := NewTransport("test.retryafter", fastOptions()).(requestIDTransport).next.(*retryTransport)
+	rt.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	res, err := (&http.Client{Transport: rt}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(waits) != 1 || waits[0] != 0 {
+		t.Errorf("waited %v, want the Retry-After", waits)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("jitter(1s) = %v", d)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	s := newServer(t, nil, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	now := time.Now()
+	bt := &breakerTransport{next: http.DefaultTransport, threshold: 2, cooldown: time.Minute, hosts: map[string]*breaker{}, now: func() time.Time { return now }}
+	client := &http.Client{Transport: bt}
+	get := func() (int, error) {
+		res, err := client.Get(s.URL)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	get()
+	get()
+	if _, err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("circuit not open: %v", err)
+	}
+	if s.calls != 2 {
+		t.Errorf("%d calls through an open circuit", s.calls)
+	}
+
+	// After the cooldown one request probes the host, and closes the
+	// circuit.
+	now = now.Add(time.Minute)
+	if !bt.allow(s.Listener.Addr().String()) || bt.allow(s.Listener.Addr().String()) {
+		t.Error("want a single probe after the cooldown")
+	}
+	bt.release(s.Listener.Addr().String())
+	if code, err := get(); err != nil || code != http.StatusOK {
+		t.Fatalf("probe: %d, %v", code, err)
+	}
+	if code, err := get(); err != nil || code != http.StatusOK {
+		t.Errorf("after the probe: %d, %v", code, err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(RequestIDHeader)
+	}))
+	defer s.Close()
+
+	var seen string
+	// Serve a request with hlog, which calls s from its handler.
+	handler := hlog.RequestIDHandler("request_id", RequestIDHeader)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := hlog.IDFromRequest(r); ok {
+			seen = v.String()
+		}
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, s.URL, nil)
+		res, err := New("test.requestid", Options{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if req.Header.Get(RequestIDHeader) != "" {
+			t.Error("the caller's request was changed")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got == "" || got != seen {
+		t.Errorf("sent request ID %q, want %q", got, seen)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00:ec2::254":   false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"64:ff9b::a00:1":  false,
+	} {
+		if got := IsPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("IsPublicIP(%s) = %v", ip, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package httpclient
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// published is the "httpclient" expvar, holding the counters of each label.
+var published = expvar.NewMap("httpclient")
+
+var (
+	metricsMu sync.Mutex
+	byLabel   = map[string]*metrics{}
+)
+
+// metrics count the requests of the clients with one label. Requests
+// counts attempts, so a retried call counts more than once.
+type metrics struct {
+	label      string
+	requests   expvar.Int
+	errors     expvar.Int
+	retries    expvar.Int
+	rejected   expvar.Int
+	durationMs expvar.Int
+	statuses   expvar.Map
+}
+
+func metricsFor(label string) *metrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := byLabel[label]; ok {
+		return m
+	}
+	m := &metrics{label: label}
+	m.statuses.Init()
+	vars := new(expvar.Map).Init()
+	vars.Set("requests", &m.requests)
+	vars.Set("errors", &m.errors)
+	vars.Set("retries", &m.retries)
+	vars.Set("circuitOpen", &m.rejected)
+	vars.Set("durationMs", &m.durationMs)
+	vars.Set("statuses", &m.statuses)
+	published.Set(label, vars)
+	byLabel[label] = m
+	return m
+}
+
+// Stats are the counters of the clients with one label since the process
+// started.
+// swagger:model HTTPClientStats
+type Stats struct {
+	Label string `json:"label"`
+	// Requests counts attempts, so a retried call counts more than once.
+	Requests int64 `json:"requests"`
+	// Errors counts attempts that got no response.
+	Errors  int64 `json:"errors"`
+	Retries int64 `json:"retries"`
+	// CircuitOpen counts attempts failed with ErrCircuitOpen.
+	CircuitOpen int64 `json:"circuitOpen"`
+	// DurationMs is the total time spent on attempts.
+	DurationMs int64 `json:"durationMs"`
+	// Statuses counts responses by status code.
+	Statuses map[string]int64 `json:"statuses"`
+}
+
+// AllStats returns the Stats of every label, sorted by label.
+func AllStats() []Stats {
+	metricsMu.Lock()
+	all := make([]*metrics, 0, len(byLabel))
+	for _, m := range byLabel {
+		all = append(all, m)
+	}
+	metricsMu.Unlock()
+
+	out := make([]Stats, 0, len(all))
+	for _, m := range all {
+		s := Stats{
+			Label:       m.label,
+			Requests:    m.requests.Value(),
+			Errors:      m.errors.Value(),
+			Retries:     m.retries.Value(),
+			CircuitOpen: m.rejected.Value(),
+			DurationMs:  m.durationMs.Value(),
+			Statuses:    map[string]int64{},
+		}
+		m.statuses.Do(func(kv expvar.KeyValue) {
+			s.Statuses[kv.Key] = kv.Value.(*expvar.Int).Value()
+		})
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Label < out[j].Label })
+	return out
+}
+
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	m := t.metrics
+	m.requests.Add(1)
+	m.durationMs.Add(time.Since(start).Milliseconds())
+	switch {
+	case err == ErrCircuitOpen:
+		m.rejected.Add(1)
+	case err != nil:
+		m.errors.Add(1)
+	default:
+		m.statuses.Add(strconv.Itoa(res.StatusCode), 1)
+	}
+	return res, err
+}
@@ -0,0 +1,156 @@
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// IdempotencyKeyHeader makes a POST or PATCH safe to retry for services
+// that honour it.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// retryTransport bounds each attempt by opts.Timeout and sends idempotent
+// requests again after transient failures.
+type retryTransport struct {
+	next    http.RoundTripper
+	opts    Options
+	metrics *metrics
+	sleep   func(context.Context, time.Duration) error
+	jitter  func(time.Duration) time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if idempotent(req) {
+		retries = t.opts.MaxRetries
+	}
+	wait := t.opts.RetryWait
+	for attempt := 0; ; attempt++ {
+		res, err := t.attempt(req, attempt)
+		if attempt == retries || req.Context().Err() != nil || !retryable(res, err) {
+			return res, err
+		}
+		d := t.jitter(wait)
+		if res != nil {
+			if after, ok := retryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+				d = after
+			}
+		}
+		if d > t.opts.MaxRetryWait {
+			return res, err
+		}
+		if res != nil {
+			// Drain a little so the connection can be reused.
+			_, _ = io.CopyN(io.Discard, res.Body, 4<<10)
+			res.Body.Close()
+		}
+		zerolog.Ctx(req.Context()).Debug().
+			Str("provider", t.metrics.label).
+			Str("method", req.Method).
+			Str("host", req.URL.Host).
+			Int("attempt", attempt+1).
+			Dur("wait", d).
+			Msg("retrying request")
+		if err := t.sleep(req.Context(), d); err != nil {
+			return nil, err
+		}
+		t.metrics.retries.Add(1)
+		wait *= 2
+	}
+}
+
+// attempt sends req once, within its own timeout. The timeout lasts until
+// the response body is closed.
+func (t *retryTransport) attempt(req *http.Request, n int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.opts.Timeout)
+	r := req.WithContext(ctx)
+	if n > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	res, err := t.next.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// idempotent reports whether req may be sent more than once: its method is
+// idempotent, or it has an Idempotency-Key, and its body can be sent again.
+func idempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// retryable reports whether an attempt failed in a way worth retrying;
+// an open circuit isn't.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return err != ErrCircuitOpen
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header, either seconds or an HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	at, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := at.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,119 @@
+// Package jobs is a durable background job queue in the jobs table.
+//
+// Enqueue inserts a job, in the caller's transaction if given one, so work
+// is queued exactly when the change asking for it commits. Workers claim
+// jobs with SELECT ... FOR UPDATE SKIP LOCKED, so any number of them can
+// share the table, and run the handler registered for each job's kind.
+// Failed jobs are retried with exponential backoff until they have run
+// MaxAttempts times, then kept in the dead state.
+//
+// Jobs run at least once: a worker that dies mid-job leaves it claimed until
+// its lease expires, and another worker then runs it again. Handlers must
+// be idempotent.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"time"
+
+	"whimsy/pkg/models"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultMaxAttempts is how many times a job runs unless enqueued with
+// another MaxAttempts.
+const DefaultMaxAttempts = 10
+
+// NotifyChannel is the pub/sub channel Enqueue notifies of jobs ready to
+// run, with the job kind as payload. Workers listening on it pick jobs up
+// without waiting for their next poll.
+const NotifyChannel = "jobs"
+
+// ErrDuplicate is returned by Enqueue for a UniqueKey already pending or
+// running. The caller's transaction is unaffected.
+var ErrDuplicate = goerrors.New("duplicate job")
+
+// Job is the payload of a job. Its JSON encoding, which must be an object,
+// is stored and decoded for the handler of its Kind.
+type Job interface {
+	Kind() string
+}
+
+// Options change how and when a job runs.
+type Options struct {
+	// Priority orders ready jobs, higher first.
+	Priority int
+	// RunAt delays the job. The zero value runs it now.
+	RunAt time.Time
+	// MaxAttempts defaults to DefaultMaxAttempts.
+	MaxAttempts int
+	// UniqueKey, if set, makes Enqueue return ErrDuplicate while a pending
+	// or running job has the same key.
+	UniqueKey string
+}
+
+// Enqueue queues job. Pass the transaction making the change that needs the
+// work, so neither commits without the other.
+func Enqueue(ctx context.Context, tx *gorm.DB, job Job, opts Options) (*models.Job, error) {
+	payload := models.JSONMap{}
+	if err := roundTrip(job, &payload); err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	j := &models.Job{
+		ID:          id,
+		Kind:        job.Kind(),
+		Payload:     payload,
+		State:       models.JobPending,
+		Priority:    opts.Priority,
+		RunAt:       opts.RunAt,
+		MaxAttempts: opts.MaxAttempts,
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = now
+	}
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.UniqueKey != "" {
+		j.UniqueKey = &opts.UniqueKey
+	}
+
+	tx = tx.WithContext(ctx)
+	res := tx.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "unique_key"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "state IN ('pending', 'running')"}}},
+		DoNothing:   true,
+	}).Create(j)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrDuplicate
+	}
+	if !j.RunAt.After(now) {
+		// Delivered when tx commits, and not at all if it rolls back.
+		if err := tx.Exec("SELECT pg_notify(?, ?)", NotifyChannel, j.Kind).Error; err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// roundTrip decodes the JSON encoding of v into out.
+func roundTrip(v, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
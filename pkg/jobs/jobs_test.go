@@ -0,0 +1,327 @@
+package jobs
+
+import (
+	"context"
+	goerrors "errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
+	"whimsy/pkg/testutils"
+
+	"gorm.io/gorm"
+)
+
+var db *gorm.DB
+
+func TestMain(m *testing.M) {
+	db = testutils.ConnectDb("jobs")
+	if err := migrate.Migrate(db); err != nil {
+		panic(err)
+	}
+	exitVal := m.Run()
+	testutils.ResetDb(db)
+	os.Exit(exitVal)
+}
+
+type greet struct {
+	Name string
+}
+
+func (greet) Kind() string { return "test.greet" }
+
+type count struct {
+	N int
+}
+
+func (*count) Kind() string { return "test.count" }
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 30; attempt++ {
+		d := backoff(attempt)
+		if d < minBackoff/2 || d > maxBackoff {
+			t.Errorf("backoff(%d) = %s", attempt, d)
+		}
+	}
+	if d := backoff(3); d < 20*time.Second || d > 40*time.Second {
+		t.Errorf("backoff(3) = %s", d)
+	}
+}
+
+func TestHandleDecodesPayloads(t *testing.T) {
+	w := NewWorker(nil, WorkerOptions{})
+	var got []interface{}
+	record := func(_ context.Context, job Job) error {
+		got = append(got, job)
+		return nil
+	}
+	w.Handle(greet{}, record)
+	w.Handle(&count{}, record)
+	for _, job := range []Job{greet{Name: "ada"}, &count{N: 3}} {
+		payload := models.JSONMap{}
+		if err := roundTrip(job, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.run(context.Background(), &models.Job{Kind: job.Kind(), Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g, ok := got[0].(greet); !ok || g.Name != "ada" {
+		t.Errorf("got %#v, want a greet", got[0])
+	}
+	if c, ok := got[1].(*count); !ok || c.N != 3 {
+		t.Errorf("got %#v, want a *count", got[1])
+	}
+
+	w.handlers["test.panic"] = handler{typ: w.handlers["test.greet"].typ, fn: func(context.Context, Job) error {
+		panic("boom")
+	}}
+	if err := w.run(context.Background(), &models.Job{Kind: "test.panic"}); err == nil {
+		t.Error("a panicking job succeeded")
+	}
+}
+
+func resetJobs(t *testing.T) {
+	t.Helper()
+	if err := db.Exec("TRUNCATE jobs").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadJob(t *testing.T, j *models.Job) models.Job {
+	t.Helper()
+	var got models.Job
+	if err := db.First(&got, "id = ?", j.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestEnqueue(t *testing.T) {
+	resetJobs(t)
+	ctx := context.Background()
+
+	j, err := Enqueue(ctx, db, greet{Name: "ada"}, Options{UniqueKey: "greet:ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loadJob(t, j); got.State != models.JobPending || got.MaxAttempts != DefaultMaxAttempts || got.Payload["Name"] != "ada" {
+		t.Errorf("stored %+v", got)
+	}
+	if _, err := Enqueue(ctx, db, greet{Name: "ada"}, Options{UniqueKey: "greet:ada"}); !goerrors.Is(err, ErrDuplicate) {
+		t.Errorf("duplicate enqueue = %v", err)
+	}
+
+	// A duplicate doesn't spoil the caller's transaction, and a rollback
+	// takes the job with it.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := Enqueue(ctx, tx, greet{Name: "ada"}, Options{UniqueKey: "greet:ada"}); !goerrors.Is(err, ErrDuplicate) {
+			t.Errorf("duplicate enqueue = %v", err)
+		}
+		if _, err := Enqueue(ctx, tx, greet{Name: "grace"}, Options{}); err != nil {
+			return err
+		}
+		return goerrors.New("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatal(err)
+	}
+	var n int64
+	db.Model(&models.Job{}).Count(&n)
+	if n != 1 {
+		t.Errorf("%d jobs queued, want 1", n)
+	}
+
+	// Dead jobs don't hold their key.
+	db.Model(&models.Job{}).Where("id = ?", j.ID).Update("state", models.JobDead)
+	if _, err := Enqueue(ctx, db, greet{Name: "ada"}, Options{UniqueKey: "greet:ada"}); err != nil {
+		t.Errorf("enqueue after the job died = %v", err)
+	}
+}
+
+func TestWorkerOrder(t *testing.T) {
+	resetJobs(t)
+	ctx := context.Background()
+	now := time.Now()
+	for _, name := range []string{"low", "high", "later"} {
+		opts := Options{}
+		switch name {
+		case "high":
+			opts.Priority = 10
+		case "later":
+			opts.Priority = 20
+			opts.RunAt = now.Add(time.Hour)
+		}
+		if _, err := Enqueue(ctx, db, greet{Name: name}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ran []string
+	w := NewWorker(db, WorkerOptions{})
+	w.Handle(greet{}, func(_ context.Context, job Job) error {
+		ran = append(ran, job.(greet).Name)
+		return nil
+	})
+	for {
+		worked, err := w.work(ctx, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !worked {
+			break
+		}
+	}
+	if len(ran) != 2 || ran[0] != "high" || ran[1] != "low" {
+		t.Errorf("ran %v, want [high low]", ran)
+	}
+	var left []models.Job
+	db.Find(&left)
+	if len(left) != 1 || left[0].Payload["Name"] != "later" {
+		t.Errorf("%d jobs left, want the later one", len(left))
+	}
+}
+
+func TestWorkerRetries(t *testing.T) {
+	resetJobs(t)
+	ctx := context.Background()
+	j, err := Enqueue(ctx, db, greet{Name: "flaky"}, Options{MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	w := NewWorker(db, WorkerOptions{})
+	w.now = func() time.Time { return now }
+	w.Handle(greet{}, func(context.Context, Job) error {
+		return goerrors.New("smtp unavailable")
+	})
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if worked, err := w.work(ctx, ctx); !worked || err != nil {
+			t.Fatalf("attempt %d: worked = %v, %v", attempt, worked, err)
+		}
+		got := loadJob(t, j)
+		if got.Attempts != attempt || got.LastError != "smtp unavailable" || got.LockedBy != nil {
+			t.Fatalf("after attempt %d: %+v", attempt, got)
+		}
+		if attempt < 3 {
+			if got.State != models.JobPending || !got.RunAt.After(now) {
+				t.Fatalf("after attempt %d: %s at %s", attempt, got.State, got.RunAt)
+			}
+			if worked, _ := w.work(ctx, ctx); worked {
+				t.Fatal("retried before the backoff")
+			}
+			now = got.RunAt
+		} else if got.State != models.JobDead || got.DiedAt == nil {
+			t.Errorf("after the last attempt: %s", got.State)
+		}
+	}
+	now = now.Add(24 * time.Hour)
+	if worked, _ := w.work(ctx, ctx); worked {
+		t.Error("a dead job ran")
+	}
+}
+
+func TestWorkerLeaseExpiry(t *testing.T) {
+	resetJobs(t)
+	ctx := context.Background()
+	j, err := Enqueue(ctx, db, greet{Name: "orphan"}, Options{MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	w := NewWorker(db, WorkerOptions{Timeout: time.Minute})
+	w.now = func() time.Time { return now }
+	ran := 0
+	w.Handle(greet{}, func(context.Context, Job) error {
+		ran++
+		return nil
+	})
+
+	// A worker claims the job and dies.
+	if job, err := w.claim(ctx); err != nil || job == nil {
+		t.Fatalf("claim = %v, %v", job, err)
+	}
+	if worked, _ := w.work(ctx, ctx); worked {
+		t.Fatal("claimed a job under lease")
+	}
+	now = now.Add(time.Minute + leaseMargin + time.Second)
+	if job, err := w.claim(ctx); err != nil || job == nil || job.Attempts != 2 {
+		t.Fatalf("reclaim = %+v, %v", job, err)
+	}
+
+	// Out of attempts, the job dies without running.
+	now = now.Add(time.Minute + leaseMargin + time.Second)
+	if worked, err := w.work(ctx, ctx); !worked || err != nil {
+		t.Fatalf("worked = %v, %v", worked, err)
+	}
+	if got := loadJob(t, j); got.State != models.JobDead || got.LastError != errLeaseExpired.Error() || ran != 0 {
+		t.Errorf("got %s %q after %d runs", got.State, got.LastError, ran)
+	}
+}
+
+func TestWorkerRun(t *testing.T) {
+	resetJobs(t)
+	ctx, cancel := context.WithCancel(testutils.NewContext(t))
+	defer cancel()
+
+	const n = 20
+	var (
+		mu      sync.Mutex
+		seen    = map[int]int{}
+		started = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+	)
+	w := NewWorker(db, WorkerOptions{Concurrency: 4, PollInterval: 10 * time.Millisecond})
+	w.Handle(&count{}, func(_ context.Context, job Job) error {
+		mu.Lock()
+		seen[job.(*count).N]++
+		mu.Unlock()
+		if job.(*count).N == n {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return nil
+	})
+	var stopped int32
+	go func() {
+		w.Run(ctx)
+		atomic.StoreInt32(&stopped, 1)
+	}()
+
+	for i := 1; i <= n; i++ {
+		if _, err := Enqueue(ctx, db, &count{N: i}, Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&stopped) != 0 {
+		t.Fatal("Run returned before its running job finished")
+	}
+	close(release)
+	for atomic.LoadInt32(&stopped) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i <= n; i++ {
+		if seen[i] != 1 {
+			t.Errorf("job %d ran %d times", i, seen[i])
+		}
+	}
+	var left int64
+	db.Model(&models.Job{}).Count(&left)
+	if left != 0 {
+		t.Errorf("%d jobs left", left)
+	}
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"context"
+
+	"whimsy/pkg/mailer"
+)
+
+// SendMail delivers a rendered message in the background, retrying while
+// the mail server is unavailable. Enqueue it in the transaction issuing any
+// token the message carries. Dead jobs keep the message, links included.
+type SendMail struct {
+	Message mailer.Message
+}
+
+func (SendMail) Kind() string {
+	return "mail.send"
+}
+
+// SendMailHandler sends SendMail jobs with m.
+func SendMailHandler(m mailer.Mailer) HandlerFunc {
+	return func(ctx context.Context, job Job) error {
+		return m.Send(ctx, job.(SendMail).Message)
+	}
+}
@@ -0,0 +1,291 @@
+package jobs
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"whimsy/pkg/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// Defaults for WorkerOptions.
+const (
+	DefaultConcurrency  = 4
+	DefaultPollInterval = 5 * time.Second
+	DefaultTimeout      = 5 * time.Minute
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// leaseMargin is how long past Timeout a claim lasts, so a job times out on
+// its worker before another can claim it.
+const leaseMargin = time.Minute
+
+// Retry backoff bounds, see backoff.
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = time.Hour
+)
+
+var errLeaseExpired = goerrors.New("job lease expired, its worker likely died")
+
+// HandlerFunc runs a job, passed with the type it was registered with. An
+// error retries the job later, or kills it after its last attempt.
+type HandlerFunc func(ctx context.Context, job Job) error
+
+// WorkerOptions tune a Worker. Zero values take the defaults above.
+type WorkerOptions struct {
+	// Concurrency is how many jobs run at once.
+	Concurrency int
+	// PollInterval is how often idle workers look for jobs. Wake finds them
+	// sooner.
+	PollInterval time.Duration
+	// Timeout bounds each attempt of a job.
+	Timeout time.Duration
+	// DrainTimeout is how long Run waits for running jobs once its context
+	// is done, before cancelling theirs.
+	DrainTimeout time.Duration
+}
+
+type handler struct {
+	typ reflect.Type
+	ptr bool
+	fn  HandlerFunc
+}
+
+// Worker runs queued jobs of the kinds it has handlers for.
+type Worker struct {
+	db       *gorm.DB
+	opts     WorkerOptions
+	handlers map[string]handler
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+func NewWorker(db *gorm.DB, opts WorkerOptions) *Worker {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+	return &Worker{
+		db:       db,
+		opts:     opts,
+		handlers: map[string]handler{},
+		wake:     make(chan struct{}, opts.Concurrency),
+		now:      time.Now,
+	}
+}
+
+// Handle registers fn for jobs of the kind of job. fn is passed jobs of the
+// same type as job, a pointer if job is one. Call Handle before Run.
+func (w *Worker) Handle(job Job, fn HandlerFunc) {
+	kind := job.Kind()
+	if _, ok := w.handlers[kind]; ok {
+		panic("jobs: duplicate handler for " + kind)
+	}
+	h := handler{typ: reflect.TypeOf(job), fn: fn}
+	if h.typ.Kind() == reflect.Ptr {
+		h.typ, h.ptr = h.typ.Elem(), true
+	}
+	w.handlers[kind] = h
+}
+
+// Wake makes an idle goroutine look for jobs now, as when NotifyChannel
+// reports one.
+func (w *Worker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run works jobs until ctx is done, then waits for the running jobs to
+// finish, for at most DrainTimeout before cancelling them.
+func (w *Worker) Run(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+	// Jobs outlive ctx while draining.
+	jobCtx, cancelJobs := context.WithCancel(logger.WithContext(context.Background()))
+	defer cancelJobs()
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx, jobCtx)
+		}()
+	}
+	<-ctx.Done()
+
+	logger.Info().Msg("draining jobs")
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	t := time.NewTimer(w.opts.DrainTimeout)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+		logger.Warn().Msg("jobs didn't drain in time, cancelling them")
+		cancelJobs()
+		<-drained
+	}
+}
+
+func (w *Worker) loop(ctx, jobCtx context.Context) {
+	for ctx.Err() == nil {
+		worked, err := w.work(ctx, jobCtx)
+		if err != nil && ctx.Err() == nil {
+			zerolog.Ctx(ctx).Err(err).Msg("job queue failed")
+		}
+		if worked && err == nil {
+			continue
+		}
+		t := time.NewTimer(w.opts.PollInterval)
+		select {
+		case <-ctx.Done():
+		case <-w.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// work claims a job and runs it in jobCtx. It reports whether there was a
+// job to run.
+func (w *Worker) work(ctx, jobCtx context.Context) (bool, error) {
+	if len(w.handlers) == 0 {
+		return false, nil
+	}
+	job, err := w.claim(ctx)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	logger := zerolog.Ctx(jobCtx).With().
+		Str("job_id", job.ID.String()).
+		Str("kind", job.Kind).
+		Int("attempt", job.Attempts).
+		Logger()
+	runErr := errLeaseExpired
+	if job.Attempts <= job.MaxAttempts {
+		runErr = w.run(logger.WithContext(jobCtx), job)
+	}
+	if err := w.finish(logger.WithContext(context.Background()), job, runErr); err != nil {
+		return true, err
+	}
+	switch {
+	case runErr == nil:
+		logger.Debug().Msg("job done")
+	case job.State == models.JobDead:
+		logger.Error().Err(runErr).Msg("job failed for the last time")
+	default:
+		logger.Warn().Err(runErr).Time("retry_at", job.RunAt).Msg("job failed")
+	}
+	return true, nil
+}
+
+// claim takes the next ready job, or one whose worker's lease expired, for
+// this worker. It returns nil without one.
+func (w *Worker) claim(ctx context.Context) (*models.Job, error) {
+	kinds := make([]string, 0, len(w.handlers))
+	for kind := range w.handlers {
+		kinds = append(kinds, kind)
+	}
+	token, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := w.now()
+
+	var job models.Job
+	res := w.db.WithContext(ctx).Raw(`
+UPDATE jobs SET state = ?, attempts = attempts + 1, locked_by = ?, locked_until = ?, updated_at = ?
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE kind IN ? AND (state = ? AND run_at <= ? OR state = ? AND locked_until < ?)
+	ORDER BY priority DESC, run_at
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING *`,
+		models.JobRunning, token, now.Add(w.opts.Timeout+leaseMargin), now,
+		kinds, models.JobPending, now, models.JobRunning, now,
+	).Scan(&job)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// run decodes the payload of job and calls its handler.
+func (w *Worker) run(ctx context.Context, job *models.Job) (err error) {
+	h := w.handlers[job.Kind]
+	ctx, cancel := context.WithTimeout(ctx, w.opts.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	v := reflect.New(h.typ)
+	if err := roundTrip(job.Payload, v.Interface()); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+	if !h.ptr {
+		v = v.Elem()
+	}
+	return h.fn(ctx, v.Interface().(Job))
+}
+
+// finish deletes a job that succeeded, or schedules a retry of one that
+// failed, or kills it. Nothing changes if another worker claimed the job
+// since.
+func (w *Worker) finish(ctx context.Context, job *models.Job, runErr error) error {
+	q := w.db.WithContext(ctx).Model(job).Where("locked_by = ?", job.LockedBy)
+	if runErr == nil {
+		return q.Delete(job).Error
+	}
+	now := w.now()
+	job.LastError = runErr.Error()
+	job.LockedBy, job.LockedUntil = nil, nil
+	if job.Attempts >= job.MaxAttempts {
+		job.State, job.DiedAt = models.JobDead, &now
+	} else {
+		job.State, job.RunAt = models.JobPending, now.Add(backoff(job.Attempts))
+	}
+	return q.Select("state", "run_at", "last_error", "locked_by", "locked_until", "died_at", "updated_at").Updates(job).Error
+}
+
+// backoff is a random wait before retrying after the given attempt,
+// doubling from minBackoff up to maxBackoff.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 20 {
+		if b := minBackoff << uint(attempt-1); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,219 @@
+// Package mailer sends transactional email through a pluggable Mailer.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a rendered email.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// encode renders msg as a multipart/alternative MIME message.
+func encode(msg Message, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", msg.From)
+	header.Set("To", strings.Join(msg.To, ", "))
+	header.Set("Subject", mimeEncodeHeader(msg.Subject))
+	header.Set("Date", now.Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	if id, err := messageID(msg.From); err == nil {
+		header.Set("Message-ID", id)
+	}
+	for key, vals := range header {
+		for _, val := range vals {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, val)
+		}
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := io.WriteString(qw, part.body); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func mimeEncodeHeader(s string) string {
+	for _, r := range s {
+		if r > 127 {
+			return "=?utf-8?q?" + strings.ReplaceAll(qEncode(s), " ", "_") + "?="
+		}
+	}
+	return s
+}
+
+func qEncode(s string) string {
+	var buf bytes.Buffer
+	qw := quotedprintable.NewWriter(&buf)
+	io.WriteString(qw, s)
+	qw.Close()
+	return strings.ReplaceAll(buf.String(), "=\r\n", "")
+}
+
+func messageID(from string) (string, error) {
+	domain := "whimsy.local"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+// SMTPMailer delivers through an SMTP relay using STARTTLS and PLAIN auth.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	b, err := encode(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+
+	var a smtp.Auth
+	if m.Username != "" {
+		a = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	// net/smtp has no context support, so honour cancellation before sending.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", m.Host, m.Port), a, from.Address, msg.To, b)
+}
+
+// LogMailer is for local development. It writes each message to Dir as an
+// .eml file, or to Out when Dir is empty. Messages aren't redacted, so the
+// tokens in them are readable by anyone with the logs.
+type LogMailer struct {
+	Dir  string
+	Out  io.Writer
+	From string
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	now := time.Now()
+	b, err := encode(msg, now)
+	if err != nil {
+		return err
+	}
+	if m.Dir == "" {
+		out := m.Out
+		if out == nil {
+			out = os.Stdout
+		}
+		_, err := fmt.Fprintf(out, "----- mail to %s -----\n%s\n%s\n", strings.Join(msg.To, ", "), msg.Subject, msg.Text)
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000000000"), sanitizeFilename(msg.To))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), b, 0o644)
+}
+
+func sanitizeFilename(to []string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.Join(to, "_"))
+}
+
+// MemoryMailer captures messages in memory for tests.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(_ context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of the captured messages.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset forgets captured messages.
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
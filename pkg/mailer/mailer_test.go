@@ -0,0 +1,88 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+func TestMatchLocale(t *testing.T) {
+	tests := []struct {
+		header string
+		want   language.Tag
+	}{
+		{"", language.English},
+		{"es-MX,es;q=0.9,en;q=0.8", language.Spanish},
+		{"fr-FR,en;q=0.5", language.English},
+		{"de", language.English},
+	}
+	for _, tt := range tests {
+		if got := MatchLocale(tt.header); got != tt.want {
+			t.Errorf("MatchLocale(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := LinkData{Name: "Ada <admin>", Link: "https://app.test/reset-password?token=abc", ExpiresInHours: 1}
+
+	msg, err := Render(language.Spanish, "reset_password", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Restablece tu contraseña de Whimsy" {
+		t.Errorf("unexpected subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.Text, data.Link) || !strings.Contains(msg.Text, "1 hora.") {
+		t.Errorf("unexpected text %q", msg.Text)
+	}
+	if strings.Contains(msg.HTML, "<admin>") {
+		t.Errorf("html body is not escaped: %q", msg.HTML)
+	}
+
+	msg, err = Render(language.English, "verify_email", LinkData{Link: "x", ExpiresInHours: 48})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "48 hours") {
+		t.Errorf("unexpected text %q", msg.Text)
+	}
+
+	if _, err := Render(language.English, "missing", data); err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	var out bytes.Buffer
+	m := &LogMailer{Out: &out, From: "Whimsy <no-reply@whimsy.test>"}
+	if err := m.Send(context.Background(), Message{To: []string{"a@whimsy.test"}, Subject: "Hello", Text: "Body"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "a@whimsy.test") || !strings.Contains(s, "Body") {
+		t.Errorf("unexpected output %q", s)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	b, err := encode(Message{
+		From:    "Whimsy <no-reply@whimsy.test>",
+		To:      []string{"a@whimsy.test"},
+		Subject: "Contraseña",
+		Text:    "plain",
+		HTML:    "<p>html</p>",
+	}, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, want := range []string{"Subject: =?utf-8?q?", "multipart/alternative", "text/plain", "text/html", "Message-Id: <"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("encoded message is missing %q:\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+// Templates live in templates/<locale>/<name>.txt, defining the "subject" and
+// "text" blocks, and templates/<locale>/<name>.html defining "html".
+//go:embed templates
+var templateFS embed.FS
+
+type localeTemplates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+var (
+	// DefaultLocale is used when no requested locale is available.
+	DefaultLocale = language.English
+
+	locales   = map[language.Tag]*localeTemplates{}
+	matcher   language.Matcher
+	supported []language.Tag
+)
+
+func init() {
+	if err := loadTemplates(templateFS); err != nil {
+		panic(err)
+	}
+}
+
+func loadTemplates(fsys fs.FS) error {
+	dirs, err := fs.ReadDir(fsys, "templates")
+	if err != nil {
+		return err
+	}
+	// The default locale goes first, the matcher falls back to it.
+	supported = []language.Tag{DefaultLocale}
+	for _, dir := range dirs {
+		tag, err := language.Parse(dir.Name())
+		if err != nil {
+			return fmt.Errorf("invalid template locale %s: %w", dir.Name(), err)
+		}
+		lt := &localeTemplates{
+			text: map[string]*texttemplate.Template{},
+			html: map[string]*htmltemplate.Template{},
+		}
+		files, err := fs.ReadDir(fsys, path.Join("templates", dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			p := path.Join("templates", dir.Name(), f.Name())
+			name := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
+			switch path.Ext(f.Name()) {
+			case ".txt":
+				if lt.text[name], err = texttemplate.ParseFS(fsys, p); err != nil {
+					return err
+				}
+			case ".html":
+				if lt.html[name], err = htmltemplate.ParseFS(fsys, p); err != nil {
+					return err
+				}
+			}
+		}
+		locales[tag] = lt
+		if tag != DefaultLocale {
+			supported = append(supported, tag)
+		}
+	}
+	if _, ok := locales[DefaultLocale]; !ok {
+		return fmt.Errorf("missing templates for default locale %s", DefaultLocale)
+	}
+	matcher = language.NewMatcher(supported)
+	return nil
+}
+
+// LinkData is the template data of emails built around a single link.
+type LinkData struct {
+	Name           string
+	Link           string
+	ExpiresInHours int
+}
+
+// MatchLocale picks the best template locale for an Accept-Language header.
+func MatchLocale(acceptLanguage string) language.Tag {
+	tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	_, i, _ := matcher.Match(tags...)
+	return supported[i]
+}
+
+// Render builds the message called name in the locale closest to tag.
+func Render(tag language.Tag, name string, data interface{}) (Message, error) {
+	_, i, _ := matcher.Match(tag)
+	lt := locales[supported[i]]
+	text, ok := lt.text[name]
+	if !ok {
+		if lt = locales[DefaultLocale]; lt.text[name] == nil {
+			return Message{}, fmt.Errorf("unknown mail template %s", name)
+		}
+		text = lt.text[name]
+	}
+
+	var msg Message
+	var buf bytes.Buffer
+	if err := text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := text.ExecuteTemplate(&buf, "text", data); err != nil {
+		return msg, err
+	}
+	msg.Text = strings.TrimSpace(buf.String()) + "\n"
+
+	if html, ok := lt.html[name]; ok {
+		buf.Reset()
+		if err := html.ExecuteTemplate(&buf, "html", data); err != nil {
+			return msg, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                         "",
+		"gzip":                     "gzip",
+		"gzip, deflate, br":        "br",
+		"gzip;q=1.0, br;q=0.5":     "gzip",
+		"zstd, gzip":               "zstd",
+		"*":                        "br",
+		"br;q=0, *;q=0.1":          "zstd",
+		"identity":                 "",
+		"deflate, gzip;q=0":        "",
+		"GZIP;q=0.8, identity;q=1": "gzip",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("%q: got %q want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := `{"data":"` + strings.Repeat("whimsy", 500) + `"}`
+	handler := Compress(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"abc"`)
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		r := httptest.NewRequest("GET", "/?body="+large, nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("%s: got content encoding %q", encoding, got)
+		}
+		if got := w.Header().Get("ETag"); got != `W/"abc"` {
+			t.Errorf("%s: etag not weakened: %s", encoding, got)
+		}
+		zr, err := decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != large {
+			t.Errorf("%s: body mismatch", encoding)
+		}
+	}
+
+	// Below the threshold the body is sent as is.
+	r := httptest.NewRequest("GET", "/?body=small", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("small body compressed with %s", got)
+	}
+	if w.Body.String() != "small" {
+		t.Errorf("invalid body %q", w.Body.String())
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("invalid vary %q", got)
+	}
+}
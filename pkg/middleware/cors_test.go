@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newCORSRouter(t *testing.T) *mux.Router {
+	cors, err := NewCORS(CORSOptions{
+		AllowedOrigins:   []string{"https://app.whimsy.com", "https://*.whimsy.dev"},
+		ExposedHeaders:   []string{"X-WHIMSY-REQUEST-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Use(DefaultSecurityHeaders().Middleware)
+	router.Use(cors.Middleware)
+	router.Methods(http.MethodOptions).HandlerFunc(PreflightHandler)
+	router.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.Handle("/docs", OverrideHeaders(map[string]string{
+		"Content-Security-Policy": "default-src 'self'",
+		"X-Frame-Options":         "",
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).Methods("GET")
+	return router
+}
+
+func TestCORSOrigins(t *testing.T) {
+	router := newCORSRouter(t)
+	for origin, want := range map[string]string{
+		"https://app.whimsy.com":       "https://app.whimsy.com",
+		"https://pr-12.whimsy.dev":     "https://pr-12.whimsy.dev",
+		"https://a.b.whimsy.dev":       "https://a.b.whimsy.dev",
+		"https://whimsy.dev":           "",
+		"http://pr-12.whimsy.dev":      "",
+		"https://evil.com/.whimsy.dev": "",
+		"https://app.whimsy.com.evil":  "",
+	} {
+		r := httptest.NewRequest("GET", "/users", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %s: got %q want %q", origin, got, want)
+		}
+		if want != "" && w.Header().Get("Access-Control-Expose-Headers") != "X-WHIMSY-REQUEST-ID" {
+			t.Errorf("origin %s: missing exposed headers", origin)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	router := newCORSRouter(t)
+
+	r := httptest.NewRequest("OPTIONS", "/users", nil)
+	r.Header.Set("Origin", "https://pr-12.whimsy.dev")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	r.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d", w.Code)
+	}
+	h := w.Header()
+	if got := h.Get("Access-Control-Allow-Origin"); got != "https://pr-12.whimsy.dev" {
+		t.Errorf("invalid allow origin: %s", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("invalid allow credentials: %s", got)
+	}
+	if got := h.Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("invalid max age: %s", got)
+	}
+	if got := h.Get("Access-Control-Allow-Headers"); got != "authorization, content-type" {
+		t.Errorf("invalid allow headers: %s", got)
+	}
+
+	r.Header.Set("Access-Control-Request-Headers", "X-Not-Allowed")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed header was allowed: %s", got)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	if _, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err != ErrCredentialedWildcard {
+		t.Errorf("credentials for every origin: got %v", err)
+	}
+	cors, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://evil.test")
+	w := httptest.NewRecorder()
+	cors.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected the anonymous wildcard, got %q", got)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	router := newCORSRouter(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+	h := w.Header()
+	if got := h.Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("invalid hsts: %s", got)
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("invalid content type options: %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	h = w.Header()
+	if got := h.Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("csp not overridden: %s", got)
+	}
+	if _, ok := h["X-Frame-Options"]; ok {
+		t.Errorf("frame options not removed")
+	}
+}
@@ -1,23 +1,47 @@
 package migrate
 
 import (
+	"context"
 	"fmt"
-	//"whimsy/pkg/models"
+	"time"
+
+	"whimsy/pkg/audit"
+	"whimsy/pkg/authz"
+	_ "whimsy/pkg/models" // registers the core models
+	"whimsy/pkg/models/registry"
 
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
+// AuditPartitionsAhead is how many months of audit_events partitions exist
+// beyond the current one. Migrate runs on every start and the scheduler
+// daily, so this only needs to cover the longest time between either.
+const AuditPartitionsAhead = 3
+
+// Migrate auto-migrates every model added with registry.Register, runs the
+// SQL added with registry.RegisterMigration, then creates upcoming audit
+// partitions and seeds the default roles.
 func Migrate(db *gorm.DB) error {
-	for i, v := range []interface{}{
-		// add in all models below:
-		// e.g.
-		//&models.User{},
-	} {
+	for i, v := range registry.Models() {
 		if err := db.AutoMigrate(v); err != nil {
 			log.Err(err).Int("step", i).Str("type", fmt.Sprintf("%T", v)).Msg("migration failed")
 			return err
 		}
 	}
+	for _, m := range registry.Migrations() {
+		if err := db.Exec(m.SQL).Error; err != nil {
+			log.Err(err).Str("migration", m.Name).Msg("migration failed")
+			return err
+		}
+	}
+	if err := audit.EnsurePartitions(context.Background(), db, time.Now(), AuditPartitionsAhead); err != nil {
+		log.Err(err).Msg("creating audit partitions failed")
+		return err
+	}
+	if err := authz.EnsureRoles(context.Background(), db, authz.DefaultRoles...); err != nil {
+		log.Err(err).Msg("seeding roles failed")
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"whimsy/pkg/models/registry"
+)
+
+// ApiKey is a credential for server to server clients. The key is
+// "<prefix>.<secret>", the prefix is stored to find the key and shown in
+// listings, the secret only as a hash.
+// swagger:model ApiKey
+type ApiKey struct {
+	Base
+
+	Name       string `gorm:"not null" json:"name"`
+	Prefix     string `gorm:"uniqueIndex;not null" json:"prefix"`
+	SecretHash string `gorm:"not null" json:"-"`
+	// Scopes are space separated permissions, matched like role permissions.
+	Scopes         string     `gorm:"not null;default:''" json:"scopes"`
+	RateLimitClass string     `gorm:"not null;default:'standard'" json:"rateLimitClass"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt     *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt      *time.Time `json:"revokedAt,omitempty"`
+}
+
+func init() {
+	registry.Register(&ApiKey{})
+}
+
+// ScopeList returns the scopes as a slice.
+func (k *ApiKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Active reports whether the key can still authenticate requests.
+func (k *ApiKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// AuditEvent records a security relevant action, written by audit.Record.
+// Events form a hash chain in Seq order: each Hash covers the event and the
+// previous event's hash, so edits and deletions are detectable. The table is
+// partitioned by month of CreatedAt and created by the migration below,
+// not AutoMigrate.
+// swagger:model AuditEvent
+type AuditEvent struct {
+	Seq       int64     `gorm:"primaryKey;autoIncrement:false" json:"seq"`
+	CreatedAt time.Time `gorm:"primaryKey" json:"createdAt"`
+	ID        uuid.UUID `gorm:"type:uuid" json:"id"`
+
+	// ActorID is the user who acted, nil for anonymous requests, API keys
+	// and the system.
+	ActorID *uuid.UUID `gorm:"type:uuid" json:"actorId,omitempty"`
+	// ImpersonatorID is the admin acting as ActorID, if any.
+	ImpersonatorID *uuid.UUID `gorm:"type:uuid" json:"impersonatorId,omitempty"`
+	Action         string     `json:"action"`
+	TargetType     string     `json:"targetType"`
+	TargetID       string     `json:"targetId"`
+	RequestID      string     `json:"requestId,omitempty"`
+	IPAddress      string     `json:"ipAddress,omitempty"`
+	// Changes maps each changed field to its {"from", "to"} values.
+	Changes JSONMap `json:"changes"`
+	// Metadata holds action specific details.
+	Metadata JSONMap `json:"metadata"`
+
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+func init() {
+	registry.RegisterTable("audit_events")
+	registry.RegisterMigration("audit_events", `
+CREATE TABLE IF NOT EXISTS audit_events (
+	seq bigint NOT NULL,
+	created_at timestamptz NOT NULL,
+	id uuid NOT NULL,
+	actor_id uuid,
+	impersonator_id uuid,
+	action text NOT NULL,
+	target_type text NOT NULL,
+	target_id text NOT NULL,
+	request_id text NOT NULL DEFAULT '',
+	ip_address text NOT NULL DEFAULT '',
+	changes jsonb NOT NULL DEFAULT '{}',
+	metadata jsonb NOT NULL DEFAULT '{}',
+	prev_hash text NOT NULL,
+	hash text NOT NULL,
+	PRIMARY KEY (seq, created_at)
+) PARTITION BY RANGE (created_at);
+-- Catches events outside the monthly partitions audit.EnsurePartitions
+-- creates ahead of time.
+CREATE TABLE IF NOT EXISTS audit_events_default PARTITION OF audit_events DEFAULT;
+CREATE INDEX IF NOT EXISTS idx_audit_events_seq ON audit_events (seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events (target_type, target_id);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+-- AFTER, as BEFORE row triggers on partitioned tables need Postgres 13.
+CREATE TRIGGER audit_events_append_only AFTER UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+`)
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"whimsy/pkg/constants"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+// Base is embedded in every persisted model. IDs are random UUIDv4s assigned
+// on create, and CreatedBy/UpdatedBy are filled from the user in the
+// statement context, see db.WithContext.
+type Base struct {
+	ID        uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	CreatedBy *uuid.UUID     `gorm:"type:uuid" json:"createdBy,omitempty"`
+	UpdatedBy *uuid.UUID     `gorm:"type:uuid" json:"updatedBy,omitempty"`
+}
+
+func (Base) audited() {}
+
+type auditedModel interface {
+	audited()
+}
+
+// actorFromContext returns the authenticated user ID, if any.
+func actorFromContext(ctx context.Context) *uuid.UUID {
+	if ctx == nil {
+		return nil
+	}
+	id, err := uuid.FromString(utils.GetStringValueFromContext(constants.UserIDKey, ctx))
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+func isAudited(stmt *gorm.Statement) bool {
+	if stmt.Schema == nil {
+		return false
+	}
+	_, ok := reflect.New(stmt.Schema.ModelType).Interface().(auditedModel)
+	return ok
+}
+
+// eachModel calls fn for every struct value a statement writes.
+func eachModel(stmt *gorm.Statement, fn func(reflect.Value)) {
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			fn(reflect.Indirect(stmt.ReflectValue.Index(i)))
+		}
+	case reflect.Struct:
+		fn(stmt.ReflectValue)
+	}
+}
+
+func baseBeforeCreate(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || !isAudited(stmt) {
+		return
+	}
+	idField := stmt.Schema.LookUpField("id")
+	createdBy := stmt.Schema.LookUpField("created_by")
+	updatedBy := stmt.Schema.LookUpField("updated_by")
+	actor := actorFromContext(stmt.Context)
+
+	eachModel(stmt, func(rv reflect.Value) {
+		if _, zero := idField.ValueOf(stmt.Context, rv); zero {
+			id, err := uuid.NewV4()
+			if err != nil {
+				db.AddError(err)
+				return
+			}
+			db.AddError(idField.Set(stmt.Context, rv, id))
+		}
+		if actor != nil {
+			if _, zero := createdBy.ValueOf(stmt.Context, rv); zero {
+				db.AddError(createdBy.Set(stmt.Context, rv, actor))
+			}
+			db.AddError(updatedBy.Set(stmt.Context, rv, actor))
+		}
+	})
+}
+
+func baseBeforeUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	// Like UpdatedAt, UpdatedBy is left alone by UpdateColumn(s).
+	if db.Error != nil || stmt.SkipHooks || !isAudited(stmt) {
+		return
+	}
+	if actor := actorFromContext(stmt.Context); actor != nil {
+		stmt.SetColumn("updated_by", actor, true)
+	}
+}
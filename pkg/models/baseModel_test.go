@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"whimsy/pkg/models/registry"
 	"whimsy/pkg/testutils"
 
 	"gorm.io/gorm"
@@ -14,11 +15,11 @@ var db *gorm.DB
 
 func TestMain(m *testing.M) {
 	db = testutils.ConnectDb("models")
+	if err := db.Use(Plugin{}); err != nil {
+		log.Fatal(err)
+	}
 
-	err := db.AutoMigrate(
-		// add in all models here, e.g.
-		// &User{},
-	)
+	err := db.AutoMigrate(registry.Models()...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"whimsy/pkg/constants"
+
+	"github.com/gofrs/uuid"
+)
+
+type auditedWidget struct {
+	Base
+	Name string
+}
+
+func TestBase(t *testing.T) {
+	if err := db.AutoMigrate(&auditedWidget{}); err != nil {
+		t.Fatal(err)
+	}
+
+	creator, updater := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	ctx := context.WithValue(context.Background(), constants.UserIDKey, creator.String())
+
+	w := auditedWidget{Name: "duck"}
+	if err := db.WithContext(ctx).Create(&w).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w.ID == uuid.Nil || w.ID.Version() != uuid.V4 {
+		t.Errorf("invalid id %s", w.ID)
+	}
+	if w.CreatedBy == nil || *w.CreatedBy != creator {
+		t.Errorf("invalid created by %v", w.CreatedBy)
+	}
+
+	ctx = context.WithValue(context.Background(), constants.UserIDKey, updater.String())
+	if err := db.WithContext(ctx).Model(&w).Updates(map[string]interface{}{"name": "goose"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var got auditedWidget
+	if err := db.First(&got, "id = ?", w.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if *got.CreatedBy != creator || got.UpdatedBy == nil || *got.UpdatedBy != updater {
+		t.Errorf("invalid audit fields %v %v", got.CreatedBy, got.UpdatedBy)
+	}
+
+	if err := db.Delete(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&auditedWidget{}, "id = ?", w.ID).Error; err == nil {
+		t.Error("soft deleted row was found")
+	}
+	if err := db.Unscoped().First(&auditedWidget{}, "id = ?", w.ID).Error; err != nil {
+		t.Errorf("soft deleted row was removed: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// JobState is where a Job is in its life. Jobs that succeed are deleted.
+type JobState string
+
+const (
+	// JobPending jobs run once RunAt has passed.
+	JobPending JobState = "pending"
+	// JobRunning jobs are claimed by a worker until LockedUntil, after
+	// which another worker may claim them again.
+	JobRunning JobState = "running"
+	// JobDead jobs failed MaxAttempts times and are kept for inspection.
+	JobDead JobState = "dead"
+)
+
+// Job is a unit of background work, queued with jobs.Enqueue and run by
+// jobs.Worker. Higher priorities run first, then older RunAts.
+type Job struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Kind     string    `gorm:"not null" json:"kind"`
+	Payload  JSONMap   `json:"payload"`
+	State    JobState  `gorm:"not null;default:'pending'" json:"state"`
+	Priority int       `gorm:"not null;default:0" json:"priority"`
+	RunAt    time.Time `gorm:"not null" json:"runAt"`
+	// UniqueKey, if set, is unique among pending and running jobs.
+	UniqueKey   *string `json:"uniqueKey,omitempty"`
+	Attempts    int     `gorm:"not null;default:0" json:"attempts"`
+	MaxAttempts int     `gorm:"not null" json:"maxAttempts"`
+	LastError   string  `gorm:"not null;default:''" json:"lastError,omitempty"`
+
+	// LockedBy identifies the claim of the worker running the job.
+	LockedBy    *uuid.UUID `gorm:"type:uuid" json:"-"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+	DiedAt      *time.Time `json:"diedAt,omitempty"`
+}
+
+func init() {
+	registry.Register(&Job{})
+	registry.RegisterMigration("jobs", `
+CREATE INDEX IF NOT EXISTS idx_jobs_claim ON jobs (priority DESC, run_at) WHERE state = 'pending';
+CREATE INDEX IF NOT EXISTS idx_jobs_locked_until ON jobs (locked_until) WHERE state = 'running';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_unique_key ON jobs (unique_key) WHERE state IN ('pending', 'running');
+`)
+}
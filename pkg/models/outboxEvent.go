@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// OutboxEvent is a domain event written by outbox.Publish in the transaction
+// of the change it describes, and delivered by outbox.Relay. Events of an
+// aggregate are delivered in ID order.
+// swagger:model OutboxEvent
+type OutboxEvent struct {
+	ID            int64     `gorm:"primaryKey" json:"id"`
+	CreatedAt     time.Time `json:"createdAt"`
+	AggregateType string    `gorm:"not null" json:"aggregateType"`
+	AggregateID   string    `gorm:"not null" json:"aggregateId"`
+	Type          string    `gorm:"not null" json:"type"`
+	Payload       JSONMap   `json:"payload"`
+	// TenantID is the account the event belongs to, whose webhooks receive it.
+	TenantID *uuid.UUID `gorm:"type:uuid" json:"tenantId,omitempty"`
+
+	Attempts      int        `gorm:"not null;default:0" json:"-"`
+	LastError     string     `gorm:"not null;default:''" json:"-"`
+	NextAttemptAt time.Time  `gorm:"not null" json:"-"`
+	DeliveredAt   *time.Time `json:"-"`
+}
+
+func init() {
+	registry.Register(&OutboxEvent{})
+	registry.RegisterMigration("outbox_events", `
+CREATE INDEX IF NOT EXISTS idx_outbox_events_pending ON outbox_events (aggregate_type, aggregate_id, id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_events_delivered_at ON outbox_events (delivered_at) WHERE delivered_at IS NOT NULL;
+`)
+}
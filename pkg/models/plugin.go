@@ -0,0 +1,27 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Plugin registers the gorm callbacks models rely on. Register it once per
+// connection with db.Use(models.Plugin{}).
+type Plugin struct{}
+
+func (Plugin) Name() string { return "whimsy:models" }
+
+func (Plugin) Initialize(db *gorm.DB) error {
+	create := db.Callback().Create()
+	if err := create.Before("gorm:create").Register("whimsy:base_before_create", baseBeforeCreate); err != nil {
+		return err
+	}
+
+	update := db.Callback().Update()
+	if err := update.Before("gorm:update").Register("whimsy:base_before_update", baseBeforeUpdate); err != nil {
+		return err
+	}
+	if err := update.Before("gorm:update").Register("whimsy:version_before_update", versionBeforeUpdate); err != nil {
+		return err
+	}
+	return update.After("gorm:update").Register("whimsy:version_after_update", versionAfterUpdate)
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// RecoveryCode is a one time second factor for users who lost their
+// authenticator. Only the hash of the code is stored.
+type RecoveryCode struct {
+	Base
+
+	UserID   uuid.UUID `gorm:"type:uuid;not null;index"`
+	User     *User     `gorm:"constraint:OnDelete:CASCADE"`
+	CodeHash string    `gorm:"uniqueIndex;not null"`
+	UsedAt   *time.Time
+}
+
+func init() {
+	registry.Register(&RecoveryCode{})
+}
@@ -0,0 +1,68 @@
+// Package registry holds the list of persisted models. It has no
+// dependencies so that both migrate and testutils can read it without import
+// cycles through the packages that define the models.
+package registry
+
+import "sync"
+
+var (
+	mu     sync.Mutex
+	models []interface{}
+)
+
+// Register adds models to be migrated by migrate.Migrate and truncated by
+// testutils.ResetDb. Call it from the init function of the defining package.
+func Register(m ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	models = append(models, m...)
+}
+
+// Models returns the registered models in registration order.
+func Models() []interface{} {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]interface{}(nil), models...)
+}
+
+// Migration is raw SQL for what AutoMigrate can't express, such as triggers.
+// migrate.Migrate runs every migration on each run, after the models, so the
+// SQL must be idempotent.
+type Migration struct {
+	Name string
+	SQL  string
+}
+
+var migrations []Migration
+
+// RegisterMigration adds SQL to run after the models are migrated. Call it
+// from the init function of the package defining the tables it touches.
+func RegisterMigration(name, sql string) {
+	mu.Lock()
+	defer mu.Unlock()
+	migrations = append(migrations, Migration{Name: name, SQL: sql})
+}
+
+// Migrations returns the registered migrations in registration order.
+func Migrations() []Migration {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Migration(nil), migrations...)
+}
+
+var tables []string
+
+// RegisterTable adds tables created by migrations rather than models, so
+// testutils.ResetDb truncates them too.
+func RegisterTable(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	tables = append(tables, names...)
+}
+
+// Tables returns the tables added with RegisterTable.
+func Tables() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string(nil), tables...)
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// Permission is a named action such as "users:write". Role permissions may
+// use wildcards, "users:*" or "*", see authz.
+// swagger:model Permission
+type Permission struct {
+	Base
+
+	Name        string `gorm:"uniqueIndex;not null" json:"name"`
+	Description string `json:"description"`
+}
+
+// Role groups permissions under a name users are bound to.
+// swagger:model Role
+type Role struct {
+	Base
+
+	Name        string       `gorm:"uniqueIndex;not null" json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions,omitempty"`
+}
+
+// RoleBinding grants a role to a user, on every resource when Resource is
+// empty or on the resources it matches, e.g. "users/<id>" or "users/*".
+// swagger:model RoleBinding
+type RoleBinding struct {
+	Base
+
+	UserID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_role_bindings_grant" json:"userId"`
+	User     *User     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	RoleID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_role_bindings_grant" json:"roleId"`
+	Role     *Role     `gorm:"constraint:OnDelete:CASCADE" json:"role,omitempty"`
+	Resource string    `gorm:"not null;default:'';uniqueIndex:idx_role_bindings_grant" json:"resource"`
+}
+
+func init() {
+	registry.Register(&Permission{}, &Role{}, &RoleBinding{})
+}
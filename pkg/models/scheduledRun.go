@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+)
+
+// RunStatus is the outcome of a ScheduledRun.
+type RunStatus string
+
+const (
+	RunRunning   RunStatus = "running"
+	RunSucceeded RunStatus = "succeeded"
+	RunFailed    RunStatus = "failed"
+	RunTimedOut  RunStatus = "timed_out"
+	// RunAbandoned runs were interrupted by the scheduler stopping or
+	// losing leadership.
+	RunAbandoned RunStatus = "abandoned"
+)
+
+// ScheduledRun records a run of a scheduler task. A task runs at most once
+// per ScheduledAt.
+// swagger:model ScheduledRun
+type ScheduledRun struct {
+	ID          int64      `gorm:"primaryKey" json:"id"`
+	Task        string     `gorm:"not null;uniqueIndex:idx_scheduled_runs_task_at" json:"task"`
+	ScheduledAt time.Time  `gorm:"not null;uniqueIndex:idx_scheduled_runs_task_at" json:"scheduledAt"`
+	StartedAt   time.Time  `gorm:"not null;index" json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Status      RunStatus  `gorm:"not null;index" json:"status"`
+	Error       string     `gorm:"not null;default:''" json:"error,omitempty"`
+	// Node is the host and process that ran the task.
+	Node string `gorm:"not null" json:"node"`
+}
+
+func init() {
+	registry.Register(&ScheduledRun{})
+}
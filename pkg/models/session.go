@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// Session is a server side login. Clients hold an opaque token, of which only
+// the hash is stored, so a session can be revoked at any time.
+// swagger:model Session
+type Session struct {
+	Base
+
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	User      *User     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	TokenHash string    `gorm:"uniqueIndex;not null" json:"-"`
+	// ExpiresAt slides forward while the session is in use.
+	ExpiresAt  time.Time  `gorm:"not null" json:"expiresAt"`
+	LastSeenAt time.Time  `gorm:"not null" json:"lastSeenAt"`
+	RevokedAt  *time.Time `json:"-"`
+	// ImpersonatorID is the admin who started the session to act as the
+	// user. Impersonation sessions don't slide.
+	ImpersonatorID *uuid.UUID `gorm:"type:uuid" json:"impersonatorId,omitempty"`
+
+	DeviceOS  string `json:"deviceOS"`
+	UserAgent string `json:"userAgent"`
+	IPAddress string `json:"ipAddress"`
+}
+
+func init() {
+	registry.Register(&Session{})
+}
+
+// Active reports whether the session can still authenticate requests.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
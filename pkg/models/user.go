@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+)
+
+// User is an account that signs in with an email and password.
+// swagger:model User
+type User struct {
+	Base
+	Versioned
+
+	Email     string `gorm:"uniqueIndex;not null" json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+
+	PasswordHash        string     `gorm:"not null" json:"-"`
+	FailedLoginAttempts int        `gorm:"not null;default:0" json:"-"`
+	LockedUntil         *time.Time `json:"-"`
+	LastLoginAt         *time.Time `json:"lastLoginAt,omitempty"`
+	EmailVerifiedAt     *time.Time `json:"emailVerifiedAt,omitempty"`
+
+	// TOTPSecret is encrypted with utils.Encrypter. It is set on enrollment
+	// but only enforced once TOTPEnabledAt is set.
+	TOTPSecret    string     `gorm:"column:totp_secret" json:"-"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at" json:"totpEnabledAt,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code, so it can't be
+	// replayed.
+	TOTPLastStep int64 `gorm:"column:totp_last_step;not null;default:0" json:"-"`
+}
+
+func init() {
+	registry.Register(&User{})
+}
+
+// IsLocked reports whether logins are refused after repeated failures.
+func (u *User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// MFAEnabled reports whether logins need a second factor.
+func (u *User) MFAEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
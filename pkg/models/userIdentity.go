@@ -0,0 +1,27 @@
+package models
+
+import (
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// UserIdentity links a user to an account at an OpenID Connect provider, so
+// they can sign in with it.
+// swagger:model UserIdentity
+type UserIdentity struct {
+	Base
+
+	UserID   uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	User     *User     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Provider string    `gorm:"not null;uniqueIndex:idx_user_identities_subject" json:"provider"`
+	// Subject is the provider's stable ID for the account, the sub claim.
+	Subject string `gorm:"not null;uniqueIndex:idx_user_identities_subject" json:"-"`
+	// Email is the address the provider asserted when the identity was
+	// linked, for display only.
+	Email string `json:"email"`
+}
+
+func init() {
+	registry.Register(&UserIdentity{})
+}
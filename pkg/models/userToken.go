@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// TokenPurpose scopes a UserToken to a single flow.
+type TokenPurpose string
+
+const (
+	TokenPurposeVerifyEmail   TokenPurpose = "verify_email"
+	TokenPurposeResetPassword TokenPurpose = "reset_password"
+)
+
+// UserToken is a single use, expiring token mailed to a user. Only the hash of
+// the token is stored.
+type UserToken struct {
+	Base
+
+	UserID    uuid.UUID    `gorm:"type:uuid;not null;index"`
+	User      *User        `gorm:"constraint:OnDelete:CASCADE"`
+	Purpose   TokenPurpose `gorm:"not null"`
+	TokenHash string       `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time    `gorm:"not null"`
+	UsedAt    *time.Time
+}
+
+func init() {
+	registry.Register(&UserToken{})
+}
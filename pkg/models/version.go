@@ -0,0 +1,103 @@
+package models
+
+import (
+	goerrors "errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Versioned adds an optimistic concurrency version to a model. With Plugin
+// registered, every update of a loaded model is conditional on the version it
+// was loaded with, and increments it.
+type Versioned struct {
+	Version int `gorm:"not null;default:1" json:"version"`
+}
+
+func (Versioned) versioned() {}
+
+type versionedModel interface {
+	versioned()
+}
+
+// ErrVersionConflict matches any *VersionConflictError with errors.Is.
+var ErrVersionConflict = goerrors.New("version conflict")
+
+// VersionConflictError is returned when an update matched no row at the
+// expected version, because another writer updated or deleted it first.
+type VersionConflictError struct {
+	Table   string
+	Version int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s: version %d is no longer current", e.Table, e.Version)
+}
+
+func (e *VersionConflictError) Is(target error) bool { return target == ErrVersionConflict }
+
+const (
+	versionCheckKey     = "whimsy:version_check"
+	skipVersionCheckKey = "whimsy:skip_version_check"
+)
+
+// SkipVersionCheck disables the version condition for a single statement.
+func SkipVersionCheck(db *gorm.DB) *gorm.DB {
+	return db.Set(skipVersionCheckKey, true)
+}
+
+func versionBeforeUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil {
+		return
+	}
+	// Batch updates of slices are not versioned.
+	if stmt.ReflectValue.Kind() != reflect.Struct || !stmt.ReflectValue.CanAddr() {
+		return
+	}
+	if _, ok := stmt.ReflectValue.Addr().Interface().(versionedModel); !ok {
+		return
+	}
+	if skip, ok := db.Get(skipVersionCheckKey); ok && skip == true {
+		return
+	}
+	field := stmt.Schema.LookUpField("version")
+	if field == nil {
+		return
+	}
+
+	value, zero := field.ValueOf(stmt.Context, stmt.ReflectValue)
+	if zero {
+		// The row wasn't loaded, e.g. Model(&User{}).Where(...).Updates(map),
+		// so there is no version to check against. Still bump it when the
+		// assignments can carry an expression.
+		if _, ok := stmt.Dest.(map[string]interface{}); ok {
+			stmt.SetColumn(field.DBName, gorm.Expr("? + 1", clause.Column{Name: field.DBName}))
+		}
+		return
+	}
+
+	current := value.(int)
+	stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: current},
+	}})
+	stmt.SetColumn(field.DBName, current+1)
+	db.InstanceSet(versionCheckKey, current)
+}
+
+func versionAfterUpdate(db *gorm.DB) {
+	v, ok := db.InstanceGet(versionCheckKey)
+	if !ok {
+		return
+	}
+	current := v.(int)
+	if db.Error == nil && db.RowsAffected == 0 && !db.DryRun {
+		// Restore the in memory version so callers can reload and retry.
+		if field := db.Statement.Schema.LookUpField("version"); field != nil {
+			_ = field.Set(db.Statement.Context, db.Statement.ReflectValue, current)
+		}
+		db.AddError(&VersionConflictError{Table: db.Statement.Table, Version: current})
+	}
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	goerrors "errors"
+	"testing"
+)
+
+type versionedWidget struct {
+	ID   uint
+	Name string
+	Versioned
+}
+
+func TestVersionConflict(t *testing.T) {
+	if err := db.AutoMigrate(&versionedWidget{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := versionedWidget{Name: "duck"}
+	if err := db.Create(&w).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w.Version != 1 {
+		t.Fatalf("got version %d", w.Version)
+	}
+
+	var stale versionedWidget
+	if err := db.First(&stale, w.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Model(&w).Updates(map[string]interface{}{"name": "goose"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w.Version != 2 {
+		t.Errorf("got version %d", w.Version)
+	}
+
+	stale.Name = "swan"
+	err := db.Save(&stale).Error
+	var conflict *VersionConflictError
+	if !goerrors.As(err, &conflict) || !goerrors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected version conflict, got %v", err)
+	}
+	if stale.Version != 1 {
+		t.Errorf("version not restored: %d", stale.Version)
+	}
+
+	if err := SkipVersionCheck(db).Save(&stale).Error; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"whimsy/pkg/models/registry"
+
+	"github.com/gofrs/uuid"
+)
+
+// WebhookEndpoint is a URL an account registered to receive its events,
+// signed with a secret only the account and the server know.
+// swagger:model WebhookEndpoint
+type WebhookEndpoint struct {
+	Base
+
+	OwnerID     uuid.UUID `gorm:"type:uuid;not null;index" json:"ownerId"`
+	Owner       *User     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	URL         string    `gorm:"not null" json:"url"`
+	Description string    `gorm:"not null;default:''" json:"description"`
+	// EventTypes are space separated event types the endpoint receives.
+	// "user.*" matches every user event and "*" every event.
+	EventTypes string `gorm:"not null" json:"-"`
+	// Secret is the signing secret, encrypted with utils.Encrypter.
+	Secret string `gorm:"not null" json:"-"`
+	// ConsecutiveFailures counts failed attempts since the last success. The
+	// endpoint is disabled once it reaches the limit.
+	ConsecutiveFailures int        `gorm:"not null;default:0" json:"consecutiveFailures"`
+	DisabledAt          *time.Time `json:"disabledAt,omitempty"`
+}
+
+func (e *WebhookEndpoint) EventTypeList() []string {
+	return strings.Fields(e.EventTypes)
+}
+
+// Subscribes reports whether the endpoint receives events of type typ.
+func (e *WebhookEndpoint) Subscribes(typ string) bool {
+	for _, pattern := range e.EventTypeList() {
+		if pattern == "*" || pattern == typ ||
+			strings.HasSuffix(pattern, ".*") && strings.HasPrefix(typ, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryState is where a webhook delivery stands.
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliverySucceeded DeliveryState = "succeeded"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// WebhookDelivery is an outbox event sent to an endpoint, once per pair.
+// Body is kept so retries and redeliveries send the same bytes.
+// swagger:model WebhookDelivery
+type WebhookDelivery struct {
+	ID          int64            `gorm:"primaryKey" json:"id"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	UpdatedAt   time.Time        `json:"updatedAt"`
+	EndpointID  uuid.UUID        `gorm:"type:uuid;not null;uniqueIndex:idx_webhook_deliveries_event" json:"endpointId"`
+	Endpoint    *WebhookEndpoint `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	EventID     int64            `gorm:"not null;uniqueIndex:idx_webhook_deliveries_event" json:"eventId"`
+	EventType   string           `gorm:"not null" json:"eventType"`
+	Body        string           `gorm:"type:text;not null" json:"body"`
+	State       DeliveryState    `gorm:"not null;default:'pending'" json:"state"`
+	Attempts    int              `gorm:"not null;default:0" json:"attempts"`
+	LastError   string           `gorm:"not null;default:''" json:"lastError,omitempty"`
+	DeliveredAt *time.Time       `json:"deliveredAt,omitempty"`
+}
+
+// WebhookAttempt logs one request of a delivery.
+// swagger:model WebhookAttempt
+type WebhookAttempt struct {
+	ID          int64            `gorm:"primaryKey" json:"id"`
+	DeliveryID  int64            `gorm:"not null;index" json:"deliveryId"`
+	Delivery    *WebhookDelivery `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	AttemptedAt time.Time        `gorm:"not null" json:"attemptedAt"`
+	DurationMs  int64            `gorm:"not null" json:"durationMs"`
+	// StatusCode is 0 when no response came back, see Error.
+	StatusCode   int    `gorm:"not null;default:0" json:"statusCode"`
+	ResponseBody string `gorm:"type:text;not null;default:''" json:"responseBody"`
+	Error        string `gorm:"not null;default:''" json:"error,omitempty"`
+	// Redelivery marks attempts requested by the endpoint's owner.
+	Redelivery bool `gorm:"not null;default:false" json:"redelivery"`
+}
+
+// Succeeded reports whether the endpoint accepted the attempt.
+func (a *WebhookAttempt) Succeeded() bool {
+	return a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+func init() {
+	registry.Register(&WebhookEndpoint{}, &WebhookDelivery{}, &WebhookAttempt{})
+}
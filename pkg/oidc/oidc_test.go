@@ -0,0 +1,185 @@
+package oidc
+
+import (
+	"context"
+	goerrors "errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"whimsy/pkg/testutils"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *testutils.MockOIDCIssuer) {
+	issuer := testutils.NewMockOIDCIssuer(t)
+	p := NewProvider(Config{
+		Name:         "mock",
+		IssuerURL:    issuer.URL,
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "http://app.test/auth/callback",
+	}, nil)
+	return p, issuer
+}
+
+// login runs the authorization code flow and returns the verified ID token.
+func login(t *testing.T, p *Provider, issuer *testutils.MockOIDCIssuer, nonce string) (*IDToken, error) {
+	ctx := context.Background()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, "some-state", nonce, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := issuer.Authorize(t, authURL)
+	if state != "some-state" {
+		t.Fatalf("state = %q", state)
+	}
+	return p.Exchange(ctx, code, verifier, nonce)
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636 appendix B.
+	got := PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("PKCEChallenge = %q, want %q", got, want)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	raw, err := p.AuthCodeURL(context.Background(), "st", "no", "ch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, issuer.URL+"/authorize?") {
+		t.Errorf("authorization URL %q isn't at the issuer", raw)
+	}
+	for k, want := range map[string]string{
+		"client_id":             issuer.ClientID,
+		"scope":                 "openid email profile",
+		"state":                 "st",
+		"nonce":                 "no",
+		"code_challenge":        "ch",
+		"code_challenge_method": "S256",
+		"redirect_uri":          "http://app.test/auth/callback",
+	} {
+		if got := u.Query().Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	p.IssuerURL = issuer.URL + "/"
+	if _, err := p.Discover(context.Background()); err == nil {
+		t.Fatal("expected an error for a mismatched issuer")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	issuer.SetUser(testutils.OIDCUser{Subject: "abc", Email: "ada@example.com", EmailVerified: true, GivenName: "Ada"})
+
+	tok, err := login(t, p, issuer, "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Subject != "abc" || tok.Email != "ada@example.com" || !bool(tok.EmailVerified) || tok.GivenName != "Ada" {
+		t.Errorf("unexpected claims %+v", tok)
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	ctx := context.Background()
+	_, challenge, _ := NewPKCE()
+	authURL, err := p.AuthCodeURL(ctx, "s", "n", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := issuer.Authorize(t, authURL)
+	other, _, _ := NewPKCE()
+	if _, err := p.Exchange(ctx, code, other, "n"); err == nil {
+		t.Fatal("expected the exchange to fail without the matching verifier")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(map[string]interface{})
+	}{
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }},
+		{"several audiences without azp", func(c map[string]interface{}) { c["aud"] = []string{"whimsy-test", "other"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, issuer := newTestProvider(t)
+			issuer.Claims = tt.claims
+			if _, err := login(t, p, issuer, "n-1"); !goerrors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAudienceList(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	issuer.Claims = func(c map[string]interface{}) {
+		c["aud"] = []string{"other", issuer.ClientID}
+		c["azp"] = issuer.ClientID
+	}
+	if _, err := login(t, p, issuer, "n-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyForgedSignature(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	if _, err := login(t, p, issuer, "n-1"); err != nil {
+		t.Fatal(err)
+	}
+	// Valid claims, but the signature of another token.
+	raw := issuer.SignIDToken(t, map[string]interface{}{
+		"iss": issuer.URL, "sub": "abc", "aud": issuer.ClientID, "nonce": "n",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	parts := strings.Split(raw, ".")
+	other := issuer.SignIDToken(t, map[string]interface{}{"sub": "other"})
+	parts[2] = strings.Split(other, ".")[2]
+	if _, err := p.Verify(context.Background(), strings.Join(parts, "."), "n"); err == nil {
+		t.Fatal("expected a forged signature to be rejected")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	if _, err := login(t, p, issuer, "n-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.RotateKey(t)
+	// Unknown keys are only refetched once a minute.
+	if _, err := login(t, p, issuer, "n-2"); !goerrors.Is(err, ErrUnknownKey) {
+		t.Fatalf("err = %v, want ErrUnknownKey", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := login(t, p, issuer, "n-3"); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+}
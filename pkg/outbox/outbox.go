@@ -0,0 +1,311 @@
+// Package outbox publishes domain events reliably: Publish writes an event
+// to the outbox_events table in the transaction of the change it describes,
+// and a Relay delivers it to a Sink afterwards, so a change is never
+// committed without its event or announced without being committed.
+//
+// Delivery is at least once: a relay claims a batch of events for a lease,
+// sends them outside of any transaction, and marks each delivered once the
+// sink accepted it. An event is sent again if that fails, or if the relay
+// dies with the lease. Events of one aggregate are delivered in order, a
+// failing one holding back those after it, while others carry on.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// NotifyChannel is the pub/sub channel Publish notifies of new events, so
+// relays listening on it pick them up without waiting for their next poll.
+const NotifyChannel = "outbox"
+
+// Defaults for RelayOptions.
+const (
+	DefaultBatchSize    = 100
+	DefaultPollInterval = 5 * time.Second
+	DefaultMaxBackoff   = 10 * time.Minute
+	DefaultLease        = time.Minute
+	// DefaultRetention is how long delivered events are kept, see Cleanup.
+	DefaultRetention = 24 * time.Hour
+)
+
+// Event is a change to an aggregate, such as a user, that other systems
+// may care about.
+type Event struct {
+	AggregateType string
+	AggregateID   string
+	// Type names what happened, as "<aggregate>.<past tense verb>".
+	Type string
+	// Payload is stored as JSON and must encode to an object.
+	Payload interface{}
+	// TenantID is the account the event belongs to, if any.
+	TenantID *uuid.UUID
+}
+
+// Publish writes ev to the outbox. Pass the transaction making the change.
+func Publish(ctx context.Context, tx *gorm.DB, ev Event) (*models.OutboxEvent, error) {
+	payload := models.JSONMap{}
+	b, err := json.Marshal(ev.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+	e := &models.OutboxEvent{
+		AggregateType: ev.AggregateType,
+		AggregateID:   ev.AggregateID,
+		Type:          ev.Type,
+		Payload:       payload,
+		TenantID:      ev.TenantID,
+		NextAttemptAt: time.Now(),
+	}
+	tx = tx.WithContext(ctx)
+	if err := tx.Create(e).Error; err != nil {
+		return nil, err
+	}
+	// Delivered when tx commits, and not at all if it rolls back.
+	if err := tx.Exec("SELECT pg_notify(?, ?)", NotifyChannel, e.Type).Error; err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Cleanup deletes events delivered before the retention period.
+func Cleanup(ctx context.Context, db *gorm.DB, retention time.Duration) (int64, error) {
+	res := db.WithContext(ctx).Where("delivered_at < ?", time.Now().Add(-retention)).Delete(&models.OutboxEvent{})
+	return res.RowsAffected, res.Error
+}
+
+// Sink delivers events to another system.
+type Sink interface {
+	// Send delivers ev. An error retries it later.
+	Send(ctx context.Context, ev *models.OutboxEvent) error
+}
+
+// TxSink is a Sink writing to the database. The relay sends to it in the
+// transaction marking the event delivered, which ctx carries, see
+// database.TxFromContext, so its writes happen exactly once. Other sinks are
+// sent to outside of any transaction, so no locks are held while they wait
+// on the network.
+type TxSink interface {
+	Sink
+	// SendsInTx marks the sink as transactional.
+	SendsInTx()
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, ev *models.OutboxEvent) error
+
+func (f SinkFunc) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	return f(ctx, ev)
+}
+
+// MultiSink sends events to each of its sinks in turn. When one fails, the
+// event is retried on all of them, so those before it see it again. A
+// relay sends to its TxSinks last, once the others accepted the event.
+type MultiSink []Sink
+
+func (m MultiSink) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	for _, s := range m {
+		if err := s.Send(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RelayOptions tune a Relay. Zero values take the defaults above.
+type RelayOptions struct {
+	// BatchSize is how many events a relay claims at once.
+	BatchSize int
+	// PollInterval is how often an idle relay looks for events. Wake finds
+	// them sooner.
+	PollInterval time.Duration
+	// MaxBackoff caps the doubling wait before resending a failed event.
+	MaxBackoff time.Duration
+	// Lease is how long claimed events are left to their relay. Events it
+	// hasn't marked by then are claimed again, so it must cover sending a
+	// batch.
+	Lease time.Duration
+}
+
+// Relay moves events from the outbox to a sink. Any number of relays can
+// share the outbox.
+type Relay struct {
+	db *database.DB
+	// sinks are sent to outside of transactions, then txSinks in the one
+	// marking the event delivered.
+	sinks   MultiSink
+	txSinks MultiSink
+	opts    RelayOptions
+	wake    chan struct{}
+	now     func() time.Time
+}
+
+func NewRelay(db *gorm.DB, sink Sink, opts RelayOptions) *Relay {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = DefaultLease
+	}
+	r := &Relay{
+		db:   database.New(db),
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		now:  time.Now,
+	}
+	r.addSink(sink)
+	return r
+}
+
+func (r *Relay) addSink(sink Sink) {
+	switch s := sink.(type) {
+	case MultiSink:
+		for _, s := range s {
+			r.addSink(s)
+		}
+	case TxSink:
+		r.txSinks = append(r.txSinks, s)
+	default:
+		r.sinks = append(r.sinks, s)
+	}
+}
+
+// Wake makes an idle relay look for events now, as when NotifyChannel
+// reports one.
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays events until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+	for ctx.Err() == nil {
+		n, err := r.relay(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Err(err).Msg("outbox relay failed")
+		}
+		if n > 0 && err == nil {
+			continue
+		}
+		t := time.NewTimer(r.opts.PollInterval)
+		select {
+		case <-ctx.Done():
+		case <-r.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// relay claims and sends a batch of the oldest undelivered event of each
+// aggregate. It returns how many it handled, delivered or not.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := range events {
+		if ctx.Err() != nil {
+			// The rest is claimed again once the lease expires.
+			return i, ctx.Err()
+		}
+		if err := r.send(ctx, &events[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
+
+// claim leases a batch of events to the relay by pushing their next attempt
+// past the lease, so other relays leave them alone until then.
+func (r *Relay) claim(ctx context.Context) ([]models.OutboxEvent, error) {
+	var events []models.OutboxEvent
+	err := r.db.InTx(ctx, func(tx *gorm.DB) error {
+		events = nil
+		now := r.now()
+		// An event is eligible only once every earlier one of its aggregate
+		// was delivered, which also keeps relays off the aggregates of
+		// events another relay has claimed.
+		if err := tx.Raw(`
+SELECT * FROM outbox_events e
+WHERE delivered_at IS NULL AND next_attempt_at <= ?
+	AND NOT EXISTS (
+		SELECT 1 FROM outbox_events p
+		WHERE p.delivered_at IS NULL AND p.aggregate_type = e.aggregate_type
+			AND p.aggregate_id = e.aggregate_id AND p.id < e.id
+	)
+ORDER BY id
+LIMIT ?
+FOR UPDATE SKIP LOCKED`, now, r.opts.BatchSize).Scan(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		ids := make([]int64, len(events))
+		for i := range events {
+			ids[i] = events[i].ID
+		}
+		return tx.Model(&models.OutboxEvent{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(r.opts.Lease)).Error
+	})
+	return events, err
+}
+
+// send delivers a claimed event, then marks it delivered, or schedules its
+// next attempt.
+func (r *Relay) send(ctx context.Context, ev *models.OutboxEvent) error {
+	logger := zerolog.Ctx(ctx).With().Int64("event_id", ev.ID).Str("type", ev.Type).Logger()
+	sendErr := r.sinks.Send(ctx, ev)
+	attempts := ev.Attempts
+	return r.db.InTx(ctx, func(tx *gorm.DB) error {
+		err := sendErr
+		if err == nil {
+			err = r.txSinks.Send(tx.Statement.Context, ev)
+		}
+		now := r.now()
+		if err == nil {
+			return tx.Model(ev).Update("delivered_at", now).Error
+		}
+		ev.Attempts = attempts + 1
+		wait := r.backoff(ev.Attempts)
+		logger.Warn().Err(err).Int("attempt", ev.Attempts).Dur("retry_in", wait).Msg("outbox delivery failed")
+		return tx.Model(ev).Updates(map[string]interface{}{
+			"attempts":        ev.Attempts,
+			"last_error":      err.Error(),
+			"next_attempt_at": now.Add(wait),
+		}).Error
+	})
+}
+
+// backoff is a random wait before resending after the given attempt,
+// doubling from a second up to MaxBackoff.
+func (r *Relay) backoff(attempt int) time.Duration {
+	d := r.opts.MaxBackoff
+	if attempt < 30 {
+		if b := time.Second << uint(attempt-1); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,297 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
+	"whimsy/pkg/testutils"
+
+	"gorm.io/gorm"
+)
+
+var db *gorm.DB
+
+func TestMain(m *testing.M) {
+	db = testutils.ConnectDb("outbox")
+	if err := migrate.Migrate(db); err != nil {
+		panic(err)
+	}
+	exitVal := m.Run()
+	testutils.ResetDb(db)
+	os.Exit(exitVal)
+}
+
+func TestBackoff(t *testing.T) {
+	r := NewRelay(nil, LogSink{}, RelayOptions{})
+	for attempt := 1; attempt < 40; attempt++ {
+		if d := r.backoff(attempt); d < time.Second/2 || d > DefaultMaxBackoff {
+			t.Errorf("backoff(%d) = %s", attempt, d)
+		}
+	}
+	if d := r.backoff(4); d < 4*time.Second || d > 8*time.Second {
+		t.Errorf("backoff(4) = %s", d)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := &WriterSink{W: &buf}
+	for i := int64(1); i <= 2; i++ {
+		ev := &models.OutboxEvent{ID: i, Type: "user.registered", AggregateType: "user", AggregateID: "u1", Payload: models.JSONMap{"n": i}}
+		if err := s.Send(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines: %s", len(lines), buf.String())
+	}
+	var got models.OutboxEvent
+	if err := json.Unmarshal(lines[1], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 2 || got.Type != "user.registered" || got.Payload["n"] != float64(2) {
+		t.Errorf("unexpected event %+v", got)
+	}
+}
+
+func resetEvents(t *testing.T) {
+	t.Helper()
+	if err := db.Exec("TRUNCATE outbox_events, jobs").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publish(t *testing.T, tx *gorm.DB, aggregateID, typ string) *models.OutboxEvent {
+	t.Helper()
+	ev, err := Publish(context.Background(), tx, Event{
+		AggregateType: "user",
+		AggregateID:   aggregateID,
+		Type:          typ,
+		Payload:       map[string]string{"id": aggregateID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestPublishJoinsTransaction(t *testing.T) {
+	resetEvents(t)
+	rollback := goerrors.New("rollback")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		publish(t, tx, "u1", "user.registered")
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := db.Model(&models.OutboxEvent{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d events survived the rollback", n)
+	}
+}
+
+// recorder is a sink recording what it was sent, failing events of the
+// types in fail.
+type recorder struct {
+	mu   sync.Mutex
+	sent []string
+	fail map[string]bool
+}
+
+func (s *recorder) Send(_ context.Context, ev *models.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail[ev.Type] {
+		return goerrors.New("unavailable")
+	}
+	s.sent = append(s.sent, ev.AggregateID+" "+ev.Type)
+	return nil
+}
+
+func TestRelayOrdersPerAggregate(t *testing.T) {
+	resetEvents(t)
+	ctx := testutils.NewContext(t)
+	publish(t, db, "u1", "user.registered")
+	publish(t, db, "u1", "user.updated")
+	publish(t, db, "u2", "user.deleted")
+	publish(t, db, "u1", "user.deleted")
+
+	sink := &recorder{fail: map[string]bool{"user.updated": true}}
+	r := NewRelay(db, sink, RelayOptions{})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if _, err := r.relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// u1's failing update holds back its deletion, not u2's.
+	want := []string{"u1 user.registered", "u2 user.deleted"}
+	if len(sink.sent) != len(want) || sink.sent[0] != want[0] || sink.sent[1] != want[1] {
+		t.Fatalf("sent %v, want %v", sink.sent, want)
+	}
+	var failed models.OutboxEvent
+	if err := db.Where("type = ?", "user.updated").Take(&failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.Attempts != 1 || failed.LastError != "unavailable" || !failed.NextAttemptAt.After(now) || failed.DeliveredAt != nil {
+		t.Errorf("unexpected failed event %+v", failed)
+	}
+
+	// Once the sink recovers and the backoff passed, u1 carries on in order.
+	sink.fail = nil
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := r.relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want = append(want, "u1 user.updated", "u1 user.deleted")
+	if len(sink.sent) != len(want) || sink.sent[2] != want[2] || sink.sent[3] != want[3] {
+		t.Errorf("sent %v, want %v", sink.sent, want)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	resetEvents(t)
+	ctx := testutils.NewContext(t)
+	old, recent, pending := publish(t, db, "u1", "a"), publish(t, db, "u1", "b"), publish(t, db, "u1", "c")
+	for ev, at := range map[*models.OutboxEvent]time.Time{old: time.Now().Add(-48 * time.Hour), recent: time.Now()} {
+		if err := db.Model(ev).Update("delivered_at", at).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := Cleanup(ctx, db, DefaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []models.OutboxEvent
+	if err := db.Order("id").Find(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(left) != 2 || left[0].ID != recent.ID || left[1].ID != pending.ID {
+		t.Errorf("deleted %d, left %+v", n, left)
+	}
+}
+
+// txRecorder is a TxSink noting whether each event came in a transaction.
+type txRecorder struct {
+	inTx []bool
+}
+
+func (*txRecorder) SendsInTx() {}
+
+func (s *txRecorder) Send(ctx context.Context, _ *models.OutboxEvent) error {
+	_, ok := database.TxFromContext(ctx)
+	s.inTx = append(s.inTx, ok)
+	return nil
+}
+
+func TestRelaySinks(t *testing.T) {
+	resetEvents(t)
+	ctx := testutils.NewContext(t)
+	ev := publish(t, db, "u1", "user.registered")
+
+	tx := &txRecorder{}
+	var externalInTx bool
+	external := SinkFunc(func(ctx context.Context, _ *models.OutboxEvent) error {
+		_, externalInTx = database.TxFromContext(ctx)
+		return nil
+	})
+	r := NewRelay(db, MultiSink{tx, external}, RelayOptions{})
+	if len(r.sinks) != 1 || len(r.txSinks) != 1 {
+		t.Fatalf("sinks %v, tx sinks %v", r.sinks, r.txSinks)
+	}
+	if n, err := r.relay(ctx); err != nil || n != 1 {
+		t.Fatalf("relayed %d: %v", n, err)
+	}
+	if externalInTx || len(tx.inTx) != 1 || !tx.inTx[0] {
+		t.Errorf("external sink in a transaction: %v, tx sink: %v", externalInTx, tx.inTx)
+	}
+	if err := db.First(ev, ev.ID).Error; err != nil || ev.DeliveredAt == nil {
+		t.Errorf("event not delivered: %v", err)
+	}
+}
+
+func TestJobSink(t *testing.T) {
+	resetEvents(t)
+	ctx, cancel := context.WithCancel(testutils.NewContext(t))
+	defer cancel()
+	ev := publish(t, db, "u1", "user.registered")
+	publish(t, db, "u2", "user.deleted")
+
+	handled := make(chan models.OutboxEvent, 1)
+	handlers := EventHandlers{"user.registered": func(_ context.Context, ev *models.OutboxEvent) error {
+		handled <- *ev
+		return nil
+	}}
+	r := NewRelay(db, JobSink{Handlers: handlers, Options: jobs.Options{MaxAttempts: 3}}, RelayOptions{})
+	if len(r.txSinks) != 1 {
+		t.Fatalf("JobSink isn't a TxSink: %v", r.sinks)
+	}
+	if n, err := r.relay(ctx); err != nil || n != 2 {
+		t.Fatalf("relayed %d: %v", n, err)
+	}
+	var queued []models.Job
+	if err := db.Find(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Events without a handler aren't queued.
+	if len(queued) != 1 || queued[0].Kind != "outbox.user.registered" || queued[0].MaxAttempts != 3 {
+		t.Fatalf("queued %+v", queued)
+	}
+
+	w := jobs.NewWorker(db, jobs.WorkerOptions{PollInterval: 10 * time.Millisecond})
+	handlers.Register(w)
+	go w.Run(ctx)
+	select {
+	case got := <-handled:
+		if got.ID != ev.ID || got.AggregateID != "u1" {
+			t.Errorf("handled %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event job not run")
+	}
+}
+
+func TestRelayLease(t *testing.T) {
+	resetEvents(t)
+	ctx := testutils.NewContext(t)
+	publish(t, db, "u1", "user.registered")
+	publish(t, db, "u2", "user.registered")
+
+	now := time.Now()
+	a := NewRelay(db, LogSink{}, RelayOptions{BatchSize: 1, Lease: time.Minute})
+	b := NewRelay(db, LogSink{}, RelayOptions{Lease: time.Minute})
+	a.now = func() time.Time { return now }
+	b.now = a.now
+	claimed, err := a.claim(ctx)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("claimed %v: %v", claimed, err)
+	}
+	// The claim committed, and other relays skip the event while leased.
+	others, err := b.claim(ctx)
+	if err != nil || len(others) != 1 || others[0].ID == claimed[0].ID {
+		t.Fatalf("second relay claimed %v: %v", others, err)
+	}
+	now = now.Add(2 * time.Minute)
+	again, err := b.claim(ctx)
+	if err != nil || len(again) != 2 {
+		t.Errorf("after the lease, claimed %v: %v", again, err)
+	}
+}
@@ -0,0 +1,129 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/models"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// LogSink logs events, for development.
+type LogSink struct{}
+
+func (LogSink) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	zerolog.Ctx(ctx).Info().
+		Int64("event_id", ev.ID).
+		Str("type", ev.Type).
+		Str("aggregate", ev.AggregateType+":"+ev.AggregateID).
+		Interface("payload", ev.Payload).
+		Msg("outbox event")
+	return nil
+}
+
+// WriterSink writes events to W as JSON lines.
+type WriterSink struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (s *WriterSink) Send(_ context.Context, ev *models.OutboxEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(append(b, '\n'))
+	return err
+}
+
+// EventJob is the job JobSink enqueues for an event.
+type EventJob struct {
+	Event models.OutboxEvent `json:"event"`
+}
+
+func (j EventJob) Kind() string {
+	return "outbox." + j.Event.Type
+}
+
+// EventHandlers handle events in background jobs, by event type, through
+// JobSink. Add handlers before the worker and relay start.
+type EventHandlers map[string]func(ctx context.Context, ev *models.OutboxEvent) error
+
+// Register adds a worker handler for the EventJobs of each event type.
+func (h EventHandlers) Register(w *jobs.Worker) {
+	for typ, fn := range h {
+		fn := fn
+		w.Handle(EventJob{Event: models.OutboxEvent{Type: typ}}, func(ctx context.Context, job jobs.Job) error {
+			ev := job.(EventJob).Event
+			return fn(ctx, &ev)
+		})
+	}
+}
+
+// JobSink enqueues an EventJob per event of the types Handlers handles, in
+// the relay's transaction, so each becomes exactly one job. Other events
+// aren't enqueued, as no worker would run them.
+type JobSink struct {
+	Handlers EventHandlers
+	Options  jobs.Options
+}
+
+// SendsInTx makes JobSink a TxSink.
+func (JobSink) SendsInTx() {}
+
+func (s JobSink) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	if _, ok := s.Handlers[ev.Type]; !ok {
+		return nil
+	}
+	tx, ok := database.TxFromContext(ctx)
+	if !ok {
+		panic("outbox: JobSink used outside of a relay")
+	}
+	// A savepoint, so a failed insert doesn't abort the relay's transaction.
+	return tx.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		_, err := jobs.Enqueue(ctx, tx, EventJob{Event: *ev}, s.Options)
+		return err
+	})
+}
+
+// SQSSink sends events to an SQS queue, as the JSON of the event with its
+// type as the "type" message attribute. On FIFO queues, events of an
+// aggregate share a message group, keeping them in order, and the event ID
+// deduplicates resends.
+type SQSSink struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+	FIFO     bool
+}
+
+func (s SQSSink) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	in := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.QueueURL),
+		MessageBody: aws.String(string(b)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"type": {DataType: aws.String("String"), StringValue: aws.String(ev.Type)},
+		},
+	}
+	if s.FIFO {
+		in.MessageGroupId = aws.String(ev.AggregateType + ":" + ev.AggregateID)
+		in.MessageDeduplicationId = aws.String(strconv.FormatInt(ev.ID, 10))
+	}
+	_, err = s.Client.SendMessageWithContext(ctx, in)
+	return err
+}
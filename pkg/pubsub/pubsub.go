@@ -0,0 +1,306 @@
+// Package pubsub delivers Postgres NOTIFY messages to subscribers in the
+// process, for cache invalidation and live updates.
+//
+// One connection LISTENs on every channel with subscribers. If it drops,
+// PubSub reconnects and LISTENs again; notifications sent in between are
+// lost, so subscribers get a Notification with Reset set and should reload
+// whatever they derive from the channel.
+package pubsub
+
+import (
+	"context"
+	goerrors "errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// SubscriptionBuffer is how many notifications a slow subscriber may fall
+// behind before notifications to it are dropped.
+const SubscriptionBuffer = 64
+
+// maxBackoff caps the wait between reconnects.
+const maxBackoff = 30 * time.Second
+
+// ErrClosed is returned by Publish after Close.
+var ErrClosed = goerrors.New("pubsub closed")
+
+// Notification is a message published on a channel.
+type Notification struct {
+	Channel string
+	Payload string
+	// Reset reports that notifications may have been missed, after a lost
+	// connection or a full buffer. Payload is empty.
+	Reset bool
+}
+
+type subscription struct {
+	ch chan Notification
+	// missed is set when a notification was dropped, so the next delivery
+	// is a Reset.
+	missed bool
+}
+
+// PubSub publishes and subscribes to notifications over a pgx pool.
+type PubSub struct {
+	pool *pgxpool.Pool
+
+	mu   sync.Mutex
+	subs map[string]map[*subscription]struct{}
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel func()
+	done   chan struct{}
+	// pid is the backend of the listening connection, for tests.
+	pid uint32
+}
+
+// New starts listening through pool. Close stops it.
+func New(pool *pgxpool.Pool) *PubSub {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PubSub{
+		pool:   pool,
+		subs:   map[string]map[*subscription]struct{}{},
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Close stops listening and closes every subscription.
+func (p *PubSub) Close() {
+	p.cancel()
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for channel, subs := range p.subs {
+		for s := range subs {
+			close(s.ch)
+		}
+		delete(p.subs, channel)
+	}
+}
+
+// Publish sends payload to the subscribers of channel in every process,
+// right away: it runs on a pool connection, outside any transaction of
+// ctx. To notify only when a transaction commits, run
+// SELECT pg_notify(channel, payload) on it instead, as jobs.Enqueue does.
+func (p *PubSub) Publish(ctx context.Context, channel, payload string) error {
+	if p.ctx.Err() != nil {
+		return ErrClosed
+	}
+	_, err := p.pool.Exec(ctx, "SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
+
+// Subscribe returns the notifications of channel until ctx is done, when
+// the returned channel is closed. Notifications published before the
+// LISTEN for a new channel is in place are missed.
+func (p *PubSub) Subscribe(ctx context.Context, channel string) <-chan Notification {
+	s := &subscription{ch: make(chan Notification, SubscriptionBuffer)}
+	p.mu.Lock()
+	if p.ctx.Err() != nil {
+		p.mu.Unlock()
+		close(s.ch)
+		return s.ch
+	}
+	if p.subs[channel] == nil {
+		p.subs[channel] = map[*subscription]struct{}{}
+	}
+	p.subs[channel][s] = struct{}{}
+	p.mu.Unlock()
+	p.poke()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.ctx.Done():
+			return // Close closes the subscription
+		}
+		p.mu.Lock()
+		if _, ok := p.subs[channel][s]; ok {
+			delete(p.subs[channel], s)
+			if len(p.subs[channel]) == 0 {
+				delete(p.subs, channel)
+			}
+			close(s.ch)
+		}
+		p.mu.Unlock()
+		p.poke()
+	}()
+	return s.ch
+}
+
+// poke makes the listener update its LISTENs.
+func (p *PubSub) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PubSub) channels() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]bool, len(p.subs))
+	for channel := range p.subs {
+		out[channel] = true
+	}
+	return out
+}
+
+// dispatch delivers n to the subscribers of its channel without blocking.
+func (p *PubSub) dispatch(n Notification) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s := range p.subs[n.Channel] {
+		deliver(s, n)
+	}
+}
+
+// reset tells every subscriber notifications may have been missed.
+func (p *PubSub) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for channel, subs := range p.subs {
+		for s := range subs {
+			s.missed = true
+			deliver(s, Notification{Channel: channel, Reset: true})
+		}
+	}
+}
+
+func deliver(s *subscription, n Notification) {
+	if s.missed && !n.Reset {
+		n = Notification{Channel: n.Channel, Reset: true}
+	}
+	select {
+	case s.ch <- n:
+		s.missed = false
+	default:
+		if !s.missed {
+			log.Warn().Str("channel", n.Channel).Msg("pubsub subscriber too slow, dropping notifications")
+		}
+		s.missed = true
+	}
+}
+
+func (p *PubSub) run() {
+	defer close(p.done)
+	failures := 0
+	connected := false
+	for {
+		err := p.listen(func() {
+			if connected {
+				p.reset()
+			}
+			connected = true
+			failures = 0
+		})
+		if p.ctx.Err() != nil {
+			return
+		}
+		failures++
+		wait := backoff(failures)
+		log.Warn().Err(err).Dur("retry_in", wait).Msg("pubsub connection lost")
+		t := time.NewTimer(wait)
+		select {
+		case <-p.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// backoff is a random wait before the given reconnect, up to 100ms doubled
+// per failure and at most maxBackoff.
+func backoff(failures int) time.Duration {
+	max := maxBackoff
+	if failures < 10 {
+		if d := 100 * time.Millisecond << uint(failures-1); d < max {
+			max = d
+		}
+	}
+	return max/2 + time.Duration(rand.Int63n(int64(max/2)+1))
+}
+
+// listen holds a connection LISTENing on the subscribed channels until it
+// fails or p is closed. connected is called once the LISTENs are in place.
+func (p *PubSub) listen(connected func()) error {
+	c, err := p.pool.Acquire(p.ctx)
+	if err != nil {
+		return err
+	}
+	conn := c.Conn()
+	defer func() {
+		// A connection left LISTENing mustn't go back to the pool.
+		_ = conn.Close(context.Background())
+		c.Release()
+	}()
+	atomic.StoreUint32(&p.pid, conn.PgConn().PID())
+
+	listening := map[string]bool{}
+	first := true
+	for {
+		want := p.channels()
+		for channel := range want {
+			if !listening[channel] {
+				if _, err := conn.Exec(p.ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+					return err
+				}
+				listening[channel] = true
+			}
+		}
+		for channel := range listening {
+			if !want[channel] {
+				if _, err := conn.Exec(p.ctx, "UNLISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+					return err
+				}
+				delete(listening, channel)
+			}
+		}
+		if first {
+			connected()
+			first = false
+		}
+
+		n, err := p.wait(conn)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return p.ctx.Err()
+			}
+			if goerrors.Is(err, context.Canceled) && !conn.IsClosed() {
+				continue // poked
+			}
+			return err
+		}
+		p.dispatch(Notification{Channel: n.Channel, Payload: n.Payload})
+	}
+}
+
+// wait returns the next notification, or context.Canceled once poked.
+func (p *PubSub) wait(conn *pgx.Conn) (*pgconn.Notification, error) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-p.wake:
+			cancel()
+		case <-stop:
+		}
+	}()
+	return conn.WaitForNotification(ctx)
+}
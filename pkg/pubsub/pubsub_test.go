@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"whimsy/pkg/testutils"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var pool *pgxpool.Pool
+
+func TestMain(m *testing.M) {
+	pool = testutils.ConnectPool("pubsub")
+	exitVal := m.Run()
+	pool.Close()
+	os.Exit(exitVal)
+}
+
+func TestDeliverResetsAfterDrops(t *testing.T) {
+	s := &subscription{ch: make(chan Notification, 2)}
+	for _, payload := range []string{"a", "b", "c", "d"} {
+		deliver(s, Notification{Channel: "users", Payload: payload})
+	}
+	if !s.missed {
+		t.Fatal("a full buffer didn't mark the subscription")
+	}
+	for _, want := range []string{"a", "b"} {
+		if n := <-s.ch; n.Payload != want || n.Reset {
+			t.Errorf("got %+v, want %s", n, want)
+		}
+	}
+	deliver(s, Notification{Channel: "users", Payload: "e"})
+	if n := <-s.ch; !n.Reset || n.Payload != "" || n.Channel != "users" {
+		t.Errorf("got %+v after drops, want a reset", n)
+	}
+	deliver(s, Notification{Channel: "users", Payload: "f"})
+	if n := <-s.ch; n.Reset || n.Payload != "f" {
+		t.Errorf("got %+v after the reset", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures := 1; failures < 20; failures++ {
+		d := backoff(failures)
+		if d < 50*time.Millisecond || d > maxBackoff {
+			t.Errorf("backoff(%d) = %s", failures, d)
+		}
+	}
+	if d := backoff(1); d > 100*time.Millisecond {
+		t.Errorf("first backoff = %s", d)
+	}
+}
+
+// next returns the next notification on ch, failing after a few seconds.
+func next(t *testing.T, ch <-chan Notification) Notification {
+	t.Helper()
+	select {
+	case n, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	return Notification{}
+}
+
+// publishUntil publishes to channel until ch receives something, as the
+// LISTEN of a new subscription is in place some time after Subscribe.
+func publishUntil(t *testing.T, ps *PubSub, ch <-chan Notification, channel, payload string) Notification {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		if err := ps.Publish(ctx, channel, payload); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case n := <-ch:
+			return n
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("no notification")
+	return Notification{}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ps := New(pool)
+	defer ps.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	users := ps.Subscribe(ctx, "users")
+	if n := publishUntil(t, ps, users, "users", "1"); n.Payload != "1" || n.Channel != "users" {
+		t.Errorf("got %+v", n)
+	}
+	for len(users) > 0 {
+		<-users
+	}
+
+	// Channel names aren't limited to identifiers.
+	odd := ps.Subscribe(ctx, `Cache "Keys"`)
+	publishUntil(t, ps, odd, `Cache "Keys"`, "k")
+	if err := ps.Publish(ctx, "users", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := next(t, users); n.Payload != "2" {
+		t.Errorf("got %+v", n)
+	}
+
+	unsubCtx, unsub := context.WithCancel(ctx)
+	second := ps.Subscribe(unsubCtx, "users")
+	if err := ps.Publish(ctx, "users", "3"); err != nil {
+		t.Fatal(err)
+	}
+	next(t, users)
+	unsub()
+	for range second {
+	}
+
+	ps.Close()
+	for range users {
+	}
+	if err := ps.Publish(ctx, "users", "4"); err != ErrClosed {
+		t.Errorf("Publish after Close = %v", err)
+	}
+	if _, ok := <-ps.Subscribe(ctx, "users"); ok {
+		t.Error("Subscribe after Close returned an open channel")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ps := New(pool)
+	defer ps.Close()
+	ctx := context.Background()
+	ch := ps.Subscribe(ctx, "orders")
+	publishUntil(t, ps, ch, "orders", "before")
+
+	pid := atomic.LoadUint32(&ps.pid)
+	if _, err := pool.Exec(ctx, "SELECT pg_terminate_backend($1)", pid); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n := next(t, ch)
+		if n.Reset {
+			break
+		}
+	}
+	if atomic.LoadUint32(&ps.pid) == pid {
+		t.Error("still on the terminated connection")
+	}
+	if err := ps.Publish(ctx, "orders", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if n := next(t, ch); n.Payload != "after" {
+		t.Errorf("got %+v after reconnecting", n)
+	}
+}
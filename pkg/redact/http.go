@@ -0,0 +1,119 @@
+package redact
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers returns a copy of h with configured headers redacted and the
+// other values going through Text.
+func (r *Redactor) Headers(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		redacted := make([]string, len(values))
+		for i, v := range values {
+			if r.Header(name) {
+				redacted[i] = Redacted
+			} else {
+				redacted[i] = r.Text(v)
+			}
+		}
+		out[name] = redacted
+	}
+	return out
+}
+
+// URL redacts configured query parameters from a URL or request URI.
+func (r *Redactor) URL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.RawQuery == "" {
+		return r.Text(raw)
+	}
+	u.RawQuery = r.values(u.RawQuery)
+	return u.String()
+}
+
+// Form redacts an application/x-www-form-urlencoded body. Both configured
+// fields and query parameters are redacted from it.
+func (r *Redactor) Form(body string) string {
+	return r.values(body)
+}
+
+func (r *Redactor) values(raw string) string {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return r.Text(raw)
+	}
+	for name, vs := range values {
+		for i, v := range vs {
+			if r.QueryParam(name) || r.Field(name) {
+				vs[i] = Redacted
+			} else {
+				vs[i] = r.Text(v)
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// Body redacts a body of the given Content-Type: JSON and forms are
+// parsed, anything else goes through Text.
+func (r *Redactor) Body(contentType, body string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		return r.Form(body)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if b, err := r.JSON([]byte(body)); err == nil {
+			return string(b)
+		}
+	}
+	return r.Text(body)
+}
+
+// Dump redacts an HTTP request or response dump, as written by
+// httputil.DumpRequestOut or httputil.DumpResponse: the request URI's
+// query, headers and body.
+func (r *Redactor) Dump(dump string) string {
+	head, body := dump, ""
+	sep := strings.Index(dump, "\r\n\r\n")
+	if sep >= 0 {
+		head, body = dump[:sep], dump[sep+4:]
+	}
+	lines := strings.Split(head, "\r\n")
+	// A request line is "METHOD URI PROTO", a status line starts with the
+	// protocol.
+	if parts := strings.SplitN(lines[0], " ", 3); len(parts) == 3 && !strings.HasPrefix(parts[0], "HTTP/") {
+		parts[1] = r.URL(parts[1])
+		lines[0] = strings.Join(parts, " ")
+	}
+	var contentType string
+	chunked := false
+	for i, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name, value := line[:colon], strings.TrimSpace(line[colon+1:])
+		switch {
+		case r.Header(name):
+			value = Redacted
+		case strings.EqualFold(name, "Content-Type"):
+			contentType = value
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			chunked = strings.EqualFold(value, "chunked")
+		}
+		lines[i+1] = name + ": " + r.Text(value)
+	}
+	out := strings.Join(lines, "\r\n")
+	if sep < 0 {
+		return out
+	}
+	if chunked {
+		// Chunk sizes break JSON and forms apart, so fall back to text.
+		return out + "\r\n\r\n" + r.Text(body)
+	}
+	return out + "\r\n\r\n" + r.Body(contentType, body)
+}
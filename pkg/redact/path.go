@@ -0,0 +1,97 @@
+package redact
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// segment is a step of a JSONPath: a key or index, "*" for any, found
+// directly under the previous step or, when deep, anywhere beneath it.
+type segment struct {
+	name string
+	deep bool
+}
+
+func (s segment) matches(key string) bool {
+	return s.name == "*" || s.name == key
+}
+
+// parsePath parses the JSONPath subset of Config.Paths: $, .name, ..name,
+// [n], [*], ['name'] and .* steps.
+func parsePath(p string) ([]segment, error) {
+	invalid := func() ([]segment, error) {
+		return nil, fmt.Errorf("redact: invalid JSONPath %q", p)
+	}
+	if !strings.HasPrefix(p, "$") {
+		return invalid()
+	}
+	var segs []segment
+	rest := p[1:]
+	for rest != "" {
+		var seg segment
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			seg.deep = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] != '[':
+			return invalid()
+		}
+		if strings.HasPrefix(rest, "[") {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return invalid()
+			}
+			seg.name = rest[1:end]
+			rest = rest[end+1:]
+			if q := seg.name; len(q) >= 2 && (q[0] == '\'' || q[0] == '"') && q[len(q)-1] == q[0] {
+				seg.name = q[1 : len(q)-1]
+			} else if _, err := strconv.Atoi(q); err != nil && q != "*" {
+				return invalid()
+			}
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			seg.name, rest = rest[:end], rest[end:]
+		}
+		if seg.name == "" {
+			return invalid()
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 0 {
+		return invalid()
+	}
+	return segs, nil
+}
+
+// matchPath reports whether a value at path, its keys and indexes from the
+// root, matches one of the configured paths.
+func (r *Redactor) matchPath(path []string) bool {
+	for _, segs := range r.paths {
+		if match(segs, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(segs []segment, path []string) bool {
+	if len(segs) == 0 {
+		return len(path) == 0
+	}
+	s := segs[0]
+	if s.deep {
+		for i := range path {
+			if s.matches(path[i]) && match(segs[1:], path[i+1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(path) > 0 && s.matches(path[0]) && match(segs[1:], path[1:])
+}
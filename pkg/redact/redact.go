@@ -0,0 +1,338 @@
+// Package redact removes secrets and personal data from what the server
+// logs or returns in errors: JSON documents, HTTP dumps, headers, query
+// strings, form bodies and free text.
+//
+// A Redactor is configured with field, header and query parameter names,
+// JSONPath patterns, and the built-in patterns it looks for in text: card
+// numbers ("pan"), US social security numbers ("ssn") and email addresses
+// ("email").
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces redacted values.
+const Redacted = "[REDACTED]"
+
+// Built-in patterns for Config.Patterns.
+const (
+	PatternPAN   = "pan"
+	PatternSSN   = "ssn"
+	PatternEmail = "email"
+)
+
+// Defaults for Config.
+var (
+	DefaultFields = []string{
+		"password", "newPassword", "currentPassword",
+		"token", "accessToken", "refreshToken", "idToken", "mfaToken",
+		"secret", "clientSecret", "apiKey", "recoveryCodes",
+		"authorization", "cookie",
+	}
+	DefaultHeaders = []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		"X-Api-Key", "Whimsy-Webhook-Signature",
+	}
+	DefaultQuery    = []string{"token", "access_token", "id_token", "code", "client_secret", "state"}
+	DefaultPatterns = []string{PatternPAN, PatternSSN, PatternEmail}
+)
+
+type Config struct {
+	// Fields are JSON keys and form fields redacted wherever they appear,
+	// whatever their value. Names match ignoring case, "_" and "-", so
+	// "accessToken" also redacts "access_token".
+	Fields []string
+	// Headers are HTTP headers redacted from dumps.
+	Headers []string
+	// Query are query parameters redacted from URLs, and from form bodies.
+	Query []string
+	// Paths are JSONPath patterns of values to redact, e.g.
+	// "$.card.number", "$.items[*].token" or "$..ssn".
+	Paths []string
+	// Patterns are the built-in patterns redacted from text.
+	Patterns []string
+}
+
+// DefaultConfig returns a Config using the defaults above.
+func DefaultConfig() Config {
+	return Config{Fields: DefaultFields, Headers: DefaultHeaders, Query: DefaultQuery, Patterns: DefaultPatterns}
+}
+
+// Redactor redacts values as configured. It's safe for concurrent use.
+type Redactor struct {
+	fields  map[string]bool
+	headers map[string]bool
+	query   map[string]bool
+	paths   [][]segment
+
+	pan, ssn, email bool
+	// fieldText finds configured fields in text that isn't valid JSON, such
+	// as truncated dumps, and queryText configured query parameters.
+	fieldText, queryText *regexp.Regexp
+}
+
+// New returns a Redactor for cfg, or an error if a path or pattern is
+// invalid.
+func New(cfg Config) (*Redactor, error) {
+	r := &Redactor{fields: map[string]bool{}, headers: map[string]bool{}, query: map[string]bool{}}
+	var fieldAlts, queryAlts []string
+	for _, f := range cfg.Fields {
+		r.fields[normalize(f)] = true
+		fieldAlts = append(fieldAlts, regexp.QuoteMeta(f))
+	}
+	for _, h := range cfg.Headers {
+		r.headers[strings.ToLower(h)] = true
+	}
+	for _, q := range cfg.Query {
+		r.query[strings.ToLower(q)] = true
+		queryAlts = append(queryAlts, regexp.QuoteMeta(q))
+	}
+	for _, p := range cfg.Paths {
+		segs, err := parsePath(p)
+		if err != nil {
+			return nil, err
+		}
+		r.paths = append(r.paths, segs)
+	}
+	for _, p := range cfg.Patterns {
+		switch strings.ToLower(p) {
+		case PatternPAN:
+			r.pan = true
+		case PatternSSN:
+			r.ssn = true
+		case PatternEmail:
+			r.email = true
+		default:
+			return nil, fmt.Errorf("redact: unknown pattern %q", p)
+		}
+	}
+	if len(fieldAlts) > 0 {
+		r.fieldText = regexp.MustCompile(`(?i)("(?:` + strings.Join(fieldAlts, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	}
+	if len(queryAlts) > 0 {
+		r.queryText = regexp.MustCompile(`(?i)([?&](?:` + strings.Join(queryAlts, "|") + `)=)[^&\s"#]*`)
+	}
+	return r, nil
+}
+
+var (
+	defaultMu sync.RWMutex
+	def       = mustNew(DefaultConfig())
+)
+
+func mustNew(cfg Config) *Redactor {
+	r, err := New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Default returns the Redactor used by logs, HTTP dumps and errors.
+func Default() *Redactor {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return def
+}
+
+// SetDefault replaces the Redactor returned by Default.
+func SetDefault(r *Redactor) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	def = r
+}
+
+// normalize folds field names so accessToken, access_token and
+// Access-Token match.
+func normalize(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// Field reports whether values of the JSON key or form field name are
+// redacted.
+func (r *Redactor) Field(name string) bool {
+	return r.fields[normalize(name)]
+}
+
+// Header reports whether the HTTP header name is redacted.
+func (r *Redactor) Header(name string) bool {
+	return r.headers[strings.ToLower(name)]
+}
+
+// QueryParam reports whether the query parameter name is redacted.
+func (r *Redactor) QueryParam(name string) bool {
+	return r.query[strings.ToLower(name)]
+}
+
+var (
+	panPattern   = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	ssnPattern   = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@([A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,})`)
+	bearer       = regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9\-._~+/]+=*`)
+)
+
+// Text redacts the built-in patterns, bearer credentials, configured query
+// parameters and, for text that looks like broken JSON, configured fields.
+// Card numbers keep their last four digits and emails their domain.
+func (r *Redactor) Text(s string) string {
+	if r.pan {
+		s = panPattern.ReplaceAllStringFunc(s, maskPAN)
+	}
+	if r.ssn {
+		s = ssnPattern.ReplaceAllString(s, "***-**-****")
+	}
+	if r.email {
+		s = emailPattern.ReplaceAllString(s, "***@$1")
+	}
+	s = bearer.ReplaceAllString(s, "$1 "+Redacted)
+	if r.queryText != nil {
+		s = r.queryText.ReplaceAllString(s, "${1}"+Redacted)
+	}
+	if r.fieldText != nil {
+		s = r.fieldText.ReplaceAllString(s, `${1}"`+Redacted+`"`)
+	}
+	return s
+}
+
+// maskPAN masks what looks like a card number and passes the Luhn check.
+func maskPAN(s string) string {
+	digits := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits = append(digits, s[i])
+		}
+	}
+	if !luhn(digits) {
+		return s
+	}
+	return strings.Repeat("*", len(digits)-4) + string(digits[len(digits)-4:])
+}
+
+func luhn(digits []byte) bool {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-i)%2 == 0 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// JSON redacts a JSON document. It keeps the order of keys but not the
+// whitespace between tokens. Configured fields and paths are
+// replaced with Redacted whatever their value, numbers included, and
+// strings go through Text. It returns an error if b isn't valid JSON.
+func (r *Redactor) JSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := r.value(dec, &out, nil); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("redact: data after the JSON value")
+	}
+	return out.Bytes(), nil
+}
+
+// value copies the next value of dec at path to out, redacted.
+func (r *Redactor) value(dec *json.Decoder, out *bytes.Buffer, path []string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		end := byte('}')
+		if t == '[' {
+			end = ']'
+		}
+		out.WriteByte(byte(t))
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			var key string
+			var redact bool
+			if t == '{' {
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key = k.(string)
+				writeString(out, key)
+				out.WriteByte(':')
+				redact = r.Field(key)
+			} else {
+				key = fmt.Sprint(i)
+			}
+			child := append(path[:len(path):len(path)], key)
+			if redact || r.matchPath(child) {
+				if err := skip(dec); err != nil {
+					return err
+				}
+				writeString(out, Redacted)
+				continue
+			}
+			if err := r.value(dec, out, child); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		out.WriteByte(end)
+	case string:
+		writeString(out, r.Text(t))
+	case json.Number:
+		if s := t.String(); r.pan && maskPAN(s) != s {
+			writeString(out, maskPAN(s))
+		} else {
+			out.WriteString(s)
+		}
+	case bool:
+		fmt.Fprint(out, t)
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+// skip consumes the next value of dec.
+func skip(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func writeString(out *bytes.Buffer, s string) {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	out.Truncate(out.Len() - 1) // Encode's newline
+}
@@ -0,0 +1,139 @@
+package redact
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func newRedactor(t *testing.T, paths ...string) *Redactor {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Paths = paths
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestJSON(t *testing.T) {
+	r := newRedactor(t, "$.card.number", "$.items[*].sku", "$..ssn")
+	tests := []struct {
+		in, want string
+	}{
+		{`{"password":"hunter2","name":"Ann"}`, `{"password":"[REDACTED]","name":"Ann"}`},
+		{`{"access_token":12345,"Refresh-Token":{"a":[1]}}`, `{"access_token":"[REDACTED]","Refresh-Token":"[REDACTED]"}`},
+		{`{"card":{"number":42,"brand":"visa"}}`, `{"card":{"number":"[REDACTED]","brand":"visa"}}`},
+		{`{"items":[{"sku":"a"},{"sku":"b","qty":2}]}`, `{"items":[{"sku":"[REDACTED]"},{"sku":"[REDACTED]","qty":2}]}`},
+		{`{"user":{"profile":{"ssn":"x"}},"ssn":1}`, `{"user":{"profile":{"ssn":"[REDACTED]"}},"ssn":"[REDACTED]"}`},
+		{`{"note":"card 4111 1111 1111 1111, ssn 123-45-6789, mail ann@whimsy.test"}`, `{"note":"card ************1111, ssn ***-**-****, mail ***@whimsy.test"}`},
+		{`{"pan":4111111111111111,"id":1234567890123}`, `{"pan":"************1111","id":1234567890123}`},
+		{`[true,null,"<b>"]`, `[true,null,"<b>"]`},
+	}
+	for _, tt := range tests {
+		got, err := r.JSON([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+		} else if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+	for _, invalid := range []string{`{"a":`, `{"a":1} {}`} {
+		if _, err := r.JSON([]byte(invalid)); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	r := newRedactor(t)
+	tests := []struct {
+		in, want string
+	}{
+		{"4111-1111-1111-1112 fails the Luhn check", "4111-1111-1111-1112 fails the Luhn check"},
+		{"Authorization: Bearer abc.def-ghi", "Authorization: Bearer [REDACTED]"},
+		{"GET /callback?code=abc&next=/home", "GET /callback?code=[REDACTED]&next=/home"},
+		{`truncated {"name":"a","password":"hun`, `truncated {"name":"a","password":"[REDACTED]"`},
+		{`{"token": 12345, "ok": true}`, `{"token": "[REDACTED]", "ok": true}`},
+	}
+	for _, tt := range tests {
+		if got := r.Text(tt.in); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, p := range []string{"$", "card.number", "$.a[", "$.a[x]", "$.a..", "$a"} {
+		if _, err := parsePath(p); err == nil {
+			t.Errorf("%q parsed", p)
+		}
+	}
+	tests := []struct {
+		path string
+		key  []string
+		want bool
+	}{
+		{"$.a.b", []string{"a", "b"}, true},
+		{"$.a.b", []string{"a", "b", "c"}, false},
+		{"$['a b'][0]", []string{"a b", "0"}, true},
+		{"$.*.b", []string{"x", "b"}, true},
+		{"$..b", []string{"x", "y", "b"}, true},
+		{"$..a[*].c", []string{"x", "a", "3", "c"}, true},
+		{"$..a.c", []string{"a", "x", "c"}, false},
+	}
+	for _, tt := range tests {
+		segs, err := parsePath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := match(segs, tt.key); got != tt.want {
+			t.Errorf("%s on %v: got %v", tt.path, tt.key, got)
+		}
+	}
+	if _, err := New(Config{Patterns: []string{"iban"}}); err == nil {
+		t.Error("unknown pattern accepted")
+	}
+}
+
+func TestDump(t *testing.T) {
+	r := newRedactor(t)
+	req := "POST /token?client_secret=s3cret&x=1 HTTP/1.1\r\n" +
+		"Host: idp.test\r\n" +
+		"Authorization: Basic dXNlcjpwYXNz\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\n\r\n" +
+		"code=abc&grant_type=authorization_code&password=p"
+	got := r.Dump(req)
+	want := "POST /token?client_secret=%5BREDACTED%5D&x=1 HTTP/1.1\r\n" +
+		"Host: idp.test\r\n" +
+		"Authorization: [REDACTED]\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\n\r\n" +
+		"code=%5BREDACTED%5D&grant_type=authorization_code&password=%5BREDACTED%5D"
+	if got != want {
+		t.Errorf("request:\n got %q\nwant %q", got, want)
+	}
+
+	res := "HTTP/1.1 200 OK\r\nSet-Cookie: s=1\r\nContent-Type: application/json; charset=utf-8\r\n\r\n{\"id_token\":\"eyJ\",\"expires_in\":3600}"
+	if got := r.Dump(res); !strings.Contains(got, "Set-Cookie: [REDACTED]") || !strings.HasSuffix(got, `{"id_token":"[REDACTED]","expires_in":3600}`) {
+		t.Errorf("response: %q", got)
+	}
+
+	h := r.Headers(http.Header{"Cookie": {"a=b"}, "Accept": {"*/*"}})
+	if h.Get("Cookie") != Redacted || h.Get("Accept") != "*/*" {
+		t.Errorf("headers: %v", h)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(newRedactor(t).Writer(&buf))
+	logger.Info().Str("password", "hunter2").Int("token", 42).Str("request", "GET /reset?token=abc").Msg("reset for ann@whimsy.test")
+	want := `{"level":"info","password":"[REDACTED]","token":"[REDACTED]","request":"GET /reset?token=[REDACTED]","message":"reset for ***@whimsy.test"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %s", buf.String())
+	}
+}
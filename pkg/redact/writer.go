@@ -0,0 +1,31 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+)
+
+// Writer returns a writer redacting the JSON log events written to it, for
+// zerolog loggers; zerolog hooks can add fields but not change them. Events
+// that aren't JSON go through Text.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+// Write redacts p, a whole event as zerolog writes them.
+func (w writer) Write(p []byte) (int, error) {
+	event := bytes.TrimRight(p, "\n")
+	out, err := w.r.JSON(event)
+	if err != nil {
+		out = []byte(w.r.Text(string(event)))
+	}
+	if _, err := w.w.Write(append(out, p[len(event):]...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
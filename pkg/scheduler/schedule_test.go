@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	from := time.Date(2022, 3, 15, 10, 30, 0, 0, time.UTC) // a Tuesday
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"* * * * *", []string{"2022-03-15T10:31:00Z", "2022-03-15T10:32:00Z"}},
+		{"*/20 * * * *", []string{"2022-03-15T10:40:00Z", "2022-03-15T11:00:00Z"}},
+		{"5/20 9-11 * * *", []string{"2022-03-15T10:45:00Z", "2022-03-15T11:05:00Z"}},
+		{"0 3 * * *", []string{"2022-03-16T03:00:00Z", "2022-03-17T03:00:00Z"}},
+		{"@daily", []string{"2022-03-16T00:00:00Z"}},
+		{"@hourly", []string{"2022-03-15T11:00:00Z"}},
+		{"0 0 1 * *", []string{"2022-04-01T00:00:00Z", "2022-05-01T00:00:00Z"}},
+		{"0 9 * * mon-fri", []string{"2022-03-16T09:00:00Z", "2022-03-17T09:00:00Z", "2022-03-18T09:00:00Z", "2022-03-21T09:00:00Z"}},
+		{"0 0 * * 7", []string{"2022-03-20T00:00:00Z"}},
+		// Both day fields restricted: either matches.
+		{"0 0 1 * sun", []string{"2022-03-20T00:00:00Z", "2022-03-27T00:00:00Z", "2022-04-01T00:00:00Z"}},
+		{"0 12 29 feb *", []string{"2024-02-29T12:00:00Z"}},
+		{"30 1,13 * jan,mar *", []string{"2022-03-15T13:30:00Z", "2022-03-16T01:30:00Z"}},
+		{"CRON_TZ=Europe/Paris 0 3 * * *", []string{"2022-03-16T02:00:00Z", "2022-03-17T02:00:00Z"}},
+		{"@every 90m", []string{"2022-03-15T12:00:00Z", "2022-03-15T13:30:00Z"}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		at := from
+		for _, want := range tt.want {
+			at = s.Next(at)
+			if got := at.UTC().Format(time.RFC3339); got != want {
+				t.Errorf("%q: got %s, want %s", tt.spec, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"0 0 30 feb *",
+		"@every",
+		"@every -1m",
+		"@sometimes",
+		"CRON_TZ=Nowhere/Special 0 0 * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestDaylightSaving(t *testing.T) {
+	s, err := Parse("CRON_TZ=Europe/Paris 30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 02:30 doesn't exist in Paris on 27 March 2022, so that day is skipped
+	// like any other time that doesn't match.
+	got := s.Next(time.Date(2022, 3, 26, 12, 0, 0, 0, time.UTC))
+	if want := time.Date(2022, 3, 28, 0, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got.UTC(), want)
+	}
+}
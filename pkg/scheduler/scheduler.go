@@ -0,0 +1,325 @@
+// Package scheduler runs periodic tasks, such as cleanups and reports, once
+// across every process running a Scheduler.
+//
+// Processes elect a leader with a session level pg_try_advisory_lock held on
+// a dedicated connection; only the leader runs tasks, and the others retry
+// the lock now and then in case it goes away. Each run is recorded in the
+// scheduled_runs table, unique per task and scheduled time, which also keeps
+// a former leader that lost its connection from repeating a run.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	goerrors "errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"whimsy/pkg/models"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Defaults for Task and Options.
+const (
+	DefaultTimeout       = 10 * time.Minute
+	DefaultRetryInterval = 30 * time.Second
+)
+
+// leaderLock is the pg_try_advisory_lock key held by the leader.
+const leaderLock int64 = 0x7363686564756c65 // "schedule"
+
+// MissedPolicy says what a task does about runs due while no leader ran it,
+// or while its previous run overran.
+type MissedPolicy int
+
+const (
+	// SkipMissed waits for the next scheduled time.
+	SkipMissed MissedPolicy = iota
+	// RunMissedOnce runs once right away for all the missed runs, as the
+	// latest of them.
+	RunMissedOnce
+)
+
+// Task is a periodic job.
+type Task struct {
+	// Name identifies the task's runs, so it must be unique and stable.
+	Name     string
+	Schedule Schedule
+	Run      func(ctx context.Context) error
+	// Timeout bounds a run, DefaultTimeout by default.
+	Timeout time.Duration
+	// Jitter delays each run by a random duration up to Jitter, to spread
+	// tasks scheduled at the same time.
+	Jitter time.Duration
+	Missed MissedPolicy
+}
+
+// Options tune a Scheduler. Zero values take the defaults above.
+type Options struct {
+	// RetryInterval is how often followers try to take the lead, and the
+	// leader checks it still holds it, give or take some jitter.
+	RetryInterval time.Duration
+}
+
+// Scheduler runs tasks while it is the leader.
+type Scheduler struct {
+	db    *gorm.DB
+	opts  Options
+	tasks []Task
+	node  string
+	now   func() time.Time
+}
+
+func New(db *gorm.DB, opts Options) *Scheduler {
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	host, _ := os.Hostname()
+	return &Scheduler{
+		db:   db,
+		opts: opts,
+		node: fmt.Sprintf("%s/%d", host, os.Getpid()),
+		now:  time.Now,
+	}
+}
+
+// Add registers t. Call it before Run.
+func (s *Scheduler) Add(t Task) {
+	if t.Name == "" || t.Schedule == nil || t.Run == nil {
+		panic("scheduler: tasks need a name, a schedule and a run function")
+	}
+	for _, other := range s.tasks {
+		if other.Name == t.Name {
+			panic("scheduler: duplicate task " + t.Name)
+		}
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = DefaultTimeout
+	}
+	s.tasks = append(s.tasks, t)
+}
+
+// Run competes for leadership until ctx is done, running the tasks while it
+// leads. It returns once running tasks have stopped.
+func (s *Scheduler) Run(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+	for {
+		led, err := s.lead(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Err(err).Msg("scheduler leadership failed")
+		}
+		if led {
+			logger.Info().Msg("scheduler stopped leading")
+		}
+		if !sleep(ctx, jitter(s.opts.RetryInterval)) {
+			return
+		}
+	}
+}
+
+// jitter returns d give or take a quarter.
+func jitter(d time.Duration) time.Duration {
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d, reporting false if ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// lead takes the leader lock if it is free and runs the tasks until ctx is
+// done or the lock's connection fails. It reports whether it led.
+func (s *Scheduler) lead(ctx context.Context) (bool, error) {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	// The lock belongs to the session, so the connection mustn't go back to
+	// the pool: ErrBadConn makes database/sql close it, releasing the lock.
+	defer func() {
+		_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		_ = conn.Close()
+	}()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLock).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	zerolog.Ctx(ctx).Info().Str("node", s.node).Msg("scheduler leading")
+
+	leadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.schedule(leadCtx)
+	}()
+	err = s.hold(leadCtx, conn)
+	cancel()
+	wg.Wait()
+	return true, err
+}
+
+// hold checks the lock's connection until ctx is done or it fails.
+func (s *Scheduler) hold(ctx context.Context, conn *sql.Conn) error {
+	for sleep(ctx, jitter(s.opts.RetryInterval)) {
+		checkCtx, cancel := context.WithTimeout(ctx, s.opts.RetryInterval)
+		err := conn.PingContext(checkCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("lost the leader lock connection: %w", err)
+		}
+	}
+	return nil
+}
+
+// schedule runs every task on its schedule until ctx is done.
+func (s *Scheduler) schedule(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range s.tasks {
+		wg.Add(1)
+		go func(t Task) {
+			defer wg.Done()
+			s.loop(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, t Task) {
+	logger := zerolog.Ctx(ctx).With().Str("task", t.Name).Logger()
+	ctx = logger.WithContext(ctx)
+
+	var last models.ScheduledRun
+	if err := s.db.WithContext(ctx).Where("task = ?", t.Name).Order("scheduled_at DESC").Limit(1).Find(&last).Error; err != nil {
+		logger.Err(err).Msg("loading the last run failed")
+		return
+	}
+	from := last.ScheduledAt
+	if last.ID == 0 {
+		// A new task isn't behind.
+		from = s.now()
+	}
+	for {
+		at := s.following(t, from)
+		if at.IsZero() {
+			logger.Warn().Msg("task never runs again")
+			return
+		}
+		if !sleep(ctx, at.Sub(s.now())+randomDelay(t.Jitter)) {
+			return
+		}
+		if err := s.run(ctx, t, at); err != nil {
+			logger.Err(err).Msg("recording the run failed")
+		}
+		from = at
+	}
+}
+
+func randomDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// following returns when t runs after its run scheduled at last, applying
+// its MissedPolicy if that is already past.
+func (s *Scheduler) following(t Task, last time.Time) time.Time {
+	now := s.now()
+	next := t.Schedule.Next(last)
+	if next.IsZero() || !next.Before(now) {
+		return next
+	}
+	if t.Missed == RunMissedOnce {
+		// The latest missed time, due right away. Every leader picks the
+		// same one, so the catch-up is recorded, and runs, once.
+		for {
+			after := t.Schedule.Next(next)
+			if after.IsZero() || after.After(now) {
+				return next
+			}
+			next = after
+		}
+	}
+	return t.Schedule.Next(now)
+}
+
+// run runs t for its time at, unless it already ran for it, and records
+// the outcome.
+func (s *Scheduler) run(ctx context.Context, t Task, at time.Time) error {
+	logger := zerolog.Ctx(ctx)
+	run := &models.ScheduledRun{
+		Task:        t.Name,
+		ScheduledAt: at.UTC().Truncate(time.Microsecond), // Postgres precision
+		StartedAt:   s.now(),
+		Status:      models.RunRunning,
+		Node:        s.node,
+	}
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(run)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		logger.Info().Time("scheduled_at", at).Msg("task already ran")
+		return nil
+	}
+
+	err := s.call(ctx, t)
+	finished := s.now()
+	run.FinishedAt = &finished
+	switch {
+	case err == nil:
+		run.Status = models.RunSucceeded
+		logger.Info().Dur("duration", finished.Sub(run.StartedAt)).Msg("task done")
+	case ctx.Err() != nil:
+		run.Status, run.Error = models.RunAbandoned, err.Error()
+		logger.Warn().Err(err).Msg("task abandoned")
+	case goerrors.Is(err, context.DeadlineExceeded):
+		run.Status, run.Error = models.RunTimedOut, err.Error()
+		logger.Error().Err(err).Msg("task timed out")
+	default:
+		run.Status, run.Error = models.RunFailed, err.Error()
+		logger.Error().Err(err).Msg("task failed")
+	}
+	// Recorded even when ctx is done.
+	return s.db.WithContext(logger.WithContext(context.Background())).
+		Select("finished_at", "status", "error").Updates(run).Error
+}
+
+func (s *Scheduler) call(ctx context.Context, t Task) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	err = t.Run(ctx)
+	if err == nil && ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	return err
+}
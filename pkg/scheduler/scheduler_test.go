@@ -0,0 +1,197 @@
+package scheduler
+
+import (
+	"context"
+	goerrors "errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"whimsy/pkg/models"
+	"whimsy/pkg/testutils"
+
+	"gorm.io/gorm"
+)
+
+var db *gorm.DB
+
+func TestMain(m *testing.M) {
+	db = testutils.ConnectDb("scheduler")
+	if err := db.AutoMigrate(&models.ScheduledRun{}); err != nil {
+		panic(err)
+	}
+	exitVal := m.Run()
+	testutils.ResetDb(db)
+	os.Exit(exitVal)
+}
+
+func TestFollowing(t *testing.T) {
+	now := time.Date(2022, 3, 15, 10, 30, 0, 0, time.UTC)
+	s := New(nil, Options{})
+	s.now = func() time.Time { return now }
+	hourly := Task{Schedule: mustParse(t, "@hourly")}
+
+	if got := s.following(hourly, now.Add(-10*time.Minute)); !got.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("on time: got %s", got)
+	}
+	if got := s.following(hourly, now.Add(-5*time.Hour)); !got.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("skipping missed runs: got %s", got)
+	}
+	hourly.Missed = RunMissedOnce
+	missed := now.Add(-30 * time.Minute)
+	if got := s.following(hourly, now.Add(-5*time.Hour)); !got.Equal(missed) {
+		t.Errorf("running missed runs once: got %s", got)
+	}
+	if got := s.following(hourly, now.Add(-time.Hour)); !got.Equal(missed) {
+		t.Errorf("running one missed run: got %s", got)
+	}
+	if got := s.following(hourly, missed); !got.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("after the missed run: got %s", got)
+	}
+}
+
+func mustParse(t *testing.T, spec string) Schedule {
+	t.Helper()
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCall(t *testing.T) {
+	s := New(nil, Options{})
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(ctx context.Context) error
+		want error
+	}{
+		{"ok", func(context.Context) error { return nil }, nil},
+		{"timeout", func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }, context.DeadlineExceeded},
+		{"timeout ignored", func(ctx context.Context) error { <-ctx.Done(); return nil }, context.DeadlineExceeded},
+		{"panic", func(context.Context) error { panic("boom") }, nil},
+	}
+	for _, tt := range tests {
+		err := s.call(ctx, Task{Run: tt.run, Timeout: 10 * time.Millisecond})
+		switch {
+		case tt.name == "panic":
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		case !goerrors.Is(err, tt.want) && err != tt.want:
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func resetRuns(t *testing.T) {
+	t.Helper()
+	if err := db.Exec("TRUNCATE scheduled_runs").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunRecordsOutcome(t *testing.T) {
+	resetRuns(t)
+	ctx := testutils.NewContext(t)
+	s := New(db, Options{})
+	at := time.Date(2022, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	calls := 0
+	tasks := map[string]Task{
+		"ok":      {Name: "ok", Timeout: time.Second, Run: func(context.Context) error { calls++; return nil }},
+		"failing": {Name: "failing", Timeout: time.Second, Run: func(context.Context) error { return goerrors.New("disk full") }},
+		"slow": {Name: "slow", Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}
+	for _, task := range tasks {
+		if err := s.run(ctx, task, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A run is recorded once per scheduled time.
+	if err := s.run(ctx, tasks["ok"], at); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("ok ran %d times", calls)
+	}
+
+	var runs []models.ScheduledRun
+	if err := db.Order("task").Find(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]models.RunStatus{"ok": models.RunSucceeded, "failing": models.RunFailed, "slow": models.RunTimedOut}
+	if len(runs) != len(want) {
+		t.Fatalf("%d runs recorded", len(runs))
+	}
+	for _, r := range runs {
+		if r.Status != want[r.Task] || r.FinishedAt == nil || !r.ScheduledAt.Equal(at) || r.Node != s.node {
+			t.Errorf("unexpected run %+v", r)
+		}
+	}
+}
+
+func TestLeadership(t *testing.T) {
+	resetRuns(t)
+	var (
+		mu    sync.Mutex
+		nodes []string
+	)
+	newScheduler := func(node string) *Scheduler {
+		s := New(db, Options{RetryInterval: 50 * time.Millisecond})
+		s.node = node
+		s.Add(Task{Name: "tick", Schedule: Every(time.Second), Run: func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			nodes = append(nodes, node)
+			return nil
+		}})
+		return s
+	}
+
+	ctxA, stopA := context.WithCancel(testutils.NewContext(t))
+	ctxB, stopB := context.WithCancel(testutils.NewContext(t))
+	defer stopB()
+	doneA, doneB := make(chan struct{}), make(chan struct{})
+	go func() { newScheduler("a").Run(ctxA); close(doneA) }()
+	time.Sleep(200 * time.Millisecond) // a leads
+	go func() { newScheduler("b").Run(ctxB); close(doneB) }()
+
+	time.Sleep(2500 * time.Millisecond)
+	stopA()
+	<-doneA
+	time.Sleep(2500 * time.Millisecond)
+	stopB()
+	<-doneB
+
+	mu.Lock()
+	defer mu.Unlock()
+	sawA, sawB := false, false
+	for _, n := range nodes {
+		if n == "a" && sawB {
+			t.Fatalf("a ran after b took over: %v", nodes)
+		}
+		sawA, sawB = sawA || n == "a", sawB || n == "b"
+	}
+	if !sawA || !sawB {
+		t.Errorf("runs by %v, want a then b", nodes)
+	}
+
+	var runs []models.ScheduledRun
+	if err := db.Order("scheduled_at").Find(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != len(nodes) {
+		t.Errorf("%d runs recorded for %d ticks", len(runs), len(nodes))
+	}
+	for i := 1; i < len(runs); i++ {
+		if !runs[i].ScheduledAt.After(runs[i-1].ScheduledAt) {
+			t.Errorf("runs %d and %d share a time", i-1, i)
+		}
+	}
+}
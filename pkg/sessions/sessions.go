@@ -0,0 +1,298 @@
+// Package sessions stores revocable, server side logins in Postgres.
+package sessions
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"whimsy/pkg/auth"
+	"whimsy/pkg/database"
+	"whimsy/pkg/models"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidSession is returned for unknown, expired and revoked sessions.
+var ErrInvalidSession = goerrors.New("invalid session")
+
+// Store creates and checks sessions. A session expires after IdleTTL without
+// use, and never lives past MaxAge.
+type Store struct {
+	db      *gorm.DB
+	IdleTTL time.Duration
+	MaxAge  time.Duration
+	// TouchInterval limits how often a busy session's expiry is written.
+	TouchInterval time.Duration
+	// SecureCookie sets the Secure attribute, turn it off for plain HTTP in
+	// local development only.
+	SecureCookie bool
+	now          func() time.Time
+}
+
+func NewStore(db *gorm.DB, idleTTL, maxAge time.Duration) *Store {
+	return &Store{db: db, IdleTTL: idleTTL, MaxAge: maxAge, TouchInterval: time.Minute, SecureCookie: true, now: time.Now}
+}
+
+// WithDB returns a copy of the store that uses db, such as a transaction.
+func (s *Store) WithDB(db *gorm.DB) *Store {
+	c := *s
+	c.db = db
+	return &c
+}
+
+// CookieName is the cookie browsers carry the session token in. Other clients
+// send it as a bearer token.
+const CookieName = "whimsy_session"
+
+// SetCookie hands token to a browser. SameSite=Lax keeps the cookie off
+// cross-site POSTs, which covers CSRF for the JSON API.
+func (s *Store) SetCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   s.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearCookie removes the session cookie.
+func (s *Store) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   s.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Device describes the client a session was created from.
+type Device struct {
+	OS        string
+	UserAgent string
+	IPAddress string
+}
+
+// DeviceFromRequest reads the device of r. The platform header is set by our
+// own apps, see utils.GetDeviceOS.
+func DeviceFromRequest(r *http.Request) Device {
+	ua := r.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return Device{OS: utils.GetDeviceOS(r), UserAgent: ua, IPAddress: clientIP(r)}
+}
+
+var (
+	proxiesMu      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// SetTrustedProxies sets the addresses or CIDR ranges of the proxies in front
+// of the server, such as the load balancer. Their X-Forwarded-For entries are
+// believed; without any, the client is whoever opened the connection.
+func SetTrustedProxies(proxies []string) error {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return fmt.Errorf("sessions: invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("sessions: invalid trusted proxy %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	proxiesMu.Lock()
+	defer proxiesMu.Unlock()
+	trustedProxies = nets
+	return nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	proxiesMu.RLock()
+	defer proxiesMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the connection, unless it comes from a trusted
+// proxy. X-Forwarded-For is then read from the right, each hop appended by
+// the proxy before it, and the first hop that isn't a trusted proxy is the
+// client. Entries left of it are whatever the client sent.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (s *Store) expiry(createdAt, now time.Time) time.Time {
+	expiresAt := now.Add(s.IdleTTL)
+	if limit := createdAt.Add(s.MaxAge); s.MaxAge > 0 && expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
+}
+
+// Create starts a session for userID and returns its token.
+func (s *Store) Create(ctx context.Context, userID uuid.UUID, device Device) (string, *models.Session, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now()
+	session := &models.Session{
+		UserID:     userID,
+		TokenHash:  hash,
+		ExpiresAt:  s.expiry(now, now),
+		LastSeenAt: now,
+		DeviceOS:   device.OS,
+		UserAgent:  device.UserAgent,
+		IPAddress:  device.IPAddress,
+	}
+	if err := s.db.WithContext(ctx).Create(session).Error; err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// Impersonate starts a session for admin to act as userID, ending after ttl
+// however much it is used.
+func (s *Store) Impersonate(ctx context.Context, userID, admin uuid.UUID, ttl time.Duration, device Device) (string, *models.Session, error) {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now()
+	session := &models.Session{
+		UserID:         userID,
+		TokenHash:      hash,
+		ExpiresAt:      now.Add(ttl),
+		LastSeenAt:     now,
+		ImpersonatorID: &admin,
+		DeviceOS:       device.OS,
+		UserAgent:      device.UserAgent,
+		IPAddress:      device.IPAddress,
+	}
+	if err := s.db.WithContext(ctx).Create(session).Error; err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// Lookup returns the active session of token, sliding its expiry forward.
+// touched reports whether the expiry moved, so cookies can be refreshed.
+func (s *Store) Lookup(ctx context.Context, token string, device Device) (session *models.Session, touched bool, err error) {
+	var found models.Session
+	// A replica could still accept a revoked session, or not know a new one.
+	err = s.db.WithContext(database.WithPrimary(ctx)).Where("token_hash = ?", auth.HashOpaqueToken(token)).First(&found).Error
+	if goerrors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, ErrInvalidSession
+	} else if err != nil {
+		return nil, false, err
+	}
+	now := s.now()
+	if !found.Active(now) {
+		return nil, false, ErrInvalidSession
+	}
+	if now.Sub(found.LastSeenAt) < s.TouchInterval {
+		return &found, false, nil
+	}
+
+	expiresAt := s.expiry(found.CreatedAt, now)
+	if found.ImpersonatorID != nil {
+		expiresAt = found.ExpiresAt
+	}
+	updates := map[string]interface{}{
+		"last_seen_at": now,
+		"expires_at":   expiresAt,
+		"ip_address":   device.IPAddress,
+	}
+	// UpdateColumns skips hooks, so a touch isn't recorded as an edit.
+	if err := s.db.WithContext(ctx).Model(&found).UpdateColumns(updates).Error; err != nil {
+		return nil, false, err
+	}
+	found.LastSeenAt = now
+	found.ExpiresAt = updates["expires_at"].(time.Time)
+	found.IPAddress = device.IPAddress
+	return &found, true, nil
+}
+
+// List returns the active sessions of userID, most recently used first.
+func (s *Store) List(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	var sessions []models.Session
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, s.now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke ends one session of userID. It returns ErrInvalidSession if there is
+// no such active session.
+func (s *Store) Revoke(ctx context.Context, userID, sessionID uuid.UUID) error {
+	res := s.db.WithContext(ctx).Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		UpdateColumn("revoked_at", s.now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidSession
+	}
+	return nil
+}
+
+// RevokeAll ends every session of userID, except keep if it isn't uuid.Nil.
+// It returns how many sessions were revoked.
+func (s *Store) RevokeAll(ctx context.Context, userID, keep uuid.UUID) (int64, error) {
+	q := s.db.WithContext(ctx).Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if keep != uuid.Nil {
+		q = q.Where("id <> ?", keep)
+	}
+	res := q.UpdateColumn("revoked_at", s.now())
+	return res.RowsAffected, res.Error
+}
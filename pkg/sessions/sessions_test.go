@@ -0,0 +1,64 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeviceFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("User-Agent", "Whimsy/1.0")
+	r.Header.Set("X-Platform", "iOS")
+	if d := DeviceFromRequest(r); d != (Device{OS: "iOS", UserAgent: "Whimsy/1.0", IPAddress: "10.0.0.1"}) {
+		t.Errorf("unexpected device %+v", d)
+	}
+
+	// Forwarded headers are ignored unless a trusted proxy sends them.
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if d := DeviceFromRequest(r); d.IPAddress != "10.0.0.1" {
+		t.Errorf("expected the remote address, got %s", d.IPAddress)
+	}
+
+	if err := SetTrustedProxies([]string{"10.0.0.0/24", "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+	for fwd, want := range map[string]string{
+		"203.0.113.7":                         "203.0.113.7",
+		"198.51.100.9, 203.0.113.7":           "203.0.113.7", // spoofed by the client
+		"198.51.100.9, 203.0.113.7, 10.0.0.2": "203.0.113.7",
+		"10.0.0.3, 192.0.2.1":                 "10.0.0.3", // only proxies
+		"203.0.113.7, not-an-ip":              "10.0.0.1",
+		"not-an-ip, 10.0.0.2":                 "10.0.0.2",
+	} {
+		r.Header.Set("X-Forwarded-For", fwd)
+		if d := DeviceFromRequest(r); d.IPAddress != want {
+			t.Errorf("%s: expected %s, got %s", fwd, want, d.IPAddress)
+		}
+	}
+	r.RemoteAddr = "198.51.100.1:5555"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if d := DeviceFromRequest(r); d.IPAddress != "198.51.100.1" {
+		t.Errorf("untrusted remote: expected its address, got %s", d.IPAddress)
+	}
+	if err := SetTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid range accepted")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := NewStore(nil, time.Hour, 24*time.Hour)
+	created := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	if got := s.expiry(created, created); !got.Equal(created.Add(time.Hour)) {
+		t.Errorf("expected the idle TTL, got %v", got)
+	}
+	if got := s.expiry(created, created.Add(10*time.Hour)); !got.Equal(created.Add(11 * time.Hour)) {
+		t.Errorf("expected the expiry to slide, got %v", got)
+	}
+	if got := s.expiry(created, created.Add(23*time.Hour+30*time.Minute)); !got.Equal(created.Add(24 * time.Hour)) {
+		t.Errorf("expected the max age to cap the expiry, got %v", got)
+	}
+}
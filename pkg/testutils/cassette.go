@@ -0,0 +1,335 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"whimsy/pkg/redact"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CassetteModeEnv selects the CassetteMode of cassettes that don't set
+// one, e.g. WHIMSY_CASSETTES=record go test ./pkg/oidc to record them
+// again against the real services.
+const CassetteModeEnv = "WHIMSY_CASSETTES"
+
+type CassetteMode string
+
+const (
+	// CassetteReplay serves recorded interactions and fails requests that
+	// match none. It's the default, so tests run offline.
+	CassetteReplay CassetteMode = "replay"
+	// CassetteRecord sends requests to the real service and rewrites the
+	// cassette with them when the test ends.
+	CassetteRecord CassetteMode = "record"
+	// CassetteRecordOnce records a cassette that doesn't exist yet, and
+	// replays one that does.
+	CassetteRecordOnce CassetteMode = "once"
+)
+
+// ErrUnmatchedRequest fails replayed requests no interaction matches.
+var ErrUnmatchedRequest = errors.New("cassette: no recorded interaction matches the request")
+
+// CassetteRequest is a request as recorded, after redaction.
+type CassetteRequest struct {
+	Method  string      `json:"method" yaml:"method"`
+	URL     string      `json:"url" yaml:"url"`
+	Headers http.Header `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body    string      `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// CassetteResponse is a response as recorded, after redaction.
+type CassetteResponse struct {
+	Status  int         `json:"status" yaml:"status"`
+	Headers http.Header `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body    string      `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// Interaction is a request and the response it got.
+type Interaction struct {
+	Request  CassetteRequest  `json:"request" yaml:"request"`
+	Response CassetteResponse `json:"response" yaml:"response"`
+}
+
+// Matcher reports whether a request, redacted like recorded ones, matches
+// a recorded request.
+type Matcher func(req, recorded CassetteRequest) bool
+
+// MatchMethod matches requests with the same method.
+func MatchMethod(req, recorded CassetteRequest) bool {
+	return req.Method == recorded.Method
+}
+
+// MatchURL matches requests to the same URL, with query parameters in any
+// order.
+func MatchURL(req, recorded CassetteRequest) bool {
+	return MatchURLIgnoring()(req, recorded)
+}
+
+// MatchURLIgnoring matches requests to the same URL aside from the given
+// query parameters, such as timestamps or nonces.
+func MatchURLIgnoring(params ...string) Matcher {
+	return func(req, recorded CassetteRequest) bool {
+		a, errA := url.Parse(req.URL)
+		b, errB := url.Parse(recorded.URL)
+		if errA != nil || errB != nil {
+			return req.URL == recorded.URL
+		}
+		qa, qb := a.Query(), b.Query()
+		for _, p := range params {
+			qa.Del(p)
+			qb.Del(p)
+		}
+		a.RawQuery, b.RawQuery = "", ""
+		return a.String() == b.String() && reflect.DeepEqual(qa, qb)
+	}
+}
+
+// MatchBody matches requests with the same body. JSON bodies and forms
+// match whatever the order of their keys.
+func MatchBody(req, recorded CassetteRequest) bool {
+	if req.Body == recorded.Body {
+		return true
+	}
+	var a, b interface{}
+	if json.Unmarshal([]byte(req.Body), &a) == nil && json.Unmarshal([]byte(recorded.Body), &b) == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	fa, errA := url.ParseQuery(req.Body)
+	fb, errB := url.ParseQuery(recorded.Body)
+	return errA == nil && errB == nil && len(fa) > 0 && reflect.DeepEqual(fa, fb)
+}
+
+// MatchAll matches requests all of matchers match.
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(req, recorded CassetteRequest) bool {
+		for _, m := range matchers {
+			if !m(req, recorded) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// DefaultMatcher matches requests by method and URL.
+var DefaultMatcher = MatchAll(MatchMethod, MatchURL)
+
+type CassetteOptions struct {
+	// Mode defaults to the one in CassetteModeEnv, or CassetteReplay.
+	Mode CassetteMode
+	// Matcher defaults to DefaultMatcher.
+	Matcher Matcher
+	// Transport sends requests when recording, http.DefaultTransport by
+	// default.
+	Transport http.RoundTripper
+	// Redactor redacts what is recorded, redact.Default() by default.
+	// Replayed requests are redacted the same way before matching.
+	Redactor *redact.Redactor
+}
+
+// Cassette is an http.RoundTripper recording interactions with real
+// services to a file, then replaying them offline. Files ending in .json
+// are JSON, others YAML. Recorded secrets and personal data are redacted,
+// so replayed responses hold redact.Redacted in their place.
+//
+// Each recorded interaction is replayed once, in order among those
+// matching a request.
+type Cassette struct {
+	path    string
+	mode    CassetteMode
+	matcher Matcher
+	real    http.RoundTripper
+	redact  *redact.Redactor
+	t       testing.TB
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// NewCassette loads the cassette at path, or prepares to record it. When
+// recording, the file is written as the test ends.
+func NewCassette(t testing.TB, path string, opts CassetteOptions) *Cassette {
+	t.Helper()
+	c := &Cassette{path: path, mode: opts.Mode, matcher: opts.Matcher, real: opts.Transport, redact: opts.Redactor, t: t}
+	if c.mode == "" {
+		c.mode = CassetteMode(os.Getenv(CassetteModeEnv))
+	}
+	if c.mode == "" {
+		c.mode = CassetteReplay
+	}
+	if c.matcher == nil {
+		c.matcher = DefaultMatcher
+	}
+	if c.real == nil {
+		c.real = http.DefaultTransport
+	}
+	if c.redact == nil {
+		c.redact = redact.Default()
+	}
+
+	_, err := os.Stat(path)
+	switch {
+	case c.mode == CassetteRecordOnce && os.IsNotExist(err):
+		c.mode = CassetteRecord
+	case c.mode == CassetteRecordOnce:
+		c.mode = CassetteReplay
+	case c.mode != CassetteRecord && c.mode != CassetteReplay:
+		t.Fatalf("cassette: unknown mode %q in %s", c.mode, CassetteModeEnv)
+	}
+	if c.mode == CassetteRecord {
+		t.Cleanup(func() {
+			if err := c.save(); err != nil {
+				t.Errorf("cassette: saving %s: %v", path, err)
+			}
+		})
+		return c
+	}
+
+	if err := c.load(); err != nil {
+		t.Fatalf("cassette: loading %s: %v (record it with %s=%s)", path, err, CassetteModeEnv, CassetteRecord)
+	}
+	return c
+}
+
+// Client returns a client sending its requests through c.
+func (c *Cassette) Client() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+// Interactions returns the interactions recorded or loaded so far.
+func (c *Cassette) Interactions() []Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Interaction(nil), c.interactions...)
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	recorded := c.request(req, body)
+	if c.mode == CassetteRecord {
+		return c.record(req, body, recorded)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, in := range c.interactions {
+		if !c.used[i] && c.matcher(recorded, in.Request) {
+			c.used[i] = true
+			return in.Response.toResponse(req), nil
+		}
+	}
+	c.t.Errorf("cassette %s: unmatched %s %s", c.path, recorded.Method, recorded.URL)
+	return nil, fmt.Errorf("%w: %s %s", ErrUnmatchedRequest, recorded.Method, recorded.URL)
+}
+
+// request returns req as recorded.
+func (c *Cassette) request(req *http.Request, body []byte) CassetteRequest {
+	return CassetteRequest{
+		Method:  req.Method,
+		URL:     c.redact.URL(req.URL.String()),
+		Headers: c.redact.Headers(req.Header),
+		Body:    c.redact.Body(req.Header.Get("Content-Type"), string(body)),
+	}
+}
+
+func (c *Cassette) record(req *http.Request, body []byte, recorded CassetteRequest) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.Body = http.NoBody
+	if len(body) > 0 {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := c.real.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interactions = append(c.interactions, Interaction{
+		Request: recorded,
+		Response: CassetteResponse{
+			Status:  res.StatusCode,
+			Headers: c.redact.Headers(res.Header),
+			Body:    c.redact.Body(res.Header.Get("Content-Type"), string(resBody)),
+		},
+	})
+	return res, nil
+}
+
+func (r CassetteResponse) toResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.Headers.Clone(),
+		Body:          ioutil.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+func (c *Cassette) json() bool {
+	return strings.EqualFold(filepath.Ext(c.path), ".json")
+}
+
+func (c *Cassette) load() error {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	if c.json() {
+		err = json.Unmarshal(b, &c.interactions)
+	} else {
+		err = yaml.Unmarshal(b, &c.interactions)
+	}
+	c.used = make([]bool, len(c.interactions))
+	return err
+}
+
+func (c *Cassette) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b []byte
+	var err error
+	if c.json() {
+		b, err = json.MarshalIndent(c.interactions, "", "  ")
+	} else {
+		b, err = yaml.Marshal(c.interactions)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, b, 0o644)
+}
@@ -0,0 +1,115 @@
+package testutils
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// partner is a fake third-party API.
+func partner(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=s3cret")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = w.Write([]byte(`{"access_token":"live-token","email":"ann@partner.test"}`))
+		default:
+			_, _ = w.Write([]byte(`{"echo":` + string(body) + `}`))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func get(t *testing.T, client *http.Client, method, url, body string) (string, error) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer live-key")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	return string(b), err
+}
+
+// recordingT captures the errors of a cassette expected to fail.
+type recordingT struct {
+	*testing.T
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func TestCassette(t *testing.T) {
+	for _, ext := range []string{".yaml", ".json"} {
+		t.Run(ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cassettes", "partner"+ext)
+			srv := partner(t)
+			matcher := MatchAll(MatchMethod, MatchURLIgnoring("ts"), MatchBody)
+
+			t.Run("record", func(t *testing.T) {
+				client := NewCassette(t, path, CassetteOptions{Mode: CassetteRecord, Matcher: matcher}).Client()
+				if got, err := get(t, client, "POST", srv.URL+"/token?ts=1", `{"a":1,"b":2}`); err != nil || !strings.Contains(got, "live-token") {
+					t.Fatalf("recording returned %q, %v", got, err)
+				}
+				if _, err := get(t, client, "PUT", srv.URL+"/items/1", `{"name":"duck"}`); err != nil {
+					t.Fatal(err)
+				}
+			})
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range []string{"live-token", "live-key", "s3cret", "ann@"} {
+				if strings.Contains(string(b), secret) {
+					t.Errorf("cassette holds %q:\n%s", secret, b)
+				}
+			}
+
+			srv.Close() // replays are offline
+			t.Run("replay", func(t *testing.T) {
+				t.Setenv(CassetteModeEnv, string(CassetteRecordOnce))
+				c := NewCassette(t, path, CassetteOptions{Matcher: matcher})
+				got, err := get(t, c.Client(), "POST", srv.URL+"/token?ts=2", `{"b":2, "a":1}`)
+				if err != nil || got != `{"access_token":"[REDACTED]","email":"***@partner.test"}` {
+					t.Errorf("replayed %q, %v", got, err)
+				}
+				if got, err := get(t, c.Client(), "PUT", srv.URL+"/items/1", `{"name":"duck"}`); err != nil || got != `{"echo":{"name":"duck"}}` {
+					t.Errorf("replayed %q, %v", got, err)
+				}
+			})
+
+			t.Run("unmatched", func(t *testing.T) {
+				rt := &recordingT{T: t}
+				c := NewCassette(rt, path, CassetteOptions{Mode: CassetteReplay, Matcher: matcher})
+				if _, err := get(t, c.Client(), "PUT", srv.URL+"/items/1", `{"name":"goose"}`); !errors.Is(err, ErrUnmatchedRequest) {
+					t.Errorf("other body: %v", err)
+				}
+				if _, err := get(t, c.Client(), "PUT", srv.URL+"/items/1", `{"name":"duck"}`); err != nil {
+					t.Fatal(err)
+				}
+				// Each interaction plays once.
+				if _, err := get(t, c.Client(), "PUT", srv.URL+"/items/1", `{"name":"duck"}`); !errors.Is(err, ErrUnmatchedRequest) {
+					t.Errorf("replayed twice: %v", err)
+				}
+				if len(rt.errors) != 2 {
+					t.Errorf("%d test errors, want 2", len(rt.errors))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"whimsy/pkg/auth"
+)
+
+// OIDCUser is the account the mock issuer signs in.
+type OIDCUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+type pendingCode struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	user        OIDCUser
+}
+
+// MockOIDCIssuer is an in-process OpenID Connect provider. It serves
+// discovery, a JWKS, an authorize endpoint that signs in the user set with
+// SetUser without any prompt, and a token endpoint that checks PKCE and
+// returns RS256 ID tokens.
+type MockOIDCIssuer struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Claims, if set, can change the ID token claims before signing, to
+	// test verification failures.
+	Claims func(claims map[string]interface{})
+
+	mu    sync.Mutex
+	key   *rsa.PrivateKey
+	keyID string
+	user  OIDCUser
+	codes map[string]pendingCode
+}
+
+// NewMockOIDCIssuer starts an issuer that is closed when the test ends. Its
+// issuer URL is its URL field.
+func NewMockOIDCIssuer(t testing.TB) *MockOIDCIssuer {
+	t.Helper()
+	m := &MockOIDCIssuer{
+		ClientID:     "whimsy-test",
+		ClientSecret: "whimsy-test-secret",
+		user:         OIDCUser{Subject: "mock-subject", Email: "oidc@example.com", EmailVerified: true},
+		codes:        map[string]pendingCode{},
+	}
+	m.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// SetUser changes who the next authorization signs in.
+func (m *MockOIDCIssuer) SetUser(u OIDCUser) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user = u
+}
+
+// RotateKey replaces the signing key, as providers do from time to time.
+func (m *MockOIDCIssuer) RotateKey(t testing.TB) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.key = key
+	m.keyID = randomID()
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Authorize follows an authorization URL as a browser would, and returns
+// the code and state the issuer redirects back with.
+func (m *MockOIDCIssuer) Authorize(t testing.TB, authURL string) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", res.Status)
+	}
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+// SignIDToken signs arbitrary claims with the current key.
+func (m *MockOIDCIssuer) SignIDToken(t testing.TB, claims map[string]interface{}) string {
+	t.Helper()
+	m.mu.Lock()
+	key, keyID := m.key, m.keyID
+	m.mu.Unlock()
+	token, err := auth.SignJWT(key, keyID, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func oauthError(w http.ResponseWriter, code string) {
+	writeMockJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func (m *MockOIDCIssuer) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeMockJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *MockOIDCIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	pub, keyID := m.key.PublicKey, m.keyID
+	m.mu.Unlock()
+	writeMockJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *MockOIDCIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	switch {
+	case q.Get("client_id") != m.ClientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case err != nil || q.Get("redirect_uri") == "":
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	case q.Get("response_type") != "code", q.Get("code_challenge_method") != "S256", q.Get("code_challenge") == "":
+		http.Error(w, "authorization code flow with S256 PKCE required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomID()
+	m.mu.Lock()
+	m.codes[code] = pendingCode{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+		user:        m.user,
+	}
+	m.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockOIDCIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != m.ClientID || secret != m.ClientSecret {
+		writeMockJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+
+	// Codes are single use.
+	m.mu.Lock()
+	pending, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case !ok, pending.redirectURI != r.PostFormValue("redirect_uri"):
+		oauthError(w, "invalid_grant")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge:
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            m.URL,
+		"sub":            pending.user.Subject,
+		"aud":            m.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          pending.nonce,
+		"email":          pending.user.Email,
+		"email_verified": pending.user.EmailVerified,
+		"given_name":     pending.user.GivenName,
+		"family_name":    pending.user.FamilyName,
+	}
+	if m.Claims != nil {
+		m.Claims(claims)
+	}
+	m.mu.Lock()
+	key, keyID := m.key, m.keyID
+	m.mu.Unlock()
+	idToken, err := auth.SignJWT(key, keyID, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMockJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomID(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
@@ -6,11 +6,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"whimsy/pkg/mailer"
+	"whimsy/pkg/models/registry"
+	"whimsy/pkg/utils"
+
 	"github.com/gofrs/uuid"
 	"github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/rs/zerolog"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -60,9 +66,40 @@ func ConnectDb(packageName string) *gorm.DB {
 	return db
 }
 
+// ConnectPool opens a pgx pool on the test database of packageName, which
+// ConnectDb creates.
+func ConnectPool(packageName string) *pgxpool.Pool {
+	if db, err := ConnectDb(packageName).DB(); err == nil {
+		db.Close()
+	}
+	pool, err := pgxpool.Connect(context.Background(), fmt.Sprintf("host=%s port=%s user=%s "+
+		"password='%s' dbname=%s sslmode=disable", os.Getenv("PG_HOST"), os.Getenv("PG_PORT"), os.Getenv("PG_USER"), os.Getenv("PG_PASSWORD"), os.Getenv("PG_TEST_DB")+"_"+packageName))
+	if err != nil {
+		panic(err)
+	}
+	return pool
+}
+
+// ResetDb truncates the tables of every model added with registry.Register,
+// and those added with registry.RegisterTable.
 func ResetDb(db *gorm.DB) {
-	// add in all tables below, e.g.
-	// db.Exec("TRUNCATE users CASCADE;")
+	var tables []string
+	for _, m := range registry.Models() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(m); err != nil {
+			panic(err)
+		}
+		tables = append(tables, db.Statement.Quote(stmt.Schema.Table))
+	}
+	for _, t := range registry.Tables() {
+		tables = append(tables, db.Statement.Quote(t))
+	}
+	if len(tables) == 0 {
+		return
+	}
+	if err := db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " CASCADE").Error; err != nil {
+		panic(err)
+	}
 }
 
 func NewContext(t *testing.T) context.Context {
@@ -108,3 +145,22 @@ func (c eqCmpMatcher) Matches(x interface{}) bool {
 func (c eqCmpMatcher) String() string {
 	return fmt.Sprintf("Cmp Matcher: %T", c.want)
 }
+
+// NewCaptureMailer returns a mailer that records messages instead of sending.
+func NewCaptureMailer() *mailer.MemoryMailer {
+	return &mailer.MemoryMailer{}
+}
+
+// AssertMailSent fails the test unless m captured a message to the address
+// whose subject contains subject, and returns the latest such message.
+func AssertMailSent(t testing.TB, m *mailer.MemoryMailer, to, subject string) mailer.Message {
+	t.Helper()
+	msgs := m.Messages()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if strings.Contains(msgs[i].Subject, subject) && utils.DoesArrayContainString(msgs[i].To, to) {
+			return msgs[i]
+		}
+	}
+	t.Fatalf("no mail to %s with subject %q in %d captured messages", to, subject, len(msgs))
+	return mailer.Message{}
+}
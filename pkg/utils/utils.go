@@ -6,33 +6,19 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
-	"regexp"
 	"strings"
 	"time"
 	"whimsy/pkg/constants"
+	"whimsy/pkg/redact"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
 )
 
-var santizeFields = []string{
-}
-
 func StrPtr(s string) *string {
 	return &s
 }
 
-// santizeRegexFields is a cached regex.Compile called for each field.
-var santizeRegexFields = func() map[string]*regexp.Regexp {
-	m := make(map[string]*regexp.Regexp)
-	for _, field := range santizeFields {
-		// Case-insensitive regex match
-		regexstr := fmt.Sprintf(`(?i)("%s"):\s?"([^\"]+)"`, field)
-		m[field] = regexp.MustCompile(regexstr)
-	}
-	return m
-}()
-
 func Message(status bool, message string) map[string]interface{} {
 	return map[string]interface{}{"status": status, "message": message}
 }
@@ -56,28 +42,33 @@ func LogAndReportError(ctx context.Context, err error, msg string) {
 	ReportError(ctx, err)
 }
 
+// DefaultMaxDumpBytes is how much of a dump HttpLoggingRoundTripper logs by
+// default.
+const DefaultMaxDumpBytes = 4 << 10
+
 // This type implements the http.RoundTripper interface
 type HttpLoggingRoundTripper struct {
 	Proxied http.RoundTripper
 	Label   string
+	// MaxBodyBytes caps the logged request and response dumps,
+	// DefaultMaxDumpBytes if unset.
+	MaxBodyBytes int
 }
 
-func redactedStr(input string) string {
-	return strings.Repeat("*", len(input))
+// truncateDump cuts dump to max bytes, noting how much was left out.
+func truncateDump(dump []byte, max int) string {
+	if max <= 0 {
+		max = DefaultMaxDumpBytes
+	}
+	if len(dump) <= max {
+		return string(dump)
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", strings.ToValidUTF8(string(dump[:max]), ""), len(dump)-max)
 }
 
+// SanitizeDump redacts an HTTP dump with the default redact.Redactor.
 func SanitizeDump(input string) string {
-	for _, field := range santizeFields {
-		reg := santizeRegexFields[field]
-		rs := reg.FindStringSubmatch(input)
-
-		if len(rs) > 1 {
-			replacementStr := fmt.Sprintf(`$1:"%s"`, redactedStr(rs[2]))
-			input = reg.ReplaceAllString(input, replacementStr)
-		}
-	}
-
-	return input
+	return redact.Default().Dump(input)
 }
 
 func GetStringValueFromContext(key constants.ContextKey, ctx context.Context) string {
@@ -91,10 +82,15 @@ func (lrt HttpLoggingRoundTripper) RoundTrip(req *http.Request) (*http.Response,
 
 	startTime := time.Now()
 
-	dump, err := httputil.DumpRequestOut(req, true)
-	if err != nil {
-		logger.Err(err).Send()
-		return nil, err
+	traced := logger.GetLevel() <= zerolog.TraceLevel && zerolog.GlobalLevel() <= zerolog.TraceLevel
+	var dump []byte
+	var err error
+	if traced {
+		// Dumping reads the whole body, so only do it when it's logged.
+		if dump, err = httputil.DumpRequestOut(req, true); err != nil {
+			logger.Err(err).Send()
+			return nil, err
+		}
 	}
 
 	userId := ""
@@ -105,7 +101,7 @@ func (lrt HttpLoggingRoundTripper) RoundTrip(req *http.Request) (*http.Response,
 
 	logger.Trace().
 		Str("provider", lrt.Label).
-		Str("request_body", SanitizeDump(string(dump))).
+		Str("request_body", truncateDump([]byte(SanitizeDump(string(dump))), lrt.MaxBodyBytes)).
 		Str("user_id", userId).
 		Send()
 
@@ -122,11 +118,14 @@ func (lrt HttpLoggingRoundTripper) RoundTrip(req *http.Request) (*http.Response,
 		return nil, err
 	}
 
+	if !traced {
+		return res, nil
+	}
 	if dump, err = httputil.DumpResponse(res, true); err != nil {
 		logger.Error().Err(err).Send()
 	} else {
 		logger.Trace().
-			Str("response_body", SanitizeDump(string(dump))).
+			Str("response_body", truncateDump([]byte(SanitizeDump(string(dump))), lrt.MaxBodyBytes)).
 			Str("provider", lrt.Label).
 			Int("code", res.StatusCode).
 			Str("user_id", userId).
@@ -0,0 +1,108 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	goerrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of webhook requests.
+const (
+	// DeliveryHeader identifies the delivery, the same across retries, so
+	// receivers can ignore repeats.
+	DeliveryHeader  = "Whimsy-Webhook-Id"
+	EventTypeHeader = "Whimsy-Webhook-Event"
+	// TimestampHeader is the Unix time the request was signed at.
+	TimestampHeader = "Whimsy-Webhook-Timestamp"
+	// SignatureHeader holds space separated "v1=<hex>" signatures, of which
+	// one must match.
+	SignatureHeader = "Whimsy-Webhook-Signature"
+)
+
+// DefaultTolerance is how old a signature Verify accepts by default.
+const DefaultTolerance = 5 * time.Minute
+
+// secretPrefix marks webhook secrets, so they are recognizable in config.
+const secretPrefix = "whsec_"
+
+// Errors returned by Verify and VerifyRequest.
+var (
+	ErrNoSignature      = goerrors.New("webhooks: missing signature headers")
+	ErrInvalidSignature = goerrors.New("webhooks: signature mismatch")
+	ErrTimestamp        = goerrors.New("webhooks: timestamp outside the tolerance")
+	ErrTooLarge         = goerrors.New("webhooks: body too large")
+)
+
+// GenerateSecret returns a new random signing secret.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Sign returns the v1 signature of body sent at timestamp: the hex
+// HMAC-SHA256 of "<unix timestamp>.<body>" keyed with secret. Signing the
+// timestamp keeps a captured request from being replayed later.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a webhook request with body, for
+// receivers. It fails for requests signed more than tolerance away from
+// now; pass 0 for DefaultTolerance. Ignoring deliveries whose
+// DeliveryHeader was seen before completes the replay protection.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration, now time.Time) error {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	ts, sigs := header.Get(TimestampHeader), header.Get(SignatureHeader)
+	if ts == "" || sigs == "" {
+		return ErrNoSignature
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrNoSignature
+	}
+	at := time.Unix(unix, 0)
+	if d := now.Sub(at); d > tolerance || d < -tolerance {
+		return ErrTimestamp
+	}
+	want := Sign(secret, at, body)
+	for _, sig := range strings.Fields(sigs) {
+		if hmac.Equal([]byte(sig), []byte(want)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyRequest reads the body of r, failing past maxBody bytes, and
+// verifies it with Verify. It returns the body for decoding.
+func VerifyRequest(r *http.Request, secret string, maxBody int64, tolerance time.Duration) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBody {
+		return nil, ErrTooLarge
+	}
+	if err := Verify(secret, r.Header, body, tolerance, time.Now()); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
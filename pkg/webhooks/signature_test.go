@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedHeader(secret string, at time.Time, body []byte) http.Header {
+	h := http.Header{}
+	h.Set(TimestampHeader, strconv.FormatInt(at.Unix(), 10))
+	h.Set(SignatureHeader, Sign(secret, at, body))
+	return h
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, secretPrefix) {
+		t.Errorf("secret %q lacks its prefix", secret)
+	}
+	now := time.Unix(1650000000, 0)
+	body := []byte(`{"id":1,"type":"user.registered"}`)
+
+	rotated := signedHeader("old secret", now, body)
+	rotated.Set(SignatureHeader, rotated.Get(SignatureHeader)+" "+Sign(secret, now, body))
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		want   error
+	}{
+		{"valid", signedHeader(secret, now, body), body, nil},
+		{"slightly early", signedHeader(secret, now.Add(time.Minute), body), body, nil},
+		{"one of several signatures", rotated, body, nil},
+		{"tampered body", signedHeader(secret, now, body), []byte(`{"id":2,"type":"user.registered"}`), ErrInvalidSignature},
+		{"other secret", signedHeader("whsec_other", now, body), body, ErrInvalidSignature},
+		{"replayed", signedHeader(secret, now.Add(-time.Hour), body), body, ErrTimestamp},
+		{"unsigned", http.Header{}, body, ErrNoSignature},
+	}
+	for _, tt := range tests {
+		if err := Verify(secret, tt.header, tt.body, 0, now); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A timestamp changed to pass the tolerance no longer matches.
+	h := signedHeader(secret, now.Add(-time.Hour), body)
+	h.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	if err := Verify(secret, h, body, 0, now); err != ErrInvalidSignature {
+		t.Errorf("moved timestamp: got %v", err)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	r := httptest.NewRequest("POST", "/hook", bytes.NewReader(body))
+	r.Header = signedHeader("whsec_test", time.Now(), body)
+	got, err := VerifyRequest(r, "whsec_test", 1<<10, 0)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	r = httptest.NewRequest("POST", "/hook", bytes.NewReader(body))
+	r.Header = signedHeader("whsec_test", time.Now(), body)
+	if _, err := VerifyRequest(r, "whsec_test", 4, 0); err != ErrTooLarge {
+		t.Errorf("oversized body: got %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+// Package webhooks sends outbox events to the HTTP endpoints accounts
+// register for them.
+//
+// A Dispatcher, used as an outbox sink, records a delivery per endpoint
+// subscribed to an event and queues a Deliver job for it, in the relay's
+// transaction. Workers handle those jobs with a Deliverer, which POSTs the
+// event signed with the endpoint's secret, see Sign, and logs every attempt.
+// Failed attempts are retried with the job queue's exponential backoff, and
+// an endpoint failing DisableAfter times in a row is disabled.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/jobs"
+	"whimsy/pkg/models"
+	"whimsy/pkg/outbox"
+	"whimsy/pkg/utils"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Defaults for Options.
+const (
+	DefaultTimeout      = 10 * time.Second
+	DefaultMaxAttempts  = 12
+	DefaultDisableAfter = 50
+)
+
+// maxResponseBody is how much of a response an attempt logs.
+const maxResponseBody = 4 << 10
+
+// Options tune deliveries. Zero values take the defaults above.
+type Options struct {
+	// Timeout bounds a request.
+	Timeout time.Duration
+	// MaxAttempts is how many times a delivery is tried before it fails.
+	// With the job queue's backoff, the default spreads them over two to
+	// three hours.
+	MaxAttempts int
+	// DisableAfter is how many failed attempts in a row disable an endpoint.
+	DisableAfter int
+	// HTTP configures the "webhooks" client. Its Timeout is replaced by
+	// Timeout, and deliveries are never retried by the client: the job
+	// queue retries them. Without a Transport, requests only go to public
+	// addresses, see httpclient.PublicTransport.
+	HTTP httpclient.Options
+	// AllowPrivateNetworks lets endpoints resolve to private and loopback
+	// addresses, for local development only.
+	AllowPrivateNetworks bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.DisableAfter <= 0 {
+		o.DisableAfter = DefaultDisableAfter
+	}
+	o.HTTP.Timeout = o.Timeout
+	o.HTTP.MaxRetries = httpclient.NoRetries
+	// Tenants share receiver hosts, so one failing endpoint mustn't open a
+	// circuit for the others; endpoints are disabled one by one instead.
+	o.HTTP.BreakerThreshold = httpclient.NoBreaker
+	if o.HTTP.Transport == nil && !o.AllowPrivateNetworks {
+		o.HTTP.Transport = httpclient.PublicTransport()
+	}
+	return o
+}
+
+// Event is the JSON body of webhook requests.
+type Event struct {
+	ID        int64          `json:"id"`
+	Type      string         `json:"type"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Data      models.JSONMap `json:"data"`
+}
+
+// PingEvent is the type of the events Ping publishes. Only the endpoint
+// pinged receives them, whatever it subscribes to.
+const PingEvent = "webhook.ping"
+
+// Ping publishes a PingEvent for ep in tx, so its owner can check their
+// receiver before real events come.
+func Ping(ctx context.Context, tx *gorm.DB, ep *models.WebhookEndpoint) (*models.OutboxEvent, error) {
+	return outbox.Publish(ctx, tx, outbox.Event{
+		AggregateType: "webhook",
+		AggregateID:   ep.ID.String(),
+		Type:          PingEvent,
+		Payload:       map[string]interface{}{"endpointId": ep.ID},
+		TenantID:      &ep.OwnerID,
+	})
+}
+
+// receives reports whether ep is sent ev.
+func receives(ep *models.WebhookEndpoint, ev *models.OutboxEvent) bool {
+	if ev.Type == PingEvent {
+		return ev.Payload["endpointId"] == ep.ID.String()
+	}
+	return ep.Subscribes(ev.Type)
+}
+
+// Deliver is the job of sending a delivery.
+type Deliver struct {
+	DeliveryID int64 `json:"deliveryId"`
+	// Redelivery makes a single attempt, even to a disabled endpoint or for
+	// a delivery that already succeeded.
+	Redelivery bool `json:"redelivery,omitempty"`
+}
+
+func (Deliver) Kind() string {
+	return "webhooks.deliver"
+}
+
+// Dispatcher is the outbox sink for webhooks. Events go to the enabled
+// endpoints of their tenant subscribed to their type, and pings to the
+// endpoint pinged.
+type Dispatcher struct {
+	opts Options
+}
+
+func NewDispatcher(opts Options) *Dispatcher {
+	return &Dispatcher{opts: opts.withDefaults()}
+}
+
+// SendsInTx makes the Dispatcher an outbox.TxSink.
+func (*Dispatcher) SendsInTx() {}
+
+func (d *Dispatcher) Send(ctx context.Context, ev *models.OutboxEvent) error {
+	if ev.TenantID == nil {
+		return nil
+	}
+	tx, ok := database.TxFromContext(ctx)
+	if !ok {
+		panic("webhooks: Dispatcher used outside of a relay")
+	}
+	// A savepoint, so a failed insert doesn't abort the relay's transaction.
+	return tx.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var endpoints []models.WebhookEndpoint
+		if err := tx.Where("owner_id = ? AND disabled_at IS NULL", ev.TenantID).Find(&endpoints).Error; err != nil {
+			return err
+		}
+		var body []byte
+		for i := range endpoints {
+			ep := &endpoints[i]
+			if !receives(ep, ev) {
+				continue
+			}
+			if body == nil {
+				var err error
+				if body, err = json.Marshal(Event{ID: ev.ID, Type: ev.Type, CreatedAt: ev.CreatedAt, Data: ev.Payload}); err != nil {
+					return err
+				}
+			}
+			delivery := &models.WebhookDelivery{
+				EndpointID: ep.ID,
+				EventID:    ev.ID,
+				EventType:  ev.Type,
+				Body:       string(body),
+				State:      models.DeliveryPending,
+			}
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue // the event was relayed before
+			}
+			if _, err := jobs.Enqueue(ctx, tx, Deliver{DeliveryID: delivery.ID}, jobs.Options{MaxAttempts: d.opts.MaxAttempts}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Redeliver queues one more attempt of delivery, as its endpoint's owner may
+// ask once they fixed their receiver. Redelivering again before it ran is a
+// no-op.
+func Redeliver(ctx context.Context, tx *gorm.DB, delivery *models.WebhookDelivery) error {
+	_, err := jobs.Enqueue(ctx, tx, Deliver{DeliveryID: delivery.ID, Redelivery: true}, jobs.Options{
+		MaxAttempts: 1,
+		UniqueKey:   "webhooks.redeliver:" + strconv.FormatInt(delivery.ID, 10),
+	})
+	if goerrors.Is(err, jobs.ErrDuplicate) {
+		return nil
+	}
+	return err
+}
+
+// Deliverer sends deliveries, handling Deliver jobs.
+type Deliverer struct {
+	db     *gorm.DB
+	enc    utils.Encrypter
+	opts   Options
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewDeliverer returns a Deliverer decrypting endpoint secrets with enc.
+func NewDeliverer(db *gorm.DB, enc utils.Encrypter, opts Options) *Deliverer {
+	opts = opts.withDefaults()
+	return &Deliverer{
+		db:   db,
+		enc:  enc,
+		opts: opts,
+		client: &http.Client{
+			Transport: httpclient.NewTransport("webhooks", opts.HTTP),
+			// A redirect is a failure, not a hint to post elsewhere.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		now: time.Now,
+	}
+}
+
+// Handle is the jobs.HandlerFunc of Deliver jobs. It returns an error to
+// have the job retried.
+func (d *Deliverer) Handle(ctx context.Context, job jobs.Job) error {
+	j := job.(Deliver)
+	db := d.db.WithContext(ctx)
+	var delivery models.WebhookDelivery
+	if err := db.Preload("Endpoint").Take(&delivery, "id = ?", j.DeliveryID).Error; err != nil {
+		if goerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	ep := delivery.Endpoint
+	switch {
+	case delivery.State != models.DeliveryPending && !j.Redelivery:
+		return nil
+	case ep == nil:
+		return d.fail(ctx, &delivery, "endpoint deleted")
+	case ep.DisabledAt != nil && !j.Redelivery:
+		return d.fail(ctx, &delivery, "endpoint disabled")
+	}
+
+	secret, err := d.enc.DecryptString(ep.Secret)
+	if err != nil {
+		return err
+	}
+	attempt, err := d.send(ctx, ep.URL, secret, &delivery)
+	if err != nil {
+		return err
+	}
+	attempt.Redelivery = j.Redelivery
+	if err := d.record(ctx, &delivery, ep, attempt); err != nil {
+		return err
+	}
+	if delivery.State == models.DeliveryPending && !j.Redelivery {
+		return fmt.Errorf("webhook delivery failed: %s", delivery.LastError)
+	}
+	return nil
+}
+
+// send makes one attempt at delivery. It returns an error instead when the
+// request wasn't sent, with a circuit open, which isn't the endpoint's
+// failure to count.
+func (d *Deliverer) send(ctx context.Context, url, secret string, delivery *models.WebhookDelivery) (*models.WebhookAttempt, error) {
+	start := d.now()
+	attempt := &models.WebhookAttempt{DeliveryID: delivery.ID, AttemptedAt: start}
+	body := []byte(delivery.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Whimsy-Webhooks/1.0")
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(EventTypeHeader, delivery.EventType)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(start.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(secret, start, body))
+
+	res, err := d.client.Do(req)
+	if goerrors.Is(err, httpclient.ErrCircuitOpen) {
+		return nil, err
+	}
+	attempt.DurationMs = d.now().Sub(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, nil
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseBody))
+	attempt.StatusCode = res.StatusCode
+	// Postgres text can't hold NULs or invalid UTF-8.
+	attempt.ResponseBody = strings.ToValidUTF8(strings.ReplaceAll(string(b), "\x00", ""), "�")
+	return attempt, nil
+}
+
+// record logs attempt and updates the delivery and its endpoint with its
+// outcome, disabling the endpoint after too many failures.
+func (d *Deliverer) record(ctx context.Context, delivery *models.WebhookDelivery, ep *models.WebhookEndpoint, attempt *models.WebhookAttempt) error {
+	delivery.Attempts++
+	updates := map[string]interface{}{"attempts": delivery.Attempts}
+	if attempt.Succeeded() {
+		delivery.State, delivery.LastError, delivery.DeliveredAt = models.DeliverySucceeded, "", &attempt.AttemptedAt
+		updates["delivered_at"] = attempt.AttemptedAt
+	} else {
+		delivery.LastError = attempt.Error
+		if attempt.StatusCode != 0 {
+			delivery.LastError = "HTTP " + strconv.Itoa(attempt.StatusCode)
+		}
+		switch {
+		case attempt.Redelivery && delivery.State == models.DeliveryPending:
+			// Automatic retries are still due, and decide the outcome.
+		case attempt.Redelivery || delivery.Attempts >= d.opts.MaxAttempts:
+			delivery.State = models.DeliveryFailed
+		default:
+			delivery.State = models.DeliveryPending
+		}
+	}
+	updates["state"], updates["last_error"] = delivery.State, delivery.LastError
+
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(delivery).Updates(updates).Error; err != nil {
+			return err
+		}
+		if attempt.Succeeded() {
+			return tx.Model(ep).UpdateColumn("consecutive_failures", 0).Error
+		}
+		if err := tx.Raw(`
+UPDATE webhook_endpoints SET
+	consecutive_failures = consecutive_failures + 1,
+	disabled_at = CASE WHEN consecutive_failures + 1 >= ? THEN COALESCE(disabled_at, ?) ELSE disabled_at END
+WHERE id = ?
+RETURNING consecutive_failures, disabled_at`, d.opts.DisableAfter, attempt.AttemptedAt, ep.ID).Scan(ep).Error; err != nil {
+			return err
+		}
+		if ep.ConsecutiveFailures == d.opts.DisableAfter {
+			zerolog.Ctx(ctx).Warn().Str("endpoint_id", ep.ID.String()).Int("failures", ep.ConsecutiveFailures).Msg("webhook endpoint disabled")
+		}
+		return nil
+	})
+}
+
+// fail ends a delivery that can't be attempted.
+func (d *Deliverer) fail(ctx context.Context, delivery *models.WebhookDelivery, reason string) error {
+	return d.db.WithContext(ctx).Model(delivery).Updates(map[string]interface{}{
+		"state":      models.DeliveryFailed,
+		"last_error": reason,
+	}).Error
+}
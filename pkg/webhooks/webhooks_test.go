@@ -0,0 +1,379 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"whimsy/pkg/database"
+	"whimsy/pkg/httpclient"
+	"whimsy/pkg/migrate"
+	"whimsy/pkg/models"
+	"whimsy/pkg/testutils"
+	"whimsy/pkg/utils"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	db  *gorm.DB
+	enc utils.Encrypter
+)
+
+func TestMain(m *testing.M) {
+	db = testutils.ConnectDb("webhooks")
+	if err := migrate.Migrate(db); err != nil {
+		panic(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	enc = utils.Encrypter{PrivateKey: key}
+	exitVal := m.Run()
+	testutils.ResetDb(db)
+	os.Exit(exitVal)
+}
+
+func resetWebhooks(t *testing.T) {
+	t.Helper()
+	if err := db.Exec("TRUNCATE webhook_attempts, webhook_deliveries, webhook_endpoints, jobs, outbox_events CASCADE").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newUser(t *testing.T) uuid.UUID {
+	t.Helper()
+	user := &models.User{Email: testutils.UuidStr() + "@whimsy.test", PasswordHash: "-"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+func newEndpoint(t *testing.T, owner uuid.UUID, url, secret, eventTypes string) *models.WebhookEndpoint {
+	t.Helper()
+	encrypted, err := enc.EncryptString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &models.WebhookEndpoint{OwnerID: owner, URL: url, EventTypes: eventTypes, Secret: encrypted}
+	if err := db.Create(ep).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+// dispatch sends ev through d in a transaction, as a relay does.
+func dispatch(t *testing.T, d *Dispatcher, ev *models.OutboxEvent) {
+	t.Helper()
+	ctx := testutils.NewContext(t)
+	if err := database.New(db).InTx(ctx, func(tx *gorm.DB) error {
+		return d.Send(tx.Statement.Context, ev)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	resetWebhooks(t)
+	owner, other := newUser(t), newUser(t)
+	all := newEndpoint(t, owner, "https://a.test/hook", "whsec_a", "*")
+	users := newEndpoint(t, owner, "https://b.test/hook", "whsec_b", "user.*")
+	newEndpoint(t, owner, "https://c.test/hook", "whsec_c", "invoice.paid")
+	newEndpoint(t, other, "https://d.test/hook", "whsec_d", "*")
+	disabled := newEndpoint(t, owner, "https://e.test/hook", "whsec_e", "*")
+	if err := db.Model(disabled).Update("disabled_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ev := &models.OutboxEvent{ID: 42, Type: "user.registered", TenantID: &owner, CreatedAt: time.Now(), Payload: models.JSONMap{"email": "a@whimsy.test"}}
+	d := NewDispatcher(Options{MaxAttempts: 3})
+	dispatch(t, d, ev)
+	dispatch(t, d, ev) // relayed again
+	dispatch(t, d, &models.OutboxEvent{ID: 43, Type: "user.registered"})
+
+	var deliveries []models.WebhookDelivery
+	if err := db.Order("endpoint_id").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := map[uuid.UUID]bool{}
+	for _, delivery := range deliveries {
+		got[delivery.EndpointID] = true
+		var body Event
+		if err := json.Unmarshal([]byte(delivery.Body), &body); err != nil || body.ID != 42 || body.Data["email"] != "a@whimsy.test" {
+			t.Errorf("unexpected body %s: %v", delivery.Body, err)
+		}
+	}
+	if len(deliveries) != 2 || !got[all.ID] || !got[users.ID] {
+		t.Errorf("deliveries %+v, want one for each of %s and %s", deliveries, all.ID, users.ID)
+	}
+	var jobs []models.Job
+	if err := db.Find(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Kind != "webhooks.deliver" || jobs[0].MaxAttempts != 3 {
+		t.Errorf("queued %+v", jobs)
+	}
+}
+
+func TestDispatchPing(t *testing.T) {
+	resetWebhooks(t)
+	owner := newUser(t)
+	pinged := newEndpoint(t, owner, "https://a.test/hook", "whsec_a", "invoice.paid")
+	newEndpoint(t, owner, "https://b.test/hook", "whsec_b", "*")
+
+	var ev *models.OutboxEvent
+	if err := db.Transaction(func(tx *gorm.DB) (err error) {
+		ev, err = Ping(testutils.NewContext(t), tx, pinged)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(ev, ev.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	dispatch(t, NewDispatcher(Options{}), ev)
+
+	var deliveries []models.WebhookDelivery
+	if err := db.Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].EndpointID != pinged.ID || deliveries[0].EventType != PingEvent {
+		t.Errorf("deliveries %+v, want a ping to %s only", deliveries, pinged.ID)
+	}
+}
+
+// receiver is a webhook endpoint answering with status and checking
+// signatures with secret.
+type receiver struct {
+	*httptest.Server
+	status int32
+	calls  int32
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	rcv := &receiver{status: http.StatusOK}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&rcv.calls, 1)
+		if _, err := VerifyRequest(r, secret, 1<<20, 0); err != nil {
+			t.Errorf("verifying the request: %v", err)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&rcv.status)))
+		_, _ = w.Write([]byte("thanks"))
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func newDelivery(t *testing.T, ep *models.WebhookEndpoint, eventID int64) *models.WebhookDelivery {
+	t.Helper()
+	d := &models.WebhookDelivery{EndpointID: ep.ID, EventID: eventID, EventType: "user.registered", Body: `{"id":` + strconv.FormatInt(eventID, 10) + `}`, State: models.DeliveryPending}
+	if err := db.Create(d).Error; err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func reload(t *testing.T, out interface{}, id interface{}) {
+	t.Helper()
+	if err := db.First(out, "id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	resetWebhooks(t)
+	ctx := testutils.NewContext(t)
+	rcv := newReceiver(t, "whsec_test")
+	ep := newEndpoint(t, newUser(t), rcv.URL, "whsec_test", "*")
+	delivery := newDelivery(t, ep, 1)
+	dl := NewDeliverer(db, enc, Options{MaxAttempts: 2, AllowPrivateNetworks: true})
+
+	atomic.StoreInt32(&rcv.status, http.StatusServiceUnavailable)
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID}); err == nil {
+		t.Error("a failed attempt wasn't retried")
+	}
+	reload(t, delivery, delivery.ID)
+	if delivery.State != models.DeliveryPending || delivery.Attempts != 1 || delivery.LastError != "HTTP 503" {
+		t.Errorf("after a failure: %+v", delivery)
+	}
+
+	atomic.StoreInt32(&rcv.status, http.StatusNoContent)
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID}); err != nil {
+		t.Fatal(err)
+	}
+	reload(t, delivery, delivery.ID)
+	reload(t, ep, ep.ID)
+	if delivery.State != models.DeliverySucceeded || delivery.DeliveredAt == nil || ep.ConsecutiveFailures != 0 {
+		t.Errorf("after a success: %+v, endpoint %+v", delivery, ep)
+	}
+	// A job run again after success doesn't send again.
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&rcv.calls); calls != 2 {
+		t.Errorf("%d calls, want 2", calls)
+	}
+
+	var attempts []models.WebhookAttempt
+	if err := db.Where("delivery_id = ?", delivery.ID).Order("id").Find(&attempts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[0].StatusCode != 503 || attempts[1].StatusCode != 204 || attempts[0].ResponseBody != "thanks" {
+		t.Errorf("attempts %+v", attempts)
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	resetWebhooks(t)
+	ctx := testutils.NewContext(t)
+	rcv := newReceiver(t, "whsec_test")
+	atomic.StoreInt32(&rcv.status, http.StatusInternalServerError)
+	ep := newEndpoint(t, newUser(t), rcv.URL, "whsec_test", "*")
+	dl := NewDeliverer(db, enc, Options{MaxAttempts: 2, DisableAfter: 3, AllowPrivateNetworks: true})
+
+	first, second := newDelivery(t, ep, 1), newDelivery(t, ep, 2)
+	_ = dl.Handle(ctx, Deliver{DeliveryID: first.ID})
+	if err := dl.Handle(ctx, Deliver{DeliveryID: first.ID}); err != nil {
+		t.Errorf("the last attempt was retried: %v", err)
+	}
+	reload(t, first, first.ID)
+	if first.State != models.DeliveryFailed || first.Attempts != 2 {
+		t.Errorf("after the last attempt: %+v", first)
+	}
+
+	// The third failure in a row disables the endpoint.
+	_ = dl.Handle(ctx, Deliver{DeliveryID: second.ID})
+	reload(t, ep, ep.ID)
+	if ep.DisabledAt == nil || ep.ConsecutiveFailures != 3 {
+		t.Fatalf("endpoint not disabled: %+v", ep)
+	}
+	if err := dl.Handle(ctx, Deliver{DeliveryID: second.ID}); err != nil {
+		t.Fatal(err)
+	}
+	reload(t, second, second.ID)
+	if calls := atomic.LoadInt32(&rcv.calls); second.State != models.DeliveryFailed || second.LastError != "endpoint disabled" || calls != 3 {
+		t.Errorf("delivery to a disabled endpoint: %+v, %d calls", second, calls)
+	}
+
+	// Owners can still redeliver, once.
+	atomic.StoreInt32(&rcv.status, http.StatusOK)
+	if err := db.Transaction(func(tx *gorm.DB) error { return Redeliver(ctx, tx, second) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error { return Redeliver(ctx, tx, second) }); err != nil {
+		t.Fatal(err)
+	}
+	var queued []models.Job
+	if err := db.Find(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].MaxAttempts != 1 {
+		t.Fatalf("queued %+v", queued)
+	}
+	if err := dl.Handle(ctx, Deliver{DeliveryID: second.ID, Redelivery: true}); err != nil {
+		t.Fatal(err)
+	}
+	reload(t, second, second.ID)
+	reload(t, ep, ep.ID)
+	if second.State != models.DeliverySucceeded || ep.ConsecutiveFailures != 0 || ep.DisabledAt == nil {
+		t.Errorf("after redelivery: %+v, endpoint %+v", second, ep)
+	}
+}
+
+func TestRedeliverWhilePending(t *testing.T) {
+	resetWebhooks(t)
+	ctx := testutils.NewContext(t)
+	rcv := newReceiver(t, "whsec_test")
+	atomic.StoreInt32(&rcv.status, http.StatusInternalServerError)
+	ep := newEndpoint(t, newUser(t), rcv.URL, "whsec_test", "*")
+	dl := NewDeliverer(db, enc, Options{MaxAttempts: 3, AllowPrivateNetworks: true})
+
+	delivery := newDelivery(t, ep, 1)
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID}); err == nil {
+		t.Fatal("failed attempt not retried")
+	}
+	// A failed redelivery leaves the automatic retries to it.
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID, Redelivery: true}); err != nil {
+		t.Fatal(err)
+	}
+	reload(t, delivery, delivery.ID)
+	if delivery.State != models.DeliveryPending {
+		t.Fatalf("after a failed redelivery: %+v", delivery)
+	}
+	atomic.StoreInt32(&rcv.status, http.StatusOK)
+	if err := dl.Handle(ctx, Deliver{DeliveryID: delivery.ID}); err != nil {
+		t.Fatal(err)
+	}
+	reload(t, delivery, delivery.ID)
+	if calls := atomic.LoadInt32(&rcv.calls); delivery.State != models.DeliverySucceeded || calls != 3 {
+		t.Errorf("retry after a failed redelivery: %+v, %d calls", delivery, calls)
+	}
+}
+
+func TestDeliverRedirect(t *testing.T) {
+	resetWebhooks(t)
+	target := newReceiver(t, "whsec_test")
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	ep := newEndpoint(t, newUser(t), redirect.URL, "whsec_test", "*")
+	delivery := newDelivery(t, ep, 1)
+
+	dl := NewDeliverer(db, enc, Options{AllowPrivateNetworks: true})
+	attempt, err := dl.send(context.Background(), ep.URL, "whsec_test", delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.StatusCode != http.StatusTemporaryRedirect || attempt.Succeeded() || atomic.LoadInt32(&target.calls) != 0 {
+		t.Errorf("redirect followed: %+v", attempt)
+	}
+}
+
+func TestDeliverPrivateAddress(t *testing.T) {
+	rcv := newReceiver(t, "whsec_test")
+	dl := NewDeliverer(nil, enc, Options{})
+	for _, u := range []string{rcv.URL, "http://localhost:1/hook", "http://169.254.169.254/latest/meta-data/"} {
+		attempt, err := dl.send(context.Background(), u, "whsec_test", &models.WebhookDelivery{ID: 1, Body: "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.StatusCode != 0 || !strings.Contains(attempt.Error, "not public") {
+			t.Errorf("%s: %+v", u, attempt)
+		}
+	}
+	if calls := atomic.LoadInt32(&rcv.calls); calls != 0 {
+		t.Errorf("%d calls to a loopback receiver", calls)
+	}
+}
+
+func TestDeliverSharedHost(t *testing.T) {
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer rcv.Close()
+	dl := NewDeliverer(nil, enc, Options{AllowPrivateNetworks: true})
+
+	// One tenant's failing endpoint doesn't cut off the others on its host.
+	for i := 0; i < 2*httpclient.DefaultBreakerThreshold; i++ {
+		if _, err := dl.send(context.Background(), rcv.URL+"/broken", "whsec_test", &models.WebhookDelivery{ID: 1, Body: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attempt, err := dl.send(context.Background(), rcv.URL+"/healthy", "whsec_test", &models.WebhookDelivery{ID: 2, Body: "{}"})
+	if err != nil || !attempt.Succeeded() {
+		t.Errorf("healthy endpoint: %+v, %v", attempt, err)
+	}
+}